@@ -0,0 +1,228 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	callerIDKey
+	tenantIDKey
+	// tenantNamedKey is set when the tenant came from X-Tenant-ID (ScopeTenantAdmin), not the
+	// credential
+	tenantNamedKey
+	// scopesKey holds the scopes of a provisioned API key (absent for the static API_KEY)
+	scopesKey
+	// credentialKey holds the credential authentication verified (see credentialFromContext)
+	credentialKey
+	// identityKey holds the *requestIdentity the access log reads once the request is served
+	identityKey
+	// revealedTokenKey holds the token of a reveal token being redeemed (see withRevealedToken)
+	revealedTokenKey
+	clientIPKey
+	// preparedCandidatesKey holds first token candidates generated ahead for a batch
+	preparedCandidatesKey
+	// lookupMemoKey holds the request-scoped memo of a batch's lookups
+	lookupMemoKey
+)
+
+// RequestIDFromContext returns the request id assigned by AccessLogMiddleware (or "").
+func RequestIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(requestIDKey).(string)
+	return v
+}
+
+// CallerIDFromContext returns the caller id resolved by authentication (or "").
+func CallerIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(callerIDKey).(string)
+	return v
+}
+
+// TenantFromContext returns the tenant the request's credential acts for (or ""): the tenant of
+// the credential, or X-Tenant-ID for credentials holding ScopeTenantAdmin.
+func TenantFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(tenantIDKey).(string)
+	return v
+}
+
+// credentialFromContext returns the credential authentication verified (or ""): "apikey:" and
+// a fingerprint of the API key, "bearer:" and the token subject, or "cert:" and the client
+// certificate identity. Unlike the request headers it cannot be chosen by an unauthenticated
+// client.
+func credentialFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(credentialKey).(string)
+	return v
+}
+
+// ClientIPFromContext returns the client address resolved by AccessLogMiddleware (or "").
+func ClientIPFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(clientIPKey).(string)
+	return v
+}
+
+// statusRecorder captures the status code written by downstream handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers keep working behind the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// staticKeyCallerID identifies a caller of the static API_KEY without logging the key: a short
+// fingerprint of it. Every other credential has a caller id of its own.
+func staticKeyCallerID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+// requestIdentity is who a request was authenticated as. AccessLogMiddleware runs before
+// authentication and only logs once the request is served, so it puts an empty one in the
+// context and authentication fills it in.
+type requestIdentity struct {
+	callerID, tenant string
+}
+
+// noteIdentity records the caller id and tenant authentication resolved in ctx for the access
+// log.
+func noteIdentity(ctx context.Context) {
+	if id, ok := ctx.Value(identityKey).(*requestIdentity); ok {
+		id.callerID, id.tenant = CallerIDFromContext(ctx), TenantFromContext(ctx)
+	}
+}
+
+// clientIP is the remote address of the request; behind a trusted proxy the first
+// X-Forwarded-For entry (or X-Real-IP) is the client instead.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// AccessLogMiddleware emits one structured (JSON) access log line per request with method,
+// path, status, duration, caller id, tenant and request id. Caller id and tenant are the ones
+// authentication resolved ("anonymous" and "" for requests it did not authenticate); an
+// X-Caller-ID header is only logged, as claimed_caller_id. It also assigns the request id
+// (honouring an incoming X-Request-ID) and exposes it via the X-Request-ID response header.
+//
+// Env:
+// ACCESS_LOG_SAMPLE_RATE (optional, 0..1, default 1) fraction of successful requests logged;
+// responses with status >= 400 are always logged.
+// ACCESS_LOG_DISABLED (optional, "true" disables access logging entirely)
+// TRUST_PROXY_HEADERS (optional, "true" takes the client IP from X-Forwarded-For / X-Real-IP)
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	sampleRate := 1.0
+	if v := os.Getenv("ACCESS_LOG_SAMPLE_RATE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) {
+			sampleRate = math.Max(0, math.Min(1, f))
+		}
+	}
+	disabled := strings.EqualFold(os.Getenv("ACCESS_LOG_DISABLED"), "true")
+	trustProxy := strings.EqualFold(os.Getenv("TRUST_PROXY_HEADERS"), "true")
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		reqID := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if reqID == "" {
+			reqID = newRequestID()
+		}
+		id := &requestIdentity{}
+
+		ctx := context.WithValue(r.Context(), requestIDKey, reqID)
+		ctx = context.WithValue(ctx, identityKey, id)
+		ctx = context.WithValue(ctx, clientIPKey, clientIP(r, trustProxy))
+
+		w.Header().Set("X-Request-ID", reqID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if disabled {
+			return
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < 400 && sampleRate < 1 && mrand.Float64() >= sampleRate {
+			return
+		}
+		caller := id.callerID
+		if caller == "" {
+			caller = "anonymous"
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"caller_id", caller,
+			"tenant", id.tenant,
+			"request_id", reqID,
+		}
+		if claimed := strings.TrimSpace(r.Header.Get("X-Caller-ID")); claimed != "" {
+			attrs = append(attrs, "claimed_caller_id", claimed)
+		}
+		logger.Info("access", attrs...)
+	})
+}
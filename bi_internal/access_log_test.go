@@ -0,0 +1,80 @@
+package bi_internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestAccessLogIdentityComesFromAuthentication checks that caller_id and tenant are the ones
+// authentication resolved, not the request headers.
+func TestAccessLogIdentityComesFromAuthentication(t *testing.T) {
+	s := &Server{}
+	static := "static-key-for-tests"
+	s.apiKeyVal.Store(&static)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = pw
+	h := AccessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			// a rejected bearer token: X-API-Key is never checked
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, err := s.AuthenticateAPIKey(r, r.Header.Get("X-API-Key")); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	os.Stdout = stdout
+
+	send := func(bearer, apiKey, tenant string) {
+		r := httptest.NewRequest(http.MethodPost, "/tokenize", nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		r.Header.Set("X-API-Key", apiKey)
+		r.Header.Set("X-Tenant-ID", tenant)
+		r.Header.Set("X-Caller-ID", "spoofed")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send("", static, "")
+	// refused: the static key holds no tenant_admin scope
+	send("", static, "acme")
+	send("invalid", static, "acme")
+	pw.Close()
+
+	var lines []map[string]any
+	sc := bufio.NewScanner(pr)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d access log lines, want 3", len(lines))
+	}
+	want := []struct{ caller, tenant string }{
+		{staticKeyCallerID(static), ""},
+		{"anonymous", ""},
+		{"anonymous", ""},
+	}
+	for i, w := range want {
+		if lines[i]["caller_id"] != w.caller || lines[i]["tenant"] != w.tenant {
+			t.Errorf("line %d: caller_id %v, tenant %v; want %q, %q", i, lines[i]["caller_id"], lines[i]["tenant"], w.caller, w.tenant)
+		}
+		if lines[i]["claimed_caller_id"] != "spoofed" {
+			t.Errorf("line %d: claimed_caller_id %v", i, lines[i]["claimed_caller_id"])
+		}
+	}
+}
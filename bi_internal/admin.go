@@ -0,0 +1,55 @@
+package bi_internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminOnly guards admin endpoints with the X-Admin-Key header, compared against
+// ADMIN_API_KEY. When ADMIN_API_KEY is not configured admin endpoints are disabled.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminKey() == "" {
+			writeJSONError(w, http.StatusForbidden, "admin API disabled")
+			return
+		}
+		key := r.Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey())) != 1 {
+			writeJSONError(w, http.StatusForbidden, "admin key required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type DuplicateReportResponse struct {
+	Tenant   string      `json:"tenant,omitempty"`
+	DataType string      `json:"data_type,omitempty"`
+	Results  interface{} `json:"results"`
+}
+
+// GET /admin/reports/duplicates?tenant=&data_type=
+// Reports how many blind indexes were tokenized by more than one source system, without plaintext.
+func (s *Server) duplicateReportHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := strings.TrimSpace(r.URL.Query().Get("tenant"))
+	dataType := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("data_type")))
+
+	stats, err := s.store.DuplicateReport(tenant, dataType)
+	if err != nil {
+		log.Printf("duplicate report error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DuplicateReportResponse{Tenant: tenant, DataType: dataType, Results: stats})
+}
+
+// GET /admin/store-stats returns per-operation store timings (calls, errors, slow calls,
+// total and max latency) with the index path each operation uses.
+func (s *Server) storeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"stats": s.store.QueryStats()})
+}
@@ -0,0 +1,268 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// API key scopes: each client endpoint needs one of them when it is called with a
+// provisioned tenant key or a SERVICE_API_KEYS key. The static API_KEY has all of them unless
+// API_KEY_SCOPES narrows it.
+const (
+	ScopeTokenize   = "tokenize"
+	ScopeDetokenize = "detokenize"
+	ScopeDelete     = "delete"
+	ScopeReveal     = "reveal"
+)
+
+var allScopes = []string{ScopeTokenize, ScopeDetokenize, ScopeDelete, ScopeReveal}
+
+// defaultScopes are granted to a new API key that does not list its scopes.
+var defaultScopes = []string{ScopeTokenize, ScopeDetokenize}
+
+var (
+	ErrInvalidAPIKey        = errors.New("invalid API key")
+	ErrAPIKeyTenantMismatch = errors.New("X-Tenant-ID does not match the tenant of the API key")
+)
+
+const (
+	defaultAPIKeyCacheTTL = 30 * time.Second
+	// maxAPIKeyCacheEntries bounds the cache, which also remembers unknown keys
+	maxAPIKeyCacheEntries = 10000
+)
+
+// apiKeyCache remembers resolved API keys (nil for unknown ones) for API_KEY_CACHE_SEC, so
+// authentication does not query the database on every request. A revocation applies on other
+// replicas once their entry expires.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]apiKeyCacheEntry
+}
+
+type apiKeyCacheEntry struct {
+	key     *models.APIKey
+	expires time.Time
+}
+
+func newAPIKeyCache() *apiKeyCache {
+	return &apiKeyCache{
+		ttl:     time.Duration(envInt("API_KEY_CACHE_SEC", int(defaultAPIKeyCacheTTL.Seconds()))) * time.Second,
+		entries: map[string]apiKeyCacheEntry{},
+	}
+}
+
+func (c *apiKeyCache) get(hash string) (*models.APIKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[hash]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.key, true
+}
+
+func (c *apiKeyCache) put(hash string, key *models.APIKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxAPIKeyCacheEntries {
+		for h, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= maxAPIKeyCacheEntries {
+			return
+		}
+	}
+	c.entries[hash] = apiKeyCacheEntry{key: key, expires: now.Add(c.ttl)}
+}
+
+func (c *apiKeyCache) clear() {
+	c.mu.Lock()
+	c.entries = map[string]apiKeyCacheEntry{}
+	c.mu.Unlock()
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a random API key ("pii_" + 256 random bits) and its hash.
+func newAPIKey() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key := "pii_" + base64.RawURLEncoding.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+// serviceAPIKey is a global (tenant-less) key of SERVICE_API_KEYS.
+type serviceAPIKey struct {
+	callerID string
+	scopes   []string
+}
+
+// serviceKeys are the scopes of the static API_KEY (nil = all) and the SERVICE_API_KEYS by
+// key hash.
+type serviceKeys struct {
+	staticScopes []string
+	byHash       map[string]serviceAPIKey
+}
+
+// serviceKeysFromEnv reads API_KEY_SCOPES (comma-separated, default all scopes) and
+// SERVICE_API_KEYS: comma-separated caller_id:scope+scope:key entries, e.g.
+// "ingest:tokenize:<key>" for a pipeline that may tokenize but never detokenize.
+func serviceKeysFromEnv() (*serviceKeys, error) {
+	sk := &serviceKeys{byHash: map[string]serviceAPIKey{}}
+	if v := strings.TrimSpace(common.MaybeEnv("API_KEY_SCOPES")); v != "" {
+		scopes, err := normalizeScopes(strings.Split(v, ","))
+		if err != nil {
+			return nil, errors.New("API_KEY_SCOPES: " + err.Error())
+		}
+		sk.staticScopes = scopes
+	}
+	for _, entry := range strings.Split(common.MaybeEnv("SERVICE_API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errors.New("SERVICE_API_KEYS: entries must be caller_id:scope+scope:key")
+		}
+		scopes, err := normalizeScopes(strings.Split(parts[1], "+"))
+		if err != nil {
+			return nil, errors.New("SERVICE_API_KEYS: " + err.Error())
+		}
+		sk.byHash[hashAPIKey(parts[2])] = serviceAPIKey{callerID: strings.TrimSpace(parts[0]), scopes: scopes}
+	}
+	return sk, nil
+}
+
+// AuthenticateAPIKey resolves the API key of a request: the static API_KEY, a SERVICE_API_KEYS
+// key or a provisioned key. A service key sets its caller id and scopes, and API_KEY_SCOPES
+// limits the static key. A provisioned key sets its caller id and scopes; a tenant key also
+// fixes the tenant (an X-Tenant-ID header naming another tenant is refused with
+// ErrAPIKeyTenantMismatch). The static key, service keys and team keys have no tenant: they
+// act for no tenant, and may only name one in X-Tenant-ID when they hold ScopeTenantAdmin
+// (ErrTenantHeaderNotAllowed otherwise). Unknown, revoked, disabled and expired keys are
+// refused with ErrInvalidAPIKey.
+func (s *Server) AuthenticateAPIKey(r *http.Request, apiKey string) (*http.Request, error) {
+	sk := s.serviceKeys.Load()
+	if static := s.StaticAPIKey(); static != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(static)) == 1 {
+		ctx := r.Context()
+		var scopes []string
+		if sk != nil && sk.staticScopes != nil {
+			scopes = sk.staticScopes
+			ctx = context.WithValue(ctx, scopesKey, scopes)
+		}
+		ctx, err := bindTenant(ctx, r, "", scopes, ErrAPIKeyTenantMismatch)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, callerIDKey, staticKeyCallerID(apiKey))
+		ctx = context.WithValue(ctx, credentialKey, "apikey:"+hashAPIKey(apiKey)[:16])
+		noteIdentity(ctx)
+		return r.WithContext(ctx), nil
+	}
+	hash := hashAPIKey(apiKey)
+	if sk != nil {
+		if svc, ok := sk.byHash[hash]; ok {
+			ctx, err := bindTenant(r.Context(), r, "", svc.scopes, ErrAPIKeyTenantMismatch)
+			if err != nil {
+				return nil, err
+			}
+			ctx = context.WithValue(ctx, callerIDKey, svc.callerID)
+			ctx = context.WithValue(ctx, scopesKey, svc.scopes)
+			ctx = context.WithValue(ctx, credentialKey, "apikey:"+hash[:16])
+			noteIdentity(ctx)
+			return r.WithContext(ctx), nil
+		}
+	}
+	key, ok := s.apiKeys.get(hash)
+	if !ok {
+		var err error
+		if key, err = s.store.APIKeyByHash(r.Context(), hash); err != nil {
+			return nil, err
+		}
+		s.apiKeys.put(hash, key)
+	}
+	if key == nil || !key.Active(time.Now()) {
+		return nil, ErrInvalidAPIKey
+	}
+	ctx, err := bindTenant(r.Context(), r, key.TenantID, key.Scopes, ErrAPIKeyTenantMismatch)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, callerIDKey, key.CallerID)
+	ctx = context.WithValue(ctx, scopesKey, key.Scopes)
+	ctx = context.WithValue(ctx, credentialKey, "apikey:"+hash[:16])
+	noteIdentity(ctx)
+	return r.WithContext(ctx), nil
+}
+
+// scoped requires scope from callers using a provisioned API key.
+func (s *Server) scoped(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(r.Context(), scope) {
+			writeJSONError(w, http.StatusForbidden, "API key lacks the "+scope+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// scopedAny is scoped for endpoints any of scopes opens, e.g. the bulk jobs of tokenize and
+// detokenize runs.
+func (s *Server) scopedAny(scopes []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.ContainsFunc(scopes, func(sc string) bool { return hasScope(r.Context(), sc) }) {
+			writeJSONError(w, http.StatusForbidden, "API key lacks the "+strings.Join(scopes, " or ")+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasScope reports whether the caller holds scope; callers without scopes (the static API_KEY)
+// hold every scope.
+func hasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(scopesKey).([]string)
+	return !ok || slices.Contains(scopes, scope)
+}
+
+// normalizeScopes validates a requested scope list; empty means defaultScopes. ScopeTenantAdmin
+// is accepted too but never part of allScopes, so it is only held when listed.
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return slices.Clone(defaultScopes), nil
+	}
+	var out []string
+	for _, sc := range scopes {
+		sc = strings.ToLower(strings.TrimSpace(sc))
+		if !slices.Contains(allScopes, sc) && sc != ScopeTenantAdmin {
+			return nil, errors.New("unknown scope " + sc + ", want " + strings.Join(append(allScopes, ScopeTenantAdmin), ", "))
+		}
+		if !slices.Contains(out, sc) {
+			out = append(out, sc)
+		}
+	}
+	return out, nil
+}
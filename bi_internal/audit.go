@@ -0,0 +1,21 @@
+package bi_internal
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+var auditLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("log", "audit")
+
+// auditEvent writes a structured audit record enriched with the request identity
+// (request id, caller, tenant). Never pass plaintext PII in attrs.
+func auditEvent(ctx context.Context, event string, attrs ...any) {
+	base := []any{
+		"event", event,
+		"request_id", RequestIDFromContext(ctx),
+		"caller_id", CallerIDFromContext(ctx),
+		"tenant", TenantFromContext(ctx),
+	}
+	auditLogger.Info("audit", append(base, attrs...)...)
+}
@@ -0,0 +1,222 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	defaultAuditFlushInterval = 2 * time.Second
+	defaultAuditBufferMax     = 50000
+	auditFlushBatch           = 1000
+	auditDetailMax            = 200
+	defaultAuditListLimit     = 100
+	maxAuditListLimit         = 1000
+)
+
+// Audit outcomes of tokenize, detokenize and bulk operations.
+const (
+	auditSuccess   = "success"
+	auditNotFound  = "not_found"
+	auditNotCached = "not_cached"
+	auditDenied    = "denied"
+	auditShredded  = "shredded"
+	auditReadOnly  = "read_only"
+	auditError     = "error"
+)
+
+// auditRecorder buffers audit events in memory and writes them to pii_audit_events in the
+// background, so the hot path never waits on the insert. When the buffer is full (the database
+// is down for a long time) new events are dropped and counted rather than blocking requests.
+type auditRecorder struct {
+	mu      sync.Mutex
+	pending []models.AuditEvent
+	max     int
+	dropped int64
+}
+
+// auditRecorderFromEnv returns the recorder, or nil with AUDIT_EVENTS_DISABLED=true.
+// AUDIT_BUFFER_MAX caps the events held while the database is unreachable.
+func auditRecorderFromEnv() *auditRecorder {
+	if strings.EqualFold(common.MaybeEnv("AUDIT_EVENTS_DISABLED"), "true") {
+		return nil
+	}
+	return &auditRecorder{max: envInt("AUDIT_BUFFER_MAX", defaultAuditBufferMax)}
+}
+
+// auditOutcome classifies the error of an audited operation.
+func auditOutcome(err error) string {
+	switch {
+	case err == nil:
+		return auditSuccess
+	case errors.Is(err, ErrTokenNotFound):
+		return auditNotFound
+	case errors.Is(err, ErrTokenNotCached):
+		return auditNotCached
+	case errors.Is(err, ErrTokenForbidden), errors.Is(err, ErrGlobalFallbackDenied), errors.Is(err, ErrTypeNotAllowed):
+		return auditDenied
+	case errors.Is(err, ErrTokenShredded):
+		return auditShredded
+	case errors.Is(err, ErrReadOnly):
+		return auditReadOnly
+	default:
+		return auditError
+	}
+}
+
+// recordAudit queues one audit event for the caller, tenant and client IP on ctx. fpt is the
+// token involved ("" when there is none); the PII value itself is never recorded. Unexpected
+// errors are kept in the detail, truncated.
+func (s *Server) recordAudit(ctx context.Context, operation, dataType, fpt string, err error, detail string) {
+	if s.audit == nil {
+		return
+	}
+	outcome := auditOutcome(err)
+	if outcome == auditError && detail == "" {
+		detail = err.Error()
+	}
+	if len(detail) > auditDetailMax {
+		detail = detail[:auditDetailMax]
+	}
+	e := models.AuditEvent{
+		OccurredAt: time.Now().UTC(),
+		Operation:  operation,
+		Outcome:    outcome,
+		RequestID:  RequestIDFromContext(ctx),
+		CallerID:   CallerIDFromContext(ctx),
+		TenantID:   TenantFromContext(ctx),
+		DataType:   dataType,
+		FPT:        fpt,
+		SourceIP:   ClientIPFromContext(ctx),
+		Detail:     detail,
+	}
+	s.audit.mu.Lock()
+	if len(s.audit.pending) >= s.audit.max {
+		s.audit.dropped++
+		s.audit.mu.Unlock()
+		if s.metrics != nil {
+			s.metrics.auditDropped.Inc()
+		}
+		return
+	}
+	s.audit.pending = append(s.audit.pending, e)
+	s.audit.mu.Unlock()
+}
+
+// flushAudit writes pending events in batches; a failed batch and everything after it is put
+// back for the next flush.
+func (s *Server) flushAudit() {
+	s.audit.mu.Lock()
+	batch := s.audit.pending
+	s.audit.pending = nil
+	dropped := s.audit.dropped
+	s.audit.dropped = 0
+	s.audit.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("audit: buffer full, events dropped", "dropped", dropped)
+	}
+
+	for len(batch) > 0 {
+		n := min(len(batch), auditFlushBatch)
+		if err := s.store.InsertAuditEvents(batch[:n]); err != nil {
+			slog.Error("audit: flush failed, will retry", "error", err, "pending", len(batch))
+			s.degradation.set(subsystemAuditSink, impactBuffering, err.Error())
+			s.audit.mu.Lock()
+			s.audit.pending = append(batch, s.audit.pending...)
+			if over := len(s.audit.pending) - s.audit.max; over > 0 {
+				// keep the oldest events; the newest ones are dropped
+				s.audit.pending = s.audit.pending[:s.audit.max]
+				s.audit.dropped += int64(over)
+			}
+			s.audit.mu.Unlock()
+			return
+		}
+		batch = batch[n:]
+	}
+	s.degradation.clear(subsystemAuditSink)
+}
+
+// startAuditFlusher flushes audit events every AUDIT_FLUSH_INTERVAL_SEC (default 2).
+func (s *Server) startAuditFlusher() {
+	if s.audit == nil {
+		return
+	}
+	interval := time.Duration(envInt("AUDIT_FLUSH_INTERVAL_SEC", int(defaultAuditFlushInterval.Seconds()))) * time.Second
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			s.flushAudit()
+		}
+	}()
+}
+
+// GET /admin/audit-events?from=&to=&tenant=&caller_id=&operation=&outcome=&fpt=&before_id=&limit=
+// Lists audit events newest first. from/to are RFC 3339 timestamps or YYYY-MM-DD dates; page
+// with before_id=<next_before_id of the previous page>.
+func (s *Server) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := models.AuditEventFilter{
+		TenantID:  strings.TrimSpace(q.Get("tenant")),
+		CallerID:  strings.TrimSpace(q.Get("caller_id")),
+		Operation: strings.TrimSpace(q.Get("operation")),
+		Outcome:   strings.TrimSpace(q.Get("outcome")),
+		FPT:       strings.TrimSpace(q.Get("fpt")),
+		Limit:     defaultAuditListLimit,
+	}
+	var err error
+	if f.From, err = parseAuditTime(q.Get("from")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "from must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	if f.To, err = parseAuditTime(q.Get("to")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "to must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	if v := q.Get("before_id"); v != "" {
+		if f.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil || f.BeforeID <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "before_id must be a positive integer")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > maxAuditListLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditListLimit))
+			return
+		}
+	}
+
+	events, err := s.store.ListAuditEvents(f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list audit events failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	resp := map[string]interface{}{"events": events}
+	if len(events) == f.Limit {
+		resp["next_before_id"] = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
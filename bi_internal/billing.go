@@ -0,0 +1,174 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const defaultBillingInterval = time.Hour
+
+// billingSettle is how long after midnight a day's counts are taken as final: every replica
+// flushes its usage counters within USAGE_FLUSH_INTERVAL_SEC.
+const billingSettle = 5 * time.Minute
+
+// billingExporter sends per-tenant usage records to a billing sink so internal consumers can
+// be charged: tokenize and detokenize counts of the day so far, from the usage counters, and
+// the tenant's vault footprint.
+//
+// Env:
+// BILLING_SINK_URL (optional) records are POSTed there; unset disables the export
+// BILLING_SINK_TOKEN (optional, or BILLING_SINK_TOKEN_FILE) bearer token of the sink
+// BILLING_INTERVAL_MIN (optional, default 60)
+type billingExporter struct {
+	url      string
+	token    string
+	interval time.Duration
+	client   *http.Client
+
+	mu sync.Mutex
+	// openDay is the oldest day whose final records were not delivered yet
+	openDay time.Time
+}
+
+// BillingRecord is a tenant's usage of one UTC day. Records are re-sent every interval with
+// the day's totals so far; the sink keeps the latest record per (tenant, day). Final is set
+// once the day is over and its counts no longer change.
+type BillingRecord struct {
+	Tenant     string `json:"tenant"`
+	Day        string `json:"day"`
+	Tokenize   int64  `json:"tokenize"`
+	Detokenize int64  `json:"detokenize"`
+	// StorageBytes and Tokens are the tenant's vault rows when the record was made; they are
+	// only measured for the current day
+	StorageBytes int64     `json:"storage_bytes,omitempty"`
+	Tokens       int64     `json:"tokens,omitempty"`
+	Final        bool      `json:"final"`
+	EmittedAt    time.Time `json:"emitted_at"`
+}
+
+func billingExporterFromEnv() *billingExporter {
+	url := strings.TrimSpace(common.MaybeEnv("BILLING_SINK_URL"))
+	if url == "" {
+		return nil
+	}
+	minutes := envInt("BILLING_INTERVAL_MIN", int(defaultBillingInterval.Minutes()))
+	if minutes <= 0 {
+		panic("BILLING_INTERVAL_MIN must be positive")
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	return &billingExporter{
+		url:      url,
+		token:    strings.TrimSpace(common.MaybeEnv("BILLING_SINK_TOKEN")),
+		interval: time.Duration(minutes) * time.Minute,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		// after a restart yesterday is sent again, final; the sink keeps one record per day
+		openDay: today.AddDate(0, 0, -1),
+	}
+}
+
+// startBillingExport sends the billing records every BILLING_INTERVAL_MIN from one replica at
+// a time.
+func (s *Server) startBillingExport() {
+	if s.billing == nil {
+		return
+	}
+	s.startPeriodicJob(context.Background(), "billing-export", s.billing.interval, s.exportBilling)
+}
+
+// exportBilling sends the records of every day from the oldest open one to today. A failed
+// delivery keeps those days open, so the next run sends them again.
+func (s *Server) exportBilling(ctx context.Context) error {
+	b := s.billing
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	settled := now.Add(-billingSettle).Truncate(24 * time.Hour)
+	b.mu.Lock()
+	from := b.openDay
+	b.mu.Unlock()
+
+	usage, err := s.store.TenantDailyUsage(from, today)
+	if err != nil {
+		return fmt.Errorf("billing: usage: %w", err)
+	}
+	storage, err := s.store.TenantStorageReport()
+	if err != nil {
+		return fmt.Errorf("billing: storage: %w", err)
+	}
+
+	type recordKey struct{ tenant, day string }
+	records := map[recordKey]*BillingRecord{}
+	record := func(tenant string, day time.Time) *BillingRecord {
+		k := recordKey{tenant, day.Format("2006-01-02")}
+		if records[k] == nil {
+			records[k] = &BillingRecord{Tenant: tenant, Day: k.day, Final: day.Before(settled), EmittedAt: now}
+		}
+		return records[k]
+	}
+	for _, c := range usage {
+		rec := record(c.TenantID, c.Day.UTC())
+		switch c.Operation {
+		case quotaTokenize:
+			rec.Tokenize += c.Count
+		case quotaDetokenize:
+			rec.Detokenize += c.Count
+		}
+	}
+	for _, st := range storage {
+		rec := record(st.TenantID, today)
+		rec.StorageBytes, rec.Tokens = st.Bytes, st.Tokens
+	}
+	out := make([]BillingRecord, 0, len(records))
+	for _, rec := range records {
+		out = append(out, *rec)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Day != out[j].Day {
+			return out[i].Day < out[j].Day
+		}
+		return out[i].Tenant < out[j].Tenant
+	})
+
+	if err := b.send(ctx, out); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.openDay = settled
+	b.mu.Unlock()
+	log.Printf("billing: sent %d records from %s", len(out), from.Format("2006-01-02"))
+	return nil
+}
+
+// send POSTs records as {"records": [...]} to the sink.
+func (b *billingExporter) send(ctx context.Context, records []BillingRecord) error {
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("billing: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("billing: sink: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("billing: sink returned status %d", resp.StatusCode)
+	}
+	return nil
+}
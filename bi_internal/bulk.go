@@ -1,17 +1,15 @@
 package bi_internal
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -21,159 +19,755 @@ import (
 
 var identRE = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
 
-// BulkTokenize reads values from a target DB and sends each PII to the /tokenize HTTP API.
-// After successful tokenization it writes the returned FPT into the provided tokenColumn
-// of the exact source table row (using ctid). Returns (processedRows, successCount, error).
-func (s *Server) BulkTokenize(ctx context.Context, srcDSN, srcTable, srcColumn, dataType, tokenColumn string) (int, int, error) {
-	// validation to avoid SQL injection via table/column names
-	if !identRE.MatchString(srcTable) || !identRE.MatchString(srcColumn) || !identRE.MatchString(tokenColumn) {
-		return 0, 0, errors.New("invalid table, column or token_column name")
+const (
+	defaultBulkFetchSize = 1000
+	defaultBulkMaxRows   = 10000000
+	// defaultBulkConcurrency chunks of a run are in flight at once, each holding a source
+	// connection for its write-back transaction
+	defaultBulkConcurrency = 4
+	maxBulkConcurrency     = 64
+	// defaultBulkWriteBatch rows are written back per UPDATE statement
+	defaultBulkWriteBatch = 500
+	// maxBulkWriteParams is the bind parameter limit of one Postgres statement
+	maxBulkWriteParams = 65535
+	bulkCursorName     = "bulk_src_cursor"
+)
+
+// bulkConfig are the bulk settings, read and validated once at startup.
+type bulkConfig struct {
+	fetchSize int // BULK_FETCH_SIZE
+	maxRows   int // BULK_MAX_ROWS
+	// allowInlineDSN accepts src_dsn in bulk requests (BULK_ALLOW_INLINE_DSN, default false)
+	allowInlineDSN bool
+	concurrency    int // BULK_CONCURRENCY
+	writeBatch     int // BULK_WRITE_BATCH
+	jobWorkers     int // BULK_JOB_WORKERS
+	jobQueueSize   int // BULK_JOB_QUEUE_SIZE
+	// jobClassWorkers caps the workers of a priority class (BULK_JOB_CLASS_WORKERS)
+	jobClassWorkers map[string]int
+	// exportHosts are the hosts export_url may point at (BULK_EXPORT_HOSTS)
+	exportHosts []string
+}
+
+func bulkConfigFromEnv() (bulkConfig, error) {
+	c := bulkConfig{
+		fetchSize:      envInt("BULK_FETCH_SIZE", defaultBulkFetchSize),
+		maxRows:        envInt("BULK_MAX_ROWS", defaultBulkMaxRows),
+		allowInlineDSN: strings.EqualFold(common.MaybeEnv("BULK_ALLOW_INLINE_DSN"), "true"),
+		concurrency:    envInt("BULK_CONCURRENCY", defaultBulkConcurrency),
+		writeBatch:     envInt("BULK_WRITE_BATCH", defaultBulkWriteBatch),
+		jobWorkers:     envInt("BULK_JOB_WORKERS", defaultBulkJobWorkers),
+		jobQueueSize:   envInt("BULK_JOB_QUEUE_SIZE", defaultBulkJobQueueSize),
+		exportHosts:    exportHostsFromEnv(),
+	}
+	if c.concurrency < 1 || c.concurrency > maxBulkConcurrency {
+		return c, fmt.Errorf("BULK_CONCURRENCY must be between 1 and %d", maxBulkConcurrency)
+	}
+	if c.writeBatch < 1 {
+		return c, errors.New("BULK_WRITE_BATCH must be at least 1")
+	}
+	if c.jobWorkers < 1 || c.jobQueueSize < 1 {
+		return c, errors.New("BULK_JOB_WORKERS and BULK_JOB_QUEUE_SIZE must be at least 1")
+	}
+	var err error
+	if c.jobClassWorkers, err = parseBulkClassWorkers(common.MaybeEnv("BULK_JOB_CLASS_WORKERS")); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// BulkColumn is one PII column tokenized by a bulk run.
+type BulkColumn struct {
+	SrcColumn   string `json:"src_column"`
+	DataType    string `json:"data_type"`
+	TokenColumn string `json:"token_column"`
+}
+
+// BulkOptions are the guardrails applied to a bulk run.
+type BulkOptions struct {
+	// FetchSize is the number of rows read (and written back in one transaction) per chunk.
+	FetchSize int
+	// MaxRows stops the run after this many source rows (0 = BULK_MAX_ROWS default).
+	MaxRows int
+	// EstimateOnly returns the planner's row estimate without touching any row.
+	EstimateOnly bool
+	// Force allows a run whose estimate exceeds MaxRows (it still stops at MaxRows).
+	Force bool
+	// KeyColumn enables keyset pagination over this (unique, indexed) source column instead
+	// of one long-lived server-side cursor. Defaults to the table's primary key.
+	KeyColumn string
+	// RowKeyColumns are the columns rows are written back by (default: the primary key); they
+	// must be NOT NULL and form the primary key or a unique index.
+	RowKeyColumns []string
+	// AllowCtid permits tables without a primary key; rows are then written back by ctid,
+	// which is only stable while nothing else updates the table.
+	AllowCtid bool
+	// ExtraColumns are further PII columns of the same rows; every row's tokens are written
+	// back in a single UPDATE.
+	ExtraColumns []BulkColumn
+	// Where restricts the run to the source rows matching every filter.
+	Where []BulkFilter
+	// OnlyMissing restricts the run to rows with an empty (NULL or '') token column, so a
+	// rerun does not re-read the rows an earlier run already tokenized.
+	OnlyMissing bool
+	// Detokenize reverses the run: the source column holds tokens and the token column
+	// receives their values, through the detokenize path of the job's identity.
+	Detokenize bool
+	// ExportKeyColumn, when set, collects (source key -> fpt) pairs into a CSV export.
+	ExportKeyColumn string
+	// ExportURL is a pre-signed https object storage PUT URL on a BULK_EXPORT_HOSTS host for
+	// the export; when empty the export is written to BULK_EXPORT_DIR.
+	ExportURL string
+	// Concurrency is the number of chunks tokenized and written back in parallel
+	// (0 = BULK_CONCURRENCY, which also caps it).
+	Concurrency int
+	// Progress, when set, is called with a copy of the result after every round of chunks.
+	Progress func(BulkResult)
+	// Resume continues a failed run from its checkpoint: keyset reads start after the
+	// checkpoint key and the counters from the checkpoint's. Without a checkpoint the run
+	// starts over.
+	Resume *BulkCheckpoint
+}
+
+// BulkCheckpoint is how far a keyset run got: every row up to Key was tokenized and written
+// back (or already was), with the counters at that point. It only advances while no chunk
+// of the run failed, so a resumed run re-reads the rows of failed chunks.
+type BulkCheckpoint struct {
+	Key       string `json:"key"`
+	Processed int    `json:"processed"`
+	Success   int    `json:"success"`
+}
+
+// BulkResult summarises a bulk run.
+type BulkResult struct {
+	Processed     int   `json:"processed"`
+	Success       int   `json:"success"`
+	EstimatedRows int64 `json:"estimated_rows"`
+	MaxRows       int   `json:"max_rows"`
+	// Truncated is true when the run stopped at MaxRows and the table has more rows.
+	Truncated bool `json:"truncated"`
+	// FailedChunks counts chunks whose write-back transaction was rolled back.
+	FailedChunks int `json:"failed_chunks"`
+	// Degraded is set once the source DB circuit breaker tripped; Pauses counts the pauses.
+	Degraded bool `json:"degraded,omitempty"`
+	Pauses   int  `json:"pauses,omitempty"`
+	// ExportLocation / ExportedRows describe the (source key -> fpt) CSV export, if requested.
+	ExportLocation string `json:"export_location,omitempty"`
+	ExportedRows   int    `json:"exported_rows,omitempty"`
+	// Checkpoint is where a failed keyset run can resume (unset for cursor runs)
+	Checkpoint *BulkCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// ErrBulkTooLarge is returned when the planner estimate exceeds the max-rows limit and the
+// caller did not set Force.
+var ErrBulkTooLarge = errors.New("estimated source rows exceed max_rows")
+
+// estimateRows asks the planner (EXPLAIN, no execution) how many rows query will return.
+func estimateRows(ctx context.Context, db *sql.DB, query string) (int64, error) {
+	var plan string
+	if err := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+query).Scan(&plan); err != nil {
+		return 0, err
+	}
+	var parsed []struct {
+		Plan struct {
+			PlanRows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
 	}
+	if err := json.Unmarshal([]byte(plan), &parsed); err != nil || len(parsed) == 0 {
+		return 0, fmt.Errorf("parse explain output: %v", err)
+	}
+	return int64(parsed[0].Plan.PlanRows), nil
+}
+
+// querier is satisfied by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// bulkRow is one source row: row key (primary key or ctid), the PII values (one per target
+// column), the paging key and the export key.
+type bulkRow struct {
+	rowKey, key, exportKey sql.NullString
+	values                 []sql.NullString
+}
+
+// bulkSource yields source rows in chunks.
+type bulkSource interface {
+	next(ctx context.Context, n int) ([]bulkRow, error)
+	// retryable reports whether next may be called again after it failed
+	retryable() bool
+	close()
+}
+
+func scanBulkRows(rows *sql.Rows, t *bulkTarget) ([]bulkRow, error) {
+	defer rows.Close()
+	var out []bulkRow
+	for rows.Next() {
+		r := bulkRow{values: make([]sql.NullString, len(t.columns))}
+		dest := []interface{}{&r.rowKey}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if t.keyColumn != "" {
+			dest = append(dest, &r.key)
+		}
+		if t.exportKey != "" {
+			dest = append(dest, &r.exportKey)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			slog.Warn("bulk: source row scan failed, row skipped", "error", err)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// cursorSource reads through a server-side cursor held in a read-only transaction.
+type cursorSource struct {
+	tx     *sql.Tx
+	target *bulkTarget
+}
+
+func newCursorSource(ctx context.Context, db *sql.DB, query string, t *bulkTarget) (*cursorSource, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin source tx: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DECLARE "+bulkCursorName+" NO SCROLL CURSOR FOR "+query); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("declare source cursor: %w", err)
+	}
+	return &cursorSource{tx: tx, target: t}, nil
+}
+
+func (c *cursorSource) next(ctx context.Context, n int) ([]bulkRow, error) {
+	rows, err := c.tx.QueryContext(ctx, fmt.Sprintf("FETCH %d FROM %s", n, bulkCursorName))
+	if err != nil {
+		return nil, fmt.Errorf("fetch source: %w", err)
+	}
+	return scanBulkRows(rows, c.target)
+}
+
+// retryable is false: a failed FETCH aborts the transaction holding the cursor.
+func (c *cursorSource) retryable() bool { return false }
+
+func (c *cursorSource) close() { c.tx.Rollback() }
+
+// keysetSource pages with "WHERE key > last ORDER BY key LIMIT n": every chunk is a short,
+// independent query, so nothing holds a snapshot or locks open across the run and a failed
+// read can simply be retried.
+type keysetSource struct {
+	db      *sql.DB
+	keyCol  string
+	lastKey *string
+	target  *bulkTarget
+}
+
+func (k *keysetSource) next(ctx context.Context, n int) ([]bulkRow, error) {
+	var rows *sql.Rows
+	var err error
+	if k.lastKey == nil {
+		rows, err = k.db.QueryContext(ctx, fmt.Sprintf("%s ORDER BY %s LIMIT %d", k.target.query(), k.keyCol, n))
+	} else {
+		rows, err = k.db.QueryContext(ctx, fmt.Sprintf("%s ORDER BY %s LIMIT %d", k.target.query(k.keyCol+" > $1"), k.keyCol, n), *k.lastKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read source chunk: %w", err)
+	}
+	chunk, err := scanBulkRows(rows, k.target)
+	if err != nil {
+		return nil, fmt.Errorf("read source chunk: %w", err)
+	}
+	if len(chunk) > 0 {
+		last := chunk[len(chunk)-1].key.String
+		k.lastKey = &last
+	}
+	return chunk, nil
+}
+
+func (k *keysetSource) retryable() bool { return true }
+
+func (k *keysetSource) close() {}
+
+// BulkTokenize reads values from a target DB and tokenizes each PII in process. It writes the
+// token into the provided tokenColumn of the exact source table row (by opts.RowKeyColumns or
+// the primary key, or ctid with opts.AllowCtid).
+//
+// Rows are read in FetchSize chunks — by keyset pagination over opts.KeyColumn when given,
+// otherwise through a server-side cursor — and each chunk's write-backs are committed in one
+// transaction, so a transient failure loses at most one chunk. The run stops after MaxRows
+// rows, and the planner estimate is checked up front: runs estimated above MaxRows are
+// refused unless opts.Force is set.
+//
+// Chunk failures feed a circuit breaker (see bulkBreaker): when too many recent chunks failed
+// the run is marked degraded, pauses until the source answers again, and is aborted with
+// ErrBulkDegraded if it does not recover. Each transition is sent to BULK_WEBHOOK_URL.
+//
+// Keyset runs record a checkpoint after every round (result.Checkpoint), from which
+// opts.Resume continues a failed run instead of reading the table from the start.
+func (s *Server) BulkTokenize(ctx context.Context, srcDSN, srcTable, srcColumn, dataType, tokenColumn string, opts BulkOptions) (*BulkResult, error) {
+	if opts.FetchSize <= 0 {
+		opts.FetchSize = s.bulk.fetchSize
+	}
+	if opts.MaxRows <= 0 || opts.MaxRows > s.bulk.maxRows {
+		opts.MaxRows = s.bulk.maxRows
+	}
+	if opts.Concurrency <= 0 || opts.Concurrency > s.bulk.concurrency {
+		opts.Concurrency = s.bulk.concurrency
+	}
+	result := &BulkResult{MaxRows: opts.MaxRows}
 
 	srcDB, err := sql.Open("postgres", srcDSN)
 	if err != nil {
-		return 0, 0, fmt.Errorf("open src db: %w", err)
+		return nil, fmt.Errorf("open src db: %w", err)
 	}
 	srcDB.SetConnMaxLifetime(time.Minute * 5)
-	srcDB.SetMaxOpenConns(5)
+	// one write-back transaction per worker, plus the cursor or keyset reads
+	srcDB.SetMaxOpenConns(opts.Concurrency + 1)
 	defer srcDB.Close()
 
-	// Select ctid and the PII column so we can update the exact row later using ctid
-	query := fmt.Sprintf("SELECT ctid, %s FROM %s", srcColumn, srcTable)
-	rows, err := srcDB.QueryContext(ctx, query)
+	// validate identifiers against the source catalog (SQL injection, column types, row key)
+	columns := append([]BulkColumn{{SrcColumn: srcColumn, DataType: dataType, TokenColumn: tokenColumn}}, opts.ExtraColumns...)
+	target, err := resolveBulkTarget(ctx, srcDB, srcTable, columns, opts)
 	if err != nil {
-		return 0, 0, fmt.Errorf("query source: %w", err)
+		return nil, err
+	}
+	if opts.Resume != nil && target.keyColumn == "" {
+		return nil, invalidTarget("only runs with a key column can resume from a checkpoint")
 	}
-	defer rows.Close()
 
-	var (
-		ctidVal sql.NullString
-		value   sql.NullString
-	)
+	// Select the row key and the PII column so we can update the exact row later; the
+	// filters are pushed down so the estimate and the reads only cover the matching rows
+	query := target.query()
 
-	processed := 0
-	success := 0
+	estimate, err := estimateRows(ctx, srcDB, query)
+	if err != nil {
+		return nil, fmt.Errorf("estimate source rows: %w", err)
+	}
+	result.EstimatedRows = estimate
+	slog.InfoContext(ctx, "bulk: run planned", "table", srcTable, "estimated_rows", estimate, "max_rows", opts.MaxRows, "fetch_size", opts.FetchSize)
+	if opts.EstimateOnly {
+		return result, nil
+	}
+	if estimate > int64(opts.MaxRows) && !opts.Force {
+		return result, ErrBulkTooLarge
+	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	tokenizeURL := "http://localhost:8081/tokenize"
-	if env := common.MaybeEnv("TOKENIZE_URL"); env != "" {
-		tokenizeURL = env
+	read := 0
+	var resumeKey *string
+	if cp := opts.Resume; cp != nil {
+		result.Processed, result.Success, result.Checkpoint = cp.Processed, cp.Success, cp
+		read, resumeKey = cp.Processed, &cp.Key
+		slog.InfoContext(ctx, "bulk: resuming from checkpoint", "table", srcTable, "processed", cp.Processed)
 	}
 
-	for rows.Next() {
-		if err := rows.Scan(&ctidVal, &value); err != nil {
-			log.Printf("bulk: scan error: %v", err)
-			continue
+	var src bulkSource
+	if target.keyColumn != "" {
+		src = &keysetSource{db: srcDB, keyCol: target.keyColumn, lastKey: resumeKey, target: target}
+	} else {
+		if src, err = newCursorSource(ctx, srcDB, query, target); err != nil {
+			return nil, err
 		}
-		processed++
+	}
+	defer src.close()
 
-		if !ctidVal.Valid {
-			log.Printf("bulk: row %d - missing ctid (unexpected), skipping", processed)
-			continue
+	var export *bulkExport
+	if opts.ExportKeyColumn != "" {
+		if export, err = newBulkExport("source_key", "fpt"); err != nil {
+			return nil, err
 		}
-		ctid := ctidVal.String
+		defer export.discard()
+	}
 
-		if !value.Valid {
-			log.Printf("bulk: row %d - null value, skipping", processed)
-			continue
+	breaker := newBulkBreaker()
+	// pause waits out a tripped breaker until the source answers again
+	pause := func() error {
+		ev := bulkEvent{Table: srcTable, Processed: result.Processed, FailedChunks: result.FailedChunks, FailureRate: breaker.failureRate()}
+		result.Degraded = true
+		slog.WarnContext(ctx, "bulk: circuit breaker open, pausing", "table", srcTable, "failure_rate", ev.FailureRate)
+		ev.Event = "bulk.degraded"
+		notifyBulk(ctx, ev)
+		if err := breaker.waitForSource(ctx, srcDB, result); err != nil {
+			ev.Event, ev.Pauses, ev.Error = "bulk.aborted", result.Pauses, err.Error()
+			notifyBulk(ctx, ev)
+			return err
 		}
-		rawVal := strings.TrimSpace(value.String)
-		if rawVal == "" {
-			log.Printf("bulk: row %d - empty string, skipping", processed)
-			continue
+		slog.InfoContext(ctx, "bulk: source recovered, resuming", "table", srcTable, "pauses", result.Pauses)
+		ev.Event, ev.Pauses = "bulk.resumed", result.Pauses
+		notifyBulk(ctx, ev)
+		return nil
+	}
+	// readSource fetches the next n source rows. A failed read counts against the breaker like a
+	// failed chunk and is repeated, after a pause once the breaker trips. A read that still
+	// fails after the source answered a pause, or from a source whose reads cannot be
+	// repeated, ends the run.
+	readSource := func(n int) ([]bulkRow, error) {
+		for paused := false; ; {
+			rows, err := src.next(ctx, n)
+			if err == nil || ctx.Err() != nil || !src.retryable() {
+				return rows, err
+			}
+			slog.WarnContext(ctx, "bulk: source read failed", "table", srcTable, "error", err)
+			if breaker.record(true) {
+				if paused {
+					return nil, err
+				}
+				if err := pause(); err != nil {
+					return nil, err
+				}
+				paused = true
+			}
 		}
+	}
 
-		// Normalize same as Tokenize API: PAN -> uppercase
-		var normalized string
-		switch strings.ToUpper(strings.TrimSpace(dataType)) {
-		case "PAN":
-			normalized = strings.ToUpper(rawVal)
-		default:
-			normalized = rawVal
+	// Each round reads up to Concurrency chunks and tokenizes them in parallel, one write-back
+	// transaction each. Outcomes are applied in source order, so the counters, the export and
+	// the circuit breaker see the chunks as a serial run would.
+	checkpointHeld := false
+	for done := false; !done; {
+		var round [][]bulkRow
+		for len(round) < opts.Concurrency {
+			fetch := opts.FetchSize
+			if remaining := opts.MaxRows - read; remaining < fetch {
+				fetch = remaining
+			}
+			if fetch <= 0 {
+				// one more row tells a table of exactly MaxRows rows from a larger one; the
+				// checkpoint only covers processed rows, so reading it past them is harmless
+				extra, err := readSource(1)
+				if err != nil {
+					return result, err
+				}
+				if result.Truncated = len(extra) > 0; result.Truncated {
+					slog.InfoContext(ctx, "bulk: max_rows reached, stopping", "table", srcTable, "max_rows", opts.MaxRows)
+				}
+				done = true
+				break
+			}
+			chunk, err := readSource(fetch)
+			if err != nil {
+				return result, err
+			}
+			read += len(chunk)
+			if len(chunk) > 0 {
+				round = append(round, chunk)
+			}
+			if len(chunk) < fetch {
+				done = true // source exhausted
+				break
+			}
 		}
 
-		// Optional pre-check: skip if already tokenized in tokenization DB
-		blind := common.HMACBlindIndex(s.hmacKey, normalized)
-		if existing, err := s.store.GetByBlindIndex(blind); err == nil && existing != nil {
-			log.Printf("bulk: row %d - already tokenized (fpt=%s), skipping HTTP call", processed, existing.FPT)
-			// Also ensure token is written to source row if missing: try update source if token column empty
-			if err := writeTokenToSourceRow(ctx, srcDB, srcTable, tokenColumn, ctid, existing.FPT); err != nil {
-				log.Printf("bulk: row %d - warning: failed to write existing token to source row: %v", processed, err)
-			}
-			continue
+		outcomes := make([]bulkChunkResult, len(round))
+		var wg sync.WaitGroup
+		first := result.Processed + 1
+		for i, chunk := range round {
+			wg.Add(1)
+			go func(i int, chunk []bulkRow, first int) {
+				defer wg.Done()
+				outcomes[i] = s.bulkTokenizeChunk(ctx, srcDB, target, chunk, first)
+			}(i, chunk, first)
+			first += len(chunk)
 		}
+		wg.Wait()
 
-		// Build request to /tokenize
-		reqBody := map[string]string{
-			"pii_type":  dataType,
-			"pii_value": normalized,
+		tripped := false
+		for i, o := range outcomes {
+			result.Processed += o.rows
+			if o.failed {
+				result.FailedChunks++
+				checkpointHeld = true
+			} else {
+				result.Success += o.success
+				if export != nil {
+					for _, p := range o.pairs {
+						if err := export.add(p.key, p.fpt); err != nil {
+							return result, err
+						}
+					}
+				}
+			}
+			tripped = breaker.record(o.failed) || tripped
+			if target.keyColumn != "" && !checkpointHeld {
+				last := round[i][len(round[i])-1].key.String
+				result.Checkpoint = &BulkCheckpoint{Key: last, Processed: result.Processed, Success: result.Success}
+			}
+		}
+		if tripped {
+			if err := pause(); err != nil {
+				return result, err
+			}
 		}
-		b, _ := json.Marshal(reqBody)
+		if opts.Progress != nil && len(round) > 0 {
+			opts.Progress(*result)
+		}
+	}
 
-		reqCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
-		req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, tokenizeURL, bytes.NewReader(b))
+	if export != nil {
+		loc, err := export.publish(ctx, srcTable, opts.ExportURL, s.bulk.exportHosts)
 		if err != nil {
-			cancel()
-			log.Printf("bulk: row %d - create request error: %v", processed, err)
-			continue
+			return result, fmt.Errorf("bulk export: %w", err)
 		}
-		req.Header.Set("Content-Type", "application/json")
+		result.ExportLocation, result.ExportedRows = loc, export.rows
+	}
+
+	if s.metrics != nil {
+		s.metrics.bulkRows.WithLabelValues("success").Add(float64(result.Success))
+		s.metrics.bulkRows.WithLabelValues("failed").Add(float64(result.Processed - result.Success))
+	}
+	slog.InfoContext(ctx, "bulk-tokenize completed", "table", srcTable, "data_type", dataType, "processed", result.Processed, "success", result.Success, "failed_chunks", result.FailedChunks, "truncated", result.Truncated)
+	return result, nil
+}
 
-		resp, err := client.Do(req)
-		cancel()
+// bulkChunkResult is the outcome of one chunk: its rows, the rows newly tokenized and written
+// back, whether its transaction was lost and the (source key -> fpt) pairs to export.
+type bulkChunkResult struct {
+	rows    int
+	success int
+	failed  bool
+	pairs   []bulkMapping
+}
+
+type bulkMapping struct{ key, fpt string }
+
+// bulkTokenizeChunk tokenizes a chunk (rows first, first+1, ... of the run) and commits its
+// write-backs in one transaction. A failed write rolls back the chunk (failed) and the run
+// moves on; rerunning the job picks those rows up again. Chunks of one round run concurrently.
+func (s *Server) bulkTokenizeChunk(ctx context.Context, srcDB *sql.DB, t *bulkTarget, chunk []bulkRow, first int) bulkChunkResult {
+	out := bulkChunkResult{rows: len(chunk)}
+	tx, err := srcDB.BeginTx(ctx, nil)
+	if err != nil {
+		// a source failure like any other: count it and let the circuit breaker decide
+		out.failed = true
+		slog.WarnContext(ctx, "bulk: begin write-back tx failed, chunk skipped", "first_row", first, "last_row", first+len(chunk)-1, "error", err)
+		return out
+	}
+	defer tx.Rollback()
+
+	// write-backs are flushed every writeBatch rows, each batch in one UPDATE
+	batchSize := min(s.bulk.writeBatch, maxBulkWriteParams/(len(t.columns)+1))
+	pending := make([]bulkWrite, 0, min(batchSize, len(chunk)))
+	flush := func() error {
+		written, err := writeTokensToSourceRows(ctx, tx, t, pending)
 		if err != nil {
-			log.Printf("bulk: row %d - http error calling tokenize: %v", processed, err)
-			continue
+			return err
 		}
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("bulk: row %d - tokenize API returned status %d body=%s", processed, resp.StatusCode, strings.TrimSpace(string(body)))
-			continue
+		for _, w := range pending {
+			if w.fresh && written[w.rowKey] {
+				out.success++
+			}
 		}
+		slog.DebugContext(ctx, "bulk: wrote tokens to source rows", "rows", len(pending), "written", len(written))
+		pending = pending[:0]
+		return nil
+	}
 
-		var tr struct {
-			FPT string `json:"fpt"`
-		}
-		if err := json.Unmarshal(body, &tr); err != nil {
-			log.Printf("bulk: row %d - invalid tokenize response: %v body=%s", processed, err, strings.TrimSpace(string(body)))
-			continue
+	// a value repeated across the rows or columns of the chunk is looked up once
+	ctx = withLookupMemo(ctx)
+	for i, r := range chunk {
+		if w, ok := s.bulkTokenizeRow(ctx, t, first+i, r); ok {
+			if w.fpts[0] != "" && r.exportKey.Valid {
+				out.pairs = append(out.pairs, bulkMapping{r.exportKey.String, w.fpts[0]})
+			}
+			pending = append(pending, w)
 		}
-		if tr.FPT == "" {
-			log.Printf("bulk: row %d - tokenize returned empty fpt (body=%s)", processed, strings.TrimSpace(string(body)))
-			continue
+		if len(pending) == batchSize || (i == len(chunk)-1 && len(pending) > 0) {
+			if err := flush(); err != nil {
+				// the transaction is aborted; drop the whole chunk
+				slog.WarnContext(ctx, "bulk: write-back failed, chunk rolled back", "first_row", first, "last_row", first+len(chunk)-1, "error", err)
+				return bulkChunkResult{rows: len(chunk), failed: true}
+			}
 		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.WarnContext(ctx, "bulk: commit failed, chunk lost", "first_row", first, "last_row", first+len(chunk)-1, "error", err)
+		return bulkChunkResult{rows: len(chunk), failed: true}
+	}
+	return out
+}
 
-		// write token into source row using ctid to target exact row
-		if err := writeTokenToSourceRow(ctx, srcDB, srcTable, tokenColumn, ctid, tr.FPT); err != nil {
-			log.Printf("bulk: row %d - failed to write token to source row: %v", processed, err)
-			continue
+// bulkWrite is one row's pending write-back: its key, one token per target column ("" when
+// the value had none) and whether any token was newly created.
+type bulkWrite struct {
+	rowKey string
+	fpts   []string
+	fresh  bool
+}
+
+// bulkTokenizeRow tokenizes (detokenize runs: detokenizes) every target column of one source
+// row for the write-back. ok is false for rows without a row key, which cannot be written back.
+func (s *Server) bulkTokenizeRow(ctx context.Context, t *bulkTarget, processed int, r bulkRow) (bulkWrite, bool) {
+	if !r.rowKey.Valid {
+		slog.DebugContext(ctx, "bulk: missing row key, row skipped", "row", processed)
+		return bulkWrite{}, false
+	}
+	w := bulkWrite{rowKey: r.rowKey.String, fpts: make([]string, len(t.columns))}
+	for i, c := range t.columns {
+		var fpt string
+		var isNew bool
+		if t.detokenize {
+			fpt, isNew = s.bulkValueFor(ctx, processed, r.values[i])
+		} else {
+			fpt, isNew = s.bulkTokenFor(ctx, c.dataType, processed, r.values[i])
 		}
+		w.fpts[i] = fpt
+		w.fresh = w.fresh || isNew
+	}
+	return w, true
+}
 
-		success++
-		log.Printf("bulk: row %d - tokenized fpt=%s and wrote to source row (ctid=%s)", processed, tr.FPT, ctid)
+// bulkValueFor returns the value of one source token for a bulk detokenize run ("" when the
+// token is empty or could not be detokenized; ok is set otherwise). Tokens go through the
+// in-process detokenize path with the job's identity: tenant access, allowed types, masking,
+// the detokenize quota and the audit record apply as they do to POST /detokenize. Values are
+// never logged.
+func (s *Server) bulkValueFor(ctx context.Context, processed int, token sql.NullString) (string, bool) {
+	fpt := strings.TrimSpace(token.String)
+	if !token.Valid || fpt == "" {
+		slog.DebugContext(ctx, "bulk: empty token skipped", "row", processed)
+		return "", false
 	}
+	charge, err := s.chargeQuota(ctx, quotaDetokenize, 1)
+	if err != nil {
+		slog.WarnContext(ctx, "bulk: detokenize quota exceeded, token skipped", "row", processed, "error", err)
+		return "", false
+	}
+	val, err := s.Detokenize(ctx, fpt)
+	if err != nil {
+		s.refundQuota(ctx, charge, 1)
+		slog.WarnContext(ctx, "bulk: detokenize failed", "row", processed, "fpt", fpt, "error", err)
+		return "", false
+	}
+	return val, val != ""
+}
 
-	if err := rows.Err(); err != nil {
-		return processed, success, fmt.Errorf("rows error: %w", err)
+// bulkTokenFor returns the token of one source value ("" when the value is empty or could not
+// be tokenized) and whether this call created it. Values go through the in-process tokenize
+// path with the job's identity: validation, the tenant's allowed types and tokenize quota, and
+// the audit record apply as they do to POST /tokenize.
+func (s *Server) bulkTokenFor(ctx context.Context, dataType string, processed int, value sql.NullString) (string, bool) {
+	if !value.Valid {
+		slog.DebugContext(ctx, "bulk: null value skipped", "row", processed)
+		return "", false
+	}
+	rawVal := strings.TrimSpace(value.String)
+	if rawVal == "" {
+		slog.DebugContext(ctx, "bulk: empty value skipped", "row", processed)
+		return "", false
+	}
+
+	// Normalize same as Tokenize API: PAN -> uppercase, MOBILE -> E.164
+	normalized := common.NormalizePII(dataType, rawVal)
+
+	// validated and policy-checked before any shortcut, as POST /tokenize does
+	if verr := s.validatePII(ctx, dataType, normalized); verr != nil {
+		slog.WarnContext(ctx, "bulk: invalid value skipped", "row", processed, "data_type", dataType, "code", verr.Code)
+		return "", false
+	}
+	if err := s.checkTypeAllowed(ctx, dataType); err != nil {
+		slog.WarnContext(ctx, "bulk: data type not allowed, value skipped", "row", processed, "data_type", dataType)
+		s.recordAudit(ctx, "tokenize", dataType, "", err, "")
+		return "", false
+	}
+
+	km := s.keys.Load()
+	memo := lookupMemoFrom(ctx)
+	tenant := TenantFromContext(ctx)
+	blind := blindIndexIn(km.hmac, tenantBlindDomain(tenant), normalized)
+	if fpt, ok := memo.token(dataType, blind); ok {
+		s.memoLookup("blind")
+		return fpt, false
+	}
+
+	// Pre-check: an already tokenized value the job's identity may use needs no tokenize call
+	if existing, _, err := s.lookupByValue(ctx, km, dataType, rawVal); err == nil && existing != nil &&
+		(existing.TenantID == tenant || existing.TenantID == "") {
+		if err := s.checkGlobalFallback(ctx, existing.TenantID, dataType, existing.FPT); err != nil {
+			slog.WarnContext(ctx, "bulk: global token not available to the tenant, value skipped", "row", processed, "data_type", dataType)
+			s.recordAudit(ctx, "tokenize", dataType, "", err, "")
+			return "", false
+		}
+		slog.DebugContext(ctx, "bulk: value already tokenized, skipping the tokenize call", "row", processed, "data_type", dataType, "fpt", existing.FPT)
+		s.recordAudit(ctx, "tokenize", dataType, existing.FPT, nil, "")
+		memo.setToken(dataType, blind, existing.FPT)
+		// the write-back still fills the token column if it is empty
+		return existing.FPT, false
 	}
-	log.Printf("bulk-tokenize completed: processed=%d success=%d", processed, success)
-	return processed, success, nil
+
+	charge, err := s.chargeQuota(ctx, quotaTokenize, 1)
+	if err != nil {
+		slog.WarnContext(ctx, "bulk: tokenize quota exceeded, value skipped", "row", processed, "data_type", dataType, "error", err)
+		return "", false
+	}
+	fpt, err := s.Tokenize(ctx, dataType, normalized)
+	if err != nil {
+		s.refundQuota(ctx, charge, 1)
+		slog.WarnContext(ctx, "bulk: tokenize failed", "row", processed, "data_type", dataType, "error", err)
+		return "", false
+	}
+	return fpt, true
 }
 
-// writeTokenToSourceRow updates the given tokenColumn for the row identified by ctid.
-// It only sets the token when the token column is currently NULL/empty to avoid overwriting.
-func writeTokenToSourceRow(ctx context.Context, db *sql.DB, table, tokenColumn, ctid, fpt string) error {
-	updateSQL := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE ctid = $2 AND (COALESCE(%s, '') = '')", table, tokenColumn, tokenColumn)
-	res, err := db.ExecContext(ctx, updateSQL, fpt, ctid)
+// writeTokensToSourceRows updates the token columns of a batch of rows in a single
+// UPDATE ... FROM (VALUES ...) joined on the row key. Columns without a token ("") are left
+// alone, and a token is only set when its column is currently NULL/empty to avoid overwriting.
+// It returns the keys of the rows that changed.
+func writeTokensToSourceRows(ctx context.Context, db querier, t *bulkTarget, batch []bulkWrite) (map[string]bool, error) {
+	var values []string
+	var args []interface{}
+	for _, w := range batch {
+		hasToken := false
+		for _, fpt := range w.fpts {
+			hasToken = hasToken || fpt != ""
+		}
+		if !hasToken {
+			continue
+		}
+		row := make([]string, 0, len(w.fpts)+1)
+		// single-column keys are the key text, composite keys a JSON array of the columns
+		args = append(args, w.rowKey)
+		row = append(row, fmt.Sprintf("$%d::text", len(args)))
+		for _, fpt := range w.fpts {
+			if fpt == "" {
+				args = append(args, nil)
+			} else {
+				args = append(args, fpt)
+			}
+			row = append(row, fmt.Sprintf("$%d::text", len(args)))
+		}
+		values = append(values, "("+strings.Join(row, ", ")+")")
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	names := []string{"k"}
+	var sets, empty []string
+	for i, c := range t.columns {
+		v := fmt.Sprintf("v.t%d", i)
+		names = append(names, fmt.Sprintf("t%d", i))
+		missing := fmt.Sprintf("(COALESCE(src.%s, '') = '' AND %s IS NOT NULL)", c.tokenColumn, v)
+		sets = append(sets, fmt.Sprintf("%s = CASE WHEN %s THEN %s ELSE src.%s END", c.tokenColumn, missing, v, c.tokenColumn))
+		empty = append(empty, missing)
+	}
+	updateSQL := fmt.Sprintf("UPDATE %s AS src SET %s FROM (VALUES %s) AS v(%s) WHERE %s AND (%s) RETURNING v.k",
+		t.table, strings.Join(sets, ", "), strings.Join(values, ", "), strings.Join(names, ", "), t.rowKeyMatch("src", "v.k"), strings.Join(empty, " OR "))
+	rows, err := db.QueryContext(ctx, updateSQL, args...)
 	if err != nil {
-		return fmt.Errorf("update exec: %w", err)
+		return nil, fmt.Errorf("update exec: %w", err)
 	}
-	// Optionally check rows affected:
-	if ra, err := res.RowsAffected(); err == nil && ra == 0 {
-		// nothing updated (maybe token column already set) — return nil (not fatal)
-		return nil
+	defer rows.Close()
+	written := make(map[string]bool, len(values))
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, fmt.Errorf("update exec: %w", err)
+		}
+		written[k] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("update exec: %w", err)
 	}
-	return nil
+	return written, nil
 }
@@ -0,0 +1,161 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	defaultBulkBreakerWindow     = 10
+	defaultBulkBreakerFailurePct = 50
+	defaultBulkBreakerPause      = 30 * time.Second
+	defaultBulkBreakerMaxPauses  = 5
+)
+
+// ErrBulkDegraded is returned when the source DB kept failing through every breaker pause.
+var ErrBulkDegraded = errors.New("source database degraded, bulk run aborted")
+
+// bulkBreaker is a failure-rate circuit breaker over the source DB reads and chunk write-backs
+// of one bulk run. It trips when BULK_BREAKER_FAILURE_PCT of the last BULK_BREAKER_WINDOW
+// outcomes failed; the run then pauses and probes the source before going on.
+type bulkBreaker struct {
+	window    []bool // ring of recent chunk outcomes, true = failed
+	next      int
+	filled    int
+	threshold int
+	pause     time.Duration
+	maxPauses int
+}
+
+func newBulkBreaker() *bulkBreaker {
+	size := envInt("BULK_BREAKER_WINDOW", defaultBulkBreakerWindow)
+	if size <= 0 {
+		size = defaultBulkBreakerWindow
+	}
+	pct := envInt("BULK_BREAKER_FAILURE_PCT", defaultBulkBreakerFailurePct)
+	if pct <= 0 || pct > 100 {
+		pct = defaultBulkBreakerFailurePct
+	}
+	threshold := (size*pct + 99) / 100
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &bulkBreaker{
+		window:    make([]bool, size),
+		threshold: threshold,
+		pause:     time.Duration(envInt("BULK_BREAKER_PAUSE_SEC", int(defaultBulkBreakerPause.Seconds()))) * time.Second,
+		maxPauses: envInt("BULK_BREAKER_MAX_PAUSES", defaultBulkBreakerMaxPauses),
+	}
+}
+
+// record adds a chunk outcome and reports whether the breaker tripped.
+func (b *bulkBreaker) record(failed bool) bool {
+	b.window[b.next] = failed
+	b.next = (b.next + 1) % len(b.window)
+	if b.filled < len(b.window) {
+		b.filled++
+	}
+	return b.failures() >= b.threshold
+}
+
+func (b *bulkBreaker) failures() int {
+	n := 0
+	for i := 0; i < b.filled; i++ {
+		if b.window[i] {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *bulkBreaker) failureRate() float64 {
+	if b.filled == 0 {
+		return 0
+	}
+	return float64(b.failures()) / float64(b.filled)
+}
+
+func (b *bulkBreaker) reset() {
+	for i := range b.window {
+		b.window[i] = false
+	}
+	b.next, b.filled = 0, 0
+}
+
+// waitForSource pauses the run after the breaker tripped: it sleeps BULK_BREAKER_PAUSE_SEC,
+// pings the source and repeats until the source answers (nil) or BULK_BREAKER_MAX_PAUSES
+// pauses passed (ErrBulkDegraded).
+func (b *bulkBreaker) waitForSource(ctx context.Context, srcDB *sql.DB, result *BulkResult) error {
+	var err error
+	for i := 0; i < b.maxPauses; i++ {
+		result.Pauses++
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.pause):
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err = srcDB.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			b.reset()
+			return nil
+		}
+		log.Printf("bulk: source still failing after pause %d/%d: %v", i+1, b.maxPauses, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBulkDegraded, err)
+	}
+	return ErrBulkDegraded
+}
+
+// bulkEvent is the body POSTed to BULK_WEBHOOK_URL when a bulk run changes health.
+type bulkEvent struct {
+	Event        string    `json:"event"` // bulk.degraded, bulk.resumed or bulk.aborted
+	Table        string    `json:"table"`
+	Processed    int       `json:"processed"`
+	FailedChunks int       `json:"failed_chunks"`
+	FailureRate  float64   `json:"failure_rate"`
+	Pauses       int       `json:"pauses"`
+	Error        string    `json:"error,omitempty"`
+	At           time.Time `json:"at"`
+}
+
+// notifyBulk records a bulk health change in the audit log and POSTs it to BULK_WEBHOOK_URL
+// (if set). Delivery is best effort: a failed webhook is logged, never fatal to the run.
+func notifyBulk(ctx context.Context, ev bulkEvent) {
+	ev.At = time.Now().UTC()
+	auditEvent(ctx, ev.Event, "table", ev.Table, "processed", ev.Processed, "failed_chunks", ev.FailedChunks, "failure_rate", ev.FailureRate)
+
+	url := common.MaybeEnv("BULK_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+	b, _ := json.Marshal(ev)
+	reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		log.Printf("bulk: webhook request error: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("bulk: webhook %s failed: %v", ev.Event, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("bulk: webhook %s returned status %d", ev.Event, resp.StatusCode)
+	}
+}
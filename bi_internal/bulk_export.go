@@ -0,0 +1,178 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+// exportHostsFromEnv reads BULK_EXPORT_HOSTS: the comma-separated hosts export_url may point
+// at, exact ("bucket.s3.amazonaws.com") or by suffix ("*.storage.googleapis.com"). Unset, no
+// export_url is accepted and exports go to BULK_EXPORT_DIR only.
+func exportHostsFromEnv() []string {
+	var hosts []string
+	for _, h := range strings.Split(common.MaybeEnv("BULK_EXPORT_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// checkExportURL accepts an https export_url without credentials whose host is in hosts. The
+// address the host resolves to is checked again when the upload connects (publicDialControl).
+func checkExportURL(raw string, hosts []string) (*url.URL, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("export_url is not enabled (BULK_EXPORT_HOSTS is not set)")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return nil, errors.New("export_url must be an https URL without credentials")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok && strings.HasSuffix(host, suffix) || host == h {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("export_url host %s is not in BULK_EXPORT_HOSTS", host)
+}
+
+// cgnatNet is the shared address space of carrier-grade NAT, internal to most clouds.
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicDialControl refuses connections to loopback, private, link-local (cloud metadata),
+// shared and unspecified addresses. It runs after DNS resolution, so an allowed host name that
+// resolves to an internal address is refused too.
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatNet.Contains(ip) {
+		return fmt.Errorf("export upload to non-public address %s refused", host)
+	}
+	return nil
+}
+
+// exportClient uploads exports: direct connections to public addresses only, no proxy and no
+// redirects, which could lead anywhere.
+var exportClient = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, Control: publicDialControl}).DialContext,
+		TLSHandshakeTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// bulkExport spools (source key -> fpt) pairs to a temp CSV during a bulk run so large runs
+// do not hold the mapping in memory, then publishes it to object storage or a directory.
+// Staged CSV uploads (POST /tokenize/csv) are spooled the same way, with their own header.
+type bulkExport struct {
+	f    *os.File
+	w    *csv.Writer
+	rows int
+}
+
+func newBulkExport(header ...string) (*bulkExport, error) {
+	f, err := os.CreateTemp("", "bulk-export-*.csv")
+	if err != nil {
+		return nil, fmt.Errorf("create export spool: %w", err)
+	}
+	e := &bulkExport{f: f, w: csv.NewWriter(f)}
+	if err := e.w.Write(header); err != nil {
+		e.discard()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *bulkExport) add(key, fpt string) error {
+	return e.write([]string{key, fpt})
+}
+
+func (e *bulkExport) write(record []string) error {
+	if err := e.w.Write(record); err != nil {
+		return fmt.Errorf("write export row: %w", err)
+	}
+	e.rows++
+	return nil
+}
+
+// discard removes the spool file; safe to call after publish.
+func (e *bulkExport) discard() {
+	e.f.Close()
+	os.Remove(e.f.Name())
+}
+
+// publish uploads the CSV with an HTTP PUT to putURL (e.g. a pre-signed S3/GCS URL on one of
+// hosts) or, when putURL is empty, copies it into BULK_EXPORT_DIR. Returns where the export
+// went.
+func (e *bulkExport) publish(ctx context.Context, table, putURL string, hosts []string) (string, error) {
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		return "", err
+	}
+	if _, err := e.f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	info, err := e.f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if putURL != "" {
+		if _, err := checkExportURL(putURL, hosts); err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, putURL, e.f)
+		if err != nil {
+			return "", err
+		}
+		req.ContentLength = info.Size()
+		req.Header.Set("Content-Type", "text/csv")
+		resp, err := exportClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("upload export: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return "", fmt.Errorf("upload export: status %d", resp.StatusCode)
+		}
+		// do not echo pre-signed query parameters back
+		return strings.SplitN(putURL, "?", 2)[0], nil
+	}
+
+	dir := common.MaybeEnv("BULK_EXPORT_DIR")
+	if dir == "" {
+		return "", fmt.Errorf("no export_url given and BULK_EXPORT_DIR not set")
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s_%s.csv", table, time.Now().UTC().Format("20060102T150405Z")))
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, e.f); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -3,50 +3,253 @@ package bi_internal
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 )
 
 type BulkTokenizeRequest struct {
-	SrcDSN      string `json:"src_dsn"`
+	// SrcProfile names a registered connection profile; SrcDSN inlines the DSN instead
+	// (only accepted with BULK_ALLOW_INLINE_DSN=true)
+	SrcProfile  string `json:"src_profile,omitempty"`
+	SrcDSN      string `json:"src_dsn,omitempty"`
 	SrcTable    string `json:"src_table"`
 	SrcColumn   string `json:"src_column"`
 	DataType    string `json:"data_type"`
 	TokenColumn string `json:"token_column"`
+	// Columns lists further PII columns of the same rows (or all of them when the single
+	// src_column/data_type/token_column fields are omitted)
+	Columns []BulkColumn `json:"columns,omitempty"`
+	// Guardrails (optional)
+	MaxRows      int  `json:"max_rows,omitempty"`
+	FetchSize    int  `json:"fetch_size,omitempty"`
+	EstimateOnly bool `json:"estimate_only,omitempty"`
+	Force        bool `json:"force,omitempty"`
+	// Concurrency lowers the chunks written back in parallel (capped by BULK_CONCURRENCY)
+	Concurrency int `json:"concurrency,omitempty"`
+	// KeyColumn overrides the keyset pagination column (default: the primary key)
+	KeyColumn string `json:"key_column,omitempty"`
+	// RowKeyColumns are the write-back key (default: the primary key, single or composite)
+	RowKeyColumns []string `json:"row_key_columns,omitempty"`
+	// AllowCtid permits tables without a primary key (rows written back by ctid)
+	AllowCtid bool `json:"allow_ctid,omitempty"`
+	// Where filters the source rows; OnlyMissing skips rows whose token column is already set
+	Where       []BulkFilter `json:"where,omitempty"`
+	OnlyMissing bool         `json:"only_missing,omitempty"`
+	// Mapping export (optional): source key column and pre-signed PUT URL
+	ExportKeyColumn string `json:"export_key_column,omitempty"`
+	ExportURL       string `json:"export_url,omitempty"`
+	// Priority is the job's class: high, normal (default) or low
+	Priority string `json:"priority,omitempty"`
+	// Detokenize marks POST /bulk-detokenize runs: src_column holds tokens and token_column
+	// receives their values
+	Detokenize bool `json:"detokenize,omitempty"`
+}
+
+// BulkDetokenizeRequest is the body of POST /bulk-detokenize: the tokens of src_column are
+// detokenized into target_column of the same rows.
+type BulkDetokenizeRequest struct {
+	SrcProfile   string `json:"src_profile,omitempty"`
+	SrcDSN       string `json:"src_dsn,omitempty"`
+	SrcTable     string `json:"src_table"`
+	SrcColumn    string `json:"src_column"`
+	TargetColumn string `json:"target_column"`
+	// Guardrails and row selection, as for POST /bulk-tokenize
+	MaxRows       int          `json:"max_rows,omitempty"`
+	FetchSize     int          `json:"fetch_size,omitempty"`
+	EstimateOnly  bool         `json:"estimate_only,omitempty"`
+	Force         bool         `json:"force,omitempty"`
+	Concurrency   int          `json:"concurrency,omitempty"`
+	KeyColumn     string       `json:"key_column,omitempty"`
+	RowKeyColumns []string     `json:"row_key_columns,omitempty"`
+	AllowCtid     bool         `json:"allow_ctid,omitempty"`
+	Where         []BulkFilter `json:"where,omitempty"`
+	OnlyMissing   bool         `json:"only_missing,omitempty"`
+	Priority      string       `json:"priority,omitempty"`
 }
 
 type BulkTokenizeResponse struct {
-	Message   string `json:"message"`
-	Processed int    `json:"processed"`
-	Success   int    `json:"success"`
+	Message string `json:"message"`
+	// JobID is the queued job (GET /bulk-jobs/{id}); unset for estimate_only requests
+	JobID string `json:"job_id,omitempty"`
+	*BulkResult
+}
+
+// options are the guardrails of the run the request asks for.
+func (req *BulkTokenizeRequest) options() BulkOptions {
+	return BulkOptions{
+		FetchSize:     req.FetchSize,
+		MaxRows:       req.MaxRows,
+		EstimateOnly:  req.EstimateOnly,
+		Force:         req.Force,
+		Concurrency:   req.Concurrency,
+		KeyColumn:     req.KeyColumn,
+		AllowCtid:     req.AllowCtid,
+		RowKeyColumns: req.RowKeyColumns,
+		ExtraColumns:  req.Columns,
+		Where:         req.Where,
+		OnlyMissing:   req.OnlyMissing,
+
+		ExportKeyColumn: req.ExportKeyColumn,
+		ExportURL:       req.ExportURL,
+		Detokenize:      req.Detokenize,
+	}
+}
+
+// operation names the run in messages and logs: bulk-tokenize or bulk-detokenize.
+func (req *BulkTokenizeRequest) operation() string {
+	if req.Detokenize {
+		return "bulk-detokenize"
+	}
+	return "bulk-tokenize"
 }
 
 // HTTP handler for POST /bulk-tokenize
+// Checks the target and the row estimate, then queues the run as a job and answers 202 with
+// its id. estimate_only requests are answered directly.
 func (s *Server) bulkTokenizeHandler(w http.ResponseWriter, r *http.Request) {
 	var req BulkTokenizeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
-	if req.SrcDSN == "" || req.SrcTable == "" || req.SrcColumn == "" || req.DataType == "" || req.TokenColumn == "" {
+	if req.SrcColumn == "" && req.DataType == "" && req.TokenColumn == "" && len(req.Columns) > 0 {
+		first := req.Columns[0]
+		req.SrcColumn, req.DataType, req.TokenColumn = first.SrcColumn, first.DataType, first.TokenColumn
+		req.Columns = req.Columns[1:]
+	}
+	req.DataType = strings.ToUpper(strings.TrimSpace(req.DataType))
+	for i := range req.Columns {
+		req.Columns[i].DataType = strings.ToUpper(strings.TrimSpace(req.Columns[i].DataType))
+	}
+	if req.SrcTable == "" || req.SrcColumn == "" || req.DataType == "" || req.TokenColumn == "" {
 		http.Error(w, "missing required fields", http.StatusBadRequest)
 		return
 	}
+	s.queueBulkRun(w, r, req)
+}
 
-	log.Printf("bulk-tokenize request: table=%s column=%s type=%s token_column=%s", req.SrcTable, req.SrcColumn, req.DataType, req.TokenColumn)
+// HTTP handler for POST /bulk-detokenize
+// Detokenizes the tokens of a source column into a target column of the same rows, e.g. for
+// an authorized regulatory extract. The run is a bulk job like POST /bulk-tokenize; every
+// token goes through the detokenize path of the caller (tenant access, allowed types, masking,
+// detokenize quota and audit).
+func (s *Server) bulkDetokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var body BulkDetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.SrcTable == "" || body.SrcColumn == "" || body.TargetColumn == "" {
+		http.Error(w, "missing required fields", http.StatusBadRequest)
+		return
+	}
+	s.queueBulkRun(w, r, BulkTokenizeRequest{
+		SrcProfile:    body.SrcProfile,
+		SrcDSN:        body.SrcDSN,
+		SrcTable:      body.SrcTable,
+		SrcColumn:     body.SrcColumn,
+		TokenColumn:   body.TargetColumn,
+		MaxRows:       body.MaxRows,
+		FetchSize:     body.FetchSize,
+		EstimateOnly:  body.EstimateOnly,
+		Force:         body.Force,
+		Concurrency:   body.Concurrency,
+		KeyColumn:     body.KeyColumn,
+		RowKeyColumns: body.RowKeyColumns,
+		AllowCtid:     body.AllowCtid,
+		Where:         body.Where,
+		OnlyMissing:   body.OnlyMissing,
+		Priority:      body.Priority,
+		Detokenize:    true,
+	})
+}
 
-	processed, success, err := s.BulkTokenize(context.Background(), req.SrcDSN, req.SrcTable, req.SrcColumn, req.DataType, req.TokenColumn)
+// queueBulkRun checks the target and the row estimate of a bulk run, then queues it as a job
+// and answers 202 with its id; estimate_only requests are answered directly.
+func (s *Server) queueBulkRun(w http.ResponseWriter, r *http.Request, req BulkTokenizeRequest) {
+	op := req.operation()
+	var err error
+	if req.Priority, err = normalizeBulkPriority(req.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExportURL != "" {
+		if _, err := checkExportURL(req.ExportURL, s.bulk.exportHosts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	srcDSN, err := s.resolveSrcDSN(r.Context(), &req)
+	if errors.Is(err, ErrBulkSource) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), op+": resolving the source failed", "error", err)
+		http.Error(w, op+" failed: cannot resolve source", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), op+" request", "profile", req.SrcProfile, "table", req.SrcTable, "column", req.SrcColumn, "data_type", req.DataType, "token_column", req.TokenColumn)
+
+	opts := req.options()
+	// the job outlives the request but keeps its identity for audit and logs
+	ctx := context.WithoutCancel(r.Context())
+	// plan the run first so a bad target or an oversized table is refused before it is queued
+	planOpts := opts
+	planOpts.EstimateOnly = true
+	plan, err := s.BulkTokenize(ctx, srcDSN, req.SrcTable, req.SrcColumn, req.DataType, req.TokenColumn, planOpts)
+	if err == nil && !req.EstimateOnly && !req.Force && plan.EstimatedRows > int64(plan.MaxRows) {
+		err = ErrBulkTooLarge
+	}
+	if err != nil || req.EstimateOnly {
+		detail := "table=" + req.SrcTable
+		if plan != nil {
+			detail += fmt.Sprintf(" estimated_rows=%d estimate_only=%t", plan.EstimatedRows, req.EstimateOnly)
+		}
+		s.recordAudit(r.Context(), strings.ReplaceAll(op, "-", "_"), req.DataType, "", err, detail)
+	}
+	if err == ErrBulkTooLarge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(BulkTokenizeResponse{
+			Message:    "estimated rows exceed max_rows; narrow the run, raise max_rows or set force=true",
+			BulkResult: plan,
+		})
+		return
+	}
+	if errors.Is(err, ErrBulkInvalidTarget) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("bulk-tokenize error: %v", err)
-		http.Error(w, "bulk-tokenize failed: "+err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), op+" failed", "error", err)
+		http.Error(w, op+" failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.EstimateOnly {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BulkTokenizeResponse{Message: "estimate only, no rows processed", BulkResult: plan})
 		return
 	}
 
-	resp := BulkTokenizeResponse{
-		Message:   "bulk-tokenize completed successfully",
-		Processed: processed,
-		Success:   success,
+	job, err := s.submitBulkJob(ctx, req, srcDSN, opts, plan, "")
+	if err == ErrBulkQueueFull {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "bulk job queue is full, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), op+": queueing the job failed", "error", err)
+		http.Error(w, op+" failed: cannot queue the job", http.StatusInternalServerError)
+		return
 	}
+	slog.InfoContext(r.Context(), op+" job queued", "job_id", job.ID, "table", req.SrcTable)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	w.Header().Set("Location", apiPathPrefix+"/bulk-jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(BulkTokenizeResponse{Message: op + " job queued", JobID: job.ID, BulkResult: plan})
 }
@@ -0,0 +1,395 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	defaultBulkJobWorkers   = 2
+	defaultBulkJobQueueSize = 20
+	// bulkJobProgressInterval throttles the progress writes of a running job
+	bulkJobProgressInterval = 5 * time.Second
+	bulkJobHeartbeat        = 30 * time.Second
+	// bulkJobStaleAfter is the heartbeat age after which a queued or running job is failed
+	bulkJobStaleAfter = 5 * time.Minute
+	bulkJobListLimit  = 50
+)
+
+// ErrBulkQueueFull is returned when BULK_JOB_QUEUE_SIZE jobs already wait for a worker.
+var ErrBulkQueueFull = errors.New("bulk job queue is full")
+
+// bulkJobs queues bulk-tokenize and bulk-detokenize jobs for the BULK_JOB_WORKERS workers of
+// this replica. The jobs live in pii_bulk_jobs, so any replica answers GET /bulk-jobs/{id}; the
+// queue itself is in memory and the jobs of a stopped replica are failed once their heartbeat
+// is stale.
+//
+// Jobs are queued per priority class (see bulk_priority.go): a free worker goes to the oldest
+// job of the highest class still under its BULK_JOB_CLASS_WORKERS cap, and a running keyset job
+// pauses between rounds to hand its worker to a waiting job of a higher class.
+type bulkJobs struct {
+	mu sync.Mutex
+	// held are the queued and running jobs of this replica, renewed every 30 seconds
+	held      map[string]bool
+	queueSize int
+	// workers bounds the jobs running at once and classWorkers the running jobs of a class
+	// (0 or absent = workers); PUT /admin/bulk-workers changes both
+	workers      int
+	classWorkers map[string]int
+	// queued are the jobs waiting for a worker per class, oldest first; running counts the
+	// jobs holding one
+	queued  map[string][]*bulkJobTicket
+	running map[string]int
+	// start runs a job taken off the queue; nil until the workers are started
+	start func(bulkJobRun)
+}
+
+// bulkJobTicket is a job waiting for a worker: a new run, or a running job that paused for a
+// higher class and continues once resume is closed.
+type bulkJobTicket struct {
+	run    bulkJobRun
+	resume chan struct{}
+}
+
+// bulkJobRun is a queued job with what the worker needs beyond the stored row.
+type bulkJobRun struct {
+	id string
+	// ctx carries the submitting request's identity (tenant, caller, request id) for audit
+	// and logs, without its cancellation
+	ctx    context.Context
+	srcDSN string
+	req    BulkTokenizeRequest
+	opts   BulkOptions
+	plan   *BulkResult
+}
+
+func newBulkJobs(c bulkConfig) *bulkJobs {
+	return &bulkJobs{
+		held:         map[string]bool{},
+		queueSize:    c.jobQueueSize,
+		workers:      c.jobWorkers,
+		classWorkers: c.jobClassWorkers,
+		queued:       map[string][]*bulkJobTicket{},
+		running:      map[string]int{},
+	}
+}
+
+// startBulkJobWorkers starts the job workers and the heartbeat of the jobs this replica holds.
+func (s *Server) startBulkJobWorkers() {
+	q := s.bulkJobs
+	q.mu.Lock()
+	q.start = s.runBulkJob
+	q.dispatchLocked()
+	q.mu.Unlock()
+	go func() {
+		t := time.NewTicker(bulkJobHeartbeat)
+		defer t.Stop()
+		for range t.C {
+			s.bulkJobs.mu.Lock()
+			ids := make([]string, 0, len(s.bulkJobs.held))
+			for id := range s.bulkJobs.held {
+				ids = append(ids, id)
+			}
+			s.bulkJobs.mu.Unlock()
+			if len(ids) == 0 {
+				continue
+			}
+			if err := s.store.TouchBulkJobs(ids); err != nil {
+				slog.Warn("bulk jobs: heartbeat failed", "jobs", len(ids), "error", err)
+			}
+		}
+	}()
+}
+
+// submitBulkJob stores a queued job and hands it to the workers. plan is the estimate of the
+// run, kept as the job's result until the first chunk is done; resumedFrom names the failed
+// job a resumed run continues.
+func (s *Server) submitBulkJob(ctx context.Context, req BulkTokenizeRequest, srcDSN string, opts BulkOptions, plan *BulkResult, resumedFrom string) (*models.BulkJob, error) {
+	stored := req
+	stored.SrcDSN, stored.ExportURL = "", ""
+	request, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	result, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	job := &models.BulkJob{
+		ID:         "bulk-" + newRequestID(),
+		TenantID:   TenantFromContext(ctx),
+		CallerID:   CallerIDFromContext(ctx),
+		InstanceID: s.instanceID,
+		Table:      req.SrcTable,
+		Request:    request,
+		Result:     result,
+
+		ResumedFrom: resumedFrom,
+	}
+	q := s.bulkJobs
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queuedRunsLocked() >= q.queueSize {
+		return nil, ErrBulkQueueFull
+	}
+	if err := s.store.CreateBulkJob(job); err != nil {
+		return nil, err
+	}
+	q.held[job.ID] = true
+	run := bulkJobRun{id: job.ID, ctx: ctx, srcDSN: srcDSN, req: req, opts: opts, plan: plan}
+	q.queued[req.Priority] = append(q.queued[req.Priority], &bulkJobTicket{run: run})
+	q.dispatchLocked()
+	return job, nil
+}
+
+// runBulkJob runs a queued job to completion, writing its progress after chunks (at most every
+// five seconds) and its outcome at the end.
+func (s *Server) runBulkJob(run bulkJobRun) {
+	ctx, req := run.ctx, run.req
+	defer s.bulkJobs.done(run.id, req.Priority)
+	s.updateBulkJob(ctx, run.id, models.BulkJobRunning, run.plan, "", "")
+	var lastWrite time.Time
+	opts := run.opts
+	opts.Progress = func(p BulkResult) {
+		// only keyset runs pause: a cursor run would hold its snapshot open meanwhile
+		if p.Checkpoint != nil && s.bulkJobs.yield(run, func() {
+			s.updateBulkJob(ctx, run.id, models.BulkJobRunning, &p, "paused for a higher priority job", "")
+		}) {
+			lastWrite = time.Time{}
+		}
+		if time.Since(lastWrite) < bulkJobProgressInterval {
+			return
+		}
+		lastWrite = time.Now()
+		s.updateBulkJob(ctx, run.id, models.BulkJobRunning, &p, "", "")
+	}
+	op := req.operation()
+	slog.InfoContext(ctx, op+" job started", "job_id", run.id, "table", req.SrcTable)
+	result, err := s.BulkTokenize(ctx, run.srcDSN, req.SrcTable, req.SrcColumn, req.DataType, req.TokenColumn, opts)
+	detail := "table=" + req.SrcTable + " job=" + run.id
+	if result != nil {
+		detail += fmt.Sprintf(" processed=%d success=%d", result.Processed, result.Success)
+	} else {
+		result = run.plan
+	}
+	s.recordAudit(ctx, strings.ReplaceAll(op, "-", "_"), req.DataType, "", err, detail)
+	status, msg, errMsg := bulkJobOutcome(op, result, err)
+	if err != nil {
+		slog.WarnContext(ctx, op+" job failed", "job_id", run.id, "error", err)
+	}
+	s.updateBulkJob(ctx, run.id, status, result, msg, errMsg)
+}
+
+func (s *Server) updateBulkJob(ctx context.Context, id, status string, result *BulkResult, msg, errMsg string) {
+	raw, err := json.Marshal(result)
+	if err == nil {
+		err = s.store.UpdateBulkJob(id, status, raw, msg, errMsg)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "bulk jobs: recording the job failed", "job_id", id, "status", status, "error", err)
+	}
+}
+
+// bulkJobOutcome is the final status, message and error of a run of operation op.
+func bulkJobOutcome(op string, result *BulkResult, err error) (string, string, string) {
+	switch {
+	case err == ErrBulkTooLarge:
+		return models.BulkJobFailed, "estimated rows exceed max_rows; narrow the run, raise max_rows or set force=true", err.Error()
+	case errors.Is(err, ErrBulkDegraded):
+		return models.BulkJobFailed, "source database kept failing; " + op + " aborted, resume the job to continue", err.Error()
+	case err != nil && result != nil && result.Checkpoint != nil:
+		return models.BulkJobFailed, op + " failed; resume the job to continue from its checkpoint", err.Error()
+	case err != nil:
+		return models.BulkJobFailed, op + " failed", err.Error()
+	case result.Truncated:
+		return models.BulkJobSucceeded, op + " stopped at max_rows", ""
+	case result.Degraded:
+		return models.BulkJobSucceeded, op + " completed after source database failures", ""
+	}
+	return models.BulkJobSucceeded, op + " completed successfully", ""
+}
+
+// bulkJob returns the job if it belongs to the caller's tenant (nil otherwise), failing it
+// first when the replica running it stopped its heartbeat.
+func (s *Server) bulkJob(ctx context.Context, id string) (*models.BulkJob, error) {
+	job, err := s.store.GetBulkJob(id)
+	if err != nil || job == nil || job.TenantID != TenantFromContext(ctx) {
+		return nil, err
+	}
+	if job.Status != models.BulkJobQueued && job.Status != models.BulkJobRunning {
+		return job, nil
+	}
+	if time.Since(job.UpdatedAt) < bulkJobStaleAfter {
+		return job, nil
+	}
+	failed, err := s.store.FailStaleBulkJob(id, time.Now().Add(-bulkJobStaleAfter), "job abandoned: replica "+job.InstanceID+" stopped; resume the job to continue")
+	if err != nil || !failed {
+		return job, err
+	}
+	slog.WarnContext(ctx, "bulk jobs: stale job failed", "job_id", id, "instance", job.InstanceID)
+	return s.store.GetBulkJob(id)
+}
+
+// GET /bulk-jobs/{id}
+// Status, progress (the bulk result so far), message and error of a bulk-tokenize or
+// bulk-detokenize job.
+func (s *Server) bulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := s.bulkJob(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job lookup failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "bulk job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// GET /bulk-jobs
+// The newest bulk jobs of the caller's tenant.
+func (s *Server) listBulkJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.store.ListBulkJobs(TenantFromContext(r.Context()), bulkJobListLimit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job list failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	for i := range jobs {
+		if (jobs[i].Status == models.BulkJobQueued || jobs[i].Status == models.BulkJobRunning) && time.Since(jobs[i].UpdatedAt) >= bulkJobStaleAfter {
+			if job, err := s.bulkJob(r.Context(), jobs[i].ID); err == nil && job != nil {
+				jobs[i] = *job
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": jobs})
+}
+
+// BulkResumeRequest is the optional body of POST /bulk-jobs/{id}/resume: what the stored job
+// does not keep.
+type BulkResumeRequest struct {
+	// SrcDSN is required again for jobs submitted with an inline src_dsn
+	SrcDSN    string `json:"src_dsn,omitempty"`
+	ExportURL string `json:"export_url,omitempty"`
+	// Priority replaces the class of the failed job
+	Priority string `json:"priority,omitempty"`
+}
+
+// POST /bulk-jobs/{id}/resume
+// Queues a new job continuing a failed one from its checkpoint (or from the start when it
+// failed before the first round), with the same table, columns and guardrails.
+func (s *Server) resumeBulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	var body BulkResumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	prev, err := s.bulkJob(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job lookup failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if prev == nil {
+		writeJSONError(w, http.StatusNotFound, "bulk job not found")
+		return
+	}
+	if prev.Status != models.BulkJobFailed {
+		writeJSONError(w, http.StatusConflict, "only failed bulk jobs can be resumed")
+		return
+	}
+	var req BulkTokenizeRequest
+	var last BulkResult
+	if err := json.Unmarshal(prev.Request, &req); err != nil {
+		slog.ErrorContext(r.Context(), "bulk job resume: stored request unreadable", "job_id", prev.ID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	_ = json.Unmarshal(prev.Result, &last)
+	if req.Detokenize && !hasScope(r.Context(), ScopeDetokenize) {
+		writeJSONError(w, http.StatusForbidden, "API key lacks the "+ScopeDetokenize+" scope")
+		return
+	}
+	if !req.Detokenize && !hasScope(r.Context(), ScopeTokenize) {
+		writeJSONError(w, http.StatusForbidden, "API key lacks the "+ScopeTokenize+" scope")
+		return
+	}
+	op := req.operation()
+	if body.Priority != "" {
+		req.Priority = body.Priority
+	}
+	// jobs queued before priority classes carry none
+	if req.Priority, err = normalizeBulkPriority(req.Priority); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.SrcDSN, req.ExportURL = body.SrcDSN, body.ExportURL
+	if req.ExportURL != "" {
+		if _, err := checkExportURL(req.ExportURL, s.bulk.exportHosts); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	srcDSN, err := s.resolveSrcDSN(r.Context(), &req)
+	if errors.Is(err, ErrBulkSource) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job resume: resolving the source failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	opts := req.options()
+	opts.Resume = last.Checkpoint
+	ctx := context.WithoutCancel(r.Context())
+	planOpts := opts
+	planOpts.EstimateOnly = true
+	plan, err := s.BulkTokenize(ctx, srcDSN, req.SrcTable, req.SrcColumn, req.DataType, req.TokenColumn, planOpts)
+	if errors.Is(err, ErrBulkInvalidTarget) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job resume: planning failed", "job_id", prev.ID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, op+" failed: "+err.Error())
+		return
+	}
+	// the plan is the new job's result until its first round: start it at the checkpoint
+	if cp := last.Checkpoint; cp != nil {
+		plan.Processed, plan.Success, plan.Checkpoint = cp.Processed, cp.Success, cp
+	}
+
+	job, err := s.submitBulkJob(ctx, req, srcDSN, opts, plan, prev.ID)
+	if err == ErrBulkQueueFull {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, "bulk job queue is full, retry later")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bulk job resume: queueing the job failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	slog.InfoContext(r.Context(), op+" job resumed", "job_id", job.ID, "resumed_from", prev.ID, "checkpoint", last.Checkpoint != nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPathPrefix+"/bulk-jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(BulkTokenizeResponse{Message: op + " job queued", JobID: job.ID, BulkResult: plan})
+}
@@ -0,0 +1,240 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Bulk job priority classes, highest first.
+const (
+	bulkPriorityHigh   = "high"
+	bulkPriorityNormal = "normal"
+	bulkPriorityLow    = "low"
+)
+
+var bulkPriorities = []string{bulkPriorityHigh, bulkPriorityNormal, bulkPriorityLow}
+
+// normalizeBulkPriority validates a requested priority; empty means normal.
+func normalizeBulkPriority(p string) (string, error) {
+	p = strings.ToLower(strings.TrimSpace(p))
+	if p == "" {
+		return bulkPriorityNormal, nil
+	}
+	if !slices.Contains(bulkPriorities, p) {
+		return "", fmt.Errorf("unknown priority %q, want high, normal or low", p)
+	}
+	return p, nil
+}
+
+// parseBulkClassWorkers reads BULK_JOB_CLASS_WORKERS, e.g. "low=1,normal=3": the most workers
+// the jobs of a class may hold at once (0 = all of them).
+func parseBulkClassWorkers(spec string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		class, v, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("BULK_JOB_CLASS_WORKERS: %q is not class=workers", entry)
+		}
+		class = strings.ToLower(strings.TrimSpace(class))
+		if !slices.Contains(bulkPriorities, class) {
+			return nil, fmt.Errorf("BULK_JOB_CLASS_WORKERS: unknown class %q, want high, normal or low", class)
+		}
+		out[class] = n
+	}
+	return out, nil
+}
+
+// classCapLocked is the number of workers the jobs of class may hold at once.
+func (q *bulkJobs) classCapLocked(class string) int {
+	if n := q.classWorkers[class]; n > 0 && n < q.workers {
+		return n
+	}
+	return q.workers
+}
+
+func (q *bulkJobs) runningLocked() int {
+	n := 0
+	for _, r := range q.running {
+		n += r
+	}
+	return n
+}
+
+// queuedRunsLocked counts the queued new runs; paused jobs take no room in the queue.
+func (q *bulkJobs) queuedRunsLocked() int {
+	n := 0
+	for _, ts := range q.queued {
+		for _, t := range ts {
+			if t.resume == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// nextClassLocked is the highest class with a queued job and a worker left under its cap.
+func (q *bulkJobs) nextClassLocked() string {
+	for _, c := range bulkPriorities {
+		if len(q.queued[c]) > 0 && q.running[c] < q.classCapLocked(c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// dispatchLocked hands the free workers to the queued jobs: highest class first, oldest first
+// within a class, skipping classes at their cap.
+func (q *bulkJobs) dispatchLocked() {
+	if q.start == nil {
+		return
+	}
+	for q.runningLocked() < q.workers {
+		class := q.nextClassLocked()
+		if class == "" {
+			return
+		}
+		t := q.queued[class][0]
+		q.queued[class] = q.queued[class][1:]
+		q.running[class]++
+		if t.resume != nil {
+			close(t.resume)
+		} else {
+			go q.start(t.run)
+		}
+	}
+}
+
+// done releases the worker of a finished job.
+func (q *bulkJobs) done(id, class string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.held, id)
+	q.running[class]--
+	q.dispatchLocked()
+}
+
+// yield pauses a running job between rounds while every worker is busy and a job of a higher
+// class waits for one: the worker goes to that job, and this one continues, first of its
+// class, once a worker is free again. paused is called before waiting. It reports whether the
+// job paused.
+func (q *bulkJobs) yield(run bulkJobRun, paused func()) bool {
+	class := run.req.Priority
+	q.mu.Lock()
+	higher := q.nextClassLocked()
+	if q.runningLocked() < q.workers || higher == "" || slices.Index(bulkPriorities, higher) >= slices.Index(bulkPriorities, class) {
+		q.mu.Unlock()
+		return false
+	}
+	t := &bulkJobTicket{run: run, resume: make(chan struct{})}
+	q.running[class]--
+	q.queued[class] = append([]*bulkJobTicket{t}, q.queued[class]...)
+	q.dispatchLocked()
+	q.mu.Unlock()
+	paused()
+	<-t.resume
+	return true
+}
+
+// BulkWorkersRequest is the body of PUT /admin/bulk-workers; absent fields keep their value.
+type BulkWorkersRequest struct {
+	Workers int `json:"workers,omitempty"`
+	// Classes caps the workers of a class (0 = all of them)
+	Classes map[string]int `json:"classes,omitempty"`
+}
+
+// BulkWorkersStatus is the job scheduling of this instance: its workers, the effective
+// worker cap of each class and the jobs running and waiting per class (paused jobs wait too).
+type BulkWorkersStatus struct {
+	InstanceID string         `json:"instance_id"`
+	Workers    int            `json:"workers"`
+	Classes    map[string]int `json:"classes"`
+	Running    map[string]int `json:"running"`
+	Queued     map[string]int `json:"queued"`
+}
+
+// PUT /admin/bulk-workers
+// Changes the bulk job workers and class caps of this instance until it restarts (then
+// BULK_JOB_WORKERS and BULK_JOB_CLASS_WORKERS apply again). Running jobs are not stopped when
+// workers are removed; fewer jobs start as they finish.
+func (s *Server) putBulkWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkWorkersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q := s.bulkJobs
+	q.mu.Lock()
+	if req.Workers > 0 {
+		q.workers = req.Workers
+	}
+	classes := make(map[string]int, len(q.classWorkers)+len(req.Classes))
+	for c, n := range q.classWorkers {
+		classes[c] = n
+	}
+	for c, n := range req.Classes {
+		classes[strings.ToLower(c)] = n
+	}
+	q.classWorkers = classes
+	q.dispatchLocked()
+	status := s.bulkWorkersStatusLocked()
+	q.mu.Unlock()
+	s.adminChange(r.Context(), "bulk.workers", "instance", s.instanceID, "workers", status.Workers, "classes", status.Classes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (req *BulkWorkersRequest) validate() error {
+	if req.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+	for c, n := range req.Classes {
+		if !slices.Contains(bulkPriorities, strings.ToLower(c)) {
+			return fmt.Errorf("unknown class %q, want high, normal or low", c)
+		}
+		if n < 0 {
+			return errors.New("class workers must not be negative")
+		}
+	}
+	return nil
+}
+
+// GET /admin/bulk-workers
+func (s *Server) bulkWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	s.bulkJobs.mu.Lock()
+	status := s.bulkWorkersStatusLocked()
+	s.bulkJobs.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// bulkWorkersStatusLocked reads the scheduling state; the caller holds bulkJobs.mu.
+func (s *Server) bulkWorkersStatusLocked() BulkWorkersStatus {
+	q := s.bulkJobs
+	st := BulkWorkersStatus{
+		InstanceID: s.instanceID,
+		Workers:    q.workers,
+		Classes:    map[string]int{},
+		Running:    map[string]int{},
+		Queued:     map[string]int{},
+	}
+	for _, c := range bulkPriorities {
+		st.Classes[c] = q.classCapLocked(c)
+		st.Running[c] = q.running[c]
+		st.Queued[c] = len(q.queued[c])
+	}
+	return st
+}
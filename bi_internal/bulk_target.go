@@ -0,0 +1,344 @@
+package bi_internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrBulkInvalidTarget marks bulk requests whose source table/columns are unusable (400).
+var ErrBulkInvalidTarget = errors.New("invalid bulk target")
+
+// bulkTextTypes is the allow-list of column types the PII and token columns may have.
+var bulkTextTypes = []string{"text", "character varying", "character"}
+
+// bulkTarget is a validated bulk source: every identifier has been checked against the source
+// catalog and is quoted with pq.QuoteIdentifier before it is put into SQL.
+type bulkTarget struct {
+	name  string // unquoted table name, for logs and export names
+	table string
+	// columns are the PII columns tokenized per row, all written back in one UPDATE
+	columns []bulkTargetColumn
+	// rowKey identifies a row for the write-back: the quoted row_key_columns or primary key
+	// columns, or ctid when the table has no primary key and allow_ctid was set
+	rowKey []string
+	// rowKeyTypes are the SQL types of rowKey, which batched write-backs cast the key text to
+	rowKeyTypes []string
+	// keyColumn (keyset pagination) and exportKey are optional
+	keyColumn string
+	exportKey string
+	// filters are the row conditions pushed down into every source read (where, only_missing)
+	filters []string
+	// detokenize runs read tokens and write their values back
+	detokenize bool
+}
+
+// BulkFilter is one condition on the source rows of a bulk run, e.g.
+// {"column": "created_at", "op": ">=", "value": "2024-01-01"}. The value is cast to the
+// column's type; is_null and not_null take no value.
+type BulkFilter struct {
+	Column string  `json:"column"`
+	Op     string  `json:"op"`
+	Value  *string `json:"value,omitempty"`
+}
+
+// bulkFilterOps maps the filter operators to their SQL.
+var bulkFilterOps = map[string]string{
+	"=": "=", "!=": "<>", "<>": "<>", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+	"is_null": "IS NULL", "not_null": "IS NOT NULL",
+}
+
+// bulkTargetColumn is one quoted PII column, its token column and PII type.
+type bulkTargetColumn struct {
+	column      string
+	tokenColumn string
+	dataType    string
+}
+
+// selectList is the column list read by the bulk sources: row key, PII values, paging key and
+// export key (the last two only when configured).
+func (t *bulkTarget) selectList() string {
+	cols := t.rowKeyText()
+	for _, c := range t.columns {
+		cols += ", " + c.column
+	}
+	if t.keyColumn != "" {
+		cols += ", " + t.keyColumn
+	}
+	if t.exportKey != "" {
+		cols += ", " + t.exportKey + "::text"
+	}
+	return cols
+}
+
+// rowKeyText is the row key as one text value: the column itself for a single-column key, a
+// JSON array of the columns otherwise.
+func (t *bulkTarget) rowKeyText() string {
+	if len(t.rowKey) == 1 {
+		return t.rowKey[0] + "::text"
+	}
+	parts := make([]string, len(t.rowKey))
+	for i, k := range t.rowKey {
+		parts[i] = k + "::text"
+	}
+	return "json_build_array(" + strings.Join(parts, ", ") + ")::text"
+}
+
+// rowKeyMatch is the condition matching the rows of src to the row key texts in column key.
+func (t *bulkTarget) rowKeyMatch(src, key string) string {
+	if len(t.rowKey) == 1 {
+		return fmt.Sprintf("%s.%s = %s::%s", src, t.rowKey[0], key, t.rowKeyTypes[0])
+	}
+	conds := make([]string, len(t.rowKey))
+	for i, k := range t.rowKey {
+		conds[i] = fmt.Sprintf("%s.%s = (%s::json->>%d)::%s", src, k, key, i, t.rowKeyTypes[i])
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// query is the source read: the select list of the rows matching the filters and conds.
+func (t *bulkTarget) query(conds ...string) string {
+	q := fmt.Sprintf("SELECT %s FROM %s", t.selectList(), t.table)
+	if conds = append(append([]string(nil), t.filters...), conds...); len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return q
+}
+
+func invalidTarget(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBulkInvalidTarget, fmt.Sprintf(format, args...))
+}
+
+// resolveBulkTarget validates the bulk identifiers against the source catalog: the table and
+// columns must exist and the PII and token columns must be text-like. Rows are written back
+// by opts.RowKeyColumns, which must be NOT NULL and form the primary key or a unique index,
+// or else by the primary key (single-column keys also drive keyset pagination by default);
+// ctid is only used for tables without a primary key when opts.AllowCtid is set.
+func resolveBulkTarget(ctx context.Context, db *sql.DB, srcTable string, columns []BulkColumn, opts BulkOptions) (*bulkTarget, error) {
+	if len(columns) == 0 {
+		return nil, invalidTarget("no columns to tokenize")
+	}
+	if opts.Detokenize && opts.ExportKeyColumn != "" {
+		// the export would hold the detokenized values outside the source database
+		return nil, invalidTarget("export_key_column is not supported when detokenizing")
+	}
+	// the regex stays as a first line of defence; quoting below is what makes the SQL safe
+	ids := []string{srcTable, opts.KeyColumn, opts.ExportKeyColumn}
+	for _, f := range opts.Where {
+		if f.Column == "" {
+			return nil, invalidTarget("where: column is required")
+		}
+		ids = append(ids, f.Column)
+	}
+	ids = append(ids, opts.RowKeyColumns...)
+	textFrom := len(ids)
+	seenToken := map[string]bool{}
+	for _, c := range columns {
+		if c.SrcColumn == "" || c.TokenColumn == "" || (c.DataType == "" && !opts.Detokenize) {
+			return nil, invalidTarget("src_column, data_type and token_column are required for every column")
+		}
+		if seenToken[c.TokenColumn] {
+			return nil, invalidTarget("token column %q used twice", c.TokenColumn)
+		}
+		seenToken[c.TokenColumn] = true
+		ids = append(ids, c.SrcColumn, c.TokenColumn)
+	}
+	for _, id := range ids {
+		if id != "" && !identRE.MatchString(id) {
+			return nil, invalidTarget("invalid identifier %q", id)
+		}
+	}
+	quotedTable := pq.QuoteIdentifier(srcTable)
+
+	// relkind: r table, p partitioned table, f foreign table, v/m views
+	var relkind string
+	err := db.QueryRowContext(ctx, `SELECT relkind::text FROM pg_class WHERE oid = to_regclass($1)`, quotedTable).Scan(&relkind)
+	if err == sql.ErrNoRows {
+		return nil, invalidTarget("table %q not found", srcTable)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup source table: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT attname, format_type(atttypid, atttypmod), attnotnull
+		 FROM pg_attribute
+		 WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`, quotedTable)
+	if err != nil {
+		return nil, fmt.Errorf("lookup source columns: %w", err)
+	}
+	types := map[string]string{}
+	notNull := map[string]bool{}
+	for rows.Next() {
+		var name, typ string
+		var nn bool
+		if err := rows.Scan(&name, &typ, &nn); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		types[name], notNull[name] = typ, nn
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range ids[1:] {
+		if _, ok := types[c]; c != "" && !ok {
+			return nil, invalidTarget("column %q not found in %q", c, srcTable)
+		}
+	}
+	for _, c := range ids[textFrom:] {
+		if !isBulkTextType(types[c]) {
+			return nil, invalidTarget("column %q has type %s; only %s are allowed", c, types[c], strings.Join(bulkTextTypes, ", "))
+		}
+	}
+
+	// the primary key and the unique indexes (without expressions or predicates), by index
+	var pk []string
+	unique := map[string][]string{}
+	pkRows, err := db.QueryContext(ctx,
+		`SELECT i.indexrelid::text, i.indisprimary, a.attname
+		 FROM pg_index i
+		 JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		 WHERE i.indrelid = to_regclass($1) AND i.indisunique
+		   AND i.indexprs IS NULL AND i.indpred IS NULL`, quotedTable)
+	if err != nil {
+		return nil, fmt.Errorf("lookup primary key: %w", err)
+	}
+	for pkRows.Next() {
+		var index, name string
+		var primary bool
+		if err := pkRows.Scan(&index, &primary, &name); err != nil {
+			pkRows.Close()
+			return nil, err
+		}
+		unique[index] = append(unique[index], name)
+		if primary {
+			pk = append(pk, name)
+		}
+	}
+	pkRows.Close()
+	if err := pkRows.Err(); err != nil {
+		return nil, err
+	}
+
+	t := &bulkTarget{name: srcTable, table: quotedTable, detokenize: opts.Detokenize}
+	for _, c := range columns {
+		t.columns = append(t.columns, bulkTargetColumn{
+			column:      pq.QuoteIdentifier(c.SrcColumn),
+			tokenColumn: pq.QuoteIdentifier(c.TokenColumn),
+			dataType:    c.DataType,
+		})
+	}
+	rowKey := opts.RowKeyColumns
+	switch {
+	case len(rowKey) > 0:
+		if err := checkRowKey(rowKey, notNull, unique); err != nil {
+			return nil, err
+		}
+	case len(pk) > 0:
+		rowKey = pk
+	case !opts.AllowCtid:
+		return nil, invalidTarget("table %q has no primary key; set row_key_columns to its unique key, or allow_ctid=true to write back by ctid", srcTable)
+	case relkind == "p" || relkind == "f":
+		// a ctid is only unique within one partition, and foreign tables may have none
+		return nil, invalidTarget("table %q is partitioned or foreign, its rows cannot be written back by ctid; set row_key_columns", srcTable)
+	default:
+		// ctid changes when a row is updated or the table is rewritten; only on explicit opt-in
+		t.rowKey, t.rowKeyTypes = []string{"ctid"}, []string{"tid"}
+	}
+	for _, k := range rowKey {
+		t.rowKey = append(t.rowKey, pq.QuoteIdentifier(k))
+		t.rowKeyTypes = append(t.rowKeyTypes, types[k])
+	}
+	if len(rowKey) == 1 && opts.KeyColumn == "" {
+		opts.KeyColumn = rowKey[0]
+	}
+	if opts.KeyColumn != "" {
+		t.keyColumn = pq.QuoteIdentifier(opts.KeyColumn)
+	}
+	if opts.ExportKeyColumn != "" {
+		t.exportKey = pq.QuoteIdentifier(opts.ExportKeyColumn)
+	}
+	for _, f := range opts.Where {
+		cond, err := bulkFilterSQL(ctx, db, f, types[f.Column])
+		if err != nil {
+			return nil, err
+		}
+		t.filters = append(t.filters, cond)
+	}
+	if opts.OnlyMissing {
+		var missing []string
+		for _, c := range t.columns {
+			missing = append(missing, fmt.Sprintf("%s IS NULL OR %s = ''", c.tokenColumn, c.tokenColumn))
+		}
+		t.filters = append(t.filters, "("+strings.Join(missing, " OR ")+")")
+	}
+	return t, nil
+}
+
+// bulkFilterSQL renders a where filter on a column of type typ. The value is quoted as a
+// literal rather than bound, since the query also runs under EXPLAIN and DECLARE CURSOR, and
+// is checked to cast to typ first so a bad value is refused (400) before the run is planned.
+func bulkFilterSQL(ctx context.Context, db *sql.DB, f BulkFilter, typ string) (string, error) {
+	op, ok := bulkFilterOps[strings.ToLower(strings.TrimSpace(f.Op))]
+	if !ok {
+		return "", invalidTarget("where: unknown op %q", f.Op)
+	}
+	col := pq.QuoteIdentifier(f.Column)
+	if strings.HasPrefix(op, "IS ") {
+		if f.Value != nil {
+			return "", invalidTarget("where: %s takes no value", f.Op)
+		}
+		return col + " " + op, nil
+	}
+	if f.Value == nil {
+		return "", invalidTarget("where: %s %s needs a value", f.Column, f.Op)
+	}
+	// typ comes from format_type in the source catalog, not from the request
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("SELECT $1::%s", typ), *f.Value); err != nil {
+		return "", invalidTarget("where: %q is not a valid %s for %s", *f.Value, typ, f.Column)
+	}
+	return fmt.Sprintf("%s %s %s::%s", col, op, pq.QuoteLiteral(*f.Value), typ), nil
+}
+
+// checkRowKey accepts row_key_columns that are NOT NULL and exactly the columns of the
+// primary key or of a unique index, so each key matches one row.
+func checkRowKey(cols []string, notNull map[string]bool, unique map[string][]string) error {
+	want := map[string]bool{}
+	for _, c := range cols {
+		if want[c] {
+			return invalidTarget("row key column %q listed twice", c)
+		}
+		if !notNull[c] {
+			return invalidTarget("row key column %q must be NOT NULL", c)
+		}
+		want[c] = true
+	}
+	for _, idx := range unique {
+		if len(idx) != len(want) {
+			continue
+		}
+		covered := true
+		for _, c := range idx {
+			covered = covered && want[c]
+		}
+		if covered {
+			return nil
+		}
+	}
+	return invalidTarget("row_key_columns %s are not the primary key or a unique index", strings.Join(cols, ", "))
+}
+
+func isBulkTextType(typ string) bool {
+	for _, allowed := range bulkTextTypes {
+		if typ == allowed || strings.HasPrefix(typ, allowed+"(") {
+			return true
+		}
+	}
+	return false
+}
@@ -7,10 +7,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 
+	"bi_pii_tokenizer/common"
 	"bi_pii_tokenizer/models"
 )
 
@@ -18,20 +21,60 @@ import (
 type Cache struct {
 	client *redis.Client
 	ttl    time.Duration
+	// per key family expiry settings
+	blind cacheFamily
+	fpt   cacheFamily
+	// maxKeys is the CACHE_MAX_KEYS soft cap honoured by preloads (0 = none)
+	maxKeys int64
+	// refresh reloads entries hit within their family's refreshAhead window (set by the server)
+	refresh *cacheRefresher
+}
+
+// cacheFamily holds the expiry policy of one key family (blind -> fpt, fpt -> encrypted_value).
+// With sliding expiry a cache hit pushes the TTL out again, so hot keys never expire while
+// rarely-read keys still age out after ttl.
+//
+// With refreshAhead (CACHE_REFRESH_AHEAD_SECONDS) a hit on an entry that expires within that
+// window is served as is and the entry is reloaded from the database in the background
+// (stale-while-revalidate), so keys written together do not all miss together.
+type cacheFamily struct {
+	ttl          time.Duration
+	sliding      bool
+	refreshAhead time.Duration
+}
+
+// familyFromEnv reads CACHE_TTL_<NAME>_SECONDS (defaulting to ttl) and whether the family is
+// listed in CACHE_SLIDING_TTL ("blind,fpt", "all" or empty for fixed expiry everywhere).
+func familyFromEnv(name string, ttl time.Duration) cacheFamily {
+	f := cacheFamily{ttl: ttl}
+	if secs := envInt("CACHE_REFRESH_AHEAD_SECONDS", 0); secs > 0 {
+		f.refreshAhead = time.Duration(secs) * time.Second
+	}
+	if v := os.Getenv("CACHE_TTL_" + strings.ToUpper(name) + "_SECONDS"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			f.ttl = time.Duration(secs) * time.Second
+		}
+	}
+	for _, p := range strings.Split(os.Getenv("CACHE_SLIDING_TTL"), ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == name || p == "all" {
+			f.sliding = true
+		}
+	}
+	return f
 }
 
 // NewCacheFromEnv initializes a single-node Redis client using env:
 // REDIS_ADDR = "host:6379" (preferred)
-// REDIS_PASS (optional)
+// REDIS_PASS or REDIS_PASS_FILE (optional)
 // CACHE_TTL_SECONDS (optional, default 7 days)
+// CACHE_TTL_BLIND_SECONDS / CACHE_TTL_FPT_SECONDS (optional, per family override of CACHE_TTL_SECONDS)
+// CACHE_SLIDING_TTL (optional, "blind", "fpt", "blind,fpt" or "all": refresh TTL on cache hits)
+// CACHE_REFRESH_AHEAD_SECONDS (optional, reload entries hit this close to expiry in the background)
 // REDIS_DIAL_TIMEOUT_SEC / REDIS_RW_TIMEOUT_SEC (optional)
+// CACHE_MAX_KEYS (optional, soft cap on keys; preloads only fill up to it, newest tokens first)
 func NewCacheFromEnv() (*Cache, error) {
-	ttl := 7 * 24 * time.Hour
-	if v := os.Getenv("CACHE_TTL_SECONDS"); v != "" {
-		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
-			ttl = time.Duration(secs) * time.Second
-		}
-	}
+	ttl := cacheTTLFromEnv()
 
 	dialTimeout := 5 * time.Second
 	if v := os.Getenv("REDIS_DIAL_TIMEOUT_SEC"); v != "" {
@@ -46,7 +89,7 @@ func NewCacheFromEnv() (*Cache, error) {
 		}
 	}
 
-	pass := strings.TrimSpace(os.Getenv("REDIS_PASS"))
+	pass := strings.TrimSpace(common.MaybeEnv("REDIS_PASS"))
 
 	// Prefer explicit REDIS_ADDR
 	addr := strings.TrimSpace(os.Getenv("REDIS_ADDR"))
@@ -82,7 +125,17 @@ func NewCacheFromEnv() (*Cache, error) {
 	}
 
 	log.Printf("redis: connected in SINGLE-NODE mode (addr=%s)", addr)
-	return &Cache{client: client, ttl: ttl}, nil
+	c := &Cache{
+		client: client,
+		ttl:    ttl,
+		blind:  familyFromEnv("blind", ttl),
+		fpt:    familyFromEnv("fpt", ttl),
+
+		maxKeys: int64(envInt("CACHE_MAX_KEYS", 0)),
+	}
+	c.checkEvictionPolicy(ctx)
+	log.Printf("redis: cache ttl blind=%s (sliding=%v) fpt=%s (sliding=%v)", c.blind.ttl, c.blind.sliding, c.fpt.ttl, c.fpt.sliding)
+	return c, nil
 }
 
 func (c *Cache) Close() error {
@@ -92,72 +145,340 @@ func (c *Cache) Close() error {
 	return c.client.Close()
 }
 
-func blindCacheKey(dataType, blindIndex string) string {
+// legacyBlindCacheKey is the pre-hash blind -> fpt string key, still read (and migrated) on a
+// miss of the hash entry.
+func legacyBlindCacheKey(dataType, blindIndex string) string {
 	return fmt.Sprintf("pii:v1:%s:blind:%s", dataType, blindIndex)
 }
+func blindCacheKey(dataType, blindIndex string) string {
+	return fmt.Sprintf("pii:v2:%s:blind:%s", dataType, blindIndex)
+}
 func fptCacheKey(dataType, fpt string) string {
 	return fmt.Sprintf("pii:v1:%s:fpt:%s", dataType, fpt)
 }
 
 // internal helpers
-func (c *Cache) get(ctx context.Context, key string) (string, error) {
+func (c *Cache) get(ctx context.Context, key string, fam cacheFamily) (string, error) {
 	if c == nil || c.client == nil {
 		return "", nil
 	}
-	res, err := c.client.Get(ctx, key).Result()
+	var res string
+	var err error
+	switch {
+	case fam.sliding:
+		// GETEX reads and re-arms the TTL in one round trip
+		res, err = c.client.GetEx(ctx, key, fam.ttl).Result()
+	case c.refreshes(fam):
+		// the remaining TTL comes back in the same round trip
+		pipe := c.client.Pipeline()
+		get := pipe.Get(ctx, key)
+		ttl := pipe.PTTL(ctx, key)
+		if _, err = pipe.Exec(ctx); err == nil {
+			res = get.Val()
+			c.refreshIfExpiring(fam, ttl.Val(), key)
+		}
+	default:
+		res, err = c.client.Get(ctx, key).Result()
+	}
 	if err == redis.Nil {
 		return "", nil
 	}
 	return res, err
 }
 
-func (c *Cache) set(ctx context.Context, key string, value interface{}) error {
+// refreshes reports whether hits of fam are checked for the refresh-ahead window.
+func (c *Cache) refreshes(fam cacheFamily) bool {
+	return c.refresh != nil && fam.refreshAhead > 0 && !fam.sliding
+}
+
+// refreshIfExpiring hands the entry at key to the refresher when its remaining TTL is inside
+// the family's refresh-ahead window.
+func (c *Cache) refreshIfExpiring(fam cacheFamily, ttl time.Duration, key string) {
+	if ttl > 0 && ttl <= fam.refreshAhead {
+		c.refresh.entry(key)
+	}
+}
+
+func (c *Cache) set(ctx context.Context, key string, value interface{}, fam cacheFamily) error {
 	if c == nil || c.client == nil {
 		return nil
 	}
-	return c.client.Set(ctx, key, value, c.ttl).Err()
+	return c.client.Set(ctx, key, value, fam.ttl).Err()
 }
 
-// GetByBlindIndex returns the FPT (or empty string if not found).
+// GetByBlindIndex returns the FPT (or empty string if not found). Blind entries are Redis
+// hashes with an fpt field (entries written by older versions carry unused created and kv
+// fields too); a legacy string entry found instead is rewritten as a hash entry.
 func (c *Cache) GetByBlindIndex(ctx context.Context, dataType, blindIndex string) (string, error) {
 	if c == nil || c.client == nil {
 		return "", nil
 	}
 	k := blindCacheKey(dataType, blindIndex)
-	return c.get(ctx, k)
+	pipe := c.client.Pipeline()
+	get := pipe.HGet(ctx, k, "fpt")
+	var ttl *redis.DurationCmd
+	if c.blind.sliding {
+		pipe.Expire(ctx, k, c.blind.ttl)
+	} else if c.refreshes(c.blind) {
+		ttl = pipe.PTTL(ctx, k)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+	if fpt := get.Val(); fpt != "" {
+		if ttl != nil {
+			c.refreshIfExpiring(c.blind, ttl.Val(), k)
+		}
+		return fpt, nil
+	}
+
+	legacy := legacyBlindCacheKey(dataType, blindIndex)
+	fpt, err := c.get(ctx, legacy, c.blind)
+	if err != nil || fpt == "" {
+		return "", err
+	}
+	pipe = c.client.TxPipeline()
+	pipe.HSet(ctx, k, "fpt", fpt)
+	pipe.Expire(ctx, k, c.blind.ttl)
+	pipe.Del(ctx, legacy)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("cache: migrate legacy blind entry failed: %v", err)
+	}
+	return fpt, nil
 }
 
-// SetByBlindIndex sets blind -> fpt
+// SetByBlindIndex sets blind -> fpt.
 func (c *Cache) SetByBlindIndex(ctx context.Context, dataType, blindIndex, fpt string) error {
 	if c == nil || c.client == nil {
 		return nil
 	}
 	k := blindCacheKey(dataType, blindIndex)
-	return c.set(ctx, k, fpt)
+	pipe := c.client.TxPipeline()
+	pipe.HSet(ctx, k, "fpt", fpt)
+	pipe.Expire(ctx, k, c.blind.ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// fpt entries are stored as "<tenant>|<encrypted_value>" for tenant-owned tokens and as the bare
+// encrypted_value for global tokens. encrypted_value is base64, so it never contains '|'.
+func encodeFPTEntry(tenantID string, encryptedValue []byte) string {
+	if tenantID == "" {
+		return string(encryptedValue)
+	}
+	return tenantID + "|" + string(encryptedValue)
+}
+
+func decodeFPTEntry(v string) (tenantID, encryptedValue string) {
+	if i := strings.IndexByte(v, '|'); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return "", v
 }
 
 // GetByFPT returns encrypted_value (or empty string if not found).
 func (c *Cache) GetByFPT(ctx context.Context, dataType, fpt string) (string, error) {
+	enc, _, err := c.GetByFPTWithOwner(ctx, dataType, fpt)
+	return enc, err
+}
+
+// GetByFPTWithOwner returns encrypted_value and the owning tenant ("" for global tokens).
+func (c *Cache) GetByFPTWithOwner(ctx context.Context, dataType, fpt string) (string, string, error) {
 	if c == nil || c.client == nil {
-		return "", nil
+		return "", "", nil
 	}
 	k := fptCacheKey(dataType, fpt)
-	return c.get(ctx, k)
+	v, err := c.get(ctx, k, c.fpt)
+	if err != nil || v == "" {
+		return "", "", err
+	}
+	tenantID, enc := decodeFPTEntry(v)
+	return enc, tenantID, nil
 }
 
-// SetByFPT sets fpt -> encrypted_value. Accepts encryptedValue as []byte.
-func (c *Cache) SetByFPT(ctx context.Context, dataType, fpt string, encryptedValue []byte) error {
+// SetByFPT sets fpt -> encrypted_value (plus owning tenant). Accepts encryptedValue as []byte.
+func (c *Cache) SetByFPT(ctx context.Context, dataType, fpt, tenantID string, encryptedValue []byte) error {
 	if c == nil || c.client == nil {
 		return nil
 	}
 	k := fptCacheKey(dataType, fpt)
-	return c.set(ctx, k, string(encryptedValue))
+	return c.set(ctx, k, encodeFPTEntry(tenantID, encryptedValue), c.fpt)
+}
+
+// Evict deletes the blind index entry (hash and legacy string) and the fpt entry of a token.
+func (c *Cache) Evict(ctx context.Context, dataType, blindIndex, fpt string) error {
+	if c == nil || c.client == nil {
+		return nil
+	}
+	return c.client.Del(ctx, blindCacheKey(dataType, blindIndex), legacyBlindCacheKey(dataType, blindIndex), fptCacheKey(dataType, fpt)).Err()
+}
+
+func revealCacheKey(tokenHash string) string {
+	return fmt.Sprintf("pii:v1:reveal:%s", tokenHash)
+}
+
+// PutReveal stores a reveal record under the hashed reveal token for ttl (never overwrites).
+func (c *Cache) PutReveal(ctx context.Context, tokenHash, record string, ttl time.Duration) error {
+	if c == nil || c.client == nil {
+		return nil
+	}
+	return c.client.SetNX(ctx, revealCacheKey(tokenHash), record, ttl).Err()
+}
+
+// TakeReveal atomically reads and deletes a reveal record ("" if missing or expired).
+func (c *Cache) TakeReveal(ctx context.Context, tokenHash string) (string, error) {
+	if c == nil || c.client == nil {
+		return "", nil
+	}
+	res, err := c.client.GetDel(ctx, revealCacheKey(tokenHash)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return res, err
+}
+
+func nonceCacheKey(nonceHash string) string {
+	return fmt.Sprintf("pii:v1:nonce:%s", nonceHash)
+}
+
+// ClaimNonce records a request nonce for ttl; it reports false when the nonce was already used.
+func (c *Cache) ClaimNonce(ctx context.Context, nonceHash string, ttl time.Duration) (bool, error) {
+	if c == nil || c.client == nil {
+		return true, nil
+	}
+	return c.client.SetNX(ctx, nonceCacheKey(nonceHash), 1, ttl).Result()
+}
+
+func quotaCacheKey(key string) string {
+	return fmt.Sprintf("pii:v1:quota:%s", key)
+}
+
+// IncrQuota adds n to a quota counter that expires after ttl and returns the new total.
+func (c *Cache) IncrQuota(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	if c == nil || c.client == nil {
+		return 0, nil
+	}
+	pipe := c.client.TxPipeline()
+	incr := pipe.IncrBy(ctx, quotaCacheKey(key), n)
+	pipe.Expire(ctx, quotaCacheKey(key), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// QuotaCounters returns the totals of quota counters (0 for a missing one) without changing them.
+func (c *Cache) QuotaCounters(ctx context.Context, keys []string) ([]int64, error) {
+	out := make([]int64, len(keys))
+	if c == nil || c.client == nil || len(keys) == 0 {
+		return out, nil
+	}
+	full := make([]string, len(keys))
+	for i, k := range keys {
+		full[i] = quotaCacheKey(k)
+	}
+	vals, err := c.client.MGet(ctx, full...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			out[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return out, nil
+}
+
+func rateLimitCacheKey(key string) string {
+	return fmt.Sprintf("pii:v1:ratelimit:%s", key)
+}
+
+// takeTokenScript is a token bucket kept in a hash (tokens, ts in ms): it refills at ARGV[1]
+// tokens per second up to ARGV[2], takes ARGV[4] tokens at ARGV[3] and returns {allowed, wait ms}.
+var takeTokenScript = redis.NewScript(`local rate, burst, now, cost = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens, ts = tonumber(b[1]), tonumber(b[2])
+if tokens == nil or ts == nil then tokens, ts = burst, now end
+if now > ts then tokens = math.min(burst, tokens + (now - ts) * rate / 1000) end
+local allowed, wait = 0, 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+else
+  wait = math.ceil((cost - tokens) * 1000 / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(math.max(now, ts)))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}`)
+
+// TakeToken takes cost tokens from the shared bucket key, refilled at rate per second up to
+// burst. When the bucket is short it reports false and how long until enough tokens are back.
+func (c *Cache) TakeToken(ctx context.Context, key string, rate, burst, cost float64) (bool, time.Duration, error) {
+	if c == nil || c.client == nil {
+		return true, 0, nil
+	}
+	res, err := takeTokenScript.Run(ctx, c.client, []string{rateLimitCacheKey(key)},
+		rate, burst, time.Now().UnixMilli(), cost).Int64Slice()
+	if err != nil {
+		return true, 0, err
+	}
+	if len(res) != 2 {
+		return true, 0, fmt.Errorf("rate limit script returned %d values", len(res))
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+func lockCacheKey(name string) string {
+	return fmt.Sprintf("pii:v1:lock:%s", name)
+}
+
+// setBlindEntryNXScript writes a blind hash entry unless the key exists (the hash
+// counterpart of SET NX), used by the preload so it never overwrites fresher entries.
+var setBlindEntryNXScript = redis.NewScript(`if redis.call("EXISTS", KEYS[1]) == 1 then return 0 end
+redis.call("HSET", KEYS[1], "fpt", ARGV[1])
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])`)
+
+// compare-and-set scripts so only the current holder can renew or release a lock
+var (
+	renewLockScript   = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`)
+	releaseLockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+)
+
+// AcquireLock takes the named lock for owner if nobody holds it.
+func (c *Cache) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	if c == nil || c.client == nil {
+		return false, nil
+	}
+	return c.client.SetNX(ctx, lockCacheKey(name), owner, ttl).Result()
+}
+
+// RenewLock extends the lock if owner still holds it.
+func (c *Cache) RenewLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	if c == nil || c.client == nil {
+		return false, nil
+	}
+	n, err := renewLockScript.Run(ctx, c.client, []string{lockCacheKey(name)}, owner, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// ReleaseLock drops the lock if owner still holds it.
+func (c *Cache) ReleaseLock(ctx context.Context, name, owner string) error {
+	if c == nil || c.client == nil {
+		return nil
+	}
+	return releaseLockScript.Run(ctx, c.client, []string{lockCacheKey(name)}, owner).Err()
 }
 
 // PreloadFromStore streams tokens directly from DB to Redis with pipelined sets using single client.
 // This function uses context.Background() internally for long-running DB/Redis operations so it is not
 // cancelled by a short-lived request context. It returns an error on critical failures.
 func (c *Cache) PreloadFromStore(ctx context.Context, store *models.Store) error {
+	return c.PreloadFromStoreLimit(ctx, store, 0)
+}
+
+// PreloadFromStoreLimit is PreloadFromStore restricted to the newest limit tokens (limit <= 0
+// loads everything); used for a partial warm before a standby instance goes active.
+func (c *Cache) PreloadFromStoreLimit(ctx context.Context, store *models.Store, limit int) error {
 	if c == nil || c.client == nil {
 		return nil
 	}
@@ -167,7 +488,7 @@ func (c *Cache) PreloadFromStore(ctx context.Context, store *models.Store) error
 	// Use a Background ctx for the actual DB/Redis operations to avoid caller cancellations.
 	opCtx := context.Background()
 
-	const batchSize = 500 // tune: 200-2000 depending on infra
+	lim := preloadLimitsFromEnv()
 	const throttlePause = 25 * time.Millisecond
 
 	// Optional: log total rows to provide progress context
@@ -176,41 +497,104 @@ func (c *Cache) PreloadFromStore(ctx context.Context, store *models.Store) error
 		log.Printf("cache preload: total rows in DB = %d", totalRows)
 	}
 
-	rows, err := store.DB().QueryContext(opCtx, `SELECT data_type, blind_index, fpt, encrypted_value FROM pii_tokens`)
+	// with CACHE_MAX_KEYS only the newest tokens that fit are loaded
+	limit, ok := c.preloadBudget(opCtx, limit)
+	if !ok {
+		return nil
+	}
+	query := `SELECT data_type, blind_index, fpt, encrypted_value, COALESCE(tenant_id, '') FROM pii_tokens`
+	if limit > 0 {
+		query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+		totalRows = limit
+	}
+	// the script is loaded once so pipelines can use EVALSHA
+	if err := setBlindEntryNXScript.Load(opCtx, c.client).Err(); err != nil {
+		return fmt.Errorf("cache preload: load script: %w", err)
+	}
+	rows, err := store.DB().QueryContext(opCtx, query)
 	if err != nil {
 		return fmt.Errorf("cache preload: db query error: %w", err)
 	}
 	defer rows.Close()
 
+	// Full pipelines are handed to at most lim.inflight writers through a bounded channel, so a
+	// stalled Redis blocks the DB reader instead of piling up batches in memory.
+	type preloadBatch struct {
+		pipe  redis.Pipeliner
+		items int
+	}
+	batches := make(chan preloadBatch, lim.inflight)
+	var (
+		wg      sync.WaitGroup
+		errMu   sync.Mutex
+		execErr error
+		flushed int
+		failed  atomic.Bool
+	)
+	for i := 0; i < lim.inflight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				if failed.Load() {
+					continue // drain
+				}
+				ctx, cancel := context.WithTimeout(opCtx, lim.execTimeout)
+				_, err := b.pipe.Exec(ctx)
+				cancel()
+				errMu.Lock()
+				if err != nil {
+					if execErr == nil {
+						execErr = fmt.Errorf("cache preload pipeline exec error after %d items: %w", flushed, err)
+					}
+					failed.Store(true)
+				} else {
+					flushed += b.items
+				}
+				errMu.Unlock()
+				// throttle to reduce impact on Redis & DB
+				time.Sleep(throttlePause)
+			}
+		}()
+	}
+	finish := func() error {
+		close(batches)
+		wg.Wait()
+		return execErr
+	}
+
 	pipe := c.client.Pipeline()
 	n := 0
 	batchCount := 0
+	batchBytes := 0
 
 	for rows.Next() {
-		var dataType, blindIndex, fpt string
+		if failed.Load() {
+			break
+		}
+		var dataType, blindIndex, fpt, tenantID string
 		var encryptedValue []byte
-		if err := rows.Scan(&dataType, &blindIndex, &fpt, &encryptedValue); err != nil {
+		if err := rows.Scan(&dataType, &blindIndex, &fpt, &encryptedValue, &tenantID); err != nil {
 			log.Printf("cache preload: row scan error: %v", err)
 			continue
 		}
 
 		// Use SetNX to avoid overwriting keys that may already exist (optional behavior).
 		// If you want unconditional overwrite, use Set instead.
-		pipe.SetNX(opCtx, blindCacheKey(dataType, blindIndex), fpt, c.ttl)
-		pipe.SetNX(opCtx, fptCacheKey(dataType, fpt), string(encryptedValue), c.ttl)
+		bk, fk := blindCacheKey(dataType, blindIndex), fptCacheKey(dataType, fpt)
+		entry := encodeFPTEntry(tenantID, encryptedValue)
+		setBlindEntryNXScript.EvalSha(opCtx, pipe, []string{bk}, fpt, c.blind.ttl.Milliseconds())
+		pipe.SetNX(opCtx, fk, entry, c.fpt.ttl)
 
 		n++
 		batchCount++
+		batchBytes += len(bk) + len(fpt) + len(fk) + len(entry)
 
-		if batchCount >= batchSize {
-			if _, err := pipe.Exec(opCtx); err != nil {
-				return fmt.Errorf("cache preload pipeline exec error after %d items: %w", n, err)
-			}
-			// throttle to reduce impact on Redis & DB
-			time.Sleep(throttlePause)
-
+		if batchCount >= lim.batchRows || batchBytes >= lim.batchBytes {
+			batches <- preloadBatch{pipe: pipe, items: batchCount}
 			pipe = c.client.Pipeline()
 			batchCount = 0
+			batchBytes = 0
 
 			if n%5000 == 0 || n < 5000 {
 				log.Printf("cache preload: processed %d/%d (approx)", n, totalRows)
@@ -218,10 +602,11 @@ func (c *Cache) PreloadFromStore(ctx context.Context, store *models.Store) error
 		}
 	}
 
-	if batchCount > 0 {
-		if _, err := pipe.Exec(opCtx); err != nil {
-			return fmt.Errorf("cache preload final pipeline exec error after %d items: %w", n, err)
-		}
+	if batchCount > 0 && !failed.Load() {
+		batches <- preloadBatch{pipe: pipe, items: batchCount}
+	}
+	if err := finish(); err != nil {
+		return err
 	}
 
 	if err := rows.Err(); err != nil {
@@ -232,6 +617,41 @@ func (c *Cache) PreloadFromStore(ctx context.Context, store *models.Store) error
 	return nil
 }
 
+// preloadLimits bound the memory and Redis pressure of a cache preload.
+type preloadLimits struct {
+	// batchRows / batchBytes flush a pipeline at whichever limit is reached first
+	batchRows  int
+	batchBytes int
+	// inflight is the number of pipelines executing or queued at once
+	inflight int
+	// execTimeout bounds a single pipeline Exec
+	execTimeout time.Duration
+}
+
+// preloadLimitsFromEnv reads PRELOAD_BATCH_ROWS (default 500), PRELOAD_BATCH_BYTES (default
+// 4 MiB), PRELOAD_INFLIGHT (default 2) and PRELOAD_EXEC_TIMEOUT_MS (default 10000).
+func preloadLimitsFromEnv() preloadLimits {
+	lim := preloadLimits{
+		batchRows:   envInt("PRELOAD_BATCH_ROWS", 500),
+		batchBytes:  envInt("PRELOAD_BATCH_BYTES", 4<<20),
+		inflight:    envInt("PRELOAD_INFLIGHT", 2),
+		execTimeout: time.Duration(envInt("PRELOAD_EXEC_TIMEOUT_MS", 10000)) * time.Millisecond,
+	}
+	if lim.batchRows <= 0 {
+		lim.batchRows = 500
+	}
+	if lim.batchBytes <= 0 {
+		lim.batchBytes = 4 << 20
+	}
+	if lim.inflight <= 0 {
+		lim.inflight = 1
+	}
+	if lim.execTimeout <= 0 {
+		lim.execTimeout = 10 * time.Second
+	}
+	return lim
+}
+
 // PreloadFromStoreBackground is a convenience wrapper that runs PreloadFromStore in the background
 // (as a goroutine). It logs errors but does not block the caller. Call this from your main/server
 // startup to warm the cache without blocking readiness.
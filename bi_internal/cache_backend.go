@@ -0,0 +1,200 @@
+package bi_internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// TokenCache is the blind index -> fpt and fpt -> encrypted_value cache in front of the vault.
+// CACHE_BACKEND selects the implementation: redis (default, shared by all replicas), memcached
+// (shared) or memory (per instance).
+type TokenCache interface {
+	GetByBlindIndex(ctx context.Context, dataType, blindIndex string) (string, error)
+	SetByBlindIndex(ctx context.Context, dataType, blindIndex, fpt string) error
+	// GetByFPTWithOwner returns encrypted_value and the owning tenant ("" for global tokens).
+	GetByFPTWithOwner(ctx context.Context, dataType, fpt string) (string, string, error)
+	SetByFPT(ctx context.Context, dataType, fpt, tenantID string, encryptedValue []byte) error
+	// Evict removes both entries of a token (deleted tokens).
+	Evict(ctx context.Context, dataType, blindIndex, fpt string) error
+	// PreloadFromStoreLimit warms the cache with the newest limit tokens (<= 0 = all).
+	PreloadFromStoreLimit(ctx context.Context, store *models.Store, limit int) error
+}
+
+// cacheTTLFromEnv is CACHE_TTL_SECONDS (default 7 days).
+func cacheTTLFromEnv() time.Duration {
+	ttl := 7 * 24 * time.Hour
+	if v := os.Getenv("CACHE_TTL_SECONDS"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+	return ttl
+}
+
+// initCache sets up the configured token cache. Redis also backs reveal records and leader
+// locks (s.cache); with the other backends those fall back to process memory and Postgres
+// advisory locks. A backend that fails to initialize leaves the server without a cache.
+func (s *Server) initCache() {
+	backend := strings.ToLower(strings.TrimSpace(common.MaybeEnv("CACHE_BACKEND")))
+	switch backend {
+	case "", "redis":
+		cache, err := NewCacheFromEnv()
+		if err != nil {
+			log.Printf("warning: redis cluster init failed, running without cache: %v", err)
+			s.degradation.set(subsystemCache, impactDatabaseFallback, "redis init failed: "+err.Error())
+			return
+		}
+		cache.refresh = newCacheRefresher(s)
+		s.cache = cache
+		s.tokens = cache
+	case "memcached":
+		mc, err := newMemcachedCacheFromEnv()
+		if err != nil {
+			log.Printf("warning: memcached init failed, running without cache: %v", err)
+			s.degradation.set(subsystemCache, impactDatabaseFallback, "memcached init failed: "+err.Error())
+			return
+		}
+		s.tokens = mc
+	case "memory":
+		mem := newMemoryCacheFromEnv()
+		mem.refresh = newCacheRefresher(s)
+		s.tokens = mem
+	case "none":
+		log.Println("cache: disabled (CACHE_BACKEND=none)")
+		s.degradation.set(subsystemCache, impactDatabaseFallback, "disabled by CACHE_BACKEND=none")
+	default:
+		log.Printf("warning: unknown CACHE_BACKEND %q, running without cache", backend)
+		s.degradation.set(subsystemCache, impactDatabaseFallback, "unknown CACHE_BACKEND "+backend)
+	}
+}
+
+// maxCacheRefreshes bounds the refresh-ahead reloads in flight per replica; hits beyond it are
+// served without a refresh and the entry simply expires.
+const maxCacheRefreshes = 16
+
+// cacheRefresher reloads cache entries from the database when a hit finds them close to
+// expiry (CACHE_REFRESH_AHEAD_SECONDS): the hit is answered from the cache and the reload runs
+// in the background, one per key at a time. The reload writes both entries of the token again,
+// re-arming their TTLs.
+type cacheRefresher struct {
+	s        *Server
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newCacheRefresher(s *Server) *cacheRefresher {
+	return &cacheRefresher{s: s, inflight: map[string]bool{}}
+}
+
+// entry schedules the reload of the cache entry at key; it never blocks the hit.
+func (r *cacheRefresher) entry(key string) {
+	// keys are pii:<version>:<data type>:<blind|fpt>:<id>; tokens may contain ':'
+	parts := strings.SplitN(key, ":", 5)
+	if len(parts) != 5 || (parts[3] != "blind" && parts[3] != "fpt") {
+		return
+	}
+	lookup, dataType, id := parts[3], parts[2], parts[4]
+	r.mu.Lock()
+	if r.inflight[key] {
+		r.mu.Unlock()
+		return
+	}
+	if len(r.inflight) >= maxCacheRefreshes {
+		r.mu.Unlock()
+		r.s.cacheRefreshed(lookup, "skipped")
+		return
+	}
+	r.inflight[key] = true
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.inflight, key)
+			r.mu.Unlock()
+		}()
+		var pt *models.PiiToken
+		var err error
+		if lookup == "blind" {
+			pt, err = r.s.store.GetByBlindIndex(context.Background(), id)
+		} else {
+			pt, err = r.s.store.GetByFPT(context.Background(), id)
+		}
+		switch {
+		case err != nil:
+			log.Printf("cache: refresh of a %s entry failed: %v", lookup, err)
+			r.s.cacheRefreshed(lookup, "error")
+			return
+		case pt == nil:
+			// deleted since it was cached: let the entry expire
+			r.s.cacheRefreshed(lookup, "gone")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = r.s.tokens.SetByBlindIndex(ctx, dataType, pt.BlindIndex, pt.FPT)
+		if err == nil {
+			err = r.s.tokens.SetByFPT(ctx, dataType, pt.FPT, pt.TenantID, pt.EncryptedValue)
+		}
+		if err != nil {
+			log.Printf("cache: refresh of a %s entry failed: %v", lookup, err)
+			r.s.cacheRefreshed(lookup, "error")
+			return
+		}
+		r.s.cacheRefreshed(lookup, "refreshed")
+	}()
+}
+
+// sharedCache reports whether the token cache is shared by all replicas, so a single replica
+// preloads it for everyone.
+func (s *Server) sharedCache() bool {
+	_, local := s.tokens.(*memoryCache)
+	return !local
+}
+
+// preloadTokenCache streams tokens (newest first when limited) into a cache entry by entry;
+// used by the backends without a pipelined preload of their own.
+func preloadTokenCache(ctx context.Context, tc TokenCache, store *models.Store, limit int) error {
+	query := `SELECT data_type, blind_index, fpt, encrypted_value, COALESCE(tenant_id, '') FROM pii_tokens`
+	if limit > 0 {
+		query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+	}
+	rows, err := store.DB().QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("cache preload: db query error: %w", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var dataType, blindIndex, fpt, tenantID string
+		var encryptedValue []byte
+		if err := rows.Scan(&dataType, &blindIndex, &fpt, &encryptedValue, &tenantID); err != nil {
+			log.Printf("cache preload: row scan error: %v", err)
+			continue
+		}
+		if err := tc.SetByBlindIndex(ctx, dataType, blindIndex, fpt); err != nil {
+			return fmt.Errorf("cache preload after %d items: %w", n, err)
+		}
+		if err := tc.SetByFPT(ctx, dataType, fpt, tenantID, encryptedValue); err != nil {
+			return fmt.Errorf("cache preload after %d items: %w", n, err)
+		}
+		n++
+		if n%50000 == 0 {
+			log.Printf("cache preload: processed %d", n)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cache preload rows iteration error: %w", err)
+	}
+	log.Printf("cache: preload complete, processed %d tokens", n)
+	return nil
+}
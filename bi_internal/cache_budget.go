@@ -0,0 +1,128 @@
+package bi_internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CacheStats describes how full the Redis cache is.
+type CacheStats struct {
+	Keys           int64   `json:"keys"`
+	MaxKeys        int64   `json:"max_keys,omitempty"`
+	KeyFillRatio   float64 `json:"key_fill_ratio,omitempty"`
+	UsedMemory     int64   `json:"used_memory"`
+	MaxMemory      int64   `json:"max_memory"`
+	MemFillRatio   float64 `json:"memory_fill_ratio,omitempty"`
+	EvictionPolicy string  `json:"eviction_policy"`
+	EvictedKeys    int64   `json:"evicted_keys"`
+	ExpiredKeys    int64   `json:"expired_keys"`
+}
+
+// redisInfo parses the "field:value" lines of an INFO reply.
+func redisInfo(raw string) map[string]string {
+	out := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(raw))
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":"); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Stats reads key count, memory and eviction figures from INFO / DBSIZE. INFO is used
+// instead of CONFIG GET because managed Redis offerings often disable CONFIG.
+func (c *Cache) Stats(ctx context.Context) (*CacheStats, error) {
+	raw, err := c.client.Info(ctx, "memory", "stats").Result()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := c.client.DBSize(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+	info := redisInfo(raw)
+	num := func(k string) int64 {
+		n, _ := strconv.ParseInt(info[k], 10, 64)
+		return n
+	}
+	st := &CacheStats{
+		Keys:           keys,
+		MaxKeys:        c.maxKeys,
+		UsedMemory:     num("used_memory"),
+		MaxMemory:      num("maxmemory"),
+		EvictionPolicy: info["maxmemory_policy"],
+		EvictedKeys:    num("evicted_keys"),
+		ExpiredKeys:    num("expired_keys"),
+	}
+	if st.MaxKeys > 0 {
+		st.KeyFillRatio = float64(st.Keys) / float64(st.MaxKeys)
+	}
+	if st.MaxMemory > 0 {
+		st.MemFillRatio = float64(st.UsedMemory) / float64(st.MaxMemory)
+	}
+	return st, nil
+}
+
+// checkEvictionPolicy warns when Redis may drop keys under memory pressure. Every vault cache
+// key has a TTL, so volatile-* policies evict them just like allkeys-*; reveal records and job
+// locks live in the same Redis and are lost too.
+func (c *Cache) checkEvictionPolicy(ctx context.Context) {
+	st, err := c.Stats(ctx)
+	if err != nil {
+		log.Printf("redis: cannot read eviction policy: %v", err)
+		return
+	}
+	if st.MaxMemory > 0 && st.EvictionPolicy != "" && st.EvictionPolicy != "noeviction" {
+		log.Printf("WARNING: redis maxmemory-policy=%s (maxmemory=%d): cache keys, reveal records and job locks are evicted silently under memory pressure; use noeviction or size Redis and CACHE_MAX_KEYS for the vault",
+			st.EvictionPolicy, st.MaxMemory)
+	}
+	if st.EvictedKeys > 0 {
+		log.Printf("WARNING: redis has evicted %d keys since its start", st.EvictedKeys)
+	}
+}
+
+// preloadBudget caps a preload to the tokens that fit under CACHE_MAX_KEYS (two keys per
+// token). limit is the requested row limit (<= 0 = all); the result is the limit to use and
+// whether anything fits at all.
+func (c *Cache) preloadBudget(ctx context.Context, limit int) (int, bool) {
+	if c.maxKeys <= 0 {
+		return limit, true
+	}
+	keys, err := c.client.DBSize(ctx).Result()
+	if err != nil {
+		log.Printf("cache preload: cannot read key count, preloading without budget: %v", err)
+		return limit, true
+	}
+	budget := int((c.maxKeys - keys) / 2)
+	if budget <= 0 {
+		log.Printf("cache preload: skipped, %d keys already at CACHE_MAX_KEYS=%d", keys, c.maxKeys)
+		return 0, false
+	}
+	if limit <= 0 || limit > budget {
+		log.Printf("cache preload: limited to the newest %d tokens by CACHE_MAX_KEYS=%d (%d keys present)", budget, c.maxKeys, keys)
+		return budget, true
+	}
+	return limit, true
+}
+
+// GET /admin/cache-stats
+func (s *Server) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cache == nil {
+		writeJSONError(w, http.StatusNotFound, "cache not configured")
+		return
+	}
+	st, err := s.cache.Stats(r.Context())
+	if err != nil {
+		log.Printf("cache stats error: %v", err)
+		writeJSONError(w, http.StatusBadGateway, "cache unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,232 @@
+package bi_internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	defaultMemcachedTimeout = 500 * time.Millisecond
+	memcachedPoolSize       = 8
+	// memcached reads expirations above 30 days as absolute unix times
+	memcachedMaxRelativeExpiry = 30 * 24 * time.Hour
+)
+
+// memcachedCache is a shared token cache on memcached, spoken over the text protocol. Keys are
+// hashed (memcachedKey) and spread over MEMCACHED_ADDRS by CRC32. Sliding TTLs and refresh-ahead are not supported (a
+// get does not return the remaining TTL); entries expire after the family TTL.
+type memcachedCache struct {
+	servers []*memcachedServer
+	blind   cacheFamily
+	fpt     cacheFamily
+}
+
+// memcachedServer keeps a small pool of idle connections to one memcached node.
+type memcachedServer struct {
+	addr    string
+	timeout time.Duration
+	idle    chan net.Conn
+}
+
+// newMemcachedCacheFromEnv connects to MEMCACHED_ADDRS ("host:11211,host2:11211"), with
+// MEMCACHED_TIMEOUT_MS per operation (default 500).
+func newMemcachedCacheFromEnv() (*memcachedCache, error) {
+	timeout := time.Duration(envInt("MEMCACHED_TIMEOUT_MS", int(defaultMemcachedTimeout.Milliseconds()))) * time.Millisecond
+	ttl := cacheTTLFromEnv()
+	c := &memcachedCache{blind: familyFromEnv("blind", ttl), fpt: familyFromEnv("fpt", ttl)}
+	for _, addr := range strings.Split(common.MaybeEnv("MEMCACHED_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.servers = append(c.servers, &memcachedServer{addr: addr, timeout: timeout, idle: make(chan net.Conn, memcachedPoolSize)})
+		}
+	}
+	if len(c.servers) == 0 {
+		return nil, errors.New("MEMCACHED_ADDRS not set")
+	}
+	for _, srv := range c.servers {
+		conn, err := srv.conn()
+		if err != nil {
+			return nil, fmt.Errorf("memcached %s: %w", srv.addr, err)
+		}
+		srv.put(conn)
+	}
+	log.Printf("cache: memcached servers=%d ttl blind=%s fpt=%s", len(c.servers), c.blind.ttl, c.fpt.ttl)
+	return c, nil
+}
+
+func (c *memcachedCache) server(key string) *memcachedServer {
+	return c.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.servers))]
+}
+
+func (m *memcachedServer) conn() (net.Conn, error) {
+	select {
+	case conn := <-m.idle:
+		return conn, nil
+	default:
+		return net.DialTimeout("tcp", m.addr, m.timeout)
+	}
+}
+
+func (m *memcachedServer) put(conn net.Conn) {
+	select {
+	case m.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// do runs one request/response exchange; the connection is only reused after a clean exchange.
+func (m *memcachedServer) do(fn func(rw *bufio.ReadWriter) error) error {
+	conn, err := m.conn()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := fn(rw); err != nil {
+		conn.Close()
+		return err
+	}
+	m.put(conn)
+	return nil
+}
+
+// memcachedKey is the memcached key of a cache key: its SHA-256 in hex. Memcached keys are
+// protocol text, at most 250 bytes without spaces or control characters; a hash always fits,
+// whatever the token or blind index in the cache key, and keeps tokens off the wire.
+func memcachedKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "pii:" + hex.EncodeToString(sum[:])
+}
+
+func (c *memcachedCache) get(key string) (string, error) {
+	key = memcachedKey(key)
+	var value string
+	err := c.server(key).do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "get %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line == "END\r\n" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes>
+		parts := strings.Fields(line)
+		if len(parts) != 4 || parts[0] != "VALUE" {
+			return fmt.Errorf("memcached: unexpected reply %q", strings.TrimSpace(line))
+		}
+		size, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return err
+		}
+		value = string(buf[:size])
+		if line, err = rw.ReadString('\n'); err != nil {
+			return err
+		}
+		if line != "END\r\n" {
+			return fmt.Errorf("memcached: unexpected reply %q", strings.TrimSpace(line))
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (c *memcachedCache) set(key, value string, ttl time.Duration) error {
+	key = memcachedKey(key)
+	exp := int64(ttl.Seconds())
+	if ttl > memcachedMaxRelativeExpiry {
+		exp = time.Now().Add(ttl).Unix()
+	}
+	return c.server(key).do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "set %s 0 %d %d\r\n%s\r\n", key, exp, len(value), value); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "STORED\r\n" {
+			return fmt.Errorf("memcached: set failed: %s", strings.TrimSpace(line))
+		}
+		return nil
+	})
+}
+
+// del removes key; a key that is not there is not an error.
+func (c *memcachedCache) del(key string) error {
+	key = memcachedKey(key)
+	return c.server(key).do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "DELETED\r\n" && line != "NOT_FOUND\r\n" {
+			return fmt.Errorf("memcached: delete failed: %s", strings.TrimSpace(line))
+		}
+		return nil
+	})
+}
+
+func (c *memcachedCache) GetByBlindIndex(ctx context.Context, dataType, blindIndex string) (string, error) {
+	return c.get(blindCacheKey(dataType, blindIndex))
+}
+
+func (c *memcachedCache) SetByBlindIndex(ctx context.Context, dataType, blindIndex, fpt string) error {
+	return c.set(blindCacheKey(dataType, blindIndex), fpt, c.blind.ttl)
+}
+
+func (c *memcachedCache) GetByFPTWithOwner(ctx context.Context, dataType, fpt string) (string, string, error) {
+	v, err := c.get(fptCacheKey(dataType, fpt))
+	if err != nil || v == "" {
+		return "", "", err
+	}
+	tenantID, enc := decodeFPTEntry(v)
+	return enc, tenantID, nil
+}
+
+func (c *memcachedCache) SetByFPT(ctx context.Context, dataType, fpt, tenantID string, encryptedValue []byte) error {
+	return c.set(fptCacheKey(dataType, fpt), encodeFPTEntry(tenantID, encryptedValue), c.fpt.ttl)
+}
+
+func (c *memcachedCache) Evict(ctx context.Context, dataType, blindIndex, fpt string) error {
+	if err := c.del(blindCacheKey(dataType, blindIndex)); err != nil {
+		return err
+	}
+	return c.del(fptCacheKey(dataType, fpt))
+}
+
+func (c *memcachedCache) PreloadFromStoreLimit(ctx context.Context, store *models.Store, limit int) error {
+	return preloadTokenCache(ctx, c, store, limit)
+}
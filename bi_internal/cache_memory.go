@@ -0,0 +1,130 @@
+package bi_internal
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+const defaultMemoryCacheKeys = 100000
+
+// memoryCache is a per-instance LRU token cache holding at most maxKeys entries (CACHE_MAX_KEYS,
+// default 100000), with the same per-family TTLs as the Redis cache. Nothing is shared between
+// replicas, so each one warms its own copy.
+type memoryCache struct {
+	mu      sync.Mutex
+	lru     *list.List // front = most recently used
+	items   map[string]*list.Element
+	maxKeys int
+	blind   cacheFamily
+	fpt     cacheFamily
+	// refresh reloads entries hit within their family's refreshAhead window (set by the server)
+	refresh *cacheRefresher
+}
+
+type memoryCacheItem struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newMemoryCacheFromEnv() *memoryCache {
+	ttl := cacheTTLFromEnv()
+	c := &memoryCache{
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+		maxKeys: envInt("CACHE_MAX_KEYS", defaultMemoryCacheKeys),
+		blind:   familyFromEnv("blind", ttl),
+		fpt:     familyFromEnv("fpt", ttl),
+	}
+	log.Printf("cache: in-memory LRU, max_keys=%d ttl blind=%s fpt=%s", c.maxKeys, c.blind.ttl, c.fpt.ttl)
+	return c
+}
+
+func (c *memoryCache) get(key string, fam cacheFamily) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return ""
+	}
+	it := el.Value.(*memoryCacheItem)
+	left := time.Until(it.expires)
+	if left < 0 {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		return ""
+	}
+	if fam.sliding {
+		it.expires = time.Now().Add(fam.ttl)
+	} else if c.refresh != nil && fam.refreshAhead > 0 && left <= fam.refreshAhead {
+		c.refresh.entry(key)
+	}
+	c.lru.MoveToFront(el)
+	return it.value
+}
+
+func (c *memoryCache) set(key, value string, fam cacheFamily) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(fam.ttl)
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*memoryCacheItem)
+		it.value, it.expires = value, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&memoryCacheItem{key: key, value: value, expires: expires})
+	for c.lru.Len() > c.maxKeys {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*memoryCacheItem).key)
+	}
+}
+
+func (c *memoryCache) GetByBlindIndex(ctx context.Context, dataType, blindIndex string) (string, error) {
+	return c.get(blindCacheKey(dataType, blindIndex), c.blind), nil
+}
+
+func (c *memoryCache) SetByBlindIndex(ctx context.Context, dataType, blindIndex, fpt string) error {
+	c.set(blindCacheKey(dataType, blindIndex), fpt, c.blind)
+	return nil
+}
+
+func (c *memoryCache) GetByFPTWithOwner(ctx context.Context, dataType, fpt string) (string, string, error) {
+	v := c.get(fptCacheKey(dataType, fpt), c.fpt)
+	if v == "" {
+		return "", "", nil
+	}
+	tenantID, enc := decodeFPTEntry(v)
+	return enc, tenantID, nil
+}
+
+func (c *memoryCache) SetByFPT(ctx context.Context, dataType, fpt, tenantID string, encryptedValue []byte) error {
+	c.set(fptCacheKey(dataType, fpt), encodeFPTEntry(tenantID, encryptedValue), c.fpt)
+	return nil
+}
+
+func (c *memoryCache) Evict(ctx context.Context, dataType, blindIndex, fpt string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []string{blindCacheKey(dataType, blindIndex), fptCacheKey(dataType, fpt)} {
+		if el, ok := c.items[key]; ok {
+			c.lru.Remove(el)
+			delete(c.items, key)
+		}
+	}
+	return nil
+}
+
+// PreloadFromStoreLimit loads at most the newest tokens that fit (two entries per token).
+func (c *memoryCache) PreloadFromStoreLimit(ctx context.Context, store *models.Store, limit int) error {
+	if fit := c.maxKeys / 2; limit <= 0 || limit > fit {
+		limit = fit
+	}
+	return preloadTokenCache(ctx, c, store, limit)
+}
@@ -0,0 +1,224 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	changeJournalRetryInterval = 30 * time.Second
+	changeJournalPendingMax    = 10000
+	changeJournalPage          = 1000
+)
+
+// changeJournal queues admin mutations for the hash-chained pii_change_journal. Entries are
+// appended synchronously; while the database is unreachable they are held (in order) and
+// retried with the next change and every 30 seconds.
+type changeJournal struct {
+	mu      sync.Mutex
+	pending []models.ChangeJournalEntry
+	dropped int64
+	// last is the newest entry appended by this instance
+	last models.ChangeJournalEntry
+}
+
+// adminChange records an admin mutation: an audit log event and a change journal entry with
+// the same attributes. The audit event carries the journal id and hash once appended, which
+// anchors the chain in the log sink. Never pass secrets or PII in attrs.
+func (s *Server) adminChange(ctx context.Context, action string, attrs ...any) {
+	detail := map[string]any{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		detail[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		raw = []byte(`{}`)
+	}
+	e := models.ChangeJournalEntry{
+		OccurredAt: time.Now().UTC(),
+		Action:     action,
+		Actor:      CallerIDFromContext(ctx),
+		TenantID:   TenantFromContext(ctx),
+		RequestID:  RequestIDFromContext(ctx),
+		SourceIP:   ClientIPFromContext(ctx),
+		Detail:     raw,
+	}
+	if appended, ok := s.appendChangeJournal(e); ok {
+		attrs = append(attrs, "journal_id", appended.ID, "journal_hash", appended.Hash)
+	}
+	auditEvent(ctx, action, attrs...)
+}
+
+// appendChangeJournal appends e after any held entries; ok is false when the entry is held
+// for a retry.
+func (s *Server) appendChangeJournal(e models.ChangeJournalEntry) (models.ChangeJournalEntry, bool) {
+	j := s.changes
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.pending) >= changeJournalPendingMax {
+		// keep the oldest entries so the journal has no gap before the drop
+		j.dropped++
+		slog.Error("change journal: buffer full, entry dropped", "action", e.Action, "dropped", j.dropped)
+		return e, false
+	}
+	j.pending = append(j.pending, e)
+	if !s.flushChangeJournalLocked() {
+		return e, false
+	}
+	return j.last, true
+}
+
+// flushChangeJournalLocked appends the held entries; the caller holds j.mu.
+func (s *Server) flushChangeJournalLocked() bool {
+	j := s.changes
+	if len(j.pending) == 0 {
+		return true
+	}
+	batch := append([]models.ChangeJournalEntry(nil), j.pending...)
+	if err := s.store.AppendChangeJournal(batch); err != nil {
+		slog.Error("change journal: append failed, will retry", "error", err, "pending", len(j.pending))
+		s.degradation.set(subsystemChangeJournal, impactBuffering, err.Error())
+		return false
+	}
+	j.pending, j.last = nil, batch[len(batch)-1]
+	s.degradation.clear(subsystemChangeJournal)
+	return true
+}
+
+// startChangeJournalRetry retries held journal entries every 30 seconds.
+func (s *Server) startChangeJournalRetry() {
+	go func() {
+		t := time.NewTicker(changeJournalRetryInterval)
+		defer t.Stop()
+		for range t.C {
+			s.changes.mu.Lock()
+			s.flushChangeJournalLocked()
+			s.changes.mu.Unlock()
+		}
+	}()
+}
+
+// ChangeJournalVerification is the result of re-computing the journal's hash chain.
+type ChangeJournalVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int64  `json:"entries"`
+	HeadID   int64  `json:"head_id,omitempty"`
+	HeadHash string `json:"head_hash,omitempty"`
+	// BrokenAt is the first entry whose prev_hash or hash does not match
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Pending  int    `json:"pending"`
+}
+
+// verifyChangeJournal walks the whole journal and re-computes every hash.
+func (s *Server) verifyChangeJournal(ctx context.Context) (*ChangeJournalVerification, error) {
+	v := &ChangeJournalVerification{Valid: true}
+	s.changes.mu.Lock()
+	v.Pending = len(s.changes.pending)
+	s.changes.mu.Unlock()
+	var after int64
+	prev := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, err := s.store.ListChangeJournal(after, time.Time{}, time.Time{}, changeJournalPage)
+		if err != nil {
+			return nil, err
+		}
+		for i := range page {
+			e := &page[i]
+			v.Entries++
+			switch {
+			case e.PrevHash != prev:
+				v.Valid, v.BrokenAt, v.Reason = false, e.ID, "prev_hash does not match the previous entry"
+			case e.ChainHash(prev) != e.Hash:
+				v.Valid, v.BrokenAt, v.Reason = false, e.ID, "hash does not match the entry content"
+			}
+			if !v.Valid {
+				return v, nil
+			}
+			prev, v.HeadID, v.HeadHash = e.Hash, e.ID, e.Hash
+		}
+		if len(page) < changeJournalPage {
+			return v, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// GET /admin/change-journal/export?from=&to=
+// Streams journal entries in order as NDJSON for auditors. X-Change-Journal-Head-ID and
+// X-Change-Journal-Head-Hash give the newest entry at the start of the export.
+func (s *Server) exportChangeJournalHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := parseAuditTime(q.Get("from"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "from must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	to, err := parseAuditTime(q.Get("to"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "to must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	head, err := s.store.ChangeJournalHead()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "change journal export failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if head != nil {
+		w.Header().Set("X-Change-Journal-Head-ID", fmt.Sprint(head.ID))
+		w.Header().Set("X-Change-Journal-Head-Hash", head.Hash)
+	}
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var after int64
+	for head != nil && after < head.ID {
+		page, err := s.store.ListChangeJournal(after, from, to, changeJournalPage)
+		if err != nil {
+			// the status is already sent: end the stream early, the client sees it short
+			slog.ErrorContext(r.Context(), "change journal export failed", "error", err, "after_id", after)
+			return
+		}
+		for _, e := range page {
+			if e.ID > head.ID {
+				break
+			}
+			enc.Encode(e)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(page) < changeJournalPage || r.Context().Err() != nil {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+	auditEvent(r.Context(), "change_journal.exported", "from", q.Get("from"), "to", q.Get("to"))
+}
+
+// GET /admin/change-journal/verify
+// Re-computes the hash chain of the whole journal and reports the first broken entry.
+func (s *Server) verifyChangeJournalHandler(w http.ResponseWriter, r *http.Request) {
+	v, err := s.verifyChangeJournal(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "change journal verify failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !v.Valid {
+		slog.ErrorContext(r.Context(), "change journal: hash chain broken", "id", v.BrokenAt, "reason", v.Reason)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
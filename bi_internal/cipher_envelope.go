@@ -0,0 +1,259 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// ErrTokenShredded is returned when the data key of a token was crypto-shredded.
+var ErrTokenShredded = errors.New("token value was shredded")
+
+const (
+	envelopeCiphertextPref = "env1:"
+	envelopeKeyVersionPref = "env:"
+	defaultDEKCacheTTL     = 60 * time.Second
+	// maxDEKCacheEntries bounds the unwrapped data keys held in memory
+	maxDEKCacheEntries = 100000
+)
+
+// envelopeCipher seals every value with its own random AES-256 data key (DEK). The DEK is
+// wrapped by the key encryption key (KEK) and stored in pii_deks; the ciphertext
+// "env1:<dek id>:<base64 nonce||ciphertext>" references it. A compromised DEK exposes one
+// value, and deleting a DEK crypto-shreds the value in the vault, the cache and exports alike.
+// Rows still encrypted with the local AES keys are decrypted locally until the re-encryption
+// job has moved them to envelopes.
+//
+// Env:
+// ENVELOPE_KEK (optional, default local) local = the current AES key, aws-kms = the KMS key
+// KMS_KEY_ID (required with aws-kms), KMS_ENCRYPTION_CONTEXT (optional)
+// ENVELOPE_DEK_CACHE_SEC (optional, default 60) how long unwrapped DEKs stay in memory
+type envelopeCipher struct {
+	store *models.Store
+	kek   kek
+	local localCipher
+
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int64]dekCacheEntry
+}
+
+type dekCacheEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+// kek wraps and unwraps data keys; version identifies the KEK a data key was wrapped with.
+type kek interface {
+	wrap(ctx context.Context, dek []byte) (wrapped []byte, version string, err error)
+	unwrap(ctx context.Context, wrapped []byte, version string) ([]byte, error)
+}
+
+func newEnvelopeCipher(local localCipher, store *models.Store) (*envelopeCipher, error) {
+	c := &envelopeCipher{
+		store:   store,
+		local:   local,
+		ttl:     time.Duration(envInt("ENVELOPE_DEK_CACHE_SEC", int(defaultDEKCacheTTL.Seconds()))) * time.Second,
+		entries: map[int64]dekCacheEntry{},
+	}
+	switch k := strings.ToLower(strings.TrimSpace(common.MaybeEnv("ENVELOPE_KEK"))); k {
+	case "", "local":
+		c.kek = localKEK{keys: local.keys}
+	case "aws-kms":
+		client, keyID, encCtx, err := kmsClientFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("envelope cipher provider: %w", err)
+		}
+		if keyID == "" {
+			return nil, fmt.Errorf("envelope cipher provider: ENVELOPE_KEK=aws-kms needs KMS_KEY_ID")
+		}
+		c.kek = kmsKEK{client: client, keyID: keyID, encCtx: encCtx}
+	default:
+		return nil, fmt.Errorf("invalid ENVELOPE_KEK %q: want local or aws-kms", k)
+	}
+	return c, nil
+}
+
+func isEnvelopeCiphertext(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, envelopeCiphertextPref)
+}
+
+// envelopeDEKID returns the data key id of an envelope ciphertext.
+func envelopeDEKID(ciphertext string) (int64, string, error) {
+	id, sealed, ok := strings.Cut(strings.TrimPrefix(ciphertext, envelopeCiphertextPref), ":")
+	if !ok {
+		return 0, "", fmt.Errorf("malformed envelope ciphertext")
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed envelope ciphertext: %w", err)
+	}
+	return n, sealed, nil
+}
+
+// KeyVersion is "env:" + the KEK version, e.g. env:local:v2 or env:kms.
+func (c *envelopeCipher) KeyVersion() string {
+	if l, ok := c.kek.(localKEK); ok {
+		return envelopeKeyVersionPref + l.version()
+	}
+	return envelopeKeyVersionPref + kmsKEKVersion
+}
+
+func (c *envelopeCipher) Encrypt(ctx context.Context, plaintext []byte) (string, string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", "", err
+	}
+	sealed, err := common.AESGCMEncrypt(dek, plaintext)
+	if err != nil {
+		return "", "", err
+	}
+	wrapped, version, err := c.kek.wrap(ctx, dek)
+	if err != nil {
+		return "", "", fmt.Errorf("wrap data key: %w", err)
+	}
+	id, err := c.store.CreateDEK(wrapped, version)
+	if err != nil {
+		return "", "", err
+	}
+	c.put(id, dek)
+	return envelopeCiphertextPref + strconv.FormatInt(id, 10) + ":" + sealed, envelopeKeyVersionPref + version, nil
+}
+
+func (c *envelopeCipher) Decrypt(ctx context.Context, keyVersion, ciphertext string) ([]byte, error) {
+	if !isEnvelopeCiphertext(ciphertext) {
+		return c.local.Decrypt(ctx, keyVersion, ciphertext)
+	}
+	id, sealed, err := envelopeDEKID(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := c.dek(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return common.AESGCMDecrypt(dek, sealed)
+}
+
+// dek returns the unwrapped data key, from memory or unwrapped from pii_deks.
+func (c *envelopeCipher) dek(ctx context.Context, id int64) ([]byte, error) {
+	c.mu.Lock()
+	e, ok := c.entries[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.key, nil
+	}
+	d, err := c.store.DEKByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, ErrTokenShredded
+	}
+	key, err := c.kek.unwrap(ctx, d.Wrapped, d.KEKVersion)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key %d: %w", id, err)
+	}
+	c.put(id, key)
+	return key, nil
+}
+
+func (c *envelopeCipher) put(id int64, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxDEKCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxDEKCacheEntries {
+			return
+		}
+	}
+	c.entries[id] = dekCacheEntry{key: key, expires: now.Add(c.ttl)}
+}
+
+// shred deletes the data key of an envelope ciphertext. Other replicas drop their copy of the
+// unwrapped key within ENVELOPE_DEK_CACHE_SEC.
+func (c *envelopeCipher) shred(ciphertext string) (bool, error) {
+	id, _, err := envelopeDEKID(ciphertext)
+	if err != nil {
+		return false, err
+	}
+	c.forget(id)
+	return c.store.ShredDEK(id)
+}
+
+// forget drops the unwrapped data key id from memory.
+func (c *envelopeCipher) forget(id int64) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
+
+// localKEK wraps data keys with the current AES key; unwrapping uses the key ring, so AES key
+// rotation keeps working (the re-encryption job moves tokens to DEKs under the new key).
+type localKEK struct {
+	keys *atomic.Pointer[keyMaterial]
+}
+
+const localKEKVersionPref = "local:"
+
+func (k localKEK) version() string { return localKEKVersionPref + k.keys.Load().version }
+
+func (k localKEK) wrap(ctx context.Context, dek []byte) ([]byte, string, error) {
+	km := k.keys.Load()
+	wrapped, err := common.AESGCMEncrypt(km.aes, dek)
+	return []byte(wrapped), localKEKVersionPref + km.version, err
+}
+
+func (k localKEK) unwrap(ctx context.Context, wrapped []byte, version string) ([]byte, error) {
+	plain, _, err := k.keys.Load().open(strings.TrimPrefix(version, localKEKVersionPref), func(aesKey []byte) ([]byte, error) {
+		return common.AESGCMDecrypt(aesKey, string(wrapped))
+	})
+	return plain, err
+}
+
+// kmsKEK wraps data keys with KMS Encrypt under KMS_KEY_ID. KMS keeps the material of rotated
+// KMS keys, so the version does not change with a KMS key rotation.
+type kmsKEK struct {
+	client *kms.Client
+	keyID  string
+	encCtx map[string]string
+}
+
+const kmsKEKVersion = "kms"
+
+func (k kmsKEK) wrap(ctx context.Context, dek []byte) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kmsDecryptTimeout)
+	defer cancel()
+	out, err := k.client.Encrypt(ctx, &kms.EncryptInput{KeyId: aws.String(k.keyID), Plaintext: dek, EncryptionContext: k.encCtx})
+	if err != nil {
+		return nil, "", fmt.Errorf("KMS encrypt: %w", err)
+	}
+	return out.CiphertextBlob, kmsKEKVersion, nil
+}
+
+func (k kmsKEK) unwrap(ctx context.Context, wrapped []byte, version string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, kmsDecryptTimeout)
+	defer cancel()
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{KeyId: aws.String(k.keyID), CiphertextBlob: wrapped, EncryptionContext: k.encCtx})
+	if err != nil {
+		return nil, fmt.Errorf("KMS decrypt: %w", err)
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,89 @@
+package bi_internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// CipherProvider encrypts and decrypts the encrypted_value column (and the fpt cache entries,
+// which hold the same ciphertext). The v2 column and connection profile DSNs always use the
+// local AES keys.
+type CipherProvider interface {
+	// Encrypt seals plaintext and returns the ciphertext with the key version to record in the
+	// row's key_version.
+	Encrypt(ctx context.Context, plaintext []byte) (ciphertext, keyVersion string, err error)
+	// Decrypt opens a ciphertext written with keyVersion ("" when unknown, e.g. from the cache).
+	Decrypt(ctx context.Context, keyVersion, ciphertext string) ([]byte, error)
+	// KeyVersion is the key version Encrypt currently records; rows on other versions are
+	// rewritten by the re-encryption job.
+	KeyVersion() string
+}
+
+// cipherProviderFromEnv selects the cipher provider with CIPHER_PROVIDER: "local" (default)
+// encrypts with the AES key ring, "vault-transit" with the HashiCorp Vault transit engine and
+// "envelope" with a data key per token.
+func cipherProviderFromEnv(keys *atomic.Pointer[keyMaterial], store *models.Store) (CipherProvider, error) {
+	local := localCipher{keys: keys}
+	switch p := strings.ToLower(strings.TrimSpace(common.MaybeEnv("CIPHER_PROVIDER"))); p {
+	case "", "local":
+		return local, nil
+	case "vault-transit":
+		return newVaultTransitCipher(local)
+	case "envelope":
+		return newEnvelopeCipher(local, store)
+	default:
+		return nil, fmt.Errorf("invalid CIPHER_PROVIDER %q: want local, vault-transit or envelope", p)
+	}
+}
+
+// localCipher is AES-GCM with the current key material; decryption tries the key ring.
+type localCipher struct {
+	keys *atomic.Pointer[keyMaterial]
+}
+
+func (c localCipher) Encrypt(ctx context.Context, plaintext []byte) (string, string, error) {
+	km := c.keys.Load()
+	enc, err := common.AESGCMEncrypt(km.aes, plaintext)
+	return enc, km.version, err
+}
+
+func (c localCipher) Decrypt(ctx context.Context, keyVersion, ciphertext string) ([]byte, error) {
+	if isVaultCiphertext(ciphertext) {
+		return nil, fmt.Errorf("ciphertext was written by the Vault transit engine; set CIPHER_PROVIDER=vault-transit")
+	}
+	if isEnvelopeCiphertext(ciphertext) {
+		return nil, fmt.Errorf("ciphertext is envelope-encrypted; set CIPHER_PROVIDER=envelope")
+	}
+	plain, _, err := c.keys.Load().open(keyVersion, func(aesKey []byte) ([]byte, error) {
+		return common.AESGCMDecrypt(aesKey, ciphertext)
+	})
+	return plain, err
+}
+
+func (c localCipher) KeyVersion() string { return c.keys.Load().version }
+
+// isLocalCiphertext reports whether a ciphertext was sealed directly with an AES key of the
+// ring (not by Vault or with a data key).
+func isLocalCiphertext(ciphertext string) bool {
+	return !isVaultCiphertext(ciphertext) && !isEnvelopeCiphertext(ciphertext)
+}
+
+// ringKeyVersion maps a row's key_version to the AES key version of the ring it depends on:
+// the version itself, or the KEK version of envelopes wrapped with the local key. local is
+// false for rows that do not depend on the ring (Vault, data keys wrapped by KMS).
+func ringKeyVersion(keyVersion string) (version string, local bool) {
+	switch {
+	case strings.HasPrefix(keyVersion, vaultCiphertextPref):
+		return "", false
+	case strings.HasPrefix(keyVersion, envelopeKeyVersionPref+localKEKVersionPref):
+		return strings.TrimPrefix(keyVersion, envelopeKeyVersionPref+localKEKVersionPref), true
+	case strings.HasPrefix(keyVersion, envelopeKeyVersionPref):
+		return "", false
+	}
+	return keyVersion, true
+}
@@ -0,0 +1,162 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	defaultVaultTimeout = 5 * time.Second
+	vaultCiphertextPref = "vault:"
+)
+
+// vaultTransitCipher delegates encryption to the HashiCorp Vault transit engine, so the key
+// never leaves Vault, rotation is done in Vault (`vault write -f transit/keys/<key>/rotate`) and
+// every decrypt shows up in Vault's audit log. Rows still encrypted with the local AES keys
+// are decrypted locally until the re-encryption job has moved them to Vault.
+//
+// Env:
+// VAULT_ADDR (required) e.g. https://vault.internal:8200
+// VAULT_TOKEN (required, or VAULT_TOKEN_FILE) re-read on a secret reload
+// VAULT_TRANSIT_KEY (required) the transit key name
+// VAULT_TRANSIT_MOUNT (optional, default transit)
+// VAULT_NAMESPACE (optional) Vault Enterprise namespace
+// VAULT_TIMEOUT_MS (optional, default 5000)
+type vaultTransitCipher struct {
+	addr      string
+	mount     string
+	key       string
+	namespace string
+	token     atomic.Pointer[string]
+	client    *http.Client
+	local     localCipher
+}
+
+func newVaultTransitCipher(local localCipher) (*vaultTransitCipher, error) {
+	c := &vaultTransitCipher{
+		addr:      strings.TrimRight(strings.TrimSpace(common.MaybeEnv("VAULT_ADDR")), "/"),
+		mount:     strings.Trim(strings.TrimSpace(common.MaybeEnv("VAULT_TRANSIT_MOUNT")), "/"),
+		key:       strings.TrimSpace(common.MaybeEnv("VAULT_TRANSIT_KEY")),
+		namespace: strings.TrimSpace(common.MaybeEnv("VAULT_NAMESPACE")),
+		client:    &http.Client{Timeout: time.Duration(envInt("VAULT_TIMEOUT_MS", int(defaultVaultTimeout.Milliseconds()))) * time.Millisecond},
+		local:     local,
+	}
+	if c.mount == "" {
+		c.mount = "transit"
+	}
+	if c.addr == "" || c.key == "" {
+		return nil, fmt.Errorf("vault-transit cipher provider: VAULT_ADDR and VAULT_TRANSIT_KEY are required")
+	}
+	if err := c.reloadToken(); err != nil {
+		return nil, err
+	}
+
+	// fail fast on a wrong address, token or key name
+	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	defer cancel()
+	var info struct {
+		LatestVersion      int  `json:"latest_version"`
+		SupportsEncryption bool `json:"supports_encryption"`
+	}
+	if err := c.call(ctx, http.MethodGet, "keys/"+url.PathEscape(c.key), nil, &info); err != nil {
+		return nil, fmt.Errorf("vault-transit cipher provider: read key %s: %w", c.key, err)
+	}
+	if !info.SupportsEncryption {
+		return nil, fmt.Errorf("vault-transit cipher provider: key %s does not support encryption", c.key)
+	}
+	log.Printf("cipher: Vault transit key %s/%s (latest version %d)", c.mount, c.key, info.LatestVersion)
+	return c, nil
+}
+
+// reloadToken re-reads VAULT_TOKEN, e.g. after an agent renewed the token file.
+func (c *vaultTransitCipher) reloadToken() error {
+	token := strings.TrimSpace(common.MaybeEnv("VAULT_TOKEN"))
+	if token == "" {
+		return fmt.Errorf("vault-transit cipher provider: missing env: VAULT_TOKEN (or VAULT_TOKEN_FILE)")
+	}
+	c.token.Store(&token)
+	return nil
+}
+
+func isVaultCiphertext(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, vaultCiphertextPref)
+}
+
+func (c *vaultTransitCipher) KeyVersion() string { return vaultCiphertextPref + c.key }
+
+func (c *vaultTransitCipher) Encrypt(ctx context.Context, plaintext []byte) (string, string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	in := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	if err := c.call(ctx, http.MethodPost, "encrypt/"+url.PathEscape(c.key), in, &out); err != nil {
+		return "", "", fmt.Errorf("vault transit encrypt: %w", err)
+	}
+	return out.Ciphertext, c.KeyVersion(), nil
+}
+
+func (c *vaultTransitCipher) Decrypt(ctx context.Context, keyVersion, ciphertext string) ([]byte, error) {
+	if !isVaultCiphertext(ciphertext) {
+		return c.local.Decrypt(ctx, keyVersion, ciphertext)
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	in := map[string]string{"ciphertext": ciphertext}
+	if err := c.call(ctx, http.MethodPost, "decrypt/"+url.PathEscape(c.key), in, &out); err != nil {
+		return nil, fmt.Errorf("vault transit decrypt: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// call sends one transit API request and decodes the response's data into out.
+func (c *vaultTransitCipher) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+c.mount+"/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", *c.token.Load())
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil && err != io.EOF {
+		return fmt.Errorf("status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.Join(envelope.Errors, "; "))
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
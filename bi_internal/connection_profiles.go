@@ -0,0 +1,179 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// ErrBulkSource marks bulk requests whose source connection cannot be resolved (400).
+var ErrBulkSource = errors.New("invalid bulk source")
+
+// profileAAD binds a stored DSN ciphertext to its profile name.
+func profileAAD(name string) []byte {
+	return []byte("connection-profile|" + name)
+}
+
+// resolveSrcDSN returns the source DSN of a bulk request: the decrypted DSN of src_profile,
+// which must belong to the caller's tenant, or the inline src_dsn with
+// BULK_ALLOW_INLINE_DSN=true.
+func (s *Server) resolveSrcDSN(ctx context.Context, req *BulkTokenizeRequest) (string, error) {
+	switch {
+	case req.SrcProfile != "" && req.SrcDSN != "":
+		return "", fmt.Errorf("%w: set src_profile or src_dsn, not both", ErrBulkSource)
+	case req.SrcProfile != "":
+		p, err := s.store.GetConnectionProfile(req.SrcProfile, TenantFromContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		if p == nil {
+			return "", fmt.Errorf("%w: connection profile %q not found", ErrBulkSource, req.SrcProfile)
+		}
+		dsn, err := s.decryptProfileDSN(p)
+		if err != nil {
+			return "", fmt.Errorf("decrypt connection profile %q: %w", p.Name, err)
+		}
+		return string(dsn), nil
+	case req.SrcDSN != "":
+		if !s.bulk.allowInlineDSN {
+			return "", fmt.Errorf("%w: inline src_dsn is disabled, use a connection profile (src_profile)", ErrBulkSource)
+		}
+		return req.SrcDSN, nil
+	}
+	return "", fmt.Errorf("%w: src_profile or src_dsn is required", ErrBulkSource)
+}
+
+func (s *Server) decryptProfileDSN(p *models.ConnectionProfile) ([]byte, error) {
+	return s.open("", func(aesKey []byte) ([]byte, error) {
+		return common.DecryptV2(aesKey, string(p.EncryptedDSN), profileAAD(p.Name))
+	})
+}
+
+// dsnTarget describes where a DSN points (host, port, database) without its credentials.
+func dsnTarget(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		return u.Host + u.Path
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Fields(dsn) {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			fields[k] = strings.Trim(v, "'")
+		}
+	}
+	target := fields["host"]
+	if fields["port"] != "" {
+		target += ":" + fields["port"]
+	}
+	if fields["dbname"] != "" {
+		target += "/" + fields["dbname"]
+	}
+	return target
+}
+
+type PutConnectionProfileRequest struct {
+	DSN         string `json:"dsn"`
+	Tenant      string `json:"tenant,omitempty"` // whose bulk runs may use it ("" = callers without a tenant)
+	Description string `json:"description,omitempty"`
+}
+
+// ConnectionProfileView is a profile as returned by the admin API: the target, never the DSN.
+type ConnectionProfileView struct {
+	*models.ConnectionProfile
+	Target string `json:"target,omitempty"`
+}
+
+func (s *Server) profileView(p *models.ConnectionProfile) ConnectionProfileView {
+	v := ConnectionProfileView{ConnectionProfile: p}
+	if dsn, err := s.decryptProfileDSN(p); err == nil {
+		v.Target = dsnTarget(string(dsn))
+	}
+	return v
+}
+
+// GET /admin/connection-profiles
+func (s *Server) listConnectionProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.ConnectionProfiles()
+	if err != nil {
+		log.Printf("list connection profiles error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	out := make([]ConnectionProfileView, 0, len(list))
+	for _, p := range list {
+		out = append(out, s.profileView(p))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": out})
+}
+
+// PUT /admin/connection-profiles/{name}
+// Stores the DSN encrypted; the response and every later read only show the target.
+func (s *Server) putConnectionProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(mux.Vars(r)["name"])
+	var req PutConnectionProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.DSN = strings.TrimSpace(req.DSN)
+	if !identRE.MatchString(name) {
+		writeJSONError(w, http.StatusBadRequest, "profile name may only contain letters, digits and _")
+		return
+	}
+	if req.DSN == "" {
+		writeJSONError(w, http.StatusBadRequest, "dsn is required")
+		return
+	}
+	if err := s.countEncryptions(1); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	enc, err := common.EncryptV2(s.aesKey(), []byte(req.DSN), profileAAD(name))
+	if err != nil {
+		log.Printf("encrypt connection profile error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	p, err := s.store.PutConnectionProfile(&models.ConnectionProfile{
+		Name:         name,
+		TenantID:     strings.TrimSpace(req.Tenant),
+		EncryptedDSN: []byte(enc),
+		Description:  strings.TrimSpace(req.Description),
+		CreatedBy:    CallerIDFromContext(r.Context()),
+	})
+	if err != nil {
+		log.Printf("put connection profile error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.adminChange(r.Context(), "connection_profile.updated", "profile", name, "profile_tenant", p.TenantID, "target", dsnTarget(req.DSN))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.profileView(p))
+}
+
+// DELETE /admin/connection-profiles/{name}
+func (s *Server) deleteConnectionProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	ok, err := s.store.DeleteConnectionProfile(name)
+	if err != nil {
+		log.Printf("delete connection profile error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "connection profile not found")
+		return
+	}
+	s.adminChange(r.Context(), "connection_profile.deleted", "profile", name)
+	w.WriteHeader(http.StatusNoContent)
+}
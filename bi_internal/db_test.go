@@ -0,0 +1,56 @@
+package bi_internal
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"os"
+	"testing"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/migrations"
+	"bi_pii_tokenizer/models"
+)
+
+// newDBTestServer returns a Server on the Postgres database of TEST_DATABASE_URL, with the
+// migrations applied, fresh keys and no cache; the test is skipped without the variable.
+func newDBTestServer(t *testing.T) (*Server, *models.Store) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := common.RunMigrations(db, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	store := models.NewStore(db)
+
+	km := &keyMaterial{aes: randomBytes(t, 32), version: "test", hmac: randomBytes(t, 32), hmacVersion: "test"}
+	s := &Server{
+		store:       store,
+		policies:    &tenantPolicies{},
+		ciphertext:  ciphertextPolicy{dualWrite: true, readV2: true},
+		generators:  newGeneratorRegistry(nil, nil, nil, common.TweakPerSegment, false, nil, nil),
+		changes:     &changeJournal{},
+		degradation: newDegradationTracker(),
+	}
+	s.keys.Store(km)
+	env, err := newEnvelopeCipher(localCipher{keys: &s.keys}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cipher = env
+	return s, store
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package bi_internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+const defaultDebugLogMaxBytes = 64 << 10
+
+var debugLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("log", "debug_request")
+
+// debugRequestLog logs a canonical, PII-free envelope of every API request for replaying
+// problematic traffic in staging. It is opt-in (DEBUG_REQUEST_LOG=true).
+//
+// The body is re-encoded as canonical JSON (sorted keys, no insignificant whitespace) with PII
+// values (pii_value, pii_values, ...) replaced by their blind hashes and every other string
+// outside an allow-list of structural fields redacted, at any depth. Bodies above
+// DEBUG_REQUEST_LOG_MAX_BYTES (default 64 KiB) or that are not JSON are logged by size and
+// SHA-256 only.
+func (s *Server) debugRequestLog(next http.Handler) http.Handler {
+	if !strings.EqualFold(common.MaybeEnv("DEBUG_REQUEST_LOG"), "true") {
+		return next
+	}
+	maxBytes := envInt("DEBUG_REQUEST_LOG_MAX_BYTES", defaultDebugLogMaxBytes)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "unable to read body")
+			return
+		}
+		// hand the handler the full body: what we read plus whatever is left
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+		attrs := []any{
+			"request_id", RequestIDFromContext(r.Context()),
+			"caller_id", CallerIDFromContext(r.Context()),
+			"tenant", TenantFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"content_type", r.Header.Get("Content-Type"),
+		}
+		if len(body) > maxBytes {
+			attrs = append(attrs, "body_truncated", true)
+		} else if canon, ok := s.canonicalDebugBody(body); ok {
+			attrs = append(attrs, "body", canon)
+		} else if len(body) > 0 {
+			sum := sha256.Sum256(body)
+			attrs = append(attrs, "body_bytes", len(body), "body_sha256", hex.EncodeToString(sum[:]))
+		}
+		debugLogger.Info("request", attrs...)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// debugPIIKeys hold PII values; their strings are logged as blind hashes under the pii_type
+// (or data_type) of the enclosing object.
+var debugPIIKeys = map[string]bool{
+	"pii_value": true, "pii_values": true, "value": true, "values": true, "input": true, "plaintext": true,
+}
+
+// debugSafeKeys are the fields whose strings are logged as sent: types, names of tables and
+// columns, options and tokens. Strings under any other key (DSNs, URLs, filters, unknown
+// fields) are redacted, at any depth.
+var debugSafeKeys = map[string]bool{
+	"pii_type": true, "data_type": true, "output_format": true, "masking": true, "priority": true,
+	"src_profile": true, "src_table": true, "src_column": true, "token_column": true, "target_column": true,
+	"key_column": true, "export_key_column": true, "row_key_columns": true, "column": true, "columns": true,
+	"table": true, "name": true, "source_system": true, "tenant": true, "tenant_id": true, "scopes": true,
+	"allowed_types": true, "token_prefix": true, "reason": true, "action": true, "operation": true,
+	"fpt": true, "fpts": true, "token": true, "tokens": true,
+}
+
+// canonicalDebugBody returns body as canonical JSON with PII fields replaced by blind hashes
+// and every string outside debugSafeKeys redacted.
+func (s *Server) canonicalDebugBody(body []byte) (json.RawMessage, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		// only object envelopes are known to be PII-free after redaction
+		return nil, false
+	}
+	// encoding/json writes map keys in sorted order
+	out, err := json.Marshal(s.redactDebugObject(obj))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+func (s *Server) redactDebugObject(obj map[string]any) map[string]any {
+	dataType, _ := obj["pii_type"].(string)
+	if dataType == "" {
+		dataType, _ = obj["data_type"].(string)
+	}
+	dataType = strings.ToUpper(strings.TrimSpace(dataType))
+	for k, v := range obj {
+		switch {
+		case debugPIIKeys[k]:
+			obj[k] = s.redactDebugValue(v, func(pv string) any {
+				return "blind:" + s.blindHash(dataType, common.NormalizePII(dataType, strings.TrimSpace(pv)))
+			})
+		case debugSafeKeys[k]:
+			obj[k] = s.redactDebugValue(v, func(sv string) any { return sv })
+		default:
+			obj[k] = s.redactDebugValue(v, func(string) any { return "[redacted]" })
+		}
+	}
+	return obj
+}
+
+// redactDebugValue applies str to the strings of v; nested objects are redacted by their own
+// keys.
+func (s *Server) redactDebugValue(v any, str func(string) any) any {
+	switch t := v.(type) {
+	case string:
+		return str(t)
+	case []any:
+		for i := range t {
+			t[i] = s.redactDebugValue(t[i], str)
+		}
+		return t
+	case map[string]any:
+		return s.redactDebugObject(t)
+	}
+	// numbers, booleans and null
+	return v
+}
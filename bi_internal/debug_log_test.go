@@ -0,0 +1,42 @@
+package bi_internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalDebugBodyRedactsNestedValues(t *testing.T) {
+	s := &Server{}
+	s.keys.Store(&keyMaterial{hmac: []byte("0123456789abcdef0123456789abcdef")})
+
+	secrets := []string{"ABCDE1234F", "9876543210", "a@example.com", "postgres://u:p@db/x", "https://internal/put", "id = 'ABCDE1234F'"}
+	bodies := map[string]string{
+		"tokenize":       `{"pii_type":"PAN","pii_value":"ABCDE1234F"}`,
+		"tokenize batch": `{"pii_type":"MOBILE","pii_values":["9876543210","a@example.com"]}`,
+		"nested items":   `{"items":[{"pii_type":"EMAIL","pii_value":"a@example.com"},{"data_type":"MOBILE","value":"9876543210"}]}`,
+		"bulk tokenize":  `{"src_dsn":"postgres://u:p@db/x","src_table":"customers","src_column":"pan","pii_type":"PAN","export_url":"https://internal/put","where":"id = 'ABCDE1234F'"}`,
+		"profile":        `{"name":"crm","dsn":"postgres://u:p@db/x","options":{"url":"https://internal/put"}}`,
+	}
+	for name, body := range bodies {
+		out, ok := s.canonicalDebugBody([]byte(body))
+		if !ok {
+			t.Fatalf("%s: body not logged", name)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(string(out), secret) {
+				t.Errorf("%s: %s leaked into %s", name, secret, out)
+			}
+		}
+	}
+
+	out, _ := s.canonicalDebugBody([]byte(bodies["bulk tokenize"]))
+	for _, kept := range []string{`"src_table":"customers"`, `"src_column":"pan"`, `"pii_type":"PAN"`} {
+		if !strings.Contains(string(out), kept) {
+			t.Errorf("structural field %s missing from %s", kept, out)
+		}
+	}
+	out, _ = s.canonicalDebugBody([]byte(bodies["tokenize"]))
+	if want := `"pii_value":"blind:` + s.blindHash("PAN", "ABCDE1234F") + `"`; !strings.Contains(string(out), want) {
+		t.Errorf("pii_value not replaced by its blind hash: %s", out)
+	}
+}
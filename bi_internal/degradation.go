@@ -0,0 +1,153 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Degraded subsystems and the impact mode the server runs them in.
+const (
+	subsystemCache          = "cache"
+	subsystemDatabase       = "database"
+	subsystemAuditSink      = "audit_sink"
+	subsystemChangeJournal  = "change_journal"
+	subsystemUsageCounters  = "usage_counters"
+	subsystemKeyUsage       = "key_usage"
+	subsystemTenantSettings = "tenant_settings"
+	subsystemOIDCKeys       = "oidc_jwks"
+	subsystemWrites         = "writes"
+
+	// impactDatabaseFallback: lookups skip the cache and go to the database
+	impactDatabaseFallback = "database_fallback"
+	// impactBuffering: records are held in memory and retried
+	impactBuffering = "buffering"
+	// impactStale: the last loaded copy keeps being used
+	impactStale = "stale"
+	// impactReadOnly: writes are rejected with 503
+	impactReadOnly = "read_only"
+	// impactUnavailable: requests needing the subsystem fail
+	impactUnavailable = "unavailable"
+)
+
+// Degradation is one subsystem that is currently degraded.
+type Degradation struct {
+	Subsystem string    `json:"subsystem"`
+	Impact    string    `json:"impact"`
+	Reason    string    `json:"reason"`
+	Since     time.Time `json:"since"`
+	// DurationSeconds is how long the subsystem has been degraded at report time
+	DurationSeconds int64 `json:"duration_seconds"`
+	// Occurrences counts the failures seen since the subsystem degraded
+	Occurrences int64 `json:"occurrences"`
+}
+
+// degradationTracker records which subsystems are degraded since when. Subsystems report
+// failures with set and successes with clear; the first failure starts the clock and the
+// first success afterwards logs the recovery. A nil tracker ignores everything.
+type degradationTracker struct {
+	mu     sync.Mutex
+	active map[string]*Degradation
+	// n is len(active), so clear on the hot path (cache lookups) skips the lock when healthy
+	n atomic.Int32
+}
+
+func newDegradationTracker() *degradationTracker {
+	return &degradationTracker{active: map[string]*Degradation{}}
+}
+
+func (d *degradationTracker) set(subsystem, impact, reason string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cur, ok := d.active[subsystem]; ok {
+		cur.Impact, cur.Reason = impact, reason
+		cur.Occurrences++
+		return
+	}
+	d.active[subsystem] = &Degradation{Subsystem: subsystem, Impact: impact, Reason: reason, Since: time.Now().UTC(), Occurrences: 1}
+	d.n.Store(int32(len(d.active)))
+	slog.Warn("subsystem degraded", "subsystem", subsystem, "impact", impact, "reason", reason)
+}
+
+func (d *degradationTracker) clear(subsystem string) {
+	if d == nil || d.n.Load() == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cur, ok := d.active[subsystem]
+	if !ok {
+		return
+	}
+	delete(d.active, subsystem)
+	d.n.Store(int32(len(d.active)))
+	slog.Info("subsystem recovered", "subsystem", subsystem, "degraded_for", time.Since(cur.Since).Round(time.Second).String())
+}
+
+// track is set on err and clear otherwise.
+func (d *degradationTracker) track(subsystem, impact string, err error) {
+	if err != nil {
+		d.set(subsystem, impact, err.Error())
+		return
+	}
+	d.clear(subsystem)
+}
+
+// snapshot returns the degraded subsystems, longest degraded first.
+func (d *degradationTracker) snapshot() []Degradation {
+	out := []Degradation{}
+	if d == nil {
+		return out
+	}
+	now := time.Now()
+	d.mu.Lock()
+	for _, cur := range d.active {
+		c := *cur
+		c.DurationSeconds = int64(now.Sub(c.Since).Seconds())
+		out = append(out, c)
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+// probeDependencies pings the database and Redis, so the report reflects them even when no
+// traffic has touched them lately.
+func (s *Server) probeDependencies(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	s.degradation.track(subsystemDatabase, impactUnavailable, s.store.DB().PingContext(ctx))
+	if s.cache != nil {
+		s.degradation.track(subsystemCache, impactDatabaseFallback, s.cache.client.Ping(ctx).Err())
+	}
+}
+
+// GET /admin/degradation
+// Reports which subsystems of this instance are degraded, since when and in which impact mode
+// it runs them, after probing the database and Redis.
+func (s *Server) degradationHandler(w http.ResponseWriter, r *http.Request) {
+	s.probeDependencies(r.Context())
+	subsystems := s.degradation.snapshot()
+	resp := map[string]interface{}{
+		"instance":   s.instanceID,
+		"state":      stateNames[s.state.Load()],
+		"degraded":   len(subsystems) > 0,
+		"subsystems": subsystems,
+		"checked_at": time.Now().UTC(),
+	}
+	if s.audit != nil {
+		s.audit.mu.Lock()
+		resp["audit_pending"] = len(s.audit.pending)
+		s.audit.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
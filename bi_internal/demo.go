@@ -0,0 +1,81 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// maxDemoCount bounds one /demo/generate call.
+const maxDemoCount = 1000
+
+// demoSourceSystem tags demo tokens in pii_token_sources so they can be told apart from real data.
+const demoSourceSystem = "synthetic-demo"
+
+// demoTenant owns every demo token, whoever calls: its tenant-bound blind indexes keep demo
+// values apart from the tokens of real tenants and global tokens, even when a random value
+// happens to be a real one.
+const demoTenant = "synthetic-demo"
+
+// demoEnabled reports DEMO_ENDPOINTS_ENABLED; the endpoint writes to the vault, so it is only
+// for non-production environments.
+func demoEnabled() bool {
+	return strings.EqualFold(common.MaybeEnv("DEMO_ENDPOINTS_ENABLED"), "true")
+}
+
+type DemoSample struct {
+	PIIValue string `json:"pii_value"`
+	FPT      string `json:"fpt"`
+}
+
+type DemoGenerateResponse struct {
+	DataType  string       `json:"data_type"`
+	Synthetic bool         `json:"synthetic"`
+	Samples   []DemoSample `json:"samples"`
+}
+
+// POST /demo/generate?type=PAN&count=100
+// Admin only, non-production only (DEMO_ENDPOINTS_ENABLED=true). Generates format-valid
+// synthetic values, tokenizes them for the synthetic-demo tenant (tagged with source system
+// "synthetic-demo") and returns both, for end-to-end tests without real customer data.
+func (s *Server) demoGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	dataType := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("type")))
+	count := 10
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxDemoCount {
+			writeJSONError(w, http.StatusBadRequest, "count must be between 1 and "+strconv.Itoa(maxDemoCount))
+			return
+		}
+		count = n
+	}
+
+	ctx := context.WithValue(r.Context(), tenantIDKey, demoTenant)
+	resp := DemoGenerateResponse{DataType: dataType, Synthetic: true, Samples: make([]DemoSample, 0, count)}
+	for i := 0; i < count; i++ {
+		value, err := common.SyntheticPII(dataType)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "type must be PAN, AADHAR or MOBILE")
+			return
+		}
+		fpt, err := s.Tokenize(ctx, dataType, value)
+		if err != nil {
+			log.Printf("demo generate: tokenize error: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		blind := s.storedBlindIndex(ctx, dataType, value)
+		if err := s.store.RecordTokenSource(blind, dataType, demoTenant, demoSourceSystem); err != nil {
+			log.Printf("demo generate: record source system failed: %v", err)
+		}
+		resp.Samples = append(resp.Samples, DemoSample{PIIValue: value, FPT: fpt})
+	}
+	auditEvent(ctx, "demo.generated", "data_type", dataType, "count", count)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
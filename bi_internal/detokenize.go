@@ -4,15 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
+	"regexp"
 	"strings"
 
-	"bi_pii_tokenizer/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"bi_pii_tokenizer/models"
 )
 
 type DetokenizeRequest struct {
 	FPT string `json:"fpt"`
+	// CacheOnly answers from the cache only; a cache miss returns 404 without a DB lookup.
+	CacheOnly bool `json:"cache_only,omitempty"`
 }
 
 type DetokenizeResponse struct {
@@ -30,56 +36,251 @@ func (s *Server) detokenizeHandler(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "fpt required")
 		return
 	}
-	val, err := s.Detokenize(r.Context(), req.FPT)
+	if !s.validFPTFormat(req.FPT) {
+		writeJSONErrorCode(w, http.StatusUnprocessableEntity, DetokenizeMalformedToken, "malformed fpt")
+		return
+	}
+	if !s.checkExpectedKeyVersion(w, r) {
+		return
+	}
+	charge, err := s.chargeQuota(r.Context(), quotaDetokenize, 1)
+	if err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+	val, err := s.detokenize(r.Context(), req.FPT, req.CacheOnly)
 	if err != nil {
+		s.refundQuota(r.Context(), charge, 1)
 		if err == ErrTokenNotFound {
-			writeJSONError(w, http.StatusNotFound, "token not found")
+			writeJSONErrorCode(w, http.StatusNotFound, DetokenizeTokenNotFound, "token not found")
 			return
 		}
-		log.Printf("detokenize error: %v", err)
+		if err == ErrTokenNotCached {
+			writeJSONErrorCode(w, http.StatusNotFound, DetokenizeTokenNotCached, "token not cached")
+			return
+		}
+		if err == ErrTokenShredded {
+			writeJSONErrorCode(w, http.StatusGone, DetokenizeTokenShredded, err.Error())
+			return
+		}
+		if err == ErrTokenForbidden {
+			writeJSONErrorCode(w, http.StatusForbidden, DetokenizeTokenForbidden, "token belongs to another tenant")
+			return
+		}
+		if err == ErrGlobalFallbackDenied || err == ErrTypeNotAllowed {
+			writeJSONErrorCode(w, http.StatusForbidden, DetokenizePolicyDenied, err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "detokenize failed", "error", err)
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
 	json.NewEncoder(w).Encode(DetokenizeResponse{PIIValue: val})
 }
 
+// Detokenize failure codes, returned as "code" next to the error message so clients can
+// branch on them instead of on the message.
+const (
+	DetokenizeMalformedToken = "malformed_token"
+	DetokenizeTokenNotFound  = "token_not_found"
+	DetokenizeTokenNotCached = "token_not_cached"
+	DetokenizeTokenShredded  = "token_shredded"
+	DetokenizeTokenForbidden = "token_forbidden"
+	DetokenizePolicyDenied   = "policy_denied"
+)
+
 var ErrTokenNotFound = errors.New("token not found")
 
+// ErrTokenForbidden is returned when the token belongs to another tenant and no active
+// sharing grant covers the caller.
+var ErrTokenForbidden = errors.New("token belongs to another tenant")
+
+// ErrTokenNotCached is returned by cache-only detokenize on a cache miss.
+var ErrTokenNotCached = errors.New("token not cached")
+
+var (
+	panFPTRE    = regexp.MustCompile(`^[A-Z]{5}[0-9]{4}[A-Z]$`)
+	aadharFPTRE = regexp.MustCompile(`^[0-9]{12}$`)
+	mobileFPTRE = regexp.MustCompile(`^\+[0-9]{8,15}$`)
+)
+
+// dataTypeForFPT infers the cache key family of a token from its format; the cache is keyed
+// by data type but detokenize requests only carry the token.
+func dataTypeForFPT(fpt string) string {
+	switch {
+	case aadharFPTRE.MatchString(fpt):
+		return "AADHAR"
+	case mobileFPTRE.MatchString(fpt):
+		return "MOBILE"
+	}
+	return "PAN"
+}
+
+// looksLikeToken reports whether v has the format of a token of any supported data type.
+func looksLikeToken(v string) bool {
+	return panFPTRE.MatchString(v) || aadharFPTRE.MatchString(v) || mobileFPTRE.MatchString(v)
+}
+
+// maxFPTLength caps the tokens detokenize accepts. Tokens have the length of their value, and
+// the unique fpt index refuses rows past 2704 bytes, so no longer token was ever issued.
+const maxFPTLength = 2704
+
+var (
+	// base36FPTRE is a token of any other data type under the hash generators
+	base36FPTRE = regexp.MustCompile(`^[0-9A-Z]+$`)
+	// emailDomainRE is the domain an EMAIL token keeps from its value
+	emailDomainRE = regexp.MustCompile(`^[^@\s\p{C}]+$`)
+)
+
+// validFPTFormat reports whether fpt has the shape of a token this service issues: a PAN,
+// AADHAR or MOBILE token (token prefixes keep those formats), a base36 token, or a token over
+// a TOKEN_ALPHABET_<TYPE> or FF1 alphabet, optionally followed by the "@domain" an EMAIL token
+// keeps. Anything else was never issued and is refused before any lookup.
+func (s *Server) validFPTFormat(fpt string) bool {
+	if fpt == "" || len(fpt) > maxFPTLength {
+		return false
+	}
+	if looksLikeToken(fpt) || base36FPTRE.MatchString(fpt) || s.generators.inTokenAlphabet(fpt) {
+		return true
+	}
+	at := strings.LastIndex(fpt, "@")
+	return at > 0 && emailDomainRE.MatchString(fpt[at+1:]) &&
+		(base36FPTRE.MatchString(fpt[:at]) || s.generators.inTokenAlphabet(fpt[:at]))
+}
+
 func (s *Server) Detokenize(ctx context.Context, fpt string) (string, error) {
+	return s.detokenize(ctx, fpt, false)
+}
+
+// detokenize resolves fpt via cache then DB. With cacheOnly a cache miss returns
+// ErrTokenNotCached immediately, for latency-critical callers that prefer a miss. The tenant
+// policy's allowed types and masking apply to the result.
+func (s *Server) detokenize(ctx context.Context, fpt string, cacheOnly bool) (val string, err error) {
+	ctx, span := startSpan(ctx, "detokenize", attribute.Bool("cache_only", cacheOnly))
+	defer func() { endSpan(span, err) }()
+	auditType := dataTypeForFPT(fpt)
+	defer func() { s.recordAudit(ctx, "detokenize", auditType, fpt, err, "") }()
+
 	if strings.TrimSpace(fpt) == "" {
 		return "", ErrTokenNotFound
 	}
 
+	// a token repeated within a batch request skips the lookup and decryption, not the checks
+	memo := lookupMemoFrom(ctx)
+	if m, ok := memo.value(fpt); ok {
+		s.memoLookup("fpt")
+		auditType = m.dataType
+		if err := s.authorizeTokenAccess(ctx, m.owner, m.dataType, fpt); err != nil {
+			return "", err
+		}
+		if err := s.checkTypeAllowed(ctx, m.dataType); err != nil {
+			return "", err
+		}
+		s.recordUsage(ctx, "detokenize", m.dataType)
+		return s.detokenizeOutput(ctx, m.dataType, m.plain), nil
+	}
+
 	// 1) cache lookup fpt -> encrypted_value
-	if s.cache != nil {
-		if encStr, err := s.cache.GetByFPT(ctx, "PAN", fpt); err == nil && encStr != "" {
-			plain, derr := common.AESGCMDecrypt(s.aesKey, encStr)
+	if s.tokens != nil {
+		dataType := dataTypeForFPT(fpt)
+		var encStr, owner string
+		err := traced(ctx, "cache.get_by_fpt", func(ctx context.Context) (err error) {
+			encStr, owner, err = s.tokens.GetByFPTWithOwner(ctx, dataType, fpt)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.hit", err == nil && encStr != ""))
+			return err
+		}, attribute.String("pii.type", dataType))
+		s.cacheLookup("fpt", encStr != "", err)
+		if err == nil && encStr != "" {
+			if err := s.authorizeTokenAccess(ctx, owner, dataType, fpt); err != nil {
+				return "", err
+			}
+			if err := s.checkTypeAllowed(ctx, dataType); err != nil {
+				return "", err
+			}
+			var plain []byte
+			derr := traced(ctx, "cipher.decrypt", func(ctx context.Context) (err error) {
+				plain, err = s.cipher.Decrypt(ctx, "", encStr)
+				return err
+			})
 			if derr != nil {
 				return "", derr
 			}
-			return string(plain), nil
+			memo.setValue(fpt, memoizedValue{dataType: dataType, owner: owner, plain: string(plain)})
+			s.recordUsage(ctx, "detokenize", dataType)
+			return s.detokenizeOutput(ctx, dataType, string(plain)), nil
 		}
 		// on cache error fallthrough
 	}
+	if cacheOnly {
+		return "", ErrTokenNotCached
+	}
 
 	// 2) DB lookup
-	pt, err := s.store.GetByFPT(fpt)
+	var pt *models.PiiToken
+	err = traced(ctx, "store.get_by_fpt", func(context.Context) (err error) {
+		pt, err = s.store.GetByFPT(ctx, fpt)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	if pt == nil {
 		return "", ErrTokenNotFound
 	}
+	auditType = pt.DataType
 
 	// write-back to cache
-	if s.cache != nil {
-		_ = s.cache.SetByFPT(ctx, pt.DataType, pt.FPT, pt.EncryptedValue)
-		_ = s.cache.SetByBlindIndex(ctx, pt.DataType, pt.BlindIndex, pt.FPT)
+	if s.tokens != nil {
+		_ = s.tokens.SetByFPT(ctx, pt.DataType, pt.FPT, pt.TenantID, pt.EncryptedValue)
+		_ = s.tokens.SetByBlindIndex(ctx, pt.DataType, pt.BlindIndex, pt.FPT)
 	}
 
-	plain, err := common.AESGCMDecrypt(s.aesKey, string(pt.EncryptedValue))
+	if err := s.authorizeTokenAccess(ctx, pt.TenantID, pt.DataType, pt.FPT); err != nil {
+		return "", err
+	}
+	if err := s.checkTypeAllowed(ctx, pt.DataType); err != nil {
+		return "", err
+	}
+
+	var plain []byte
+	err = traced(ctx, "cipher.decrypt", func(ctx context.Context) (err error) {
+		plain, err = s.decryptToken(ctx, pt)
+		return err
+	}, attribute.String("key_version", pt.KeyVersion))
 	if err != nil {
 		return "", err
 	}
-	return string(plain), nil
+	memo.setValue(fpt, memoizedValue{dataType: pt.DataType, owner: pt.TenantID, plain: string(plain)})
+	s.recordUsage(ctx, "detokenize", pt.DataType)
+	return s.detokenizeOutput(ctx, pt.DataType, string(plain)), nil
+}
+
+// authorizeTokenAccess allows tokens owned by the caller's tenant, and global tokens unless the
+// data type is strictly tenant-isolated (TENANT_GLOBAL_FALLBACK). Access to
+// another tenant's token requires an active sharing grant, which is consumed and audited, except
+// when redeeming a reveal token whose minting consumed it (withRevealedToken).
+func (s *Server) authorizeTokenAccess(ctx context.Context, owner, dataType, fpt string) error {
+	caller := TenantFromContext(ctx)
+	if owner == "" {
+		return s.checkGlobalFallback(ctx, owner, dataType, fpt)
+	}
+	if owner == caller {
+		return nil
+	}
+	if caller != "" {
+		if revealed, _ := ctx.Value(revealedTokenKey).(string); revealed == fpt {
+			// the grant was consumed when the reveal token was minted
+			return nil
+		}
+		g, err := s.store.UseGrant(ctx, owner, caller, dataType, grantOperationDetokenize, fpt)
+		if err != nil {
+			return err
+		}
+		if g != nil {
+			auditEvent(ctx, "grant.used", "grant_id", g.ID, "owner_tenant", owner, "data_type", dataType, "fpt", fpt)
+			return nil
+		}
+	}
+	auditEvent(ctx, "grant.denied", "owner_tenant", owner, "data_type", dataType, "fpt", fpt)
+	return ErrTokenForbidden
 }
@@ -0,0 +1,141 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	defaultBatchMaxSize         = 100000
+	defaultBatchStreamThreshold = 1000
+	batchStreamFlushEvery       = 500
+)
+
+type BatchDetokenizeRequest struct {
+	FPTs []string `json:"fpts"`
+	// CacheOnly answers every item from the cache only (misses return "token not cached").
+	CacheOnly bool `json:"cache_only,omitempty"`
+	// Lenient passes through inputs that are not found and do not look like tokens (mixed
+	// columns during migrations) instead of reporting them as errors.
+	Lenient bool `json:"lenient,omitempty"`
+}
+
+type BatchDetokenizeResult struct {
+	FPT      string `json:"fpt"`
+	PIIValue string `json:"pii_value,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Passthrough marks lenient results whose pii_value is the unchanged input.
+	Passthrough bool `json:"passthrough,omitempty"`
+}
+
+type BatchDetokenizeResponse struct {
+	Results []BatchDetokenizeResult `json:"results"`
+}
+
+func envInt(key string, def int) int {
+	if v := common.MaybeEnv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// batchItemError maps a per-item detokenize error to the message returned to the client.
+func batchItemError(err error) string {
+	switch err {
+	case ErrTokenNotFound:
+		return "token not found"
+	case ErrTokenForbidden:
+		return "token belongs to another tenant"
+	case ErrTokenNotCached:
+		return "token not cached"
+	case ErrGlobalFallbackDenied, ErrTypeNotAllowed, ErrTokenShredded:
+		return err.Error()
+	}
+	slog.Error("batch detokenize item failed", "error", err)
+	return "internal error"
+}
+
+// POST /detokenize/batch
+// Small batches return {"results":[...]}. Batches above BATCH_STREAM_THRESHOLD (or any batch
+// when the client sends Accept: application/x-ndjson) are streamed as NDJSON, one result per
+// line, flushed every few hundred results so memory stays flat for very large batches.
+func (s *Server) batchDetokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchDetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid Body Keep Tokens with fpts key")
+		return
+	}
+	if len(req.FPTs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "fpts required")
+		return
+	}
+	if len(req.FPTs) > s.batchMaxSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "batch too large, max "+strconv.Itoa(s.batchMaxSize))
+		return
+	}
+	if !s.checkExpectedKeyVersion(w, r) {
+		return
+	}
+	charge, err := s.chargeQuota(r.Context(), quotaDetokenize, len(req.FPTs))
+	if err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+	// the whole batch is charged up front so it cannot overrun the quota; tokens that fail,
+	// pass through or are never reached are given back
+	detokenized := 0
+	defer func() { s.refundQuota(r.Context(), charge, len(req.FPTs)-detokenized) }()
+
+	ctx := withLookupMemo(r.Context())
+	detok := func(fpt string) BatchDetokenizeResult {
+		fpt = strings.TrimSpace(fpt)
+		val, err := s.detokenize(ctx, fpt, req.CacheOnly)
+		if err == ErrTokenNotFound && req.Lenient && !looksLikeToken(fpt) {
+			return BatchDetokenizeResult{FPT: fpt, PIIValue: fpt, Passthrough: true}
+		}
+		if err != nil {
+			return BatchDetokenizeResult{FPT: fpt, Error: batchItemError(err)}
+		}
+		detokenized++
+		return BatchDetokenizeResult{FPT: fpt, PIIValue: val}
+	}
+
+	stream := len(req.FPTs) > s.batchStreamThreshold ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if !stream {
+		resp := BatchDetokenizeResponse{Results: make([]BatchDetokenizeResult, 0, len(req.FPTs))}
+		for _, fpt := range req.FPTs {
+			resp.Results = append(resp.Results, detok(fpt))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i, fpt := range req.FPTs {
+		if ctx.Err() != nil {
+			// client went away; stop doing work for nobody
+			return
+		}
+		if err := enc.Encode(detok(fpt)); err != nil {
+			slog.WarnContext(ctx, "batch detokenize: stream write failed", "error", err)
+			return
+		}
+		if flusher != nil && (i+1)%batchStreamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
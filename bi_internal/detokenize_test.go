@@ -0,0 +1,40 @@
+package bi_internal
+
+import (
+	"strings"
+	"testing"
+
+	"bi_pii_tokenizer/common"
+)
+
+func TestValidFPTFormat(t *testing.T) {
+	hash := &Server{generators: newGeneratorRegistry(nil, nil, map[string]string{"NAME": common.AlphabetBase62}, common.TweakPerSegment, false, nil, nil)}
+	ff1 := &Server{generators: newGeneratorRegistry(nil, nil, nil, common.TweakPerSegment, true, nil, nil)}
+	cases := []struct {
+		fpt       string
+		hash, ff1 bool
+	}{
+		{"ABCDE1234F", true, true},
+		{"234567890123", true, true},
+		{"+919876543210", true, true},
+		{"K7Q2ZP0X", true, true},
+		{"Xy7qPz", true, true},
+		{"Xy7qPz@example.com", true, true},
+		{"a.b%c+d@example.com", false, true},
+		{"Jane Q. Public", false, true},
+		{"@example.com", false, true},
+		{"Xy7q@exa mple.com", false, true},
+		{"ABCDE\x001234F", false, false},
+		{"ABCDÉ1234F", false, false},
+		{"", false, false},
+		{strings.Repeat("A", maxFPTLength+1), false, false},
+	}
+	for _, c := range cases {
+		if got := hash.validFPTFormat(c.fpt); got != c.hash {
+			t.Errorf("hash generators: validFPTFormat(%q) = %v, want %v", c.fpt, got, c.hash)
+		}
+		if got := ff1.validFPTFormat(c.fpt); got != c.ff1 {
+			t.Errorf("FF1 generators: validFPTFormat(%q) = %v, want %v", c.fpt, got, c.ff1)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const defaultBackfillBatch = 500
+
+// ciphertextPolicy controls the dual-write rollout of the v2 ciphertext column:
+// ENCRYPTION_DUAL_WRITE=true writes encrypted_value_v2 next to encrypted_value on insert, and
+// ENCRYPTION_READ_PREFERENCE=v2 decrypts from the v2 column when it is present (falling back to
+// v1). The cache keeps holding v1 ciphertext until v1 is retired.
+type ciphertextPolicy struct {
+	dualWrite bool
+	readV2    bool
+}
+
+func ciphertextPolicyFromEnv() ciphertextPolicy {
+	return ciphertextPolicy{
+		dualWrite: strings.EqualFold(common.MaybeEnv("ENCRYPTION_DUAL_WRITE"), "true"),
+		readV2:    strings.EqualFold(common.MaybeEnv("ENCRYPTION_READ_PREFERENCE"), "v2"),
+	}
+}
+
+// encryptV2 returns the v2 ciphertext to dual-write, or nil when dual-write is off.
+func (s *Server) encryptV2(aesKey []byte, dataType, blind string, plaintext []byte) ([]byte, error) {
+	if !s.ciphertext.dualWrite {
+		return nil, nil
+	}
+	enc, err := common.EncryptV2(aesKey, plaintext, common.TokenAAD(dataType, blind))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(enc), nil
+}
+
+// decryptToken decrypts a vault row honouring the read preference: the v2 column with the key
+// ring (the row's key version first), otherwise encrypted_value with the cipher provider.
+func (s *Server) decryptToken(ctx context.Context, pt *models.PiiToken) ([]byte, error) {
+	if s.ciphertext.readV2 && len(pt.EncryptedValueV2) > 0 {
+		return s.open(pt.KeyVersion, func(aesKey []byte) ([]byte, error) {
+			return common.DecryptV2(aesKey, string(pt.EncryptedValueV2), common.TokenAAD(pt.DataType, pt.BlindIndex))
+		})
+	}
+	return s.cipher.Decrypt(ctx, pt.KeyVersion, string(pt.EncryptedValue))
+}
+
+// POST /admin/backfill/encrypted-v2
+// Starts the background backfill of encrypted_value_v2 for existing rows (202). It runs on
+// one replica at a time and can be restarted safely: only rows still missing v2 are touched.
+func (s *Server) backfillV2Handler(w http.ResponseWriter, r *http.Request) {
+	s.adminChange(r.Context(), "backfill.encrypted_v2.started", "instance", s.instanceID)
+	go func() {
+		ran, err := s.RunExclusive(context.Background(), "backfill-encrypted-v2", s.backfillV2)
+		if err != nil {
+			log.Printf("backfill encrypted_v2: %v", err)
+		} else if !ran {
+			log.Println("backfill encrypted_v2 skipped: already running on another replica")
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "backfill started"})
+}
+
+// backfillV2 walks the rows missing a v2 ciphertext in id order, BACKFILL_BATCH_SIZE at a
+// time. The v2 ciphertext is written with the key of the row's v1 ciphertext, so both keep
+// the row's key version. Rows whose v1 ciphertext does not decrypt are logged and skipped.
+func (s *Server) backfillV2(ctx context.Context) error {
+	batch := envInt("BACKFILL_BATCH_SIZE", defaultBackfillBatch)
+	var afterID int64
+	done, skipped := 0, 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.readOnly.Load() {
+			// paused while in maintenance mode
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		rows, err := s.store.TokensMissingV2(afterID, batch)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for i := range rows {
+			pt := &rows[i]
+			afterID = pt.ID
+			plain, key, err := s.keys.Load().open(pt.KeyVersion, func(aesKey []byte) ([]byte, error) {
+				return common.AESGCMDecrypt(aesKey, string(pt.EncryptedValue))
+			})
+			if err != nil {
+				log.Printf("backfill encrypted_v2: token id=%d does not decrypt, skipping: %v", pt.ID, err)
+				skipped++
+				continue
+			}
+			if err := s.countEncryptions(1); err != nil {
+				return err
+			}
+			enc, err := common.EncryptV2(key.key, plain, common.TokenAAD(pt.DataType, pt.BlindIndex))
+			if err != nil {
+				return err
+			}
+			if err := s.store.SetEncryptedV2(pt.ID, []byte(enc)); err != nil {
+				return err
+			}
+			done++
+		}
+		log.Printf("backfill encrypted_v2: %d rows written, %d skipped (last id %d)", done, skipped, afterID)
+	}
+	log.Printf("backfill encrypted_v2 complete: %d rows written, %d skipped", done, skipped)
+	return nil
+}
@@ -0,0 +1,171 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const defaultFF1HSMTimeout = 2 * time.Second
+
+// ff1HSM delegates FF1 to an HSM through a sidecar, for tenants whose token keys may never be
+// in application memory. PKCS#11 has no FF1 mechanism, so the sidecar (next to the HSM
+// client library) runs FF1 with the HSM's AES key and this process only sends numerals:
+//
+//	POST {FF1_HSM_URL}/v1/ff1/encrypt
+//	{"key_label": "...", "radix": 10, "tweak": "<base64>", "numerals": [1, 2, 3]}
+//	-> {"numerals": [7, 0, 4]}
+//
+// FF1_HSM_KEYS selects the HSM key per tenant or HMAC key version, e.g.
+// "tenant:bank=bank-ff1,version:v3=ff1-v3,*=ff1-default"; a tenant entry wins over a version
+// entry, which wins over "*". Tokens of tenants and versions without an entry keep the FF1 key
+// derived from the HMAC key.
+//
+// Env:
+// FF1_HSM_URL (required with FF1_HSM_KEYS) e.g. https://localhost:8443
+// FF1_HSM_KEYS (optional) selector=key_label pairs
+// FF1_HSM_TOKEN (optional, or FF1_HSM_TOKEN_FILE) bearer token of the sidecar
+// FF1_HSM_TIMEOUT_MS (optional, default 2000)
+type ff1HSM struct {
+	url       string
+	token     string
+	byTenant  map[string]string
+	byVersion map[string]string
+	fallback  string
+	client    *http.Client
+}
+
+// ff1HSMFromEnv returns the HSM FF1 settings, nil when FF1_HSM_KEYS is unset. Every key label
+// is probed once so a wrong address, token or label fails at startup; config errors panic,
+// like other startup config errors.
+func ff1HSMFromEnv(ff1 bool) *ff1HSM {
+	spec := strings.TrimSpace(common.MaybeEnv("FF1_HSM_KEYS"))
+	if spec == "" {
+		return nil
+	}
+	if !ff1 {
+		panic("FF1_HSM_KEYS needs FF1 tokens (FIPS_MODE=true)")
+	}
+	h := &ff1HSM{
+		url:       strings.TrimRight(strings.TrimSpace(common.MaybeEnv("FF1_HSM_URL")), "/"),
+		token:     strings.TrimSpace(common.MaybeEnv("FF1_HSM_TOKEN")),
+		byTenant:  map[string]string{},
+		byVersion: map[string]string{},
+		client:    &http.Client{Timeout: time.Duration(envInt("FF1_HSM_TIMEOUT_MS", int(defaultFF1HSMTimeout.Milliseconds()))) * time.Millisecond},
+	}
+	if h.url == "" {
+		panic("FF1_HSM_KEYS needs FF1_HSM_URL")
+	}
+	labels := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		selector, label, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		selector, label = strings.TrimSpace(selector), strings.TrimSpace(label)
+		if !ok || label == "" {
+			panic(fmt.Sprintf("FF1_HSM_KEYS: %q is not selector=key_label", entry))
+		}
+		switch kind, name, _ := strings.Cut(selector, ":"); {
+		case selector == "*":
+			h.fallback = label
+		case kind == "tenant" && name != "":
+			h.byTenant[name] = label
+		case kind == "version" && name != "":
+			h.byVersion[name] = label
+		default:
+			panic(fmt.Sprintf("FF1_HSM_KEYS: unknown selector %q: want tenant:<id>, version:<hmac key version> or *", selector))
+		}
+		labels[label] = true
+	}
+	for label := range labels {
+		probe := &hsmFF1Cipher{hsm: h, label: label, radix: 10}
+		if _, err := probe.Encrypt([]byte("fpt-ff1-v1:probe"), make([]int, 6)); err != nil {
+			panic(fmt.Sprintf("FF1_HSM_KEYS: key %s: %v", label, err))
+		}
+	}
+	log.Printf("FF1 tokens: %d HSM key(s) through %s", len(labels), h.url)
+	return h
+}
+
+// label is the HSM key of tenant's tokens under the HMAC key version ("" = the derived key).
+func (h *ff1HSM) label(tenant, keyVersion string) string {
+	if h == nil {
+		return ""
+	}
+	if l, ok := h.byTenant[tenant]; ok && tenant != "" {
+		return l
+	}
+	if l, ok := h.byVersion[keyVersion]; ok {
+		return l
+	}
+	return h.fallback
+}
+
+// cipher returns the constructor of the FF1 ciphers of one HSM key.
+func (h *ff1HSM) cipher(label string) func(radix int) (common.FF1Cipher, error) {
+	return func(radix int) (common.FF1Cipher, error) {
+		return &hsmFF1Cipher{hsm: h, label: label, radix: radix}, nil
+	}
+}
+
+// hsmFF1Cipher is FF1 over one radix with a key held by the HSM.
+type hsmFF1Cipher struct {
+	hsm   *ff1HSM
+	label string
+	radix int
+}
+
+func (c *hsmFF1Cipher) Encrypt(tweak []byte, x []int) ([]int, error) {
+	if len(x) < common.FF1MinLength(c.radix) {
+		return nil, common.ErrFF1Domain
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"key_label": c.label,
+		"radix":     c.radix,
+		"tweak":     tweak,
+		"numerals":  x,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.hsm.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.hsm.url+"/v1/ff1/encrypt", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.hsm.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.hsm.token)
+	}
+	resp, err := c.hsm.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("hsm ff1: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hsm ff1: status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	var out struct {
+		Numerals []int `json:"numerals"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("hsm ff1: invalid response: %w", err)
+	}
+	if len(out.Numerals) != len(x) {
+		return nil, fmt.Errorf("hsm ff1: %d numerals returned for %d", len(out.Numerals), len(x))
+	}
+	for _, d := range out.Numerals {
+		if d < 0 || d >= c.radix {
+			return nil, fmt.Errorf("hsm ff1: numeral %d out of radix %d", d, c.radix)
+		}
+	}
+	return out.Numerals, nil
+}
@@ -0,0 +1,60 @@
+package bi_internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// fipsMinHMACKeyBits is the shortest HMAC key NIST SP 800-131A accepts (112-bit strength).
+const fipsMinHMACKeyBits = 112
+
+// fipsTLSCipherSuites are the TLS 1.2 suites allowed in FIPS mode: ECDHE with AES-GCM.
+var fipsTLSCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// FIPSMode reports whether crypto is restricted to FIPS-approved primitives: FIPS_MODE=true, or
+// always in a binary built with GOEXPERIMENT=boringcrypto (see fips_boringcrypto.go). Tokens
+// are then FF1-encrypted values (SP 800-38G) instead of being derived from SHA-256, values are
+// encrypted with AES-GCM and blind indexes stay HMAC-SHA256.
+func FIPSMode() bool {
+	return fipsBuild || strings.EqualFold(strings.TrimSpace(common.MaybeEnv("FIPS_MODE")), "true")
+}
+
+// checkFIPSConfig refuses settings that select non-approved crypto in FIPS mode.
+func checkFIPSConfig(km *keyMaterial) error {
+	if v := strings.TrimSpace(common.MaybeEnv("TOKEN_TWEAK_POLICY")); v != "" {
+		return fmt.Errorf("TOKEN_TWEAK_POLICY=%s selects the SHA-256 derived token generator; unset it to use FF1", v)
+	}
+	if v := strings.TrimSpace(common.MaybeEnv("TLS_MIN_VERSION")); v == "1.3" {
+		return errors.New("TLS_MIN_VERSION=1.3: TLS 1.3 cipher suites cannot be restricted to AES-GCM; use 1.2")
+	}
+	return checkFIPSKeys(km)
+}
+
+// checkFIPSKeys rejects HMAC keys below 112 bits of strength, current or previous.
+func checkFIPSKeys(km *keyMaterial) error {
+	if len(km.hmac)*8 < fipsMinHMACKeyBits {
+		return fmt.Errorf("HMAC key of %d bits is below %d", len(km.hmac)*8, fipsMinHMACKeyBits)
+	}
+	for _, k := range km.previousHMAC {
+		if len(k.key)*8 < fipsMinHMACKeyBits {
+			return fmt.Errorf("previous HMAC key %s of %d bits is below %d", k.version, len(k.key)*8, fipsMinHMACKeyBits)
+		}
+	}
+	return nil
+}
+
+// restrictTLSToFIPS limits the listener to TLS 1.2 with ECDHE AES-GCM suites on NIST curves.
+func restrictTLSToFIPS(cfg *tls.Config) {
+	cfg.MinVersion, cfg.MaxVersion = tls.VersionTLS12, tls.VersionTLS12
+	cfg.CipherSuites = fipsTLSCipherSuites
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
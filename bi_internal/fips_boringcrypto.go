@@ -0,0 +1,11 @@
+//go:build boringcrypto
+
+package bi_internal
+
+// A GOEXPERIMENT=boringcrypto build links the BoringCrypto module for AES, SHA-2, HMAC, RSA
+// and ECDSA, and fipsonly restricts every TLS configuration (including outgoing connections to
+// Vault, KMS and the OIDC issuer) to FIPS-approved settings. Such a binary always runs in FIPS
+// mode.
+import _ "crypto/tls/fipsonly"
+
+const fipsBuild = true
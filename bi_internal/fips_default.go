@@ -0,0 +1,6 @@
+//go:build !boringcrypto
+
+package bi_internal
+
+// fipsBuild is false in a regular build: FIPS mode is then opt-in with FIPS_MODE=true.
+const fipsBuild = false
@@ -0,0 +1,263 @@
+package bi_internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"bi_pii_tokenizer/common"
+)
+
+// Token generator versions (X-Token-Generator) per tweak policy.
+const (
+	tokenGeneratorV1 = "fpt-sha256-v1"
+	tokenGeneratorV2 = "fpt-sha256-v2"
+	// tokenGeneratorFF1 encrypts values with FF1 (FIPS mode)
+	tokenGeneratorFF1 = "fpt-ff1-v1"
+)
+
+// tweakPolicyFromEnv reads TOKEN_TWEAK_POLICY: v2 (default) derives every PAN segment from its
+// own tweak, v1 keeps the shared-hash generator for deployments whose integrators pinned its
+// test vectors. Tokens already in the vault are looked up, not regenerated, so they stay valid
+// under either policy. Panics on an unknown policy, like other startup config errors.
+func tweakPolicyFromEnv() common.TweakPolicy {
+	v := common.MaybeEnv("TOKEN_TWEAK_POLICY")
+	if strings.TrimSpace(v) == "" {
+		return common.TweakPerSegment
+	}
+	p, err := common.ParseTweakPolicy(v)
+	if err != nil {
+		panic("TOKEN_TWEAK_POLICY: " + err.Error())
+	}
+	return p
+}
+
+// FPTGenerator produces the token candidates of one tenant, data type and HMAC key version:
+// the generator output followed by the output constraints, in order: the tenant's token
+// prefix, the type-wide constraints, then the preserved characters of the value. Constraints
+// that fix trailing characters (checksums) run after the prefix so it cannot invalidate them.
+// A generator is immutable and safe for concurrent use.
+type FPTGenerator struct {
+	dataType   string
+	keyVersion string
+	prefix     string
+	// tokens derives the raw tokens under the type's TOKEN_ALPHABET_<TYPE> and tweak policy;
+	// tokensErr is set instead when that setup failed
+	tokens    *common.TokenGenerator
+	tokensErr error
+	post      []common.Postprocessor
+	preserve  []int
+	valid     func(dataType, fpt string) bool
+}
+
+// Candidate returns the counter-th token candidate of a value and whether it may be issued;
+// an invalid candidate moves cycle walking on to the next counter.
+func (g *FPTGenerator) Candidate(blind, normalized string, counter int) (string, bool, error) {
+	if g.tokensErr != nil {
+		return "", false, g.tokensErr
+	}
+	fpt, err := g.tokens.Generate(blind, normalized, counter)
+	if err != nil {
+		return "", false, err
+	}
+	return g.constrain(fpt, normalized)
+}
+
+// Candidates is Candidate for many values at once: the counter-th candidate of every
+// (blinds[i], normalized[i]) pair, with per-value errors. The generator setup is shared by the
+// whole batch.
+func (g *FPTGenerator) Candidates(ctx context.Context, blinds, normalized []string, counter int) ([]TokenCandidate, error) {
+	if g.tokensErr != nil {
+		return nil, g.tokensErr
+	}
+	fpts, errs, err := g.tokens.GenerateTokens(ctx, blinds, normalized, counter)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TokenCandidate, len(fpts))
+	for i, fpt := range fpts {
+		if errs[i] != nil {
+			out[i].Err = errs[i]
+			continue
+		}
+		out[i].FPT, out[i].Valid, out[i].Err = g.constrain(fpt, normalized[i])
+	}
+	return out, nil
+}
+
+// TokenCandidate is one value's result of FPTGenerator.Candidates.
+type TokenCandidate struct {
+	FPT   string
+	Valid bool
+	Err   error
+}
+
+// preparedCandidates are the first (counter 0) candidates of a batch, generated in one
+// Candidates call by gen and keyed by blind index.
+type preparedCandidates struct {
+	gen     *FPTGenerator
+	byBlind map[string]TokenCandidate
+}
+
+// withPreparedCandidates lets tokenize take the first candidate of the listed values from
+// byBlind instead of generating it again.
+func withPreparedCandidates(ctx context.Context, gen *FPTGenerator, byBlind map[string]TokenCandidate) context.Context {
+	return context.WithValue(ctx, preparedCandidatesKey, &preparedCandidates{gen: gen, byBlind: byBlind})
+}
+
+// preparedCandidate returns the candidate prepared for blind on ctx, if gen prepared it: a
+// generator rebuilt since (new prefix or key version) generates the candidate itself.
+func preparedCandidate(ctx context.Context, gen *FPTGenerator, blind string, counter int) (TokenCandidate, bool) {
+	p, _ := ctx.Value(preparedCandidatesKey).(*preparedCandidates)
+	if p == nil || p.gen != gen || counter != 0 {
+		return TokenCandidate{}, false
+	}
+	c, ok := p.byBlind[blind]
+	return c, ok
+}
+
+// constrain applies the output constraints to a raw token.
+func (g *FPTGenerator) constrain(fpt, normalized string) (string, bool, error) {
+	var err error
+	if fpt, err = common.ApplyPostprocessors(fpt, g.post...); err != nil {
+		return "", false, err
+	}
+	if len(g.preserve) > 0 {
+		if fpt, err = common.PreservePostprocessor(normalized, g.preserve...)(fpt); err != nil {
+			return "", false, err
+		}
+	}
+	return fpt, g.valid(g.dataType, fpt), nil
+}
+
+type generatorKey struct {
+	tenant, dataType, keyVersion string
+}
+
+// GeneratorRegistry resolves (tenant, data type, HMAC key version) to its FPTGenerator,
+// building each one on first use and caching it. A cached generator is rebuilt when the
+// tenant's token prefix changed, and generators of a replaced key version are dropped.
+type GeneratorRegistry struct {
+	mu   sync.RWMutex
+	gens map[generatorKey]*FPTGenerator
+
+	typePostprocessors map[string][]common.Postprocessor
+	panPreserve        []int
+	alphabets          map[string]string
+	tweak              common.TweakPolicy
+	// ff1 builds FF1 generators keyed from the HMAC key (FIPS mode) instead of tweak policy ones
+	ff1 bool
+	// hsm keeps the FF1 key of selected tenants and key versions in an HSM (FF1_HSM_KEYS)
+	hsm   *ff1HSM
+	valid func(dataType, fpt string) bool
+}
+
+func newGeneratorRegistry(typePostprocessors map[string][]common.Postprocessor, panPreserve []int, alphabets map[string]string, tweak common.TweakPolicy, ff1 bool, hsm *ff1HSM, valid func(dataType, fpt string) bool) *GeneratorRegistry {
+	return &GeneratorRegistry{
+		gens:               map[generatorKey]*FPTGenerator{},
+		typePostprocessors: typePostprocessors,
+		panPreserve:        panPreserve,
+		alphabets:          alphabets,
+		tweak:              tweak,
+		ff1:                ff1,
+		hsm:                hsm,
+		valid:              valid,
+	}
+}
+
+// Version is the X-Token-Generator of the registry's tweak policy, or fpt-ff1-v1.
+func (r *GeneratorRegistry) Version() string {
+	if r.ff1 {
+		return tokenGeneratorFF1
+	}
+	if r.tweak == common.TweakShared {
+		return tokenGeneratorV1
+	}
+	return tokenGeneratorV2
+}
+
+// checkFF1 returns why the normalized value cannot be FF1-tokenized as dataType, or nil;
+// always nil outside FIPS mode.
+func (r *GeneratorRegistry) checkFF1(dataType, normalized string) error {
+	if !r.ff1 {
+		return nil
+	}
+	dataType = strings.ToUpper(dataType)
+	return common.CheckFF1Value(dataType, r.alphabets[dataType], normalized)
+}
+
+// inTokenAlphabet reports whether every character of s is in the TOKEN_ALPHABET_<TYPE> of some
+// data type or, in FIPS mode, in the FF1 alphabet of types without one.
+func (r *GeneratorRegistry) inTokenAlphabet(s string) bool {
+	if r.ff1 && onlyFrom(s, common.AlphabetPrintable) {
+		return true
+	}
+	for _, alphabet := range r.alphabets {
+		if onlyFrom(s, alphabet) {
+			return true
+		}
+	}
+	return false
+}
+
+func onlyFrom(s, alphabet string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(alphabet, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the generator of tenant, dataType and keyVersion with the tenant's current token
+// prefix. hmacKey is the key of keyVersion, from which FF1 generators derive their key.
+func (r *GeneratorRegistry) Get(tenant, dataType, keyVersion, prefix string, hmacKey []byte) *FPTGenerator {
+	dataType = strings.ToUpper(dataType)
+	k := generatorKey{tenant: tenant, dataType: dataType, keyVersion: keyVersion}
+	r.mu.RLock()
+	g, ok := r.gens[k]
+	r.mu.RUnlock()
+	if ok && g.prefix == prefix {
+		return g
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.gens[k]; ok && g.prefix == prefix {
+		return g
+	}
+	g = r.build(tenant, dataType, keyVersion, prefix, hmacKey)
+	for other := range r.gens {
+		if other.tenant == tenant && other.dataType == dataType && other.keyVersion != keyVersion {
+			delete(r.gens, other)
+		}
+	}
+	r.gens[k] = g
+	return g
+}
+
+func (r *GeneratorRegistry) build(tenant, dataType, keyVersion, prefix string, hmacKey []byte) *FPTGenerator {
+	g := &FPTGenerator{dataType: dataType, keyVersion: keyVersion, prefix: prefix, valid: r.valid}
+	if label := r.hsm.label(tenant, keyVersion); r.ff1 && label != "" {
+		g.tokens, g.tokensErr = common.NewFF1TokenGeneratorWith(dataType, r.alphabets[dataType], r.hsm.cipher(label))
+	} else if r.ff1 {
+		g.tokens, g.tokensErr = common.NewFF1TokenGenerator(dataType, r.alphabets[dataType], common.DeriveKey(hmacKey, common.FF1TokenKeyPurpose))
+	} else {
+		g.tokens, g.tokensErr = common.NewTokenGenerator(dataType, r.alphabets[dataType], r.tweak)
+	}
+	if prefix != "" {
+		g.post = append(g.post, common.PrefixPostprocessor(dataType, prefix))
+	}
+	g.post = append(g.post, r.typePostprocessors[dataType]...)
+	if dataType == "PAN" {
+		g.preserve = r.panPreserve
+	}
+	return g
+}
+
+// generator returns the generator for new tokens of dataType for the caller's tenant under
+// the HMAC key version of km.
+func (s *Server) generator(ctx context.Context, dataType string, km *keyMaterial) *FPTGenerator {
+	tenant := TenantFromContext(ctx)
+	return s.generators.Get(tenant, dataType, km.hmacVersion, s.tenantSetting(tenant, dataType).TokenPrefix, km.hmac)
+}
@@ -0,0 +1,132 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/models"
+)
+
+// maxGrantDuration bounds how long a sharing grant may stay valid.
+const maxGrantDuration = 90 * 24 * time.Hour
+
+// maxGrantFPTs bounds the explicit token set a grant may list.
+const maxGrantFPTs = 10000
+
+// grantOperationDetokenize is the only operation a sharing grant can cover.
+const grantOperationDetokenize = "detokenize"
+
+type CreateGrantRequest struct {
+	OwnerTenant   string   `json:"owner_tenant"`
+	GranteeTenant string   `json:"grantee_tenant"`
+	DataType      string   `json:"data_type"`
+	Operation     string   `json:"operation,omitempty"`
+	FPTs          []string `json:"fpts,omitempty"`
+	MaxUses       *int64   `json:"max_uses,omitempty"`
+	TTLSeconds    int64    `json:"ttl_seconds"`
+	Reason        string   `json:"reason"`
+}
+
+// POST /admin/grants
+func (s *Server) createGrantHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateGrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.OwnerTenant = strings.TrimSpace(req.OwnerTenant)
+	req.GranteeTenant = strings.TrimSpace(req.GranteeTenant)
+	req.DataType = strings.ToUpper(strings.TrimSpace(req.DataType))
+	if req.OwnerTenant == "" || req.GranteeTenant == "" || req.DataType == "" {
+		writeJSONError(w, http.StatusBadRequest, "owner_tenant, grantee_tenant and data_type are required")
+		return
+	}
+	req.Operation = strings.ToLower(strings.TrimSpace(req.Operation))
+	if req.Operation == "" {
+		req.Operation = grantOperationDetokenize
+	}
+	if req.Operation != grantOperationDetokenize {
+		writeJSONError(w, http.StatusBadRequest, "operation must be "+grantOperationDetokenize)
+		return
+	}
+	if req.OwnerTenant == req.GranteeTenant {
+		writeJSONError(w, http.StatusBadRequest, "owner_tenant and grantee_tenant must differ")
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl <= 0 || ttl > maxGrantDuration {
+		writeJSONError(w, http.StatusBadRequest, "ttl_seconds must be between 1 and "+strconv.Itoa(int(maxGrantDuration.Seconds())))
+		return
+	}
+	if len(req.FPTs) > maxGrantFPTs {
+		writeJSONError(w, http.StatusBadRequest, "too many fpts in grant")
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "max_uses must be positive")
+		return
+	}
+
+	g, err := s.store.CreateGrant(&models.SharingGrant{
+		OwnerTenant:   req.OwnerTenant,
+		GranteeTenant: req.GranteeTenant,
+		DataType:      req.DataType,
+		Operation:     req.Operation,
+		FPTs:          req.FPTs,
+		MaxUses:       req.MaxUses,
+		Reason:        req.Reason,
+		CreatedBy:     CallerIDFromContext(r.Context()),
+		ExpiresAt:     time.Now().Add(ttl),
+	})
+	if err != nil {
+		log.Printf("create grant error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.adminChange(r.Context(), "grant.created", "grant_id", g.ID, "owner_tenant", g.OwnerTenant,
+		"grantee_tenant", g.GranteeTenant, "data_type", g.DataType, "fpt_count", len(g.FPTs), "expires_at", g.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// GET /admin/grants?owner_tenant=&grantee_tenant=
+func (s *Server) listGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	grants, err := s.store.ListGrants(strings.TrimSpace(q.Get("owner_tenant")), strings.TrimSpace(q.Get("grantee_tenant")))
+	if err != nil {
+		log.Printf("list grants error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"grants": grants})
+}
+
+// DELETE /admin/grants/{id}
+func (s *Server) revokeGrantHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid grant id")
+		return
+	}
+	ok, err := s.store.RevokeGrant(id)
+	if err != nil {
+		log.Printf("revoke grant error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "grant not found or already revoked")
+		return
+	}
+	s.adminChange(r.Context(), "grant.revoked", "grant_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+func TestCreateGrantValidation(t *testing.T) {
+	s := &Server{}
+	for _, body := range []string{
+		`{"owner_tenant":"A","grantee_tenant":"A","data_type":"PAN","ttl_seconds":60}`,
+		`{"owner_tenant":"A","grantee_tenant":"B","data_type":"PAN"}`,
+		`{"owner_tenant":"A","grantee_tenant":"B","data_type":"PAN","ttl_seconds":99999999}`,
+		`{"owner_tenant":"A","grantee_tenant":"B","data_type":"PAN","ttl_seconds":60,"max_uses":0}`,
+		`{"grantee_tenant":"B","data_type":"PAN","ttl_seconds":60}`,
+	} {
+		w := httptest.NewRecorder()
+		s.createGrantHandler(w, httptest.NewRequest(http.MethodPost, "/admin/grants", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestCreateGrantRejectsOtherOperations(t *testing.T) {
+	s := &Server{}
+	for _, op := range []string{"translate", "tokenize", "*"} {
+		body := `{"owner_tenant":"A","grantee_tenant":"B","data_type":"PAN","ttl_seconds":60,"operation":"` + op + `"}`
+		w := httptest.NewRecorder()
+		s.createGrantHandler(w, httptest.NewRequest(http.MethodPost, "/admin/grants", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("operation %q: %d, want 400", op, w.Code)
+		}
+	}
+}
+
+// TestDetokenizeWithSharingGrant needs a Postgres database (TEST_DATABASE_URL).
+func TestDetokenizeWithSharingGrant(t *testing.T) {
+	s, store := newDBTestServer(t)
+	km := s.keys.Load()
+	ctx := context.Background()
+
+	suffix := hex.EncodeToString(randomBytes(t, 8))
+	owner, grantee := "owner-"+suffix, "grantee-"+suffix
+	blind, fpt := "test-grant-"+suffix, "GRANT"+suffix
+	enc, keyVersion, err := s.cipher.Encrypt(ctx, []byte("ABCDE1234F"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := store.InsertToken(ctx, []byte(enc), nil, keyVersion, km.hmacVersion, blind, fpt, "PAN", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.DeleteToken(pt.ID, blind)
+	as := func(tenant string) context.Context { return context.WithValue(ctx, tenantIDKey, tenant) }
+
+	if _, err := s.Detokenize(as(grantee), fpt); err != ErrTokenForbidden {
+		t.Fatalf("detokenize without a grant: %v, want ErrTokenForbidden", err)
+	}
+	two := int64(2)
+	g, err := store.CreateGrant(&models.SharingGrant{OwnerTenant: owner, GranteeTenant: grantee, DataType: "PAN",
+		Operation: grantOperationDetokenize, FPTs: []string{fpt}, MaxUses: &two, Reason: "test", CreatedBy: "test",
+		ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.RevokeGrant(g.ID)
+
+	for i := 0; i < 2; i++ {
+		if v, err := s.Detokenize(as(grantee), fpt); err != nil || v != "ABCDE1234F" {
+			t.Fatalf("detokenize %d under the grant: %q, %v", i+1, v, err)
+		}
+	}
+	if _, err := s.Detokenize(as(grantee), fpt); err != ErrTokenForbidden {
+		t.Errorf("detokenize past max_uses: %v, want ErrTokenForbidden", err)
+	}
+	if _, err := s.Detokenize(as("third-"+suffix), fpt); err != ErrTokenForbidden {
+		t.Errorf("detokenize by a tenant without a grant: %v, want ErrTokenForbidden", err)
+	}
+}
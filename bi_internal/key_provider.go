@@ -0,0 +1,34 @@
+package bi_internal
+
+import (
+	"fmt"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// keyProvider turns a configured key value (AES_KEY_BASE64, HMAC_KEY_BASE64 and the entries of
+// the previous key lists) into the raw key.
+type keyProvider interface {
+	unwrap(value string) ([]byte, error)
+}
+
+// keyProviderFromEnv selects the key provider with KEY_PROVIDER: "env" (default) takes the
+// values as base64 raw keys, "aws-kms" as base64 KMS ciphertext blobs decrypted with AWS KMS.
+func keyProviderFromEnv() (keyProvider, error) {
+	switch p := strings.ToLower(strings.TrimSpace(common.MaybeEnv("KEY_PROVIDER"))); p {
+	case "", "env":
+		return envKeyProvider{}, nil
+	case "aws-kms":
+		return newKMSKeyProvider()
+	default:
+		return nil, fmt.Errorf("invalid KEY_PROVIDER %q: want env or aws-kms", p)
+	}
+}
+
+// envKeyProvider reads raw keys from base64 values.
+type envKeyProvider struct{}
+
+func (envKeyProvider) unwrap(value string) ([]byte, error) {
+	return common.DecodeBase64Key(value)
+}
@@ -0,0 +1,96 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"bi_pii_tokenizer/common"
+)
+
+const kmsDecryptTimeout = 10 * time.Second
+
+// kmsKeyProvider decrypts keys wrapped with AWS KMS (the CiphertextBlob of `aws kms encrypt`
+// or GenerateDataKey), so raw keys never sit in env or secret files. Credentials and region
+// come from the default AWS chain (env, shared config, IRSA, instance role).
+//
+// Env:
+// KMS_KEY_ID (optional) the KMS key every blob must be encrypted under
+// KMS_ENCRYPTION_CONTEXT (optional) "k=v,k=v" encryption context the blobs were encrypted with
+type kmsKeyProvider struct {
+	client *kms.Client
+	keyID  string
+	encCtx map[string]string
+
+	// plain caches decrypted keys per blob, so secret reloads do not call KMS again
+	mu    sync.Mutex
+	plain map[string][]byte
+}
+
+func newKMSKeyProvider() (*kmsKeyProvider, error) {
+	client, keyID, encCtx, err := kmsClientFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("aws-kms key provider: %w", err)
+	}
+	return &kmsKeyProvider{client: client, keyID: keyID, encCtx: encCtx, plain: map[string][]byte{}}, nil
+}
+
+// kmsClientFromEnv returns a KMS client of the default AWS chain with KMS_KEY_ID and the parsed
+// KMS_ENCRYPTION_CONTEXT.
+func kmsClientFromEnv() (*kms.Client, string, map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsDecryptTimeout)
+	defer cancel()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	var encCtx map[string]string
+	if raw := strings.TrimSpace(common.MaybeEnv("KMS_ENCRYPTION_CONTEXT")); raw != "" {
+		encCtx = map[string]string{}
+		for _, pair := range strings.Split(raw, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return nil, "", nil, fmt.Errorf("invalid KMS_ENCRYPTION_CONTEXT entry %q: want key=value", pair)
+			}
+			encCtx[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return kms.NewFromConfig(cfg), strings.TrimSpace(common.MaybeEnv("KMS_KEY_ID")), encCtx, nil
+}
+
+func (p *kmsKeyProvider) unwrap(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	p.mu.Lock()
+	key, ok := p.plain[value]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("KMS ciphertext is not base64: %w", err)
+	}
+	in := &kms.DecryptInput{CiphertextBlob: blob, EncryptionContext: p.encCtx}
+	if p.keyID != "" {
+		in.KeyId = aws.String(p.keyID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsDecryptTimeout)
+	defer cancel()
+	out, err := p.client.Decrypt(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("KMS decrypt: %w", err)
+	}
+
+	p.mu.Lock()
+	p.plain[value] = out.Plaintext
+	p.mu.Unlock()
+	return out.Plaintext, nil
+}
@@ -0,0 +1,238 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const defaultReencryptBatch = 500
+
+// ReencryptStatus is the progress of the re-encryption job on this replica.
+type ReencryptStatus struct {
+	Running bool `json:"running"`
+	// KeyVersion is the version rows are re-encrypted to
+	KeyVersion string     `json:"key_version,omitempty"`
+	Done       int64      `json:"done"`
+	Skipped    int64      `json:"skipped"`
+	LastID     int64      `json:"last_id"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+type reencryptJob struct {
+	mu     sync.Mutex
+	status ReencryptStatus
+}
+
+func (j *reencryptJob) update(fn func(st *ReencryptStatus)) {
+	j.mu.Lock()
+	fn(&j.status)
+	j.mu.Unlock()
+}
+
+func (j *reencryptJob) snapshot() ReencryptStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// reencrypt rewrites every row not encrypted with the current key version, REENCRYPT_BATCH_SIZE
+// rows at a time, then the connection profile DSNs. Rows are decrypted with the cipher provider
+// (the key ring, or Vault for rows already moved there), and both ciphertext columns and the
+// fpt cache entry are replaced. Rows that do not decrypt are logged and skipped. Once no row is
+// left on a previous key, that key can be removed from AES_PREVIOUS_KEYS_BASE64. With
+// CIPHER_PROVIDER=vault-transit this moves locally encrypted rows to Vault.
+func (s *Server) reencrypt(ctx context.Context) error {
+	km := s.keys.Load()
+	target := s.keyVersion()
+	now := time.Now().UTC()
+	s.reencryptJob.update(func(st *ReencryptStatus) {
+		*st = ReencryptStatus{Running: true, KeyVersion: target, StartedAt: &now}
+	})
+	err := s.reencryptTokens(ctx, km, target)
+	if err == nil {
+		err = s.reencryptProfiles(km)
+	}
+	finished := time.Now().UTC()
+	s.reencryptJob.update(func(st *ReencryptStatus) {
+		st.Running, st.FinishedAt = false, &finished
+		if err != nil {
+			st.LastError = err.Error()
+		}
+	})
+	st := s.reencryptJob.snapshot()
+	s.adminChange(ctx, "keys.reencrypt.finished", "key_version", target, "done", st.Done, "skipped", st.Skipped, "error", st.LastError)
+	return err
+}
+
+func (s *Server) reencryptTokens(ctx context.Context, km *keyMaterial, target string) error {
+	batch := envInt("REENCRYPT_BATCH_SIZE", defaultReencryptBatch)
+	var afterID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.readOnly.Load() {
+			// paused while in maintenance mode
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		rows, err := s.store.TokensNotAtKeyVersion(target, afterID, batch)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		var done, skipped int64
+		for i := range rows {
+			pt := &rows[i]
+			afterID = pt.ID
+			ok, err := s.reencryptToken(ctx, km, pt)
+			if err != nil {
+				return err
+			}
+			if ok {
+				done++
+			} else {
+				skipped++
+			}
+		}
+		s.reencryptJob.update(func(st *ReencryptStatus) {
+			st.Done += done
+			st.Skipped += skipped
+			st.LastID = afterID
+		})
+		st := s.reencryptJob.snapshot()
+		log.Printf("reencrypt: %d rows re-encrypted to %s, %d skipped (last id %d)", st.Done, target, st.Skipped, afterID)
+	}
+	return nil
+}
+
+// reencryptToken re-encrypts one row; it reports false for rows that were skipped.
+func (s *Server) reencryptToken(ctx context.Context, km *keyMaterial, pt *models.PiiToken) (bool, error) {
+	plain, err := s.cipher.Decrypt(ctx, pt.KeyVersion, string(pt.EncryptedValue))
+	if err != nil {
+		log.Printf("reencrypt: token id=%d does not decrypt, skipping: %v", pt.ID, err)
+		return false, nil
+	}
+	encryptions := int64(1)
+	if len(pt.EncryptedValueV2) > 0 || s.ciphertext.dualWrite {
+		encryptions++
+	}
+	if err := s.countEncryptions(encryptions); err != nil {
+		return false, err
+	}
+	enc, keyVersion, err := s.cipher.Encrypt(ctx, plain)
+	if err != nil {
+		return false, err
+	}
+	var encV2 []byte
+	if encryptions == 2 {
+		v2, err := common.EncryptV2(km.aes, plain, common.TokenAAD(pt.DataType, pt.BlindIndex))
+		if err != nil {
+			return false, err
+		}
+		encV2 = []byte(v2)
+	}
+	ok, err := s.store.ReencryptToken(pt.ID, pt.KeyVersion, []byte(enc), encV2, keyVersion)
+	if err != nil || !ok {
+		// a row changed concurrently is picked up by the next run
+		return false, err
+	}
+	if s.tokens != nil {
+		_ = s.tokens.SetByFPT(ctx, pt.DataType, pt.FPT, pt.TenantID, []byte(enc))
+	}
+	// the row has a new data key; the old one only still decrypts stale copies
+	if _, err := s.shredTokenKey(pt); err != nil {
+		log.Printf("reencrypt: shred previous data key of token id=%d: %v", pt.ID, err)
+	}
+	return true, nil
+}
+
+func (s *Server) reencryptProfiles(km *keyMaterial) error {
+	profiles, err := s.store.ConnectionProfiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		dsn, key, err := km.open("", func(aesKey []byte) ([]byte, error) {
+			return common.DecryptV2(aesKey, string(p.EncryptedDSN), profileAAD(p.Name))
+		})
+		if err != nil {
+			log.Printf("reencrypt: connection profile %q does not decrypt with any key of the ring, skipping: %v", p.Name, err)
+			continue
+		}
+		if key.version == km.version {
+			continue
+		}
+		enc, err := common.EncryptV2(km.aes, dsn, profileAAD(p.Name))
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetConnectionProfileDSN(p.Name, []byte(enc)); err != nil {
+			return fmt.Errorf("connection profile %q: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// POST /admin/keys/reencrypt
+// Starts re-encrypting the vault to the current key version in the background (202). It runs
+// on one replica at a time and can be restarted safely: only rows on other versions are touched.
+func (s *Server) reencryptHandler(w http.ResponseWriter, r *http.Request) {
+	s.adminChange(r.Context(), "keys.reencrypt.started", "key_version", s.keyVersion(), "instance", s.instanceID)
+	go func() {
+		ran, err := s.RunExclusive(context.Background(), "reencrypt-keys", s.reencrypt)
+		if err != nil {
+			log.Printf("reencrypt: %v", err)
+		} else if !ran {
+			log.Println("reencrypt skipped: already running on another replica")
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "re-encryption started", "key_version": s.keyVersion()})
+}
+
+// GET /admin/keys/reencrypt
+// Row counts per key version (the progress across replicas) plus this replica's job status,
+// and the row counts per HMAC key version of the blind indexes.
+func (s *Server) reencryptStatusHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := s.store.KeyVersionCounts()
+	if err != nil {
+		log.Printf("key version counts error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	hmacCounts, err := s.store.HMACKeyVersionCounts()
+	if err != nil {
+		log.Printf("hmac key version counts error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	var pending int64
+	for _, c := range counts {
+		if c.KeyVersion != s.keyVersion() {
+			pending += c.Rows
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current_key_version":      s.keyVersion(),
+		"key_versions":             counts,
+		"pending_rows":             pending,
+		"job":                      s.reencryptJob.snapshot(),
+		"current_hmac_key_version": s.keys.Load().hmacVersion,
+		"hmac_key_versions":        hmacCounts,
+	})
+}
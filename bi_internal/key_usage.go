@@ -0,0 +1,167 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// ErrCryptoperiodExceeded is returned for new encryptions once the current key version is past
+// its cryptoperiod and KEY_CRYPTOPERIOD_ENFORCE is on; deploying a new key version clears it.
+var ErrCryptoperiodExceeded = errors.New("key cryptoperiod exceeded, rotate to a new key version")
+
+// keyUsage counts AES encryptions per key version and enforces the cryptoperiod: at most
+// KEY_MAX_ENCRYPTIONS encryptions and KEY_MAX_AGE_DAYS days since the version was first used
+// (0 = no limit). Counts are kept in memory and flushed with the usage counters; totals are
+// the flushed cluster-wide value plus this replica's pending count.
+type keyUsage struct {
+	mu       sync.Mutex
+	pending  map[string]int64
+	totals   map[string]models.KeyUsage
+	alerted  map[string]bool
+	maxCount int64
+	maxAge   time.Duration
+	enforce  bool
+}
+
+func newKeyUsage() *keyUsage {
+	return &keyUsage{
+		pending:  map[string]int64{},
+		totals:   map[string]models.KeyUsage{},
+		alerted:  map[string]bool{},
+		maxCount: int64(envInt("KEY_MAX_ENCRYPTIONS", 0)),
+		maxAge:   time.Duration(envInt("KEY_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+		enforce:  strings.EqualFold(common.MaybeEnv("KEY_CRYPTOPERIOD_ENFORCE"), "true"),
+	}
+}
+
+// exceeded reports why a key version with usage u is past its cryptoperiod ("" when it is not).
+func (k *keyUsage) exceeded(u models.KeyUsage) string {
+	if k.maxCount > 0 && u.Encryptions >= k.maxCount {
+		return "max_encryptions"
+	}
+	if k.maxAge > 0 && !u.FirstUsedAt.IsZero() && time.Since(u.FirstUsedAt) >= k.maxAge {
+		return "max_age"
+	}
+	return ""
+}
+
+// exceededLocked is exceeded for the flushed totals plus pending count of version.
+func (k *keyUsage) exceededLocked(version string) string {
+	u := k.totals[version]
+	u.Encryptions += k.pending[version]
+	return k.exceeded(u)
+}
+
+// countEncryptions reserves n encryptions under the current key version. Past the
+// cryptoperiod it alerts once per version and, when enforced, refuses with
+// ErrCryptoperiodExceeded.
+func (s *Server) countEncryptions(n int64) error {
+	version := s.keyVersion()
+	k := s.keyUsage
+	k.mu.Lock()
+	reason := k.exceededLocked(version)
+	if reason != "" && k.enforce {
+		k.mu.Unlock()
+		return ErrCryptoperiodExceeded
+	}
+	k.pending[version] += n
+	alert := reason != "" && !k.alerted[version]
+	if alert {
+		k.alerted[version] = true
+	}
+	k.mu.Unlock()
+
+	if alert {
+		s.alertCryptoperiod(version, reason)
+	}
+	return nil
+}
+
+func (s *Server) alertCryptoperiod(version, reason string) {
+	log.Printf("ALERT: key version %s exceeded its cryptoperiod (%s); rotate the AES/HMAC keys", version, reason)
+	auditEvent(context.Background(), "key.cryptoperiod_exceeded", "key_version", version, "reason", reason, "enforced", s.keyUsage.enforce)
+}
+
+// flushKeyUsage writes pending counts and refreshes the totals of the current key version,
+// which also records its first use. On failure the counts are merged back.
+func (s *Server) flushKeyUsage() {
+	k := s.keyUsage
+	k.mu.Lock()
+	batch := k.pending
+	k.pending = map[string]int64{}
+	k.mu.Unlock()
+	if _, ok := batch[s.keyVersion()]; !ok {
+		batch[s.keyVersion()] = 0
+	}
+
+	var flushErr error
+	defer func() { s.degradation.track(subsystemKeyUsage, impactBuffering, flushErr) }()
+	for version, n := range batch {
+		u, err := s.store.AddKeyUsage(version, n)
+		k.mu.Lock()
+		if err != nil {
+			k.pending[version] += n
+		} else {
+			k.totals[version] = *u
+		}
+		k.mu.Unlock()
+		if err != nil {
+			log.Printf("key usage: flush failed, will retry: %v", err)
+			flushErr = err
+			continue
+		}
+		// the age limit can pass without any encryption on this replica
+		k.mu.Lock()
+		reason := k.exceededLocked(version)
+		alert := reason != "" && version == s.keyVersion() && !k.alerted[version]
+		if alert {
+			k.alerted[version] = true
+		}
+		k.mu.Unlock()
+		if alert {
+			s.alertCryptoperiod(version, reason)
+		}
+	}
+}
+
+// KeyUsageStatus is one key version's usage as reported by the admin endpoint.
+type KeyUsageStatus struct {
+	models.KeyUsage
+	Current  bool   `json:"current"`
+	Exceeded string `json:"exceeded,omitempty"`
+}
+
+// GET /admin/keys/usage
+// Lists encryptions per key version and whether the cryptoperiod is exceeded.
+func (s *Server) keyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.KeyUsages()
+	if err != nil {
+		log.Printf("key usage error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	k := s.keyUsage
+	out := make([]KeyUsageStatus, 0, len(list))
+	k.mu.Lock()
+	for _, u := range list {
+		u.Encryptions += k.pending[u.KeyVersion]
+		out = append(out, KeyUsageStatus{KeyUsage: u, Current: u.KeyVersion == s.keyVersion(), Exceeded: k.exceeded(u)})
+	}
+	k.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"max_encryptions": k.maxCount,
+		"max_age_days":    int(k.maxAge / (24 * time.Hour)),
+		"enforce":         k.enforce,
+		"results":         out,
+	})
+}
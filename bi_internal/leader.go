@@ -0,0 +1,167 @@
+package bi_internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	leaderLockTTL   = 30 * time.Second
+	leaderRenewEach = 10 * time.Second
+)
+
+// leaderLock is a named, exclusive lock shared by all replicas.
+type leaderLock interface {
+	tryAcquire(ctx context.Context) (bool, error)
+	// renew reports false when the lock was lost
+	renew(ctx context.Context) (bool, error)
+	release(ctx context.Context)
+}
+
+// redisLeaderLock holds a SET NX lock with a TTL that the holder keeps renewing.
+type redisLeaderLock struct {
+	cache *Cache
+	name  string
+	owner string
+}
+
+func (l *redisLeaderLock) tryAcquire(ctx context.Context) (bool, error) {
+	return l.cache.AcquireLock(ctx, l.name, l.owner, leaderLockTTL)
+}
+
+func (l *redisLeaderLock) renew(ctx context.Context) (bool, error) {
+	return l.cache.RenewLock(ctx, l.name, l.owner, leaderLockTTL)
+}
+
+func (l *redisLeaderLock) release(ctx context.Context) {
+	if err := l.cache.ReleaseLock(ctx, l.name, l.owner); err != nil {
+		log.Printf("leader: release %s: %v", l.name, err)
+	}
+}
+
+// pgLeaderLock holds a session-level Postgres advisory lock on a dedicated connection;
+// the lock is lost if that connection dies.
+type pgLeaderLock struct {
+	db   *sql.DB
+	name string
+	conn *sql.Conn
+}
+
+func (l *pgLeaderLock) tryAcquire(ctx context.Context) (bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, "leader:"+l.name).Scan(&ok); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !ok {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *pgLeaderLock) renew(ctx context.Context) (bool, error) {
+	if err := l.conn.PingContext(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *pgLeaderLock) release(ctx context.Context) {
+	if l.conn == nil {
+		return
+	}
+	if _, err := l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, "leader:"+l.name); err != nil {
+		log.Printf("leader: release %s: %v", l.name, err)
+	}
+	l.conn.Close()
+	l.conn = nil
+}
+
+func (s *Server) newLeaderLock(job string) leaderLock {
+	if s.cache != nil {
+		return &redisLeaderLock{cache: s.cache, name: job, owner: s.instanceID}
+	}
+	return &pgLeaderLock{db: s.store.DB(), name: job}
+}
+
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newRequestID())
+}
+
+// errLeadershipLost is the cause of the job context when the lock could not be renewed.
+var errLeadershipLost = errors.New("leadership lost")
+
+// RunExclusive runs fn only if this replica wins the job's lock (Redis when configured,
+// otherwise a Postgres advisory lock), so background jobs run once across replicas. The
+// lock is renewed while fn runs; if it is lost, fn's context is cancelled. ran is false
+// when another replica holds the lock.
+func (s *Server) RunExclusive(ctx context.Context, job string, fn func(context.Context) error) (ran bool, err error) {
+	lock := s.newLeaderLock(job)
+	ok, err := lock.tryAcquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("leader: acquire %s: %w", job, err)
+	}
+	if !ok {
+		return false, nil
+	}
+	defer lock.release(context.Background())
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		t := time.NewTicker(leaderRenewEach)
+		defer t.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-t.C:
+				held, err := lock.renew(jobCtx)
+				if jobCtx.Err() != nil {
+					return
+				}
+				if err != nil || !held {
+					log.Printf("leader: lost %s (err=%v), cancelling job", job, err)
+					cancel(errLeadershipLost)
+					return
+				}
+			}
+		}
+	}()
+
+	return true, fn(jobCtx)
+}
+
+// startPeriodicJob runs fn every interval on whichever replica wins the job lock for that
+// tick. It stops when ctx is cancelled.
+func (s *Server) startPeriodicJob(ctx context.Context, job string, interval time.Duration, fn func(context.Context) error) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				ran, err := s.RunExclusive(ctx, job, fn)
+				if err != nil {
+					log.Printf("job %s failed: %v", job, err)
+				} else if ran {
+					log.Printf("job %s completed", job)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server lifecycle states. A standby server has finished its startup checks but does not
+// serve traffic (readiness fails) until it is activated through the admin API.
+const (
+	stateStarting int32 = iota
+	stateStandby
+	stateActive
+)
+
+var stateNames = map[int32]string{
+	stateStarting: "starting",
+	stateStandby:  "standby",
+	stateActive:   "active",
+}
+
+// ReadyPath is the readiness probe path; it is served without an API key.
+const ReadyPath = "/api/fpt-tokenization/ready"
+
+// startup verifies key material against the vault and warms the cache. A shared cache
+// (Redis, memcached) is preloaded by the replica holding the lock only; an in-memory cache by
+// every replica. warmRows limits the warm to the newest rows (0 = everything).
+func (s *Server) startup(ctx context.Context, warmRows int) error {
+	if err := s.verifyKeyMaterial(s.keys.Load()); err != nil {
+		return err
+	}
+	if s.tokens == nil {
+		return nil
+	}
+	preload := func(ctx context.Context) error {
+		return s.tokens.PreloadFromStoreLimit(ctx, s.store, warmRows)
+	}
+	if !s.sharedCache() {
+		if err := preload(ctx); err != nil {
+			log.Printf("warning: cache preload failed: %v", err)
+		}
+		return nil
+	}
+	ran, err := s.RunExclusive(ctx, "cache-preload", preload)
+	if err != nil {
+		log.Printf("warning: cache preload failed: %v", err)
+	} else if !ran {
+		log.Println("cache preload skipped: another replica is preloading")
+	} else {
+		log.Println("cache preload completed")
+	}
+	return nil
+}
+
+// startInStandby runs the startup sequence in the background and parks the server in
+// standby; key verification failure keeps it in "starting" forever (never ready).
+func (s *Server) startInStandby(warmRows int) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+		defer cancel()
+		if err := s.startup(ctx, warmRows); err != nil {
+			log.Printf("standby: startup checks failed, staying not-ready: %v", err)
+			return
+		}
+		s.state.CompareAndSwap(stateStarting, stateStandby)
+		log.Println("standby: startup checks passed, waiting for activation")
+	}()
+}
+
+// activeOnly rejects API traffic with 503 unless the server is active. Health, readiness
+// and admin endpoints stay reachable so operators can inspect and flip the instance.
+func (s *Server) activeOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if s.state.Load() == stateActive ||
+			strings.HasSuffix(p, "/health") || strings.HasSuffix(p, "/ready") || strings.Contains(p, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, http.StatusServiceUnavailable, "service is "+stateNames[s.state.Load()])
+	})
+}
+
+// GET /ready
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	st := s.state.Load()
+	w.Header().Set("Content-Type", "application/json")
+	if st != stateActive {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"state": stateNames[st]})
+}
+
+// POST /admin/activate flips a standby instance to active.
+func (s *Server) activateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.state.CompareAndSwap(stateStandby, stateActive) && s.state.Load() != stateActive {
+		writeJSONError(w, http.StatusConflict, "instance is still "+stateNames[s.state.Load()])
+		return
+	}
+	s.adminChange(r.Context(), "lifecycle.activated", "instance", s.instanceID)
+	s.readyHandler(w, r)
+}
+
+// POST /admin/standby takes an active instance out of rotation.
+func (s *Server) standbyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.state.CompareAndSwap(stateActive, stateStandby) && s.state.Load() != stateStandby {
+		writeJSONError(w, http.StatusConflict, "instance is still "+stateNames[s.state.Load()])
+		return
+	}
+	s.adminChange(r.Context(), "lifecycle.standby", "instance", s.instanceID)
+	s.readyHandler(w, r)
+}
@@ -0,0 +1,86 @@
+package bi_internal
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// logRedacted replaces the value of a redacted log attribute.
+const logRedacted = "[redacted]"
+
+// piiLogKeys are attributes that would hold plaintext PII; they are redacted at every level.
+var piiLogKeys = map[string]bool{"pii_value": true, "value": true, "normalized": true}
+
+// tokenLogKeys are attributes that hold tokens or source row data; they are only written at
+// debug level and redacted above it.
+var tokenLogKeys = map[string]bool{"fpt": true, "token": true, "row_key": true, "body": true}
+
+// InitLogging makes the structured JSON logger the process default, so application logs,
+// including those written through the standard log package, are JSON lines on stdout with
+// "log":"app". LOG_LEVEL (debug, info, warn, error; default info) sets the minimum level.
+// Records logged with a request context carry its request_id, caller_id and tenant; PII
+// attributes are always redacted and token attributes are redacted above debug level.
+func InitLogging() {
+	level := new(slog.LevelVar)
+	if v := strings.TrimSpace(common.MaybeEnv("LOG_LEVEL")); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			slog.Warn("invalid LOG_LEVEL, using info", "log_level", v)
+		}
+	}
+	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(appLogHandler{next: h}).With("log", "app"))
+}
+
+// appLogHandler enriches records with the request identity on ctx and redacts PII and token
+// attributes before they reach the JSON handler.
+type appLogHandler struct {
+	next slog.Handler
+}
+
+func (h appLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h appLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	if ctx != nil {
+		if id := RequestIDFromContext(ctx); id != "" {
+			out.AddAttrs(slog.String("request_id", id))
+		}
+		if c := CallerIDFromContext(ctx); c != "" {
+			out.AddAttrs(slog.String("caller_id", c))
+		}
+		if t := TenantFromContext(ctx); t != "" {
+			out.AddAttrs(slog.String("tenant", t))
+		}
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactLogAttr(a, r.Level))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h appLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	// attributes bound to a logger are written at every level
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactLogAttr(a, slog.LevelInfo)
+	}
+	return appLogHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h appLogHandler) WithGroup(name string) slog.Handler {
+	return appLogHandler{next: h.next.WithGroup(name)}
+}
+
+func redactLogAttr(a slog.Attr, level slog.Level) slog.Attr {
+	if piiLogKeys[a.Key] || (tokenLogKeys[a.Key] && level > slog.LevelDebug) {
+		return slog.String(a.Key, logRedacted)
+	}
+	return a
+}
@@ -0,0 +1,79 @@
+package bi_internal
+
+import (
+	"context"
+	"sync"
+)
+
+// lookupMemoMax bounds the entries a request memo keeps; later values are looked up as usual.
+const lookupMemoMax = 100000
+
+// lookupMemo remembers, for the lifetime of one batch request, the token of every value
+// tokenized and the decrypted value of every token detokenized, so a value repeated across
+// the items or fields of a batch costs one cache/DB lookup. Only successful lookups are kept.
+type lookupMemo struct {
+	mu     sync.Mutex
+	tokens map[string]string        // data type + blind index -> token
+	values map[string]memoizedValue // token -> plaintext
+}
+
+// memoizedValue is a detokenized value with what is needed to authorize it again: a repeat
+// still goes through the tenant, grant and type checks of its caller.
+type memoizedValue struct {
+	dataType, owner, plain string
+}
+
+// withLookupMemo starts a request-scoped memo of blind-index and token lookups on ctx.
+func withLookupMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lookupMemoKey, &lookupMemo{
+		tokens: map[string]string{},
+		values: map[string]memoizedValue{},
+	})
+}
+
+func lookupMemoFrom(ctx context.Context) *lookupMemo {
+	m, _ := ctx.Value(lookupMemoKey).(*lookupMemo)
+	return m
+}
+
+func (m *lookupMemo) token(dataType, blind string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fpt, ok := m.tokens[dataType+":"+blind]
+	return fpt, ok
+}
+
+func (m *lookupMemo) setToken(dataType, blind, fpt string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.tokens) < lookupMemoMax {
+		m.tokens[dataType+":"+blind] = fpt
+	}
+}
+
+func (m *lookupMemo) value(fpt string) (memoizedValue, bool) {
+	if m == nil {
+		return memoizedValue{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[fpt]
+	return v, ok
+}
+
+func (m *lookupMemo) setValue(fpt string, v memoizedValue) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.values) < lookupMemoMax {
+		m.values[fpt] = v
+	}
+}
@@ -0,0 +1,138 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	defaultReadOnlyRetryAfter = 60
+	defaultReadOnlyRefresh    = 5 * time.Second
+)
+
+// ErrReadOnly is returned by write paths while the server is in read-only maintenance mode.
+var ErrReadOnly = errors.New("service is in read-only maintenance mode")
+
+// readOnlyFromEnv reads READ_ONLY (start in read-only mode) and READ_ONLY_RETRY_AFTER_SEC; the
+// mode set with POST /admin/read-only, once loaded, takes precedence.
+func (s *Server) readOnlyFromEnv() {
+	s.readOnly.Store(strings.EqualFold(common.MaybeEnv("READ_ONLY"), "true"))
+	s.readOnlyRetryAfter.Store(int64(envInt("READ_ONLY_RETRY_AFTER_SEC", defaultReadOnlyRetryAfter)))
+	s.trackReadOnly()
+}
+
+// syncReadOnly applies the shared maintenance mode of pii_maintenance, if one was set. On error
+// the current mode is kept.
+func (s *Server) syncReadOnly() {
+	m, err := s.store.MaintenanceMode()
+	if err != nil {
+		log.Printf("maintenance: loading the read-only mode failed, keeping the current mode: %v", err)
+		return
+	}
+	if m == nil {
+		return
+	}
+	s.applyReadOnly(m)
+}
+
+func (s *Server) applyReadOnly(m *models.MaintenanceMode) {
+	if m.RetryAfterSeconds > 0 {
+		s.readOnlyRetryAfter.Store(m.RetryAfterSeconds)
+	}
+	if s.readOnly.Swap(m.ReadOnly) != m.ReadOnly {
+		log.Printf("maintenance: read-only mode %v (set by %s)", m.ReadOnly, m.UpdatedBy)
+	}
+	s.trackReadOnly()
+}
+
+// startReadOnlySync loads the shared maintenance mode and polls it every
+// READ_ONLY_REFRESH_SEC, so a change made on one replica applies on all of them.
+func (s *Server) startReadOnlySync() {
+	s.syncReadOnly()
+	interval := time.Duration(envInt("READ_ONLY_REFRESH_SEC", int(defaultReadOnlyRefresh.Seconds()))) * time.Second
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			s.syncReadOnly()
+		}
+	}()
+}
+
+// trackReadOnly reports read-only mode as degraded writes.
+func (s *Server) trackReadOnly() {
+	if s.readOnly.Load() {
+		s.degradation.set(subsystemWrites, impactReadOnly, "read-only maintenance mode")
+		return
+	}
+	s.degradation.clear(subsystemWrites)
+}
+
+// writeReadOnly answers a rejected write with 503 and Retry-After.
+func (s *Server) writeReadOnly(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.FormatInt(s.readOnlyRetryAfter.Load(), 10))
+	writeJSONError(w, http.StatusServiceUnavailable, ErrReadOnly.Error())
+}
+
+// writeOp guards handlers that only write (bulk, grants, tenant settings, demo data).
+func (s *Server) writeOp(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() {
+			s.writeReadOnly(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type ReadOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+	// RetryAfterSeconds is sent as Retry-After on rejected writes (optional)
+	RetryAfterSeconds int64 `json:"retry_after_seconds,omitempty"`
+}
+
+// POST /admin/read-only toggles read-only maintenance mode on every instance: detokenize and
+// lookups (including tokenize of already tokenized values) keep working, writes return 503.
+// The mode is stored in pii_maintenance; other instances pick it up within
+// READ_ONLY_REFRESH_SEC.
+func (s *Server) readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.RetryAfterSeconds < 0 {
+		writeJSONError(w, http.StatusBadRequest, "retry_after_seconds must not be negative")
+		return
+	}
+	m := &models.MaintenanceMode{ReadOnly: req.Enabled, RetryAfterSeconds: req.RetryAfterSeconds, UpdatedBy: CallerIDFromContext(r.Context())}
+	if m.RetryAfterSeconds == 0 {
+		m.RetryAfterSeconds = s.readOnlyRetryAfter.Load()
+	}
+	if err := s.store.SetMaintenanceMode(m); err != nil {
+		slog.ErrorContext(r.Context(), "maintenance: storing the read-only mode failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.applyReadOnly(m)
+	s.adminChange(r.Context(), "maintenance.read_only", "instance", s.instanceID, "enabled", req.Enabled)
+	s.readOnlyStatusHandler(w, r)
+}
+
+// GET /admin/read-only
+func (s *Server) readOnlyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"read_only":           s.readOnly.Load(),
+		"retry_after_seconds": s.readOnlyRetryAfter.Load(),
+	})
+}
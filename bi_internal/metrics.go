@@ -0,0 +1,177 @@
+package bi_internal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"bi_pii_tokenizer/common"
+)
+
+// MetricsPath is the Prometheus scrape path; like the readiness probe it is served without an
+// API key. No metric carries a PII value, token or tenant.
+const MetricsPath = "/metrics"
+
+// serverMetrics are the Prometheus collectors of one server, registered on their own registry
+// so nothing else in the process leaks into /metrics.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	operations      *prometheus.CounterVec
+	cacheLookups    *prometheus.CounterVec
+	storeDuration   *prometheus.HistogramVec
+	storeErrors     *prometheus.CounterVec
+	bulkRows        *prometheus.CounterVec
+	auditDropped    prometheus.Counter
+	// validationFailures counts rejected input values by code, data type and caller
+	validationFailures *prometheus.CounterVec
+	// rateLimited counts requests rejected by the per-key and per-tenant rate limits
+	rateLimited *prometheus.CounterVec
+	// quotaExceeded counts requests refused by a tenant policy quota
+	quotaExceeded *prometheus.CounterVec
+	// cacheRefreshes counts refresh-ahead reloads of cache entries close to expiry
+	cacheRefreshes *prometheus.CounterVec
+}
+
+// metricsEnabled reports whether /metrics is served (METRICS_DISABLED=true turns it off).
+func metricsEnabled() bool {
+	return !strings.EqualFold(common.MaybeEnv("METRICS_DISABLED"), "true")
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_http_requests_total",
+			Help: "HTTP requests by route template, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pii_http_request_duration_seconds",
+			Help:    "HTTP request latency by route template and method.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"route", "method"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_operations_total",
+			Help: "Successful tokenize, detokenize and delete operations by data type (batch items counted one by one).",
+		}, []string{"operation", "data_type"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_cache_lookups_total",
+			Help: "Token cache lookups by lookup (blind = tokenize, fpt = detokenize) and result (hit, miss, error, memo = repeat answered within the batch request).",
+		}, []string{"lookup", "result"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pii_store_operation_duration_seconds",
+			Help:    "Database store call latency by operation.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"op"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_store_errors_total",
+			Help: "Failed database store calls by operation (not-found lookups excluded).",
+		}, []string{"op"}),
+		bulkRows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_bulk_rows_total",
+			Help: "Source rows of bulk-tokenize runs by result (success, failed).",
+		}, []string{"result"}),
+		auditDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pii_audit_events_dropped_total",
+			Help: "Audit events dropped because the audit buffer was full.",
+		}),
+		validationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_validation_failures_total",
+			Help: "Rejected tokenize input values by validation code, data type (other for unsupported types) and caller id.",
+		}, []string{"code", "data_type", "caller"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_rate_limited_total",
+			Help: "Requests rejected with 429 by the rate limit of the API key or the tenant (scope).",
+		}, []string{"scope"}),
+		quotaExceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_quota_exceeded_total",
+			Help: "Requests refused with 429 by a tenant policy quota, by operation and period (per_day, per_month).",
+		}, []string{"operation", "period"}),
+		cacheRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pii_cache_refreshes_total",
+			Help: "Cache entries reloaded from the database ahead of expiry, by lookup (blind, fpt) and result (refreshed, gone, error, skipped = too many refreshes in flight).",
+		}, []string{"lookup", "result"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.operations, m.cacheLookups, m.storeDuration, m.storeErrors, m.bulkRows, m.auditDropped, m.validationFailures, m.rateLimited, m.quotaExceeded, m.cacheRefreshes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves the registry in the Prometheus exposition format.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeStore is the store's observer: latency of every call, errors per operation.
+func (m *serverMetrics) observeStore(op string, d time.Duration, err error) {
+	m.storeDuration.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		m.storeErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// cacheLookup counts one token cache lookup; found is false on a miss.
+func (s *Server) cacheLookup(lookup string, found bool, err error) {
+	s.degradation.track(subsystemCache, impactDatabaseFallback, err)
+	if s.metrics == nil {
+		return
+	}
+	result := "hit"
+	switch {
+	case err != nil:
+		result = "error"
+	case !found:
+		result = "miss"
+	}
+	s.metrics.cacheLookups.WithLabelValues(lookup, result).Inc()
+}
+
+// cacheRefreshed counts the outcome of one refresh-ahead reload.
+func (s *Server) cacheRefreshed(lookup, result string) {
+	if s.metrics != nil {
+		s.metrics.cacheRefreshes.WithLabelValues(lookup, result).Inc()
+	}
+}
+
+// memoLookup counts a lookup answered by the request memo instead of the cache.
+func (s *Server) memoLookup(lookup string) {
+	if s.metrics != nil {
+		s.metrics.cacheLookups.WithLabelValues(lookup, "memo").Inc()
+	}
+}
+
+// httpMetrics counts and times every routed request per route template (without the API
+// prefix, so label cardinality stays bounded by the route table), method and status.
+func (s *Server) httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := "unmatched"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = strings.TrimPrefix(tpl, apiPathPrefix)
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.metrics.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		s.metrics.requests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
@@ -0,0 +1,178 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// mTLS modes (MTLS_MODE): with "optional" a verified client certificate is one more way to
+// authenticate; with "required" header credentials (API keys, bearer tokens) are refused.
+const (
+	MTLSOptional = "optional"
+	MTLSRequired = "required"
+)
+
+var (
+	// ErrClientCertNotMapped is returned for a verified client certificate whose identities
+	// are not listed in MTLS_CLIENTS.
+	ErrClientCertNotMapped = errors.New("client certificate is not mapped to a caller")
+	// ErrClientCertTenantMismatch is returned when X-Tenant-ID names another tenant than the
+	// certificate's.
+	ErrClientCertTenantMismatch = errors.New("X-Tenant-ID does not match the tenant of the client certificate")
+)
+
+// mtlsClient is what a client certificate identity maps to.
+type mtlsClient struct {
+	callerID string
+	tenant   string
+	scopes   []string
+}
+
+// mtlsConfig is the client certificate authentication of the server: the identity mapping
+// and the scopes only certificate clients get.
+type mtlsConfig struct {
+	mode    string
+	clients map[string]mtlsClient
+	// certOnlyScopes are removed from callers authenticated by a header credential
+	certOnlyScopes []string
+}
+
+// mtlsFromEnv reads the client certificate mapping; nil unless TLS_CLIENT_CA_FILE is set.
+// MTLS_CLIENTS holds comma-separated identity=caller_id:tenant:scope+scope entries, where the
+// identity is a URI, DNS or email SAN or the subject CN and the tenant may be empty, e.g.
+// "spiffe://corp/ns/risk/sa/reporting=reporting::detokenize+reveal". MTLS_CERT_ONLY_SCOPES
+// (e.g. detokenize,reveal) keeps those scopes from API keys and bearer tokens. Panics on
+// invalid settings, like other startup config errors.
+func mtlsFromEnv() *mtlsConfig {
+	if strings.TrimSpace(common.MaybeEnv("TLS_CLIENT_CA_FILE")) == "" {
+		return nil
+	}
+	c := &mtlsConfig{
+		mode:    strings.ToLower(strings.TrimSpace(common.MaybeEnv("MTLS_MODE"))),
+		clients: map[string]mtlsClient{},
+	}
+	switch c.mode {
+	case "":
+		c.mode = MTLSOptional
+	case MTLSOptional, MTLSRequired:
+	default:
+		panic("MTLS_MODE must be optional or required")
+	}
+	for _, entry := range strings.Split(common.MaybeEnv("MTLS_CLIENTS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// URI identities may hold colons; the mapping never holds "="
+		eq := strings.LastIndex(entry, "=")
+		parts := strings.SplitN(entry[eq+1:], ":", 3)
+		if eq <= 0 || len(parts) != 3 || strings.TrimSpace(parts[0]) == "" || parts[2] == "" {
+			panic("MTLS_CLIENTS: entries must be identity=caller_id:tenant:scope+scope")
+		}
+		scopes, err := normalizeScopes(strings.Split(parts[2], "+"))
+		if err != nil {
+			panic("MTLS_CLIENTS: " + err.Error())
+		}
+		c.clients[strings.TrimSpace(entry[:eq])] = mtlsClient{
+			callerID: strings.TrimSpace(parts[0]),
+			tenant:   strings.TrimSpace(parts[1]),
+			scopes:   scopes,
+		}
+	}
+	if v := strings.TrimSpace(common.MaybeEnv("MTLS_CERT_ONLY_SCOPES")); v != "" {
+		scopes, err := normalizeScopes(strings.Split(v, ","))
+		if err != nil {
+			panic("MTLS_CERT_ONLY_SCOPES: " + err.Error())
+		}
+		c.certOnlyScopes = scopes
+	}
+	log.Printf("auth: client certificates %s, %d mapped identities", c.mode, len(c.clients))
+	return c
+}
+
+// certIdentities are the identities of a client certificate in matching order: URI SANs
+// (SPIFFE ids), DNS SANs, email SANs, then the subject CN.
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// verifiedClientCert returns the client certificate the TLS handshake verified, or nil.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// MTLSEnabled reports whether client certificates are verified (TLS_CLIENT_CA_FILE).
+func (s *Server) MTLSEnabled() bool { return s.mtls != nil }
+
+// MTLSRequired reports whether every authenticated request needs a client certificate.
+func (s *Server) MTLSRequired() bool { return s.mtls != nil && s.mtls.mode == MTLSRequired }
+
+// HasClientCert reports whether the request presented a verified client certificate.
+func HasClientCert(r *http.Request) bool { return verifiedClientCert(r) != nil }
+
+// AuthenticateClientCert maps the verified client certificate of a request to its caller id,
+// scopes and tenant. A certificate with a tenant fixes it (ErrClientCertTenantMismatch for an
+// X-Tenant-ID naming another one); without one it acts for no tenant unless it holds
+// ScopeTenantAdmin, which lets it name one in X-Tenant-ID. A
+// certificate none of whose identities is in MTLS_CLIENTS gets ErrClientCertNotMapped.
+func (s *Server) AuthenticateClientCert(r *http.Request) (*http.Request, error) {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return nil, ErrClientCertNotMapped
+	}
+	for _, id := range certIdentities(cert) {
+		c, ok := s.mtls.clients[id]
+		if !ok {
+			continue
+		}
+		ctx, err := bindTenant(r.Context(), r, c.tenant, c.scopes, ErrClientCertTenantMismatch)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, callerIDKey, c.callerID)
+		ctx = context.WithValue(ctx, scopesKey, c.scopes)
+		ctx = context.WithValue(ctx, credentialKey, "cert:"+id)
+		noteIdentity(ctx)
+		return r.WithContext(ctx), nil
+	}
+	auditEvent(r.Context(), "auth.client_cert_rejected", "subject", cert.Subject.String())
+	return nil, ErrClientCertNotMapped
+}
+
+// WithoutCertOnlyScopes drops the MTLS_CERT_ONLY_SCOPES from a request authenticated by an API
+// key or bearer token, so revealing PII needs a client certificate.
+func (s *Server) WithoutCertOnlyScopes(r *http.Request) *http.Request {
+	if s.mtls == nil || len(s.mtls.certOnlyScopes) == 0 {
+		return r
+	}
+	scopes, ok := r.Context().Value(scopesKey).([]string)
+	if !ok {
+		scopes = allScopes
+	}
+	kept := []string{}
+	for _, sc := range scopes {
+		if !slices.Contains(s.mtls.certOnlyScopes, sc) {
+			kept = append(kept, sc)
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), scopesKey, kept))
+}
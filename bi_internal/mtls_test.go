@@ -0,0 +1,64 @@
+package bi_internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestAuthenticateClientCert(t *testing.T) {
+	s := &Server{mtls: &mtlsConfig{mode: MTLSOptional, clients: map[string]mtlsClient{
+		"spiffe://corp/ns/risk/sa/reporting": {callerID: "reporting", tenant: "acme", scopes: []string{ScopeDetokenize}},
+		"ops-console":                        {callerID: "ops", scopes: []string{ScopeDetokenize, ScopeTenantAdmin}},
+	}}}
+	spiffe, _ := url.Parse("spiffe://corp/ns/risk/sa/reporting")
+	withCert := func(cert *x509.Certificate, tenant string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/detokenize", nil)
+		r.Header.Set("X-Tenant-ID", tenant)
+		r.Header.Set("X-Caller-ID", "spoofed")
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return r
+	}
+	reporting := &x509.Certificate{URIs: []*url.URL{spiffe}, Subject: pkix.Name{CommonName: "unmapped-cn"}}
+
+	r, err := s.AuthenticateClientCert(withCert(reporting, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := r.Context()
+	if CallerIDFromContext(ctx) != "reporting" || TenantFromContext(ctx) != "acme" ||
+		credentialFromContext(ctx) != "cert:spiffe://corp/ns/risk/sa/reporting" {
+		t.Errorf("URI SAN mapped to caller %q, tenant %q, credential %q",
+			CallerIDFromContext(ctx), TenantFromContext(ctx), credentialFromContext(ctx))
+	}
+	if scopes, _ := ctx.Value(scopesKey).([]string); !slices.Equal(scopes, []string{ScopeDetokenize}) {
+		t.Errorf("scopes = %v", scopes)
+	}
+
+	if _, err := s.AuthenticateClientCert(withCert(reporting, "other")); err != ErrClientCertTenantMismatch {
+		t.Errorf("X-Tenant-ID naming another tenant: %v, want ErrClientCertTenantMismatch", err)
+	}
+
+	// the subject CN is matched last; a tenant_admin certificate may name the tenant
+	r, err = s.AuthenticateClientCert(withCert(&x509.Certificate{Subject: pkix.Name{CommonName: "ops-console"}}, "globex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx := r.Context(); CallerIDFromContext(ctx) != "ops" || TenantFromContext(ctx) != "globex" || !tenantNamed(ctx) {
+		t.Errorf("CN mapped to caller %q, tenant %q", CallerIDFromContext(ctx), TenantFromContext(ctx))
+	}
+
+	if _, err := s.AuthenticateClientCert(withCert(&x509.Certificate{DNSNames: []string{"unknown.corp"}}, "")); err != ErrClientCertNotMapped {
+		t.Errorf("unmapped certificate: %v, want ErrClientCertNotMapped", err)
+	}
+	if _, err := s.AuthenticateClientCert(withCert(nil, "")); err != ErrClientCertNotMapped {
+		t.Errorf("no certificate: %v, want ErrClientCertNotMapped", err)
+	}
+}
@@ -0,0 +1,370 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"bi_pii_tokenizer/common"
+)
+
+// Auth modes (AUTH_MODE): which credentials the API accepts.
+const (
+	AuthModeAPIKey = "api_key"
+	AuthModeOIDC   = "oidc"
+	AuthModeBoth   = "both"
+)
+
+const (
+	defaultJWKSRefresh   = 60 * time.Minute
+	jwksMinRefetch       = time.Minute
+	defaultOIDCClockSkew = 60
+)
+
+var (
+	// ErrInvalidBearerToken is returned for bearer tokens that fail verification.
+	ErrInvalidBearerToken = errors.New("invalid bearer token")
+	// ErrBearerTokenNoTenant is returned for valid bearer tokens without a tenant claim that
+	// do not hold ScopeTenantAdmin either.
+	ErrBearerTokenNoTenant = errors.New("bearer token has no tenant claim")
+)
+
+// oidcVerifier validates bearer JWTs of one issuer against its JWKS and maps their claims to
+// the tenant, caller id and scopes of the request.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	// claims carrying the tenant, the caller id and the scopes
+	tenantClaim, callerClaim, scopesClaim string
+	// scopePrefix is stripped from token scopes, e.g. "pii:" for pii:tokenize
+	scopePrefix string
+	skew        time.Duration
+	client      *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+	// attemptedAt is the start of the last JWKS fetch, successful or not
+	attemptedAt time.Time
+	// degradation records failing refreshes (the server's tracker)
+	degradation *degradationTracker
+}
+
+// authModeFromEnv reads AUTH_MODE (api_key, oidc or both; default api_key, or both when
+// OIDC_ISSUER is set) and builds the OIDC verifier when the mode accepts bearer tokens. Bearer
+// tokens need OIDC_AUDIENCE: without it any token the issuer signed for another client would
+// do. Panics on invalid settings or an unreachable JWKS, like other startup config errors.
+func authModeFromEnv() (string, *oidcVerifier) {
+	issuer := strings.TrimRight(strings.TrimSpace(common.MaybeEnv("OIDC_ISSUER")), "/")
+	mode := strings.ToLower(strings.TrimSpace(common.MaybeEnv("AUTH_MODE")))
+	switch {
+	case mode == "" && issuer != "":
+		mode = AuthModeBoth
+	case mode == "":
+		mode = AuthModeAPIKey
+	case mode != AuthModeAPIKey && mode != AuthModeOIDC && mode != AuthModeBoth:
+		panic("AUTH_MODE must be api_key, oidc or both")
+	}
+	if mode == AuthModeAPIKey {
+		return mode, nil
+	}
+	if issuer == "" {
+		panic("AUTH_MODE=" + mode + " needs OIDC_ISSUER")
+	}
+	v := &oidcVerifier{
+		issuer:      issuer,
+		audience:    strings.TrimSpace(common.MaybeEnv("OIDC_AUDIENCE")),
+		jwksURL:     strings.TrimSpace(common.MaybeEnv("OIDC_JWKS_URL")),
+		tenantClaim: claimName("OIDC_TENANT_CLAIM", "tenant"),
+		callerClaim: claimName("OIDC_CALLER_CLAIM", "sub"),
+		scopesClaim: claimName("OIDC_SCOPES_CLAIM", "scope"),
+		scopePrefix: strings.TrimSpace(common.MaybeEnv("OIDC_SCOPE_PREFIX")),
+		skew:        time.Duration(envInt("OIDC_CLOCK_SKEW_SEC", defaultOIDCClockSkew)) * time.Second,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		keys:        map[string]crypto.PublicKey{},
+	}
+	if v.audience == "" {
+		panic("AUTH_MODE=" + mode + " needs OIDC_AUDIENCE")
+	}
+	if v.jwksURL == "" {
+		u, err := v.discoverJWKS()
+		if err != nil {
+			panic("OIDC discovery: " + err.Error())
+		}
+		v.jwksURL = u
+	}
+	if err := v.refresh(); err != nil {
+		panic("OIDC JWKS: " + err.Error())
+	}
+	go v.refreshLoop(time.Duration(envInt("OIDC_JWKS_REFRESH_MIN", int(defaultJWKSRefresh.Minutes()))) * time.Minute)
+	log.Printf("auth: mode %s, bearer tokens of %s", mode, issuer)
+	return mode, v
+}
+
+func claimName(key, def string) string {
+	if v := strings.TrimSpace(common.MaybeEnv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// discoverJWKS reads jwks_uri from the issuer's OpenID configuration.
+func (v *oidcVerifier) discoverJWKS() (string, error) {
+	resp, err := v.client.Get(v.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("openid-configuration returned %d", resp.StatusCode)
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+	if strings.TrimRight(doc.Issuer, "/") != v.issuer {
+		return "", fmt.Errorf("issuer mismatch: configured %s, discovered %s", v.issuer, doc.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("openid-configuration has no jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refresh replaces the signing keys with the current JWKS. Keys of unsupported types and
+// encryption keys are skipped.
+func (v *oidcVerifier) refresh() error {
+	v.mu.Lock()
+	v.attemptedAt = time.Now()
+	v.mu.Unlock()
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS returned %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("auth: JWKS key %q skipped: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (v *oidcVerifier) refreshLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		err := v.refresh()
+		v.degradation.track(subsystemOIDCKeys, impactStale, err)
+		if err != nil {
+			log.Printf("auth: JWKS refresh failed, keeping current keys: %v", err)
+		}
+	}
+}
+
+// key returns the signing key kid, refetching the JWKS for an unknown kid so a rotation at
+// the issuer is picked up without waiting for the next refresh. Refetches start at most once a
+// minute, failed ones included, so tokens with made-up kids cannot hammer the issuer.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	pub, ok := v.keys[kid]
+	v.mu.RUnlock()
+	if ok {
+		return pub, nil
+	}
+	v.mu.Lock()
+	due := time.Since(v.attemptedAt) > jwksMinRefetch
+	if due {
+		// claimed here, so concurrent requests for unknown kids refetch once
+		v.attemptedAt = time.Now()
+	}
+	v.mu.Unlock()
+	if due {
+		err := v.refresh()
+		v.degradation.track(subsystemOIDCKeys, impactStale, err)
+		if err != nil {
+			log.Printf("auth: JWKS refetch failed: %v", err)
+		}
+		v.mu.RLock()
+		pub, ok = v.keys[kid]
+		v.mu.RUnlock()
+		if ok {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verify checks the signature, issuer, audience and lifetime of raw and returns its claims.
+func (v *oidcVerifier) verify(raw string) (jwt.MapClaims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.skew),
+		jwt.WithAudience(v.audience),
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// scopes maps the token's scope claim (a space-separated string or a list) to API key scopes
+// and ScopeTenantAdmin; other scopes are ignored.
+func (v *oidcVerifier) scopes(claims jwt.MapClaims) []string {
+	var raw []string
+	switch c := claims[v.scopesClaim].(type) {
+	case string:
+		raw = strings.Fields(c)
+	case []interface{}:
+		for _, s := range c {
+			if str, ok := s.(string); ok {
+				raw = append(raw, str)
+			}
+		}
+	}
+	out := []string{}
+	for _, sc := range raw {
+		sc, ok := strings.CutPrefix(sc, v.scopePrefix)
+		if ok && (slices.Contains(allScopes, sc) || sc == ScopeTenantAdmin) && !slices.Contains(out, sc) {
+			out = append(out, sc)
+		}
+	}
+	return out
+}
+
+// OIDCEnabled reports whether bearer tokens are accepted (AUTH_MODE oidc or both).
+func (s *Server) OIDCEnabled() bool { return s.oidc != nil }
+
+// APIKeysAccepted reports whether X-API-Key credentials are accepted (AUTH_MODE api_key or both).
+func (s *Server) APIKeysAccepted() bool { return s.authMode != AuthModeOIDC }
+
+// AuthenticateBearer verifies a bearer JWT and returns the request with the token's tenant,
+// caller id and scopes. Like a tenant API key, a token with a tenant claim fixes the tenant
+// (ErrAPIKeyTenantMismatch for an X-Tenant-ID naming another one). A token without the claim
+// is refused with ErrBearerTokenNoTenant unless it holds ScopeTenantAdmin, which lets it act
+// for the tenant in X-Tenant-ID. A token without any of the API scopes can call nothing.
+func (s *Server) AuthenticateBearer(r *http.Request, raw string) (*http.Request, error) {
+	claims, err := s.oidc.verify(raw)
+	if err != nil {
+		slog.InfoContext(r.Context(), "bearer token rejected", "error", err)
+		return nil, ErrInvalidBearerToken
+	}
+	scopes := s.oidc.scopes(claims)
+	tenant, _ := claims[s.oidc.tenantClaim].(string)
+	if tenant == "" && !slices.Contains(scopes, ScopeTenantAdmin) {
+		auditEvent(r.Context(), "auth.bearer_no_tenant", "claim", s.oidc.tenantClaim)
+		return nil, ErrBearerTokenNoTenant
+	}
+	ctx, err := bindTenant(r.Context(), r, tenant, scopes, ErrAPIKeyTenantMismatch)
+	if err != nil {
+		return nil, err
+	}
+	if caller, _ := claims[s.oidc.callerClaim].(string); caller != "" {
+		ctx = context.WithValue(ctx, callerIDKey, caller)
+	}
+	ctx = context.WithValue(ctx, scopesKey, scopes)
+	// the issuer is fixed, so the subject names the credential; a token without one counts alone
+	credential := "bearer:token:" + hashAPIKey(raw)[:16]
+	if sub, _ := claims["sub"].(string); sub != "" {
+		credential = "bearer:" + sub
+	}
+	ctx = context.WithValue(ctx, credentialKey, credential)
+	noteIdentity(ctx)
+	return r.WithContext(ctx), nil
+}
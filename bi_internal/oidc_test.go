@@ -0,0 +1,114 @@
+package bi_internal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthenticateBearer(t *testing.T) {
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{oidc: &oidcVerifier{
+		issuer: "https://idp.example.com", audience: "pii-tokenizer",
+		tenantClaim: "tenant", callerClaim: "client_id", scopesClaim: "scope", scopePrefix: "pii:",
+		keys: map[string]crypto.PublicKey{"k1": &signer.PublicKey},
+		// no refetch for unknown kids within the test
+		attemptedAt: time.Now(),
+	}}
+	token := func(key *rsa.PrivateKey, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{"iss": "https://idp.example.com", "aud": "pii-tokenizer", "sub": "svc-123",
+			"client_id": "crm", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range claims {
+			base[k] = v
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, base)
+		tok.Header["kid"] = "k1"
+		raw, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	auth := func(raw, tenantHeader string) (*http.Request, error) {
+		r := httptest.NewRequest(http.MethodPost, "/tokenize", nil)
+		r.Header.Set("X-Tenant-ID", tenantHeader)
+		r.Header.Set("X-Caller-ID", "spoofed")
+		return s.AuthenticateBearer(r, raw)
+	}
+
+	r, err := auth(token(signer, jwt.MapClaims{"tenant": "acme", "scope": "pii:tokenize pii:reveal openid detokenize"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := r.Context()
+	if CallerIDFromContext(ctx) != "crm" || TenantFromContext(ctx) != "acme" || credentialFromContext(ctx) != "bearer:svc-123" {
+		t.Errorf("claims mapped to caller %q, tenant %q, credential %q",
+			CallerIDFromContext(ctx), TenantFromContext(ctx), credentialFromContext(ctx))
+	}
+	if scopes, _ := ctx.Value(scopesKey).([]string); !slices.Equal(scopes, []string{ScopeTokenize, ScopeReveal}) {
+		t.Errorf("scopes = %v, want only the prefixed API scopes", scopes)
+	}
+
+	rejected := []struct {
+		name   string
+		raw    string
+		tenant string
+		want   error
+	}{
+		{"other signing key", token(other, jwt.MapClaims{"tenant": "acme"}), "", ErrInvalidBearerToken},
+		{"other audience", token(signer, jwt.MapClaims{"tenant": "acme", "aud": "another-client"}), "", ErrInvalidBearerToken},
+		{"other issuer", token(signer, jwt.MapClaims{"tenant": "acme", "iss": "https://evil.example.com"}), "", ErrInvalidBearerToken},
+		{"expired", token(signer, jwt.MapClaims{"tenant": "acme", "exp": time.Now().Add(-time.Hour).Unix()}), "", ErrInvalidBearerToken},
+		{"no tenant claim", token(signer, jwt.MapClaims{"scope": "pii:tokenize"}), "", ErrBearerTokenNoTenant},
+		{"X-Tenant-ID of another tenant", token(signer, jwt.MapClaims{"tenant": "acme"}), "globex", ErrAPIKeyTenantMismatch},
+	}
+	for _, c := range rejected {
+		if _, err := auth(c.raw, c.tenant); err != c.want {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	// a tenant_admin token without a tenant claim acts for the tenant it names
+	r, err = auth(token(signer, jwt.MapClaims{"scope": "pii:detokenize pii:" + ScopeTenantAdmin}), "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if TenantFromContext(r.Context()) != "globex" {
+		t.Errorf("tenant_admin token: tenant %q", TenantFromContext(r.Context()))
+	}
+}
+
+func TestJWKSRefetchThrottledAfterFailure(t *testing.T) {
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer jwks.Close()
+	v := &oidcVerifier{jwksURL: jwks.URL, client: jwks.Client(), keys: map[string]crypto.PublicKey{},
+		attemptedAt: time.Now().Add(-2 * jwksMinRefetch)}
+
+	for i := 0; i < 5; i++ {
+		if _, err := v.key("unknown"); err == nil {
+			t.Fatal("unknown kid accepted")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1 while the last attempt failed under a minute ago", n)
+	}
+}
@@ -0,0 +1,132 @@
+package bi_internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// panPreserveFromEnv returns the 0-based PAN positions copied from the value into its token:
+// the holder type (4th character, PAN_PRESERVE_ENTITY_TYPE=true) and the name initial (5th
+// character, PAN_PRESERVE_NAME_INITIAL=true). Preserving the holder type contradicts
+// TOKEN_VALIDITY_PAN=invalid, so that combination panics like other startup config errors.
+func panPreserveFromEnv(validity map[string]string) []int {
+	var positions []int
+	if strings.EqualFold(common.MaybeEnv("PAN_PRESERVE_ENTITY_TYPE"), "true") {
+		if validity["PAN"] == common.ValidityInvalid {
+			panic("PAN_PRESERVE_ENTITY_TYPE=true contradicts TOKEN_VALIDITY_PAN=invalid")
+		}
+		positions = append(positions, 3)
+	}
+	if strings.EqualFold(common.MaybeEnv("PAN_PRESERVE_NAME_INITIAL"), "true") {
+		positions = append(positions, 4)
+	}
+	return positions
+}
+
+// tokenValidityTypes are the data types with a real-world check a validity policy can target.
+var tokenValidityTypes = []string{"AADHAR", "PAN"}
+
+// tokenValidityFromEnv reads TOKEN_VALIDITY_<TYPE> (any, valid or invalid) per data type with a
+// real-world check. AADHAR_TOKEN_CHECKSUM=true is the older spelling of TOKEN_VALIDITY_AADHAR=valid.
+func tokenValidityFromEnv() map[string]string {
+	policies := map[string]string{}
+	for _, dataType := range tokenValidityTypes {
+		if p := strings.ToLower(strings.TrimSpace(common.MaybeEnv("TOKEN_VALIDITY_" + dataType))); p != "" {
+			policies[dataType] = p
+		}
+	}
+	if _, ok := policies["AADHAR"]; !ok && strings.EqualFold(common.MaybeEnv("AADHAR_TOKEN_CHECKSUM"), "true") {
+		policies["AADHAR"] = common.ValidityValid
+	}
+	return policies
+}
+
+// fixedFormatTypes are the data types whose token format is fixed by the type itself.
+var fixedFormatTypes = map[string]bool{"PAN": true, "AADHAR": true, "MOBILE": true}
+
+// tokenAlphabetsFromEnv reads TOKEN_ALPHABET_<TYPE>: the characters tokens of a data type
+// without a fixed format are drawn from (default base36, 0-9A-Z), as a preset (base36, base62,
+// email-local) or a literal alphabet. With an alphabet, EMAIL tokens keep the domain. Panics on
+// invalid alphabets, like other startup config errors.
+func tokenAlphabetsFromEnv() map[string]string {
+	alphabets := map[string]string{}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		dataType, ok := strings.CutPrefix(name, "TOKEN_ALPHABET_")
+		if !ok || dataType == "" || strings.HasSuffix(dataType, "_FILE") {
+			continue
+		}
+		if fixedFormatTypes[dataType] {
+			panic(name + ": " + dataType + " tokens have a fixed format")
+		}
+		alphabet, err := common.ParseTokenAlphabet(common.MaybeEnv(name))
+		if err != nil {
+			panic(name + ": " + err.Error())
+		}
+		if dataType == "EMAIL" && strings.Contains(alphabet, "@") {
+			panic(name + ": EMAIL token alphabets cannot contain @")
+		}
+		alphabets[dataType] = alphabet
+	}
+	return alphabets
+}
+
+// typePostprocessorsFromEnv builds the type-wide constraints: the token validity policies, which
+// make tokens pass (for downstream validators that reject invalid numbers) or deliberately fail
+// their type's real-world check. Panics on an unknown policy, like other startup config errors.
+func typePostprocessorsFromEnv(validity map[string]string) map[string][]common.Postprocessor {
+	pps := map[string][]common.Postprocessor{}
+	for dataType, policy := range validity {
+		pp, err := common.ValidityPostprocessor(dataType, policy)
+		if err != nil {
+			panic("TOKEN_VALIDITY_" + dataType + ": " + err.Error())
+		}
+		if pp != nil {
+			pps[dataType] = append(pps[dataType], pp)
+		}
+	}
+	return pps
+}
+
+// checkPrefixConstraints rejects a token prefix that covers a preserved PAN character, or that
+// fixes the check position of dataType to a value the validity policy forbids (a PAN prefix of
+// 4+ characters); every token would break the prefix or the policy.
+func (s *Server) checkPrefixConstraints(dataType, prefix string) error {
+	dataType = strings.ToUpper(dataType)
+	if dataType == "PAN" {
+		for _, i := range s.panPreserve {
+			if i < len(prefix) {
+				return fmt.Errorf("%w: PAN character %d is preserved from the value", common.ErrInvalidTokenPrefix, i+1)
+			}
+		}
+	}
+	policy := s.tokenValidity[dataType]
+	if dataType != "PAN" || len(prefix) < 4 || (policy != common.ValidityValid && policy != common.ValidityInvalid) {
+		return nil
+	}
+	// only the 4th character matters; pad the rest to a well-formed PAN
+	valid, _ := common.RealWorldValid(dataType, prefix[:4]+"A0000A")
+	if valid != (policy == common.ValidityValid) {
+		return fmt.Errorf("%w: 4th character conflicts with TOKEN_VALIDITY_PAN=%s", common.ErrInvalidTokenPrefix, policy)
+	}
+	return nil
+}
+
+// validTokenOutput is the validity predicate for generated tokens: the built-in rules plus the
+// operator's RESERVED_TOKENS list (comma-separated values tokens must never equal).
+func (s *Server) validTokenOutput(dataType, fpt string) bool {
+	return common.ValidTokenOutput(dataType, fpt) && !s.reservedTokens[fpt]
+}
+
+func reservedTokensFromEnv() map[string]bool {
+	reserved := map[string]bool{}
+	for _, v := range strings.Split(common.MaybeEnv("RESERVED_TOKENS"), ",") {
+		if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+			reserved[v] = true
+		}
+	}
+	return reserved
+}
@@ -0,0 +1,287 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations a tenant policy quota applies to.
+const (
+	quotaTokenize   = "tokenize"
+	quotaDetokenize = "detokenize"
+)
+
+// Quota periods, named by the limit that uses them.
+const (
+	quotaPerDay   = "per_day"
+	quotaPerMonth = "per_month"
+)
+
+// QuotaPolicy bounds the values a tenant tokenizes or detokenizes; zero limits are unset.
+// Counters are shared through Redis and per instance without it.
+type QuotaPolicy struct {
+	// PerDay bounds the values per UTC day
+	PerDay int64 `yaml:"per_day,omitempty" json:"per_day,omitempty"`
+	// PerMonth bounds the values per calendar month (UTC)
+	PerMonth int64 `yaml:"per_month,omitempty" json:"per_month,omitempty"`
+	// SoftPerMonth alerts, once a month, when the month's values reach it
+	SoftPerMonth int64 `yaml:"soft_per_month,omitempty" json:"soft_per_month,omitempty"`
+}
+
+func (q *QuotaPolicy) validate() error {
+	switch {
+	case q == nil:
+		return nil
+	case q.PerDay < 0 || q.PerMonth < 0 || q.SoftPerMonth < 0:
+		return errors.New("limits must not be negative")
+	case q.PerDay == 0 && q.PerMonth == 0 && q.SoftPerMonth == 0:
+		return errors.New("set per_day, per_month or soft_per_month")
+	case q.PerMonth > 0 && q.SoftPerMonth > q.PerMonth:
+		return errors.New("soft_per_month must not exceed per_month")
+	}
+	return nil
+}
+
+// quota returns the tenant's quota of operation (zero when it has none).
+func (ep effectivePolicy) quota(operation string) QuotaPolicy {
+	if operation == quotaTokenize {
+		return ep.tokenizeQuota
+	}
+	return ep.detokenizeQuota
+}
+
+// QuotaExceededError is returned once a tenant used up a quota; the request is refused until
+// the period ends.
+type QuotaExceededError struct {
+	Operation string
+	Period    string
+	Reset     time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Period == quotaPerMonth {
+		return e.Operation + " monthly quota exceeded"
+	}
+	return e.Operation + " quota exceeded"
+}
+
+// quotaPeriod returns the counter suffix, the end of the period and the counter TTL.
+func quotaPeriod(period string, now time.Time) (string, time.Time, time.Duration) {
+	now = now.UTC()
+	if period == quotaPerMonth {
+		return now.Format("2006-01"), time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC), 35 * 24 * time.Hour
+	}
+	return now.Format("2006-01-02"), time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC), 48 * time.Hour
+}
+
+// quotaCounterKey names the counter of tenant and operation in one period.
+func quotaCounterKey(tenant, operation, suffix string) string {
+	if operation == quotaDetokenize && len(suffix) == len("2006-01-02") {
+		// the daily detokenize counter predates the other quotas; keep its key across deploys
+		return tenant + "|" + suffix
+	}
+	return tenant + "|" + operation + "|" + suffix
+}
+
+// addQuotaUsage adds n to a counter and returns its new total.
+func (s *Server) addQuotaUsage(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	if s.cache != nil {
+		return s.cache.IncrQuota(ctx, key, n, ttl)
+	}
+	tp := s.policies
+	tp.quotaMu.Lock()
+	defer tp.quotaMu.Unlock()
+	tp.pruneQuotaLocked(time.Now())
+	tp.quota[key] += n
+	return tp.quota[key], nil
+}
+
+// pruneQuotaLocked drops in-memory counters of past days and months; the caller holds quotaMu.
+func (tp *tenantPolicies) pruneQuotaLocked(now time.Time) {
+	day, _, _ := quotaPeriod(quotaPerDay, now)
+	month, _, _ := quotaPeriod(quotaPerMonth, now)
+	for k := range tp.quota {
+		if !strings.HasSuffix(k, "|"+day) && !strings.HasSuffix(k, "|"+month) {
+			delete(tp.quota, k)
+		}
+	}
+}
+
+// quotaCharge is what chargeQuota counted: the counters it added to, so a refund goes back
+// to the same day and month even across a rollover.
+type quotaCharge struct {
+	keys []string
+	ttls []time.Duration
+}
+
+// chargeQuota counts n values of operation against the tenant's daily and monthly quota and
+// returns a *QuotaExceededError once one is used up; a refused charge is given back before it
+// returns. Crossing soft_per_month alerts once. Operations without a quota are not counted.
+// The tenant is the one bound to the credential (bindTenant), so a caller cannot charge
+// another tenant by naming it. A quota is a usage limit, not an access control: counter
+// errors do not fail requests.
+func (s *Server) chargeQuota(ctx context.Context, operation string, n int) (quotaCharge, error) {
+	var charge quotaCharge
+	p, ok := s.policyFor(ctx)
+	if !ok || p.quota(operation) == (QuotaPolicy{}) {
+		return charge, nil
+	}
+	q := p.quota(operation)
+	tenant := TenantFromContext(ctx)
+	now := time.Now()
+	for _, period := range []string{quotaPerDay, quotaPerMonth} {
+		limit := q.PerDay
+		if period == quotaPerMonth {
+			limit = q.PerMonth
+		}
+		suffix, reset, ttl := quotaPeriod(period, now)
+		key := quotaCounterKey(tenant, operation, suffix)
+		used, err := s.addQuotaUsage(ctx, key, int64(n), ttl)
+		if err != nil {
+			log.Printf("tenant policy: quota counter error: %v", err)
+			return charge, nil
+		}
+		charge.keys = append(charge.keys, key)
+		charge.ttls = append(charge.ttls, ttl)
+		if limit > 0 && used > limit {
+			auditEvent(ctx, "policy.quota_exceeded", "operation", operation, "period", period, "quota", limit, "used", used)
+			if s.metrics != nil {
+				s.metrics.quotaExceeded.WithLabelValues(operation, period).Inc()
+			}
+			s.refundQuota(ctx, charge, n)
+			return quotaCharge{}, &QuotaExceededError{Operation: operation, Period: period, Reset: reset}
+		}
+		if period == quotaPerMonth && q.SoftPerMonth > 0 && used >= q.SoftPerMonth && used-int64(n) < q.SoftPerMonth {
+			log.Printf("ALERT: tenant %s reached %d of its soft monthly %s quota of %d", tenant, used, operation, q.SoftPerMonth)
+			auditEvent(ctx, "policy.quota_soft_limit_reached", "operation", operation, "soft_per_month", q.SoftPerMonth, "used", used)
+		}
+	}
+	return charge, nil
+}
+
+// refundQuota gives n values of a charge back: the values that failed or were refused after
+// chargeQuota counted them.
+func (s *Server) refundQuota(ctx context.Context, charge quotaCharge, n int) {
+	if n <= 0 {
+		return
+	}
+	for i, key := range charge.keys {
+		if _, err := s.addQuotaUsage(ctx, key, -int64(n), charge.ttls[i]); err != nil {
+			log.Printf("tenant policy: quota refund error: %v", err)
+		}
+	}
+}
+
+// writeQuotaExceeded answers 429 with Retry-After set to the end of the exhausted period.
+func writeQuotaExceeded(w http.ResponseWriter, err error) {
+	var qe *QuotaExceededError
+	if !errors.As(err, &qe) {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(qe.Reset).Seconds())+1))
+	writeJSONError(w, http.StatusTooManyRequests, qe.Error())
+}
+
+// QuotaUsage is a tenant's usage of one operation in the current day and month (UTC) next to
+// its quota.
+type QuotaUsage struct {
+	Operation    string `json:"operation"`
+	UsedToday    int64  `json:"used_today"`
+	UsedMonth    int64  `json:"used_month"`
+	PerDay       int64  `json:"per_day,omitempty"`
+	PerMonth     int64  `json:"per_month,omitempty"`
+	SoftPerMonth int64  `json:"soft_per_month,omitempty"`
+	// Counted is false when the operation has no quota: its values are not counted here
+	Counted bool `json:"counted"`
+}
+
+// quotaUsage reads the tenant's counters of both operations without charging them.
+func (s *Server) quotaUsage(ctx context.Context, tenant string, p effectivePolicy) ([]QuotaUsage, error) {
+	now := time.Now()
+	day, _, _ := quotaPeriod(quotaPerDay, now)
+	month, _, _ := quotaPeriod(quotaPerMonth, now)
+	ops := []string{quotaTokenize, quotaDetokenize}
+	keys := make([]string, 0, 2*len(ops))
+	for _, op := range ops {
+		keys = append(keys, quotaCounterKey(tenant, op, day), quotaCounterKey(tenant, op, month))
+	}
+	var counts []int64
+	if s.cache != nil {
+		var err error
+		if counts, err = s.cache.QuotaCounters(ctx, keys); err != nil {
+			return nil, err
+		}
+	} else {
+		tp := s.policies
+		tp.quotaMu.Lock()
+		for _, k := range keys {
+			counts = append(counts, tp.quota[k])
+		}
+		tp.quotaMu.Unlock()
+	}
+	out := make([]QuotaUsage, 0, len(ops))
+	for i, op := range ops {
+		q := p.quota(op)
+		out = append(out, QuotaUsage{
+			Operation:    op,
+			UsedToday:    counts[2*i],
+			UsedMonth:    counts[2*i+1],
+			PerDay:       q.PerDay,
+			PerMonth:     q.PerMonth,
+			SoftPerMonth: q.SoftPerMonth,
+			Counted:      q != (QuotaPolicy{}),
+		})
+	}
+	return out, nil
+}
+
+// writeQuotaUsage answers the quota usage of tenant.
+func (s *Server) writeQuotaUsage(w http.ResponseWriter, r *http.Request, tenant string) {
+	var p effectivePolicy
+	if doc := s.policies.current(); doc != nil {
+		p = doc.resolve(tenant)
+	}
+	usage, err := s.quotaUsage(r.Context(), tenant, p)
+	if err != nil {
+		log.Printf("quota usage error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	month, _, _ := quotaPeriod(quotaPerMonth, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tenant":  tenant,
+		"month":   month,
+		"results": usage,
+	})
+}
+
+// GET /quota
+// The caller's tenant usage against its tokenize and detokenize quotas.
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := TenantFromContext(r.Context())
+	if tenant == "" {
+		writeJSONError(w, http.StatusBadRequest, "quotas apply to tenant callers only")
+		return
+	}
+	s.writeQuotaUsage(w, r, tenant)
+}
+
+// GET /admin/quotas?tenant=
+// One tenant's usage against its quotas. Monthly counts of every tenant for chargeback are in
+// GET /admin/reports/usage.
+func (s *Server) adminQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := strings.TrimSpace(r.URL.Query().Get("tenant"))
+	if tenant == "" {
+		writeJSONError(w, http.StatusBadRequest, "tenant is required")
+		return
+	}
+	s.writeQuotaUsage(w, r, tenant)
+}
@@ -0,0 +1,239 @@
+package bi_internal
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	rateLimitKeyScope    = "key"
+	rateLimitTenantScope = "tenant"
+
+	// rateLimitMemoryMax bounds the in-memory buckets; full (idle) buckets are dropped first
+	rateLimitMemoryMax = 100000
+)
+
+// rateLimit is a token bucket: rps tokens per second up to burst. rps 0 is unlimited.
+type rateLimit struct {
+	rps   float64
+	burst float64
+}
+
+func (l rateLimit) String() string {
+	return fmt.Sprintf("%g/s burst %g", l.rps, l.burst)
+}
+
+// memBucket is one bucket of the single-instance fallback used without Redis.
+type memBucket struct {
+	tokens float64
+	at     time.Time
+	// full is when the bucket will have refilled and can be forgotten
+	full time.Time
+}
+
+// rateLimiter throttles API traffic per credential and per tenant so one runaway client
+// cannot starve the others. The buckets live in Redis and are shared by every replica;
+// without Redis each instance keeps its own.
+type rateLimiter struct {
+	perKey    rateLimit
+	perTenant rateLimit
+	// overrides by "caller:<caller id>" and "tenant:<tenant>"
+	overrides map[string]rateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*memBucket
+}
+
+// rateLimiterFromEnv reads RATE_LIMIT_KEY_RPS / RATE_LIMIT_KEY_BURST (per API key, bearer
+// subject or client certificate), RATE_LIMIT_TENANT_RPS / RATE_LIMIT_TENANT_BURST (per tenant)
+// and RATE_LIMIT_OVERRIDES, a comma-separated list of caller:<id>=rps/burst and
+// tenant:<id>=rps/burst. Rates default to 0 (no limit); a burst defaults to twice the rate.
+// It panics on a malformed setting.
+func rateLimiterFromEnv() *rateLimiter {
+	l := &rateLimiter{overrides: map[string]rateLimit{}, buckets: map[string]*memBucket{}}
+	var err error
+	if l.perKey, err = rateLimitFromEnv("RATE_LIMIT_KEY"); err != nil {
+		panic(err)
+	}
+	if l.perTenant, err = rateLimitFromEnv("RATE_LIMIT_TENANT"); err != nil {
+		panic(err)
+	}
+	for _, entry := range strings.Split(common.MaybeEnv("RATE_LIMIT_OVERRIDES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		who, spec, ok := strings.Cut(entry, "=")
+		scope, id, _ := strings.Cut(who, ":")
+		if !ok || (scope != "caller" && scope != rateLimitTenantScope) || strings.TrimSpace(id) == "" {
+			panic(fmt.Sprintf("RATE_LIMIT_OVERRIDES: %q is not caller:<id>=rps/burst or tenant:<id>=rps/burst", entry))
+		}
+		rps, burst, _ := strings.Cut(spec, "/")
+		lim, err := parseRateLimit(rps, burst)
+		if err != nil {
+			panic(fmt.Sprintf("RATE_LIMIT_OVERRIDES: %q: %v", entry, err))
+		}
+		l.overrides[scope+":"+strings.TrimSpace(id)] = lim
+	}
+	if l.perKey.rps > 0 || l.perTenant.rps > 0 || len(l.overrides) > 0 {
+		log.Printf("rate limit: per key %v, per tenant %v, %d overrides", l.perKey, l.perTenant, len(l.overrides))
+	}
+	return l
+}
+
+func rateLimitFromEnv(prefix string) (rateLimit, error) {
+	lim, err := parseRateLimit(common.MaybeEnv(prefix+"_RPS"), common.MaybeEnv(prefix+"_BURST"))
+	if err != nil {
+		return lim, fmt.Errorf("%s_RPS / %s_BURST: %v", prefix, prefix, err)
+	}
+	return lim, nil
+}
+
+func parseRateLimit(rps, burst string) (rateLimit, error) {
+	var l rateLimit
+	var err error
+	if rps = strings.TrimSpace(rps); rps != "" {
+		if l.rps, err = strconv.ParseFloat(rps, 64); err != nil || l.rps < 0 || math.IsInf(l.rps, 0) {
+			return l, fmt.Errorf("rate %q must be a non-negative number", rps)
+		}
+	}
+	l.burst = math.Max(1, math.Ceil(2*l.rps))
+	if burst = strings.TrimSpace(burst); burst != "" {
+		if l.burst, err = strconv.ParseFloat(burst, 64); err != nil || l.burst < 1 || math.IsInf(l.burst, 0) {
+			return l, fmt.Errorf("burst %q must be at least 1", burst)
+		}
+	}
+	return l, nil
+}
+
+// limitFor returns the limit of a bucket: the override for the caller or tenant, or the default.
+func (l *rateLimiter) limitFor(scope, id string) rateLimit {
+	if scope == rateLimitKeyScope {
+		if o, ok := l.overrides["caller:"+id]; ok {
+			return o
+		}
+		return l.perKey
+	}
+	if o, ok := l.overrides[rateLimitTenantScope+":"+id]; ok {
+		return o
+	}
+	return l.perTenant
+}
+
+// take takes one token from an in-memory bucket.
+func (l *rateLimiter) take(key string, lim rateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitMemoryMax {
+			l.pruneLocked(now)
+		}
+		b = &memBucket{tokens: lim.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(lim.burst, b.tokens+now.Sub(b.at).Seconds()*lim.rps)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.full = now.Add(time.Duration((lim.burst - b.tokens) / lim.rps * float64(time.Second)))
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / lim.rps * float64(time.Second))
+}
+
+// pruneLocked drops buckets idle long enough to have refilled.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for k, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// allowRate takes a token from bucket under lim. Redis errors let the request through: the
+// limit protects capacity, it is not an access control.
+func (s *Server) allowRate(r *http.Request, bucket string, lim rateLimit) (bool, time.Duration) {
+	if lim.rps <= 0 {
+		return true, 0
+	}
+	if s.cache == nil {
+		return s.rateLimits.take(bucket, lim)
+	}
+	ok, wait, err := s.cache.TakeToken(r.Context(), bucket, lim.rps, lim.burst, 1)
+	if err != nil {
+		log.Printf("rate limit: bucket error: %v", err)
+		return true, 0
+	}
+	return ok, wait
+}
+
+// rateLimitIdentity is the credential a request is limited by: the one authentication
+// verified, never a request header it did not check (X-API-Key next to a bearer token or
+// client certificate, X-Caller-ID).
+func rateLimitIdentity(r *http.Request) string {
+	if c := credentialFromContext(r.Context()); c != "" {
+		return c
+	}
+	return "caller:" + CallerIDFromContext(r.Context())
+}
+
+// tenantRateLimitBucket is the tenant bucket of a request. The tenant is the one bound to the
+// credential; a tenant_admin credential naming a tenant in X-Tenant-ID gets a bucket of its
+// own at the tenant's rate, so it can neither drain the tenant's shared bucket nor escape its
+// limit by naming other tenants (its credential bucket still applies).
+func tenantRateLimitBucket(r *http.Request, tenant string) string {
+	if tenantNamed(r.Context()) {
+		return rateLimitTenantScope + ":" + tenant + ":" + rateLimitIdentity(r)
+	}
+	return rateLimitTenantScope + ":" + tenant
+}
+
+// rateLimited answers 429 with Retry-After once the caller's credential or its tenant has used
+// up its bucket. Health, readiness, reveal redemption and admin endpoints are not limited.
+func (s *Server) rateLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if strings.HasSuffix(p, "/health") || strings.HasSuffix(p, "/ready") || strings.Contains(p, "/admin/") ||
+			strings.HasPrefix(p, RevealPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// overrides name the caller id; the bucket belongs to the credential
+		lim := s.rateLimits.limitFor(rateLimitKeyScope, CallerIDFromContext(r.Context()))
+		if ok, wait := s.allowRate(r, rateLimitKeyScope+":"+rateLimitIdentity(r), lim); !ok {
+			s.writeRateLimited(w, rateLimitKeyScope, lim, wait)
+			return
+		}
+		if tenant := TenantFromContext(r.Context()); tenant != "" {
+			lim := s.rateLimits.limitFor(rateLimitTenantScope, tenant)
+			if ok, wait := s.allowRate(r, tenantRateLimitBucket(r, tenant), lim); !ok {
+				s.writeRateLimited(w, rateLimitTenantScope, lim, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRateLimited answers 429 with Retry-After rounded up to whole seconds.
+func (s *Server) writeRateLimited(w http.ResponseWriter, scope string, lim rateLimit, wait time.Duration) {
+	if s.metrics != nil {
+		s.metrics.rateLimited.WithLabelValues(scope).Inc()
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(lim.rps, 'f', -1, 64))
+	w.Header().Set("X-RateLimit-Scope", scope)
+	writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded for the "+map[string]string{
+		rateLimitKeyScope:    "API key",
+		rateLimitTenantScope: "tenant",
+	}[scope])
+}
@@ -0,0 +1,58 @@
+package bi_internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimitKeysOnVerifiedCredential(t *testing.T) {
+	s := &Server{rateLimits: &rateLimiter{
+		perKey:    rateLimit{rps: 0.001, burst: 1},
+		perTenant: rateLimit{rps: 0.001, burst: 2},
+		overrides: map[string]rateLimit{},
+		buckets:   map[string]*memBucket{},
+	}}
+	h := s.rateLimited(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(credential, tenant string, named bool, apiKey string) int {
+		r := httptest.NewRequest(http.MethodPost, "/tokenize", nil)
+		// a header authentication never checked, as next to a bearer token
+		r.Header.Set("X-API-Key", apiKey)
+		ctx := context.WithValue(r.Context(), credentialKey, credential)
+		ctx = context.WithValue(ctx, tenantIDKey, tenant)
+		if named {
+			ctx = context.WithValue(ctx, tenantNamedKey, true)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.WithContext(ctx))
+		return w.Code
+	}
+
+	if code := call("bearer:alice", "", false, "junk-1"); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	for i := 2; i < 5; i++ {
+		if code := call("bearer:alice", "", false, "junk-"+strconv.Itoa(i)); code != http.StatusTooManyRequests {
+			t.Fatalf("request %d with a fresh X-API-Key: %d, want 429", i, code)
+		}
+	}
+	if code := call("bearer:bob", "", false, "junk-1"); code != http.StatusOK {
+		t.Errorf("another credential: %d", code)
+	}
+
+	// a tenant_admin naming a tenant has a bucket of its own at the tenant's rate
+	if code := call("cert:admin", "acme", true, ""); code != http.StatusOK {
+		t.Errorf("tenant_admin naming acme: %d", code)
+	}
+	if code := call("apikey:acme-1", "acme", false, ""); code != http.StatusOK {
+		t.Errorf("acme key: %d", code)
+	}
+	if code := call("apikey:acme-2", "acme", false, ""); code != http.StatusOK {
+		t.Errorf("second acme key: %d", code)
+	}
+	if code := call("apikey:acme-3", "acme", false, ""); code != http.StatusTooManyRequests {
+		t.Errorf("acme past its tenant burst: %d, want 429", code)
+	}
+}
@@ -0,0 +1,237 @@
+package bi_internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	HeaderRequestNonce     = "X-Request-Nonce"
+	HeaderRequestTimestamp = "X-Request-Timestamp"
+	HeaderRequestSignature = "X-Request-Signature"
+
+	defaultReplayWindow = 5 * time.Minute
+	// defaultReplayMaxBody fits a full /detokenize/batch of BATCH_MAX_SIZE tokens
+	defaultReplayMaxBody = 16 << 20
+	minNonceLength       = 16
+	maxNonceLength       = 128
+)
+
+// replayGuard rejects replayed detokenize requests of the callers listed in
+// REPLAY_PROTECTION_CALLERS: they must send a unique X-Request-Nonce, an X-Request-Timestamp
+// (unix seconds) within REPLAY_WINDOW_SEC (default 300) of the server clock and an
+// X-Request-Signature binding both to the request. Nonces are kept in Redis (or in memory
+// without Redis) for twice the window, which covers every timestamp still accepted. The body
+// is signed, so it is read in full before the handler, up to REPLAY_MAX_BODY_BYTES.
+type replayGuard struct {
+	all     bool
+	callers map[string]bool
+	window  time.Duration
+	maxBody int64
+	// keys are the REPLAY_SIGNING_KEYS by caller id; "*" signs for callers without their own
+	keys map[string][]byte
+
+	// mu guards seen, the single-instance fallback when Redis is not configured; expired
+	// nonces are pruned in the background (startReplayPruner)
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// replayGuardFromEnv reads REPLAY_PROTECTION_CALLERS: empty (default) disables replay
+// protection, "*" applies it to every caller, otherwise a comma-separated list of caller ids
+// (the caller id of the authenticated credential, as in the access log). REPLAY_SIGNING_KEYS
+// holds the signing key of each protected caller as caller_id:base64 entries, "*" for every
+// caller without one. A protected caller without a key panics, like other startup config
+// errors.
+func replayGuardFromEnv() *replayGuard {
+	g := &replayGuard{
+		callers: map[string]bool{},
+		window:  time.Duration(envInt("REPLAY_WINDOW_SEC", int(defaultReplayWindow.Seconds()))) * time.Second,
+		maxBody: int64(envInt("REPLAY_MAX_BODY_BYTES", defaultReplayMaxBody)),
+		keys:    map[string][]byte{},
+		seen:    map[string]time.Time{},
+	}
+	for _, c := range strings.Split(common.MaybeEnv("REPLAY_PROTECTION_CALLERS"), ",") {
+		switch c = strings.TrimSpace(c); c {
+		case "":
+		case "*":
+			g.all = true
+		default:
+			g.callers[c] = true
+		}
+	}
+	for _, entry := range strings.Split(common.MaybeEnv("REPLAY_SIGNING_KEYS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		caller, raw, ok := strings.Cut(entry, ":")
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+		if caller = strings.TrimSpace(caller); !ok || caller == "" || err != nil || len(key) < 32 {
+			panic("REPLAY_SIGNING_KEYS: entries must be caller_id:base64 key of at least 32 bytes")
+		}
+		g.keys[caller] = key
+	}
+	if g.all && g.keys["*"] == nil {
+		panic("REPLAY_PROTECTION_CALLERS=* needs a * entry in REPLAY_SIGNING_KEYS")
+	}
+	for c := range g.callers {
+		if g.key(c) == nil {
+			panic(fmt.Sprintf("REPLAY_PROTECTION_CALLERS: no REPLAY_SIGNING_KEYS entry for %s", c))
+		}
+	}
+	return g
+}
+
+// key returns the signing key of caller.
+func (g *replayGuard) key(caller string) []byte {
+	if k, ok := g.keys[caller]; ok {
+		return k
+	}
+	return g.keys["*"]
+}
+
+// requestSignature is the hex HMAC-SHA256 a protected caller sends as X-Request-Signature:
+// over the method, the path with query, the timestamp, the nonce and the SHA-256 of the body,
+// joined by newlines.
+func requestSignature(key []byte, method, path, ts, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, ts, nonce, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (g *replayGuard) applies(caller string) bool {
+	return g.all || g.callers[caller]
+}
+
+// enabled reports whether any caller is protected.
+func (g *replayGuard) enabled() bool {
+	return g.all || len(g.callers) > 0
+}
+
+// claim records a nonce in memory; it reports false when the nonce is still remembered.
+func (g *replayGuard) claim(nonceHash string, ttl time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if exp, ok := g.seen[nonceHash]; ok && now.Before(exp) {
+		return false
+	}
+	g.seen[nonceHash] = now.Add(ttl)
+	return true
+}
+
+// prune drops the in-memory nonces expired by now.
+func (g *replayGuard) prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, exp := range g.seen {
+		if now.After(exp) {
+			delete(g.seen, k)
+		}
+	}
+}
+
+// startReplayPruner prunes the in-memory nonces once per window, so a request never scans
+// them. Nonces in Redis expire on their own.
+func (s *Server) startReplayPruner() {
+	if s.cache != nil || !s.replay.enabled() {
+		return
+	}
+	go func() {
+		t := time.NewTicker(s.replay.window)
+		defer t.Stop()
+		for now := range t.C {
+			s.replay.prune(now)
+		}
+	}()
+}
+
+// replayProtected wraps a handler with the nonce, timestamp and signature checks for the
+// callers replay protection applies to; the caller is the one of the authenticated credential.
+// Rejections answer 401 and are audited; when the nonce store cannot be reached the request
+// fails closed with 503.
+func (s *Server) replayProtected(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		caller := CallerIDFromContext(ctx)
+		if !s.replay.applies(caller) {
+			next(w, r)
+			return
+		}
+		nonce := strings.TrimSpace(r.Header.Get(HeaderRequestNonce))
+		ts := strings.TrimSpace(r.Header.Get(HeaderRequestTimestamp))
+		sig := strings.TrimSpace(r.Header.Get(HeaderRequestSignature))
+		if nonce == "" || ts == "" || sig == "" {
+			writeJSONError(w, http.StatusUnauthorized, HeaderRequestNonce+", "+HeaderRequestTimestamp+" and "+HeaderRequestSignature+" required")
+			return
+		}
+		if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+			writeJSONError(w, http.StatusUnauthorized, HeaderRequestNonce+" must be 16 to 128 characters")
+			return
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, HeaderRequestTimestamp+" must be unix seconds")
+			return
+		}
+		if skew := time.Since(time.Unix(sec, 0)); math.Abs(skew.Seconds()) > s.replay.window.Seconds() {
+			auditEvent(ctx, "request.replay_rejected", "reason", "stale_timestamp", "skew_sec", int64(skew.Seconds()))
+			writeJSONError(w, http.StatusUnauthorized, "request timestamp outside the allowed window")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.replay.maxBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		want := requestSignature(s.replay.key(caller), r.Method, r.URL.RequestURI(), ts, nonce, body)
+		if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
+			auditEvent(ctx, "request.replay_rejected", "reason", "bad_signature")
+			writeJSONError(w, http.StatusUnauthorized, "invalid request signature")
+			return
+		}
+
+		// nonces are scoped per caller and only their hash is stored
+		sum := sha256.Sum256([]byte(caller + "\x00" + nonce))
+		hash := hex.EncodeToString(sum[:])
+		fresh := true
+		if s.cache != nil {
+			if fresh, err = s.cache.ClaimNonce(ctx, hash, 2*s.replay.window); err != nil {
+				log.Printf("replay protection: nonce store error: %v", err)
+				writeJSONError(w, http.StatusServiceUnavailable, "replay protection unavailable")
+				return
+			}
+		} else {
+			fresh = s.replay.claim(hash, 2*s.replay.window)
+		}
+		if !fresh {
+			auditEvent(ctx, "request.replay_rejected", "reason", "nonce_reused")
+			writeJSONError(w, http.StatusUnauthorized, "request nonce already used")
+			return
+		}
+		next(w, r)
+	}
+}
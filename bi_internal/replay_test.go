@@ -0,0 +1,86 @@
+package bi_internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayProtected(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	s := &Server{replay: &replayGuard{
+		callers: map[string]bool{"partner": true},
+		window:  time.Minute,
+		maxBody: 1 << 10,
+		keys:    map[string][]byte{"partner": key},
+		seen:    map[string]time.Time{},
+	}}
+	var got string
+	h := s.replayProtected(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	})
+	send := func(caller, nonce string, at time.Time, body string, sign func(ts string) string) int {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, "/detokenize?x=1", strings.NewReader(body))
+		if nonce != "" {
+			r.Header.Set(HeaderRequestNonce, nonce)
+			r.Header.Set(HeaderRequestTimestamp, ts)
+			r.Header.Set(HeaderRequestSignature, sign(ts))
+		}
+		w := httptest.NewRecorder()
+		h(w, r.WithContext(context.WithValue(r.Context(), callerIDKey, caller)))
+		return w.Code
+	}
+	body := `{"fpt":"ABCDE1234F"}`
+	valid := func(nonce, body string) func(string) string {
+		return func(ts string) string {
+			return requestSignature(key, http.MethodPost, "/detokenize?x=1", ts, nonce, []byte(body))
+		}
+	}
+	nonce := "nonce-0123456789abcdef"
+
+	if code := send("partner", "", time.Now(), body, nil); code != http.StatusUnauthorized {
+		t.Errorf("no replay headers: %d, want 401", code)
+	}
+	if code := send("partner", nonce, time.Now(), body, valid(nonce, body)); code != http.StatusOK || got != body {
+		t.Fatalf("signed request: %d, handler read %q", code, got)
+	}
+	if code := send("partner", nonce, time.Now(), body, valid(nonce, body)); code != http.StatusUnauthorized {
+		t.Errorf("reused nonce: %d, want 401", code)
+	}
+	other := "nonce-fedcba9876543210"
+	if code := send("partner", other, time.Now(), `{"fpt":"OTHER"}`, valid(other, body)); code != http.StatusUnauthorized {
+		t.Errorf("signature of another body: %d, want 401", code)
+	}
+	if code := send("partner", other, time.Now().Add(-2*time.Minute), body, valid(other, body)); code != http.StatusUnauthorized {
+		t.Errorf("stale timestamp: %d, want 401", code)
+	}
+	large := `{"fpt":"` + strings.Repeat("A", 2<<10) + `"}`
+	if code := send("partner", other, time.Now(), large, valid(other, large)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the limit: %d, want 413", code)
+	}
+	if code := send("internal", "", time.Now(), body, nil); code != http.StatusOK {
+		t.Errorf("unprotected caller: %d", code)
+	}
+}
+
+func TestReplayGuardPrune(t *testing.T) {
+	g := &replayGuard{seen: map[string]time.Time{}}
+	if !g.claim("a", time.Minute) || g.claim("a", time.Minute) {
+		t.Fatal("a nonce is claimed once")
+	}
+	g.claim("b", -time.Second)
+	g.prune(time.Now())
+	if _, ok := g.seen["b"]; ok {
+		t.Error("expired nonce kept")
+	}
+	if _, ok := g.seen["a"]; !ok {
+		t.Error("live nonce pruned")
+	}
+}
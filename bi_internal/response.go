@@ -14,3 +14,14 @@ func writeJSONError(w http.ResponseWriter, status int, msg string) {
 	})
 }
 
+// writeJSONErrorCode is writeJSONError with a machine-readable code next to the message.
+func writeJSONErrorCode(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": msg,
+		"code":  code,
+	})
+}
+
@@ -0,0 +1,210 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const defaultRetentionInterval = 60 * time.Minute
+
+const tenantTokensTarget = "tenant_tokens"
+
+// retentionTarget is one kind of job artifact with a retention period of RETENTION_<NAME>_DAYS
+// (0 or unset = keep forever). purge removes everything older than cutoff and returns how
+// many items went. New job, error report and audit export tables register a target here.
+type retentionTarget struct {
+	name  string
+	days  int
+	purge func(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// RetentionStatus is a target's policy and the outcome of its last purge.
+type RetentionStatus struct {
+	Target     string     `json:"target"`
+	Days       int        `json:"days"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastPurged int64      `json:"last_purged"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+type retention struct {
+	mu      sync.Mutex
+	targets []retentionTarget
+	status  map[string]*RetentionStatus
+}
+
+func (s *Server) newRetention() *retention {
+	rt := &retention{status: map[string]*RetentionStatus{}}
+	add := func(name string, purge func(ctx context.Context, cutoff time.Time) (int64, error)) {
+		days := envInt("RETENTION_"+strings.ToUpper(name)+"_DAYS", 0)
+		rt.targets = append(rt.targets, retentionTarget{name: name, days: days, purge: purge})
+		rt.status[name] = &RetentionStatus{Target: name, Days: days}
+	}
+	add("bulk_exports", func(ctx context.Context, cutoff time.Time) (int64, error) {
+		return purgeBulkExports(cutoff)
+	})
+	add("bulk_jobs", func(ctx context.Context, cutoff time.Time) (int64, error) {
+		return s.store.PurgeBulkJobsFinishedBefore(cutoff)
+	})
+	add("grants", func(ctx context.Context, cutoff time.Time) (int64, error) {
+		return s.store.PurgeGrantsEndedBefore(cutoff)
+	})
+	// tenant token retention comes from the tenant policy file, not RETENTION_*_DAYS
+	rt.status[tenantTokensTarget] = &RetentionStatus{Target: tenantTokensTarget}
+	add("usage", func(ctx context.Context, cutoff time.Time) (int64, error) {
+		n, err := s.store.PurgeUsageBefore(cutoff)
+		if err != nil {
+			return n, err
+		}
+		m, err := s.store.PurgeAPIUsageBefore(cutoff)
+		return n + m, err
+	})
+	add("audit_events", func(ctx context.Context, cutoff time.Time) (int64, error) {
+		return s.store.PurgeAuditEventsBefore(cutoff)
+	})
+	return rt
+}
+
+// purgeBulkExports removes mapping export CSVs in BULK_EXPORT_DIR last written before cutoff.
+func purgeBulkExports(cutoff time.Time) (int64, error) {
+	dir := common.MaybeEnv("BULK_EXPORT_DIR")
+	if dir == "" {
+		return 0, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// purgeExpired applies every retention period once. Targets fail independently.
+func (s *Server) purgeExpired(ctx context.Context) error {
+	for _, t := range s.retention.targets {
+		if t.days <= 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cutoff := time.Now().UTC().AddDate(0, 0, -t.days)
+		n, err := t.purge(ctx, cutoff)
+		s.retention.mu.Lock()
+		st := s.retention.status[t.name]
+		now := time.Now().UTC()
+		st.LastRun, st.LastPurged, st.LastError = &now, n, ""
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		s.retention.mu.Unlock()
+		if err != nil {
+			log.Printf("retention: purge %s failed after %d items: %v", t.name, n, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("retention: purged %d %s older than %d days", n, t.name, t.days)
+			auditEvent(ctx, "retention.purged", "target", t.name, "count", n, "cutoff", cutoff.Format(time.RFC3339))
+		}
+	}
+	return s.purgeTenantTokens(ctx)
+}
+
+// purgeTenantTokens deletes the tokens of tenants whose policy sets retention.token_days,
+// evicting each from the cache. Tenants fail independently.
+func (s *Server) purgeTenantTokens(ctx context.Context) error {
+	days := s.tokenRetentionDays()
+	if len(days) == 0 {
+		return nil
+	}
+	var total int64
+	var errs []string
+	for tenant, d := range days {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cutoff := time.Now().UTC().AddDate(0, 0, -d)
+		n, err := s.store.PurgeTenantTokensBefore(tenant, cutoff, func(dataType, blindIndex, fpt string) {
+			if s.tokens != nil {
+				_ = s.tokens.Evict(ctx, dataType, blindIndex, fpt)
+			}
+		})
+		total += n
+		if err != nil {
+			log.Printf("retention: purge tokens of tenant %s failed after %d tokens: %v", tenant, n, err)
+			errs = append(errs, tenant+": "+err.Error())
+			continue
+		}
+		if n > 0 {
+			log.Printf("retention: purged %d tokens of tenant %s older than %d days", n, tenant, d)
+			auditEvent(ctx, "retention.tenant_tokens_purged", "tenant", tenant, "count", n, "cutoff", cutoff.Format(time.RFC3339))
+		}
+	}
+	s.retention.mu.Lock()
+	st := s.retention.status[tenantTokensTarget]
+	now := time.Now().UTC()
+	st.LastRun, st.LastPurged, st.LastError = &now, total, strings.Join(errs, "; ")
+	s.retention.mu.Unlock()
+	return nil
+}
+
+// startRetentionPurger runs the purge every RETENTION_INTERVAL_MIN on one replica at a time.
+// It is skipped in read-only maintenance mode.
+func (s *Server) startRetentionPurger() {
+	// with a tenant policy file, token retention can be turned on by a later reload
+	enabled := s.policies.path != ""
+	for _, t := range s.retention.targets {
+		enabled = enabled || t.days > 0
+	}
+	if !enabled {
+		return
+	}
+	interval := time.Duration(envInt("RETENTION_INTERVAL_MIN", int(defaultRetentionInterval.Minutes()))) * time.Minute
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			if s.readOnly.Load() {
+				continue
+			}
+			if _, err := s.RunExclusive(context.Background(), "retention-purge", s.purgeExpired); err != nil {
+				log.Printf("retention: %v", err)
+			}
+		}
+	}()
+}
+
+// GET /admin/retention
+func (s *Server) retentionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.retention.mu.Lock()
+	out := make([]RetentionStatus, 0, len(s.retention.targets))
+	for _, t := range s.retention.targets {
+		out = append(out, *s.retention.status[t.name])
+	}
+	out = append(out, *s.retention.status[tenantTokensTarget])
+	s.retention.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":           out,
+		"tenant_token_days": s.tokenRetentionDays(),
+	})
+}
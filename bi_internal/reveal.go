@@ -0,0 +1,243 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultRevealTTL = 60 * time.Second
+	maxRevealTTL     = 10 * time.Minute
+)
+
+// RevealPathPrefix is the public redeem path; callers hold only the reveal token, so the
+// API key middleware must let it through.
+const RevealPathPrefix = "/api/fpt-tokenization/reveal/"
+
+// revealRecord is what a reveal token resolves to. It carries the minting identity so the
+// redeem applies the same tenant checks as a normal detokenize.
+type revealRecord struct {
+	FPT      string `json:"fpt"`
+	Tenant   string `json:"tenant"`
+	CallerID string `json:"caller_id"`
+}
+
+// memoryReveals is the single-instance fallback when Redis is not configured.
+type memoryReveals struct {
+	mu      sync.Mutex
+	entries map[string]memoryReveal
+}
+
+type memoryReveal struct {
+	record  string
+	expires time.Time
+}
+
+func (m *memoryReveals) put(hash, record string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[hash] = memoryReveal{record: record, expires: now.Add(ttl)}
+}
+
+func (m *memoryReveals) take(hash string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[hash]
+	delete(m.entries, hash)
+	if !ok || time.Now().After(e.expires) {
+		return ""
+	}
+	return e.record
+}
+
+func hashRevealToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) storeReveal(ctx context.Context, hash, record string, ttl time.Duration) error {
+	if s.cache != nil {
+		return s.cache.PutReveal(ctx, hash, record, ttl)
+	}
+	s.reveals.put(hash, record, ttl)
+	return nil
+}
+
+func (s *Server) takeReveal(ctx context.Context, hash string) (string, error) {
+	if s.cache != nil {
+		return s.cache.TakeReveal(ctx, hash)
+	}
+	return s.reveals.take(hash), nil
+}
+
+type RevealTokenRequest struct {
+	FPT        string `json:"fpt"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+type RevealTokenResponse struct {
+	RevealToken string    `json:"reveal_token"`
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// POST /reveal-tokens mints a short-lived, single-use reveal token for one FPT.
+func (s *Server) mintRevealHandler(w http.ResponseWriter, r *http.Request) {
+	var req RevealTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.FPT = strings.TrimSpace(req.FPT)
+	if req.FPT == "" {
+		writeJSONError(w, http.StatusBadRequest, "fpt required")
+		return
+	}
+	ttl := defaultRevealTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxRevealTTL {
+		writeJSONError(w, http.StatusBadRequest, "ttl_seconds too large")
+		return
+	}
+
+	// the token must exist and be readable by the minting tenant
+	pt, err := s.store.GetByFPT(r.Context(), req.FPT)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reveal mint failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if pt == nil {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err := s.authorizeTokenAccess(r.Context(), pt.TenantID, pt.DataType, pt.FPT); err != nil {
+		if err == ErrTokenForbidden {
+			writeJSONError(w, http.StatusForbidden, "token belongs to another tenant")
+			return
+		}
+		if err == ErrGlobalFallbackDenied {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "reveal mint failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := s.checkTypeAllowed(r.Context(), pt.DataType); err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	// charged when minting: a reveal token is single use, so a quota rejection at redeem
+	// would burn it
+	charge, err := s.chargeQuota(r.Context(), quotaDetokenize, 1)
+	if err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		s.refundQuota(r.Context(), charge, 1)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	rec, _ := json.Marshal(revealRecord{
+		FPT:      pt.FPT,
+		Tenant:   TenantFromContext(r.Context()),
+		CallerID: CallerIDFromContext(r.Context()),
+	})
+	if err := s.storeReveal(r.Context(), hashRevealToken(token), string(rec), ttl); err != nil {
+		s.refundQuota(r.Context(), charge, 1)
+		slog.ErrorContext(r.Context(), "reveal store failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	auditEvent(r.Context(), "reveal.minted", "fpt", pt.FPT, "ttl_seconds", int(ttl.Seconds()))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevealTokenResponse{
+		RevealToken: token,
+		URL:         RevealPathPrefix + token,
+		ExpiresAt:   time.Now().Add(ttl),
+	})
+}
+
+// withRevealedToken marks fpt as the token of a reveal token being redeemed. Minting it checked
+// the caller's access and consumed any sharing grant, so redeeming reads the value without
+// using the grant again; the type policy and shred state still apply.
+func withRevealedToken(ctx context.Context, fpt string) context.Context {
+	return context.WithValue(ctx, revealedTokenKey, fpt)
+}
+
+// GET /reveal/{token} redeems a reveal token exactly once and returns the PII value.
+func (s *Server) redeemRevealHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	token := mux.Vars(r)["token"]
+	recStr, err := s.takeReveal(r.Context(), hashRevealToken(token))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reveal redeem failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if recStr == "" {
+		writeJSONError(w, http.StatusNotFound, "reveal token invalid, expired or already used")
+		return
+	}
+	var rec revealRecord
+	if err := json.Unmarshal([]byte(recStr), &rec); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	// redeem with the minting identity
+	ctx := context.WithValue(r.Context(), tenantIDKey, rec.Tenant)
+	ctx = context.WithValue(ctx, callerIDKey, rec.CallerID)
+	ctx = withRevealedToken(ctx, rec.FPT)
+	noteIdentity(ctx)
+	val, err := s.Detokenize(ctx, rec.FPT)
+	if err != nil {
+		if err == ErrTokenNotFound {
+			writeJSONError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		if err == ErrTokenShredded {
+			writeJSONError(w, http.StatusGone, err.Error())
+			return
+		}
+		if err == ErrTokenForbidden {
+			writeJSONError(w, http.StatusForbidden, "token belongs to another tenant")
+			return
+		}
+		if err == ErrGlobalFallbackDenied || err == ErrTypeNotAllowed {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "reveal redeem failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	auditEvent(ctx, "reveal.redeemed", "fpt", rec.FPT)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DetokenizeResponse{PIIValue: val})
+}
@@ -0,0 +1,70 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/models"
+)
+
+// TestRevealOfSharedTokenUsesTheGrantOnce needs a Postgres database (TEST_DATABASE_URL).
+func TestRevealOfSharedTokenUsesTheGrantOnce(t *testing.T) {
+	s, store := newDBTestServer(t)
+	s.reveals = &memoryReveals{entries: map[string]memoryReveal{}}
+	km := s.keys.Load()
+	ctx := context.Background()
+
+	suffix := hex.EncodeToString(randomBytes(t, 8))
+	owner, grantee := "owner-"+suffix, "grantee-"+suffix
+	blind, fpt := "test-reveal-"+suffix, "REVEAL"+suffix
+	enc, keyVersion, err := s.cipher.Encrypt(ctx, []byte("ABCDE1234F"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := store.InsertToken(ctx, []byte(enc), nil, keyVersion, km.hmacVersion, blind, fpt, "PAN", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.DeleteToken(pt.ID, blind)
+	one := int64(1)
+	g, err := store.CreateGrant(&models.SharingGrant{OwnerTenant: owner, GranteeTenant: grantee, DataType: "PAN",
+		Operation: "detokenize", MaxUses: &one, Reason: "test", CreatedBy: "test", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.RevokeGrant(g.ID)
+
+	mint := httptest.NewRequest(http.MethodPost, "/reveal-tokens", strings.NewReader(`{"fpt":"`+fpt+`"}`))
+	mint = mint.WithContext(context.WithValue(mint.Context(), tenantIDKey, grantee))
+	w := httptest.NewRecorder()
+	s.mintRevealHandler(w, mint)
+	if w.Code != http.StatusOK {
+		t.Fatalf("mint: %d %s", w.Code, w.Body.String())
+	}
+	var minted RevealTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&minted); err != nil {
+		t.Fatal(err)
+	}
+
+	redeem := mux.SetURLVars(httptest.NewRequest(http.MethodGet, minted.URL, nil), map[string]string{"token": minted.RevealToken})
+	w = httptest.NewRecorder()
+	s.redeemRevealHandler(w, redeem)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ABCDE1234F") {
+		t.Fatalf("redeem of a grant with one use: %d %s", w.Code, w.Body.String())
+	}
+	grants, err := store.ListGrants(owner, grantee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].Uses != 1 {
+		t.Errorf("grant uses after one reveal: %+v", grants)
+	}
+}
@@ -0,0 +1,371 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// keyMaterial is the set of keys used by the tokenization paths.
+type keyMaterial struct {
+	aes  []byte
+	hmac []byte
+	// version is reported in X-Token-KeyVersion (KEY_VERSION or a key fingerprint)
+	version string
+	// previous are older AES keys, only used to decrypt rows not yet re-encrypted
+	previous []versionedKey
+	// hmacVersion is the HMAC key version recorded with new blind indexes (HMAC_KEY_VERSION
+	// or a key fingerprint)
+	hmacVersion string
+	// previousHMAC are older HMAC keys, only used to find tokens created before a rotation
+	previousHMAC []versionedKey
+}
+
+// versionedKey is a key of a ring with its key version.
+type versionedKey struct {
+	version string
+	key     []byte
+}
+
+// ring returns the AES keys to try for a ciphertext written with version: that version's key
+// first, then the current key, then the previous keys.
+func (km *keyMaterial) ring(version string) []versionedKey {
+	return versionFirst(append([]versionedKey{{version: km.version, key: km.aes}}, km.previous...), version)
+}
+
+// hmacRing returns the HMAC keys to try for a blind index written with version, in the same
+// order as ring.
+func (km *keyMaterial) hmacRing(version string) []versionedKey {
+	return versionFirst(append([]versionedKey{{version: km.hmacVersion, key: km.hmac}}, km.previousHMAC...), version)
+}
+
+func versionFirst(keys []versionedKey, version string) []versionedKey {
+	for i, k := range keys {
+		if i > 0 && k.version == version {
+			// move it to the front, keeping the order of the others
+			copy(keys[1:i+1], keys[:i])
+			keys[0] = k
+			break
+		}
+	}
+	return keys
+}
+
+// open decrypts with the first key of the ring that authenticates the ciphertext and returns
+// that key with the plaintext. AES-GCM rejects a wrong key, so trying keys is safe.
+func (km *keyMaterial) open(version string, decrypt func(aesKey []byte) ([]byte, error)) ([]byte, versionedKey, error) {
+	var lastErr error
+	for _, k := range km.ring(version) {
+		plain, err := decrypt(k.key)
+		if err == nil {
+			return plain, k, nil
+		}
+		lastErr = err
+	}
+	return nil, versionedKey{}, lastErr
+}
+
+// open decrypts with the key ring of the current key material.
+func (s *Server) open(version string, decrypt func(aesKey []byte) ([]byte, error)) ([]byte, error) {
+	plain, _, err := s.keys.Load().open(version, decrypt)
+	return plain, err
+}
+
+// loadPreviousKeys parses AES_PREVIOUS_KEYS_BASE64: comma-separated "[version:]<base64 key>"
+// entries. A key without version gets the fingerprint version it had while it was current.
+func loadPreviousKeys(kp keyProvider, hmacKey []byte) ([]versionedKey, error) {
+	return parsePreviousKeys(kp, "AES_PREVIOUS_KEYS_BASE64", "AES", func(version string, key []byte) (string, error) {
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return "", fmt.Errorf("length %d, want 16, 24 or 32 bytes", n)
+		}
+		return keyVersionOf(version, key, hmacKey), nil
+	})
+}
+
+// loadPreviousHMACKeys parses HMAC_PREVIOUS_KEYS_BASE64 like AES_PREVIOUS_KEYS_BASE64.
+func loadPreviousHMACKeys(kp keyProvider) ([]versionedKey, error) {
+	return parsePreviousKeys(kp, "HMAC_PREVIOUS_KEYS_BASE64", "HMAC", func(version string, key []byte) (string, error) {
+		if len(key) == 0 {
+			return "", fmt.Errorf("empty key")
+		}
+		return hmacKeyVersionOf(version, key), nil
+	})
+}
+
+// parsePreviousKeys reads the "[version:]<base64 key>" list in env, unwrapping each key with
+// the key provider; versionOf validates each key and returns its version.
+func parsePreviousKeys(kp keyProvider, env, kind string, versionOf func(version string, key []byte) (string, error)) ([]versionedKey, error) {
+	var keys []versionedKey
+	for _, entry := range strings.Split(common.MaybeEnv(env), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		version, b64, ok := strings.Cut(entry, ":")
+		if !ok {
+			version, b64 = "", entry
+		}
+		key, err := kp.unwrap(b64)
+		if err == nil {
+			version, err = versionOf(version, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous %s key: %w", kind, err)
+		}
+		keys = append(keys, versionedKey{version: version, key: key})
+	}
+	return keys, nil
+}
+
+// loadKeyMaterial reads AES_KEY_BASE64 / HMAC_KEY_BASE64 from env or their mounted files
+// (AES_KEY_FILE / HMAC_KEY_FILE), and the previous keys (AES_PREVIOUS_KEYS_BASE64,
+// HMAC_PREVIOUS_KEYS_BASE64). The key provider turns each value into the raw key.
+func loadKeyMaterial(kp keyProvider) (*keyMaterial, error) {
+	aesKeyStr := common.MaybeEnv("AES_KEY_BASE64")
+	hmacKeyStr := common.MaybeEnv("HMAC_KEY_BASE64")
+	if aesKeyStr == "" {
+		return nil, fmt.Errorf("missing env: AES_KEY_BASE64 (or AES_KEY_FILE)")
+	}
+	if hmacKeyStr == "" {
+		return nil, fmt.Errorf("missing env: HMAC_KEY_BASE64 (or HMAC_KEY_FILE)")
+	}
+	aesKey, err := kp.unwrap(aesKeyStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES key: %w", err)
+	}
+	if n := len(aesKey); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("invalid AES key: length %d, want 16, 24 or 32 bytes", n)
+	}
+	hmacKey, err := kp.unwrap(hmacKeyStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HMAC key: %w", err)
+	}
+	previous, err := loadPreviousKeys(kp, hmacKey)
+	if err != nil {
+		return nil, err
+	}
+	previousHMAC, err := loadPreviousHMACKeys(kp)
+	if err != nil {
+		return nil, err
+	}
+	km := &keyMaterial{
+		aes:          aesKey,
+		hmac:         hmacKey,
+		version:      keyVersionOf(common.MaybeEnv("KEY_VERSION"), aesKey, hmacKey),
+		previous:     previous,
+		hmacVersion:  hmacKeyVersionOf(common.MaybeEnv("HMAC_KEY_VERSION"), hmacKey),
+		previousHMAC: previousHMAC,
+	}
+	if err := uniqueVersions("AES", km.ring("")); err != nil {
+		return nil, err
+	}
+	if err := uniqueVersions("HMAC", km.hmacRing("")); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+func uniqueVersions(kind string, keys []versionedKey) error {
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if seen[k.version] {
+			return fmt.Errorf("key version %s is used by more than one %s key", k.version, kind)
+		}
+		seen[k.version] = true
+	}
+	return nil
+}
+
+func (s *Server) aesKey() []byte  { return s.keys.Load().aes }
+func (s *Server) hmacKey() []byte { return s.keys.Load().hmac }
+
+func (s *Server) adminKey() string {
+	if p := s.adminKeyVal.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// StaticAPIKey is the static API_KEY accepted next to provisioned tenant keys ("" if unset).
+func (s *Server) StaticAPIKey() string {
+	if p := s.apiKeyVal.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// loadAccessKeys reads API_KEY, API_KEY_SCOPES, SERVICE_API_KEYS and ADMIN_API_KEY (or their
+// mounted files) at startup and on secret reload, so requests never read the environment. An
+// invalid scope list panics at startup; on reload the current keys are kept.
+func (s *Server) loadAccessKeys() {
+	sk, err := serviceKeysFromEnv()
+	if err != nil {
+		if s.serviceKeys.Load() == nil {
+			panic(err.Error())
+		}
+		log.Printf("secrets: API key scopes rejected, keeping current keys: %v", err)
+		return
+	}
+	apiKey := common.MaybeEnv("API_KEY")
+	if apiKey == "" && len(sk.byHash) == 0 {
+		log.Println("warning: API_KEY is not set; only provisioned tenant API keys are accepted")
+	}
+	s.apiKeyVal.Store(&apiKey)
+	s.serviceKeys.Store(sk)
+	adminKey := common.MaybeEnv("ADMIN_API_KEY")
+	s.adminKeyVal.Store(&adminKey)
+}
+
+// verifyKeyMaterial checks candidate keys against a stored token: the AES key of its
+// key_version must decrypt it and the HMAC key of its hmac_key_version must reproduce its blind
+// index. This stops a bad
+// rotation from bricking every existing token: a new key is accepted while the old one is kept
+// in AES_PREVIOUS_KEYS_BASE64 / HMAC_PREVIOUS_KEYS_BASE64. An empty vault always verifies.
+func (s *Server) verifyKeyMaterial(km *keyMaterial) error {
+	sample, err := s.store.SampleToken(context.Background())
+	if err != nil {
+		return fmt.Errorf("load sample token: %w", err)
+	}
+	if sample == nil {
+		return nil
+	}
+	var plain []byte
+	if !isLocalCiphertext(string(sample.EncryptedValue)) {
+		// Vault keys and data keys are not part of the key material; only the HMAC ring can be
+		// checked
+		if plain, err = s.cipher.Decrypt(context.Background(), sample.KeyVersion, string(sample.EncryptedValue)); err != nil {
+			return fmt.Errorf("decrypt sample token with CIPHER_PROVIDER: %w", err)
+		}
+	} else {
+		// the row's own key version must decrypt it; rows written before key versions were
+		// recorded try the whole ring
+		aesKeys := km.ring("")
+		if version, _ := ringKeyVersion(sample.KeyVersion); version != "" {
+			k, ok := keyOfVersion(aesKeys, version)
+			if !ok {
+				return fmt.Errorf("key version %s of existing tokens is missing from the AES key ring", version)
+			}
+			aesKeys = []versionedKey{k}
+		}
+		for _, k := range aesKeys {
+			if plain, err = common.AESGCMDecrypt(k.key, string(sample.EncryptedValue)); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("the AES key of existing tokens does not decrypt them: %w", err)
+		}
+	}
+	hmacKeys := km.hmacRing("")
+	if sample.HMACKeyVersion != "" {
+		k, ok := keyOfVersion(hmacKeys, sample.HMACKeyVersion)
+		if !ok {
+			return fmt.Errorf("HMAC key version %s of existing blind indexes is missing from the HMAC key ring", sample.HMACKeyVersion)
+		}
+		hmacKeys = []versionedKey{k}
+	}
+	reproduced := false
+	// the row may be tenant-bound, plain (global or created before tenant-bound indexes) or a
+	// global overflow row
+	domains := []string{tenantBlindDomain(sample.TenantID), plainBlindDomain, overflowBlindDomain}
+	for _, k := range hmacKeys {
+		for _, d := range domains {
+			reproduced = reproduced || blindIndexIn(k.key, d, string(plain)) == sample.BlindIndex
+		}
+	}
+	if !reproduced {
+		return fmt.Errorf("the HMAC key of existing blind indexes does not reproduce them")
+	}
+	// every key version rows still use must stay in its ring
+	counts, err := s.store.KeyVersionCounts()
+	if err != nil {
+		return fmt.Errorf("load key versions: %w", err)
+	}
+	for _, c := range counts {
+		version, local := ringKeyVersion(c.KeyVersion)
+		if local && version != "" && !hasVersion(km.ring(""), version) {
+			return fmt.Errorf("%d rows are still encrypted with key version %s, which is missing from the key ring", c.Rows, c.KeyVersion)
+		}
+	}
+	hmacCounts, err := s.store.HMACKeyVersionCounts()
+	if err != nil {
+		return fmt.Errorf("load HMAC key versions: %w", err)
+	}
+	for _, c := range hmacCounts {
+		if c.KeyVersion != "" && !hasVersion(km.hmacRing(""), c.KeyVersion) {
+			return fmt.Errorf("%d blind indexes use HMAC key version %s, which is missing from the HMAC key ring", c.Rows, c.KeyVersion)
+		}
+	}
+	return nil
+}
+
+func hasVersion(keys []versionedKey, version string) bool {
+	_, ok := keyOfVersion(keys, version)
+	return ok
+}
+
+func keyOfVersion(keys []versionedKey, version string) (versionedKey, bool) {
+	for _, k := range keys {
+		if k.version == version {
+			return k, true
+		}
+	}
+	return versionedKey{}, false
+}
+
+// ReloadSecrets re-reads rotated secrets. New AES/HMAC keys are only swapped in after they
+// verify against the vault; the admin key and the Vault token are swapped unconditionally.
+func (s *Server) ReloadSecrets() {
+	s.loadAccessKeys()
+	if v, ok := s.cipher.(*vaultTransitCipher); ok {
+		if err := v.reloadToken(); err != nil {
+			log.Printf("secrets: Vault token reload rejected, keeping current token: %v", err)
+		}
+	}
+
+	km, err := loadKeyMaterial(s.keyProvider)
+	if err != nil {
+		log.Printf("secrets: reload rejected, keeping current keys: %v", err)
+		return
+	}
+	cur := s.keys.Load()
+	if bytes.Equal(cur.aes, km.aes) && bytes.Equal(cur.hmac, km.hmac) && sameKeys(cur.previous, km.previous) && sameKeys(cur.previousHMAC, km.previousHMAC) {
+		return
+	}
+	if km.version == cur.version && !bytes.Equal(cur.aes, km.aes) {
+		log.Printf("secrets: reload rejected, keeping current keys: new AES key needs a new KEY_VERSION")
+		return
+	}
+	if km.hmacVersion == cur.hmacVersion && !bytes.Equal(cur.hmac, km.hmac) {
+		log.Printf("secrets: reload rejected, keeping current keys: new HMAC key needs a new HMAC_KEY_VERSION")
+		return
+	}
+	if s.fips {
+		if err := checkFIPSKeys(km); err != nil {
+			log.Printf("secrets: reload rejected in FIPS mode, keeping current keys: %v", err)
+			return
+		}
+	}
+	if err := s.verifyKeyMaterial(km); err != nil {
+		log.Printf("secrets: reload rejected, keeping current keys: %v", err)
+		return
+	}
+	s.keys.Store(km)
+	log.Printf("secrets: key material reloaded, key version %s (%d previous), HMAC key version %s (%d previous)", km.version, len(km.previous), km.hmacVersion, len(km.previousHMAC))
+}
+
+func sameKeys(a, b []versionedKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].version != b[i].version || !bytes.Equal(a[i].key, b[i].key) {
+			return false
+		}
+	}
+	return true
+}
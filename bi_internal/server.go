@@ -5,6 +5,8 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -19,52 +21,215 @@ type HealthStatusResponse struct {
 
 
 type Server struct {
-	store   *models.Store
-	aesKey  []byte
-	hmacKey []byte
-	r       *mux.Router
-	cache   *Cache
+	store *models.Store
+	// keys holds the AES/HMAC key material; swapped atomically on secret rotation
+	keys  atomic.Pointer[keyMaterial]
+	// keyProvider unwraps configured key values into raw keys (KEY_PROVIDER)
+	keyProvider keyProvider
+	// cipher encrypts and decrypts encrypted_value (CIPHER_PROVIDER)
+	cipher CipherProvider
+	r     *mux.Router
+	// cache is the Redis client (also reveal records and leader locks); nil with other backends
+	cache *Cache
+	// tokens is the token cache selected by CACHE_BACKEND; nil when running without a cache
+	tokens TokenCache
+	// adminKeyVal protects /admin endpoints (ADMIN_API_KEY); empty disables them
+	adminKeyVal atomic.Pointer[string]
+	// apiKeyVal is the static API_KEY; like the admin key it is swapped on secret reload
+	apiKeyVal atomic.Pointer[string]
+	// serviceKeys are the scopes of API_KEY (API_KEY_SCOPES) and the SERVICE_API_KEYS
+	serviceKeys atomic.Pointer[serviceKeys]
+	// reveals holds reveal tokens when Redis is not configured
+	reveals *memoryReveals
+	// batch detokenize limits (BATCH_MAX_SIZE, BATCH_STREAM_THRESHOLD)
+	batchMaxSize         int
+	batchStreamThreshold int
+	// bulk are the bulk-tokenize settings (BULK_*)
+	bulk bulkConfig
+	// bulkJobs queues bulk-tokenize jobs for this replica's workers (BULK_JOB_WORKERS)
+	bulkJobs *bulkJobs
+	// instanceID identifies this replica in leader-election locks
+	instanceID string
+	// state is the lifecycle state (starting, standby, active)
+	state atomic.Int32
+	// usage aggregates per-caller usage counters (flushed every USAGE_FLUSH_INTERVAL_SEC)
+	usage *usageRecorder
+	// apiUsage counts requests per API version, endpoint and caller (GET /admin/version-usage)
+	apiUsage *apiUsageRecorder
+	// globalFallback lists data types tenant callers may resolve from the global vault
+	globalFallback globalFallback
+	// tenantSettings caches per-tenant, per-type settings (token prefixes)
+	tenantSettings *tenantSettings
+	// typePostprocessors are output constraints applied to every new token of a type
+	typePostprocessors map[string][]common.Postprocessor
+	// tokenValidity is the validity policy per data type (TOKEN_VALIDITY_<TYPE>)
+	tokenValidity map[string]string
+	// panPreserve are the PAN positions copied from the value into the token
+	panPreserve []int
+	// generators caches the token generator per tenant, data type and HMAC key version
+	generators *GeneratorRegistry
+	// reservedTokens are values generated tokens must never equal (RESERVED_TOKENS)
+	reservedTokens map[string]bool
+	// readOnly is the maintenance mode rejecting writes with 503 + Retry-After
+	readOnly           atomic.Bool
+	readOnlyRetryAfter atomic.Int64
+	// ciphertext is the dual-write / read preference policy of the v2 ciphertext column
+	ciphertext ciphertextPolicy
+	// keyUsage counts encryptions per key version and enforces the cryptoperiod
+	keyUsage *keyUsage
+	// reencryptJob is the progress of re-encrypting the vault to the current key version
+	reencryptJob reencryptJob
+	// policies is the per-tenant PII handling policy (TENANT_POLICY_FILE)
+	policies *tenantPolicies
+	// apiKeys caches provisioned tenant API keys (API_KEY_CACHE_SEC)
+	apiKeys *apiKeyCache
+	// replay rejects replayed detokenize requests of partner callers (REPLAY_PROTECTION_CALLERS)
+	replay *replayGuard
+	// rateLimits are the per-key and per-tenant token buckets (RATE_LIMIT_*)
+	rateLimits *rateLimiter
+	// fips restricts crypto to FIPS-approved primitives (FIPS_MODE, boringcrypto builds)
+	fips bool
+	// changes holds admin mutations not yet written to the change journal
+	changes *changeJournal
+	// audit buffers tokenize/detokenize/bulk audit events for pii_audit_events
+	audit *auditRecorder
+	// vacuum is the vault bloat advisor (VACUUM_ADVISOR_*)
+	vacuum *vacuumAdvisor
+	// validation holds the optional input checks (PII_TYPES, AADHAR_VALIDATE_CHECKSUM)
+	validation piiValidation
+	// authMode is AUTH_MODE; oidc verifies bearer JWTs (nil when they are not accepted)
+	authMode string
+	oidc     *oidcVerifier
+	// mtls maps verified client certificates to callers (nil without TLS_CLIENT_CA_FILE)
+	mtls *mtlsConfig
+	// billing sends per-tenant usage records to BILLING_SINK_URL (nil when unset)
+	billing *billingExporter
+	// retention is the purge policy of job artifacts (RETENTION_<TARGET>_DAYS)
+	retention *retention
+	// metrics are the Prometheus collectors served on /metrics (nil with METRICS_DISABLED)
+	metrics *serverMetrics
+	// degradation tracks degraded subsystems for GET /admin/degradation
+	degradation *degradationTracker
 }
 
 // NewServer creates a server and initializes keys + redis cluster cache.
 // It will attempt to preload the cache synchronously from the DB store (may be slow for very large datasets).
+//
+// With START_MODE=standby the key verification and cache warm (CACHE_WARM_ROWS newest rows,
+// 0 = all) run in the background instead, and the server stays not-ready until it is
+// activated with POST /admin/activate.
 func NewServer(store *models.Store) *Server {
-	// load keys from env (panic if missing)
-	aesKeyStr := common.MustEnv("AES_KEY_BASE64")
-	hmacKeyStr := common.MustEnv("HMAC_KEY_BASE64")
-	aesKey, err := common.DecodeBase64Key(aesKeyStr)
+	// load keys from env or mounted files, unwrapped by KEY_PROVIDER (panic if missing)
+	kp, err := keyProviderFromEnv()
 	if err != nil {
-		panic("invalid AES key: " + err.Error())
+		panic(err.Error())
 	}
-	hmacKey, err := common.DecodeBase64Key(hmacKeyStr)
+	km, err := loadKeyMaterial(kp)
 	if err != nil {
-		panic("invalid HMAC key: " + err.Error())
+		panic(err.Error())
+	}
+	fips := FIPSMode()
+	if fips {
+		if err := checkFIPSConfig(km); err != nil {
+			panic("FIPS mode: " + err.Error())
+		}
+		log.Printf("FIPS mode: FF1 tokens (%s), AES-GCM values, HMAC-SHA256 blind indexes, boringcrypto build %v", tokenGeneratorFF1, fipsBuild)
+	}
+	policies, err := tenantPoliciesFromEnv()
+	if err != nil {
+		panic(err.Error())
 	}
 
 	s := &Server{
-		store:   store,
-		aesKey:  aesKey,
-		hmacKey: hmacKey,
-		r:       mux.NewRouter(),
-		cache:   nil,
+		store:       store,
+		keyProvider: kp,
+		r:           mux.NewRouter(),
+		cache:       nil,
+		reveals:     &memoryReveals{entries: map[string]memoryReveal{}},
+
+		batchMaxSize:         envInt("BATCH_MAX_SIZE", defaultBatchMaxSize),
+		batchStreamThreshold: envInt("BATCH_STREAM_THRESHOLD", defaultBatchStreamThreshold),
+		instanceID:           newInstanceID(),
+		usage:                newUsageRecorder(),
+		apiUsage:             newAPIUsageRecorder(),
+		globalFallback:       globalFallbackFromEnv(),
+		tenantSettings:       newTenantSettings(),
+		tokenValidity:        tokenValidityFromEnv(),
+		reservedTokens:       reservedTokensFromEnv(),
+		ciphertext:           ciphertextPolicyFromEnv(),
+		keyUsage:             newKeyUsage(),
+		replay:               replayGuardFromEnv(),
+		rateLimits:           rateLimiterFromEnv(),
+		fips:                 fips,
+		changes:              &changeJournal{},
+		apiKeys:              newAPIKeyCache(),
+		policies:             policies,
+		audit:                auditRecorderFromEnv(),
+		vacuum:               vacuumAdvisorFromEnv(),
+		billing:              billingExporterFromEnv(),
+		validation:           piiValidationFromEnv(),
+		degradation:          newDegradationTracker(),
+	}
+	s.keys.Store(km)
+	if metricsEnabled() {
+		s.metrics = newServerMetrics()
+		store.SetObserver(s.metrics.observeStore)
+	}
+	if s.cipher, err = cipherProviderFromEnv(&s.keys, store); err != nil {
+		panic(err.Error())
+	}
+	if _, ok := s.cipher.(localCipher); !ok && (s.ciphertext.dualWrite || s.ciphertext.readV2) {
+		panic("the v2 ciphertext column needs CIPHER_PROVIDER=local")
+	}
+	s.typePostprocessors = typePostprocessorsFromEnv(s.tokenValidity)
+	s.panPreserve = panPreserveFromEnv(s.tokenValidity)
+	s.generators = newGeneratorRegistry(s.typePostprocessors, s.panPreserve, tokenAlphabetsFromEnv(), tweakPolicyFromEnv(), s.fips, ff1HSMFromEnv(s.fips), s.validTokenOutput)
+	if s.bulk, err = bulkConfigFromEnv(); err != nil {
+		panic(err.Error())
 	}
+	s.bulkJobs = newBulkJobs(s.bulk)
+	s.readOnlyFromEnv()
+	s.loadAccessKeys()
+	s.authMode, s.oidc = authModeFromEnv()
+	if s.oidc != nil {
+		s.oidc.degradation = s.degradation
+	}
+	s.mtls = mtlsFromEnv()
+
+	// init token cache (CACHE_BACKEND, default redis)
+	s.initCache()
 
-	// init redis cluster cache
-	cache, cerr := NewCacheFromEnv()
-	if cerr != nil {
-		log.Printf("warning: redis cluster init failed, running without cache: %v", cerr)
+	warmRows := envInt("CACHE_WARM_ROWS", 0)
+	if strings.EqualFold(common.MaybeEnv("START_MODE"), "standby") {
+		s.startInStandby(warmRows)
 	} else {
-		s.cache = cache
-		// synchronous preload with generous timeout; adjust as needed
+		// synchronous startup with generous timeout; adjust as needed
 		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
 		defer cancel()
-		if err := s.cache.PreloadFromStore(ctx, store); err != nil {
-			log.Printf("warning: cache preload failed: %v", err)
-		} else {
-			log.Println("cache preload completed")
+		if err := s.startup(ctx, warmRows); err != nil {
+			panic("startup checks failed: " + err.Error())
 		}
+		s.state.Store(stateActive)
+	}
+
+	// every replica journals the policy file it switched to
+	s.policies.onReload = func(path, sum string) {
+		s.adminChange(context.Background(), "tenant_policy.reloaded", "instance", s.instanceID, "source", path, "sha256", sum)
 	}
 
+	// load the current key version's usage so the cryptoperiod applies from the first request
+	s.flushKeyUsage()
+	s.startAuditFlusher()
+	s.startReplayPruner()
+	s.startChangeJournalRetry()
+	s.startUsageFlusher(time.Duration(envInt("USAGE_FLUSH_INTERVAL_SEC", int(defaultUsageFlushInterval.Seconds()))) * time.Second)
+	s.retention = s.newRetention()
+	s.startRetentionPurger()
+	s.startVacuumAdvisor()
+	s.startBillingExport()
+	s.startBulkJobWorkers()
+	s.startReadOnlySync()
+
 	s.routes()
 	return s
 }
@@ -81,12 +246,85 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (s *Server) routes() {
-	sr := s.r.PathPrefix("/api/fpt-tokenization").Subrouter()
-	sr.HandleFunc("/tokenize", s.tokenizeHandler).Methods("POST")
-	sr.HandleFunc("/detokenize", s.detokenizeHandler).Methods("POST")
-	sr.HandleFunc("/bulk-tokenize", s.bulkTokenizeHandler).Methods("POST")
+	sr := s.r.PathPrefix(apiPathPrefix).Subrouter()
+	sr.Use(s.tracing)
+	sr.Use(s.activeOnly)
+	sr.Use(s.debugRequestLog)
+	sr.Use(s.versionUsage)
+	sr.Use(s.httpMetrics)
+	sr.Use(s.rateLimited)
+	sr.HandleFunc("/tokenize", s.scoped(ScopeTokenize, s.tokenizeHandler)).Methods("POST")
+	sr.HandleFunc("/tokenize/batch", s.scoped(ScopeTokenize, s.batchTokenizeHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/tokenize/bulk-values", s.scoped(ScopeTokenize, s.bulkValuesHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/tokenize/csv", s.scoped(ScopeTokenize, s.csvUploadHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/detokenize", s.scoped(ScopeDetokenize, s.replayProtected(s.detokenizeHandler))).Methods("POST")
+	sr.HandleFunc("/detokenize/batch", s.scoped(ScopeDetokenize, s.replayProtected(s.batchDetokenizeHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/token", s.scoped(ScopeDelete, s.writeOp(s.deleteTokenHandler))).Methods(http.MethodDelete)
+	sr.HandleFunc("/bulk-tokenize", s.scoped(ScopeTokenize, s.writeOp(s.bulkTokenizeHandler))).Methods("POST")
+	sr.HandleFunc("/bulk-detokenize", s.scoped(ScopeDetokenize, s.writeOp(s.bulkDetokenizeHandler))).Methods("POST")
+	// the resume handler checks the scope of the job's operation
+	bulkScopes := []string{ScopeTokenize, ScopeDetokenize}
+	sr.HandleFunc("/bulk-jobs", s.scopedAny(bulkScopes, s.listBulkJobsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/bulk-jobs/{id}", s.scopedAny(bulkScopes, s.bulkJobHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/bulk-jobs/{id}/resume", s.scopedAny(bulkScopes, s.writeOp(s.resumeBulkJobHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/reveal-tokens", s.scoped(ScopeReveal, s.mintRevealHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/reveal/{token}", s.redeemRevealHandler).Methods(http.MethodGet)
+	sr.HandleFunc("/quota", s.quotaHandler).Methods(http.MethodGet)
+	sr.HandleFunc("/pii-types/{type}/format", s.tokenFormatHandler).Methods(http.MethodGet)
+	// admin
+	sr.HandleFunc("/admin/reports/duplicates", s.adminOnly(s.duplicateReportHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/reports/usage", s.adminOnly(s.usageReportHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/audit-events", s.adminOnly(s.listAuditEventsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/change-journal/export", s.adminOnly(s.exportChangeJournalHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/change-journal/verify", s.adminOnly(s.verifyChangeJournalHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/version-usage", s.adminOnly(s.versionUsageHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/keys/usage", s.adminOnly(s.keyUsageHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/keys/reencrypt", s.adminOnly(s.writeOp(s.reencryptHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/keys/reencrypt", s.adminOnly(s.reencryptStatusHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/cache-stats", s.adminOnly(s.cacheStatsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/store-stats", s.adminOnly(s.storeStatsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/retention", s.adminOnly(s.retentionStatusHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/bulk-workers", s.adminOnly(s.bulkWorkersHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/bulk-workers", s.adminOnly(s.putBulkWorkersHandler)).Methods(http.MethodPut)
+	sr.HandleFunc("/admin/degradation", s.adminOnly(s.degradationHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/vacuum-advisor", s.adminOnly(s.vacuumAdvisorHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/vacuum-advisor/apply", s.adminOnly(s.writeOp(s.applyVacuumAdvisorHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/grants", s.adminOnly(s.writeOp(s.createGrantHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/grants", s.adminOnly(s.listGrantsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/grants/{id}", s.adminOnly(s.writeOp(s.revokeGrantHandler))).Methods(http.MethodDelete)
+	sr.HandleFunc("/admin/tenants", s.adminOnly(s.writeOp(s.onboardTenantHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/tenants", s.adminOnly(s.listTenantsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/tenants/{tenant}/api-keys", s.adminOnly(s.writeOp(s.createAPIKeyHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/api-keys", s.adminOnly(s.writeOp(s.createTeamAPIKeyHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/api-keys", s.adminOnly(s.listAPIKeysHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/api-keys/{id}", s.adminOnly(s.writeOp(s.updateAPIKeyHandler))).Methods(http.MethodPatch)
+	sr.HandleFunc("/admin/api-keys/{id}", s.adminOnly(s.writeOp(s.revokeAPIKeyHandler))).Methods(http.MethodDelete)
+	sr.HandleFunc("/admin/tenant-policy", s.adminOnly(s.tenantPolicyHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/quotas", s.adminOnly(s.adminQuotaHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/tenant-settings", s.adminOnly(s.listTenantSettingsHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/tenant-settings/{tenant}/{data_type}", s.adminOnly(s.writeOp(s.putTenantSettingHandler))).Methods(http.MethodPut)
+	sr.HandleFunc("/admin/connection-profiles", s.adminOnly(s.listConnectionProfilesHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/connection-profiles/{name}", s.adminOnly(s.writeOp(s.putConnectionProfileHandler))).Methods(http.MethodPut)
+	sr.HandleFunc("/admin/connection-profiles/{name}", s.adminOnly(s.writeOp(s.deleteConnectionProfileHandler))).Methods(http.MethodDelete)
+	sr.HandleFunc("/admin/tokens/shred", s.adminOnly(s.writeOp(s.shredTokenHandler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/backfill/encrypted-v2", s.adminOnly(s.writeOp(s.backfillV2Handler))).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/read-only", s.adminOnly(s.readOnlyHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/read-only", s.adminOnly(s.readOnlyStatusHandler)).Methods(http.MethodGet)
+	sr.HandleFunc("/admin/activate", s.adminOnly(s.activateHandler)).Methods(http.MethodPost)
+	sr.HandleFunc("/admin/standby", s.adminOnly(s.standbyHandler)).Methods(http.MethodPost)
+	// demo / testing
+	if demoEnabled() {
+		sr.HandleFunc("/demo/generate", s.adminOnly(s.writeOp(s.demoGenerateHandler))).Methods(http.MethodPost)
+	}
+	if testVectorsEnabled() {
+		sr.HandleFunc("/test-vectors", s.scoped(ScopeTokenize, s.testVectorsHandler)).Methods(http.MethodGet)
+	}
 	// health
 	sr.HandleFunc("/health", HealthHandler).Methods(http.MethodGet)
+	sr.HandleFunc("/ready", s.readyHandler).Methods(http.MethodGet)
+	if s.metrics != nil {
+		s.r.Handle(MetricsPath, s.metrics.handler()).Methods(http.MethodGet)
+	}
 }
 
 func (s *Server) Router() http.Handler {
@@ -0,0 +1,112 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+// ShredReceipt confirms a crypto-shredding. It never contains the PII value.
+type ShredReceipt struct {
+	ReceiptID  string    `json:"receipt_id"`
+	FPT        string    `json:"fpt"`
+	DataType   string    `json:"data_type"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	ShreddedAt time.Time `json:"shredded_at"`
+	// CacheEvicted is false when the cache could not be reached; the cached ciphertext no
+	// longer decrypts either way.
+	CacheEvicted bool `json:"cache_evicted"`
+}
+
+// shredTokenKey deletes the data key of an envelope-encrypted row; it reports false for rows
+// without one and for keys that were already shredded.
+func (s *Server) shredTokenKey(pt *models.PiiToken) (bool, error) {
+	ciphertext := string(pt.EncryptedValue)
+	if !isEnvelopeCiphertext(ciphertext) {
+		return false, nil
+	}
+	if c, ok := s.cipher.(*envelopeCipher); ok {
+		return c.shred(ciphertext)
+	}
+	id, _, err := envelopeDEKID(ciphertext)
+	if err != nil {
+		return false, err
+	}
+	return s.store.ShredDEK(id)
+}
+
+// shredToken crypto-shreds a vault row: its data key and its v2 ciphertext, which the key
+// ring still opens, go in one transaction. It reports false when the key was already gone.
+func (s *Server) shredToken(pt *models.PiiToken) (bool, error) {
+	id, _, err := envelopeDEKID(string(pt.EncryptedValue))
+	if err != nil {
+		return false, err
+	}
+	if c, ok := s.cipher.(*envelopeCipher); ok {
+		c.forget(id)
+	}
+	return s.store.ShredTokenDEK(pt.ID, id)
+}
+
+// POST /admin/tokens/shred
+// Crypto-shreds a token: deletes its data key, so its value no longer decrypts anywhere (vault
+// row, cache, exports) while the token itself stays in place; the dual-written v2 ciphertext
+// is cleared with it. Detokenize then answers 410.
+// Only envelope-encrypted tokens (CIPHER_PROVIDER=envelope) have a data key.
+func (s *Server) shredTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FPT string `json:"fpt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.FPT) == "" {
+		writeJSONError(w, http.StatusBadRequest, "fpt is required")
+		return
+	}
+	pt, err := s.store.GetByFPT(r.Context(), strings.TrimSpace(req.FPT))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "shred token: lookup failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if pt == nil {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if !isEnvelopeCiphertext(string(pt.EncryptedValue)) {
+		writeJSONError(w, http.StatusConflict, "token has no data key; re-encrypt it with CIPHER_PROVIDER=envelope first, or delete it")
+		return
+	}
+	ok, err := s.shredToken(pt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "shred token failed", "data_type", pt.DataType, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusGone, ErrTokenShredded.Error())
+		return
+	}
+
+	ctx := r.Context()
+	receipt := ShredReceipt{
+		ReceiptID:    newRequestID(),
+		FPT:          pt.FPT,
+		DataType:     pt.DataType,
+		TenantID:     pt.TenantID,
+		ShreddedAt:   time.Now().UTC(),
+		CacheEvicted: true,
+	}
+	if s.tokens != nil {
+		if err := s.tokens.Evict(ctx, pt.DataType, pt.BlindIndex, pt.FPT); err != nil {
+			slog.WarnContext(ctx, "shred token: cache eviction failed", "data_type", pt.DataType, "fpt", pt.FPT, "error", err)
+			receipt.CacheEvicted = false
+		}
+	}
+	s.adminChange(ctx, "token.shredded", "receipt_id", receipt.ReceiptID, "owner_tenant", pt.TenantID, "data_type", pt.DataType, "fpt", pt.FPT, "cache_evicted", receipt.CacheEvicted)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
@@ -0,0 +1,60 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDetokenizeShreddedTokenWithReadV2 needs a Postgres database (TEST_DATABASE_URL).
+func TestDetokenizeShreddedTokenWithReadV2(t *testing.T) {
+	s, store := newDBTestServer(t)
+	km := s.keys.Load()
+	env := s.cipher
+
+	ctx := context.Background()
+	suffix := hex.EncodeToString(randomBytes(t, 8))
+	blind, fpt := "test-shred-"+suffix, "SHRED"+suffix
+	enc, keyVersion, err := env.Encrypt(ctx, []byte("ABCDE1234F"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encV2, err := s.encryptV2(km.aes, "PAN", blind, []byte("ABCDE1234F"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := store.InsertToken(ctx, []byte(enc), encV2, keyVersion, km.hmacVersion, blind, fpt, "PAN", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.DeleteToken(pt.ID, blind)
+
+	detokenize := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.detokenizeHandler(w, httptest.NewRequest(http.MethodPost, "/detokenize", strings.NewReader(`{"fpt":"`+fpt+`"}`)))
+		return w
+	}
+	if w := detokenize(); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ABCDE1234F") {
+		t.Fatalf("before shred: %d %s", w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	s.shredTokenHandler(w, httptest.NewRequest(http.MethodPost, "/admin/tokens/shred", strings.NewReader(`{"fpt":"`+fpt+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("shred: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := detokenize(); w.Code != http.StatusGone || strings.Contains(w.Body.String(), "ABCDE1234F") {
+		t.Fatalf("after shred: want 410, got %d %s", w.Code, w.Body.String())
+	}
+	after, err := store.GetByFPT(ctx, fpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.EncryptedValueV2) != 0 {
+		t.Error("encrypted_value_v2 kept after shred")
+	}
+}
@@ -0,0 +1,210 @@
+package bi_internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+// ScopeTenantAdmin lets a credential without a tenant of its own act for the tenant named in
+// X-Tenant-ID. It is never implied: the static API_KEY only holds it when API_KEY_SCOPES lists
+// it, like any other key.
+const ScopeTenantAdmin = "tenant_admin"
+
+var (
+	// ErrGlobalFallbackDenied is returned when a tenant caller hits a global (unowned) token of
+	// a data type that is configured as strictly tenant-isolated.
+	ErrGlobalFallbackDenied = errors.New("global token not available to tenants for this data type")
+	// ErrTenantHeaderNotAllowed is returned when a credential without a tenant sends
+	// X-Tenant-ID without holding ScopeTenantAdmin.
+	ErrTenantHeaderNotAllowed = errors.New("X-Tenant-ID needs a credential of that tenant or the " + ScopeTenantAdmin + " scope")
+)
+
+// bindTenant fixes the tenant of an authenticated request. A credential with a tenant acts for
+// it, and an X-Tenant-ID naming another one fails with mismatch. A credential without a tenant
+// acts for no tenant; only with ScopeTenantAdmin among its explicit scopes may it name one in
+// X-Tenant-ID.
+func bindTenant(ctx context.Context, r *http.Request, credTenant string, scopes []string, mismatch error) (context.Context, error) {
+	header := strings.TrimSpace(r.Header.Get("X-Tenant-ID"))
+	tenant := credTenant
+	switch {
+	case credTenant != "":
+		if header != "" && header != credTenant {
+			return nil, mismatch
+		}
+	case header == "":
+	case !slices.Contains(scopes, ScopeTenantAdmin):
+		auditEvent(ctx, "auth.tenant_header_rejected", "tenant", header)
+		return nil, ErrTenantHeaderNotAllowed
+	default:
+		tenant = header
+		ctx = context.WithValue(ctx, tenantNamedKey, true)
+	}
+	return context.WithValue(ctx, tenantIDKey, tenant), nil
+}
+
+// tenantNamed reports whether the request's tenant was named in X-Tenant-ID by a
+// ScopeTenantAdmin credential rather than bound to the credential.
+func tenantNamed(ctx context.Context) bool {
+	named, _ := ctx.Value(tenantNamedKey).(bool)
+	return named
+}
+
+// Blind index domains. Tokens created for a tenant are stored under a blind index bound to the
+// tenant, so two tenants tokenizing the same value get separate tokens and looking a value up
+// never reaches another tenant's token. Global tokens keep the plain blind index; rows created
+// before tenant-bound indexes also live under it, whoever owns them.
+const (
+	plainBlindDomain = ""
+	// overflowBlindDomain holds the global token of a value whose plain blind index is taken by
+	// a tenant token created before tenant-bound indexes
+	overflowBlindDomain = "global"
+)
+
+func tenantBlindDomain(tenant string) string {
+	if tenant == "" {
+		return plainBlindDomain
+	}
+	return "tenant:" + tenant
+}
+
+// blindIndexIn is the blind index of a normalized value in domain. Domains other than the plain
+// one hash under a key derived from the HMAC key and the domain name, so no value of one domain
+// can be chosen to hash to the blind index of a value in another.
+func blindIndexIn(key []byte, domain, normalized string) string {
+	if domain == plainBlindDomain {
+		return common.HMACBlindIndex(key, normalized)
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("pii-blind-index-domain:" + domain))
+	return common.HMACBlindIndex(m.Sum(nil), normalized)
+}
+
+// lookupInDomain finds the row of a normalized value in domain under each key of the HMAC ring
+// (current key first), so tokens created before an HMAC rotation still resolve.
+func (s *Server) lookupInDomain(ctx context.Context, km *keyMaterial, domain, normalized string) (*models.PiiToken, error) {
+	for _, k := range km.hmacRing("") {
+		pt, err := s.store.GetByBlindIndex(ctx, blindIndexIn(k.key, domain, normalized))
+		if err != nil {
+			return nil, err
+		}
+		if pt != nil && (pt.HMACKeyVersion == "" || pt.HMACKeyVersion == k.version) {
+			return pt, nil
+		}
+	}
+	return nil, nil
+}
+
+// lookupByValue returns the caller's token of a value (nil when it has none yet) and the blind
+// index a new token of the value is stored under. A tenant caller gets its own token, or a
+// global one when TENANT_GLOBAL_FALLBACK allows the type; a caller without a tenant only gets
+// global tokens. Another tenant's token is never returned, so tokenize cannot tell whether
+// another tenant holds a value. MOBILE rows created before E.164 normalization are still found
+// under their legacy blind index.
+func (s *Server) lookupByValue(ctx context.Context, km *keyMaterial, dataType, value string) (*models.PiiToken, string, error) {
+	pt, blind, err := s.lookupNormalized(ctx, km, dataType, common.NormalizePII(dataType, value))
+	if err != nil || pt != nil {
+		return pt, blind, err
+	}
+	legacy, ok := legacyNormalForm(dataType, value)
+	if !ok {
+		return nil, blind, nil
+	}
+	// rows of that time predate tenant-bound indexes, so they are all in the plain domain
+	if pt, err = s.lookupInDomain(ctx, km, plainBlindDomain, legacy); err != nil {
+		return nil, "", err
+	}
+	tenant := TenantFromContext(ctx)
+	if pt != nil && strings.EqualFold(pt.DataType, dataType) &&
+		(pt.TenantID == tenant || pt.TenantID == "" && (tenant == "" || s.globalFallback.allows(dataType))) {
+		return pt, blind, nil
+	}
+	return nil, blind, nil
+}
+
+// legacyNormalForm is the form a value was blind-indexed under before NormalizePII converted
+// MOBILE numbers to E.164: only trimmed. ok is false when that form is the current one.
+func legacyNormalForm(dataType, value string) (string, bool) {
+	if !strings.EqualFold(strings.TrimSpace(dataType), "MOBILE") {
+		return "", false
+	}
+	legacy := strings.TrimSpace(value)
+	return legacy, legacy != common.NormalizePII(dataType, value)
+}
+
+// lookupNormalized is lookupByValue of a normalized value under its current blind indexes.
+func (s *Server) lookupNormalized(ctx context.Context, km *keyMaterial, dataType, normalized string) (*models.PiiToken, string, error) {
+	tenant := TenantFromContext(ctx)
+	domain := tenantBlindDomain(tenant)
+	blind := blindIndexIn(km.hmac, domain, normalized)
+	pt, err := s.lookupInDomain(ctx, km, domain, normalized)
+	switch {
+	case err != nil:
+		return nil, "", err
+	case pt != nil && (tenant != "" || pt.TenantID == ""):
+		return pt, blind, nil
+	case pt != nil:
+		// the plain index holds a tenant's token; the global token goes to the overflow domain
+		pt, err = s.lookupInDomain(ctx, km, overflowBlindDomain, normalized)
+		return pt, blindIndexIn(km.hmac, overflowBlindDomain, normalized), err
+	case tenant == "":
+		return nil, blind, nil
+	}
+	// a tenant's tokens created before tenant-bound indexes, and global tokens, are plain
+	if pt, err = s.lookupInDomain(ctx, km, plainBlindDomain, normalized); err != nil {
+		return nil, "", err
+	}
+	if pt != nil && (pt.TenantID == tenant || pt.TenantID == "" && s.globalFallback.allows(dataType)) {
+		return pt, blind, nil
+	}
+	return nil, blind, nil
+}
+
+// globalFallback lists the data types whose global tokens tenant callers may use.
+type globalFallback struct {
+	all   bool
+	types map[string]bool
+}
+
+// globalFallbackFromEnv reads TENANT_GLOBAL_FALLBACK: "*" (default) lets every data type fall
+// back to the global vault, "none" isolates all of them, otherwise a comma-separated list of
+// data types (e.g. "PAN,MOBILE") that may fall back; the others are strictly tenant-isolated.
+func globalFallbackFromEnv() globalFallback {
+	raw := strings.TrimSpace(common.MaybeEnv("TENANT_GLOBAL_FALLBACK"))
+	if raw == "" || raw == "*" {
+		return globalFallback{all: true}
+	}
+	gf := globalFallback{types: map[string]bool{}}
+	if strings.EqualFold(raw, "none") {
+		return gf
+	}
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			gf.types[t] = true
+		}
+	}
+	return gf
+}
+
+func (g globalFallback) allows(dataType string) bool {
+	return g.all || g.types[strings.ToUpper(dataType)]
+}
+
+// checkGlobalFallback rejects tenant callers presenting a global token of a strictly isolated
+// data type. It only judges global tokens (owner ""): authorizeTokenAccess checks tenant-owned
+// ones, and tokenize never resolves a value to a token the caller may not use.
+func (s *Server) checkGlobalFallback(ctx context.Context, owner, dataType, fpt string) error {
+	caller := TenantFromContext(ctx)
+	if owner != "" || caller == "" || s.globalFallback.allows(dataType) {
+		return nil
+	}
+	auditEvent(ctx, "global_fallback.denied", "data_type", dataType, "fpt", fpt)
+	return ErrGlobalFallbackDenied
+}
@@ -0,0 +1,55 @@
+package bi_internal
+
+import (
+	"context"
+	"testing"
+)
+
+// TestTokenizeFindsLegacyMobileRow needs a Postgres database (TEST_DATABASE_URL).
+func TestTokenizeFindsLegacyMobileRow(t *testing.T) {
+	s, store := newDBTestServer(t)
+	km := s.keys.Load()
+	ctx := context.Background()
+
+	// a row of the time MOBILE values were only trimmed before blind indexing
+	legacy := "98765 43210"
+	if n, ok := legacyNormalForm("MOBILE", legacy); !ok || n != legacy {
+		t.Fatalf("legacyNormalForm = %q, %v", n, ok)
+	}
+	enc, keyVersion, err := s.cipher.Encrypt(ctx, []byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blind := blindIndexIn(km.hmac, plainBlindDomain, legacy)
+	pt, err := store.InsertToken(ctx, []byte(enc), nil, keyVersion, km.hmacVersion, blind, "+91LEGACY"+blind[:8], "MOBILE", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.DeleteToken(pt.ID, blind)
+
+	fpt, err := s.Tokenize(ctx, "MOBILE", " "+legacy+" ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fpt != pt.FPT {
+		t.Errorf("tokenize of a value stored under the old normal form = %q, want the existing %q", fpt, pt.FPT)
+	}
+}
+
+func TestLegacyNormalForm(t *testing.T) {
+	cases := []struct {
+		dataType, value, legacy string
+		ok                      bool
+	}{
+		{"MOBILE", " 9876543210 ", "9876543210", true},
+		{"mobile", "+91 98765 43210", "+91 98765 43210", true},
+		{"MOBILE", "+919876543210", "", false},
+		{"PAN", " abcde1234f", "", false},
+	}
+	for _, c := range cases {
+		legacy, ok := legacyNormalForm(c.dataType, c.value)
+		if ok != c.ok || ok && legacy != c.legacy {
+			t.Errorf("legacyNormalForm(%q, %q) = %q, %v; want %q, %v", c.dataType, c.value, legacy, ok, c.legacy, c.ok)
+		}
+	}
+}
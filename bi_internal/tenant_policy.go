@@ -0,0 +1,296 @@
+package bi_internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"bi_pii_tokenizer/common"
+)
+
+// ErrTypeNotAllowed is returned when the tenant policy does not allow the data type.
+var ErrTypeNotAllowed = errors.New("data type not allowed by tenant policy")
+
+// TenantPolicy is the PII handling policy of a tenant. Unset fields fall back to the defaults
+// of the policy document.
+type TenantPolicy struct {
+	// AllowedTypes are the data types the tenant may tokenize and detokenize (unset = all)
+	AllowedTypes []string `yaml:"allowed_types,omitempty" json:"allowed_types,omitempty"`
+	Masking      *struct {
+		// Detokenize returns masked values instead of clear values
+		Detokenize *bool `yaml:"detokenize,omitempty" json:"detokenize,omitempty"`
+		// DefaultOutputFormats is used by /tokenize requests that name no output format
+		DefaultOutputFormats []string `yaml:"default_output_formats,omitempty" json:"default_output_formats,omitempty"`
+	} `yaml:"masking,omitempty" json:"masking,omitempty"`
+	// TokenizeQuota and DetokenizeQuota bound the values the tenant tokenizes and detokenizes
+	TokenizeQuota   *QuotaPolicy `yaml:"tokenize_quota,omitempty" json:"tokenize_quota,omitempty"`
+	DetokenizeQuota *QuotaPolicy `yaml:"detokenize_quota,omitempty" json:"detokenize_quota,omitempty"`
+	Retention       *struct {
+		// TokenDays purges the tenant's tokens created more than this many days ago
+		TokenDays int `yaml:"token_days" json:"token_days"`
+	} `yaml:"retention,omitempty" json:"retention,omitempty"`
+}
+
+// PolicyDocument is the TENANT_POLICY_FILE: defaults plus per-tenant overrides.
+type PolicyDocument struct {
+	Version  int                     `yaml:"version" json:"version"`
+	Defaults TenantPolicy            `yaml:"defaults" json:"defaults"`
+	Tenants  map[string]TenantPolicy `yaml:"tenants" json:"tenants"`
+}
+
+// effectivePolicy is a tenant's resolved policy.
+type effectivePolicy struct {
+	allowedTypes         []string
+	maskDetokenize       bool
+	defaultOutputFormats []string
+	tokenizeQuota        QuotaPolicy
+	detokenizeQuota      QuotaPolicy
+	tokenRetentionDays   int
+}
+
+func (p *PolicyDocument) resolve(tenant string) effectivePolicy {
+	var ep effectivePolicy
+	for _, tp := range []TenantPolicy{p.Defaults, p.Tenants[tenant]} {
+		if tp.AllowedTypes != nil {
+			ep.allowedTypes = tp.AllowedTypes
+		}
+		if m := tp.Masking; m != nil {
+			if m.Detokenize != nil {
+				ep.maskDetokenize = *m.Detokenize
+			}
+			if m.DefaultOutputFormats != nil {
+				ep.defaultOutputFormats = m.DefaultOutputFormats
+			}
+		}
+		if q := tp.TokenizeQuota; q != nil {
+			ep.tokenizeQuota = *q
+		}
+		if q := tp.DetokenizeQuota; q != nil {
+			ep.detokenizeQuota = *q
+		}
+		if r := tp.Retention; r != nil {
+			ep.tokenRetentionDays = r.TokenDays
+		}
+	}
+	return ep
+}
+
+// validate normalizes data type names and rejects values handlers could not apply.
+func (p *PolicyDocument) validate() error {
+	if p.Version != 1 {
+		return fmt.Errorf("unsupported policy version %d, want 1", p.Version)
+	}
+	check := func(where string, tp *TenantPolicy) error {
+		for i, t := range tp.AllowedTypes {
+			tp.AllowedTypes[i] = strings.ToUpper(strings.TrimSpace(t))
+		}
+		if m := tp.Masking; m != nil {
+			for _, f := range m.DefaultOutputFormats {
+				switch f {
+				case "fpt", "masked", "hash16", "blind_hash":
+				default:
+					return fmt.Errorf("%s: unsupported output format %q", where, f)
+				}
+			}
+		}
+		if err := tp.TokenizeQuota.validate(); err != nil {
+			return fmt.Errorf("%s: tokenize_quota: %w", where, err)
+		}
+		if err := tp.DetokenizeQuota.validate(); err != nil {
+			return fmt.Errorf("%s: detokenize_quota: %w", where, err)
+		}
+		if r := tp.Retention; r != nil && r.TokenDays < 0 {
+			return fmt.Errorf("%s: retention.token_days must not be negative", where)
+		}
+		return nil
+	}
+	if err := check("defaults", &p.Defaults); err != nil {
+		return err
+	}
+	if p.Defaults.Retention != nil {
+		// the purge only knows the tenants named in the document
+		return fmt.Errorf("defaults: retention must be set per tenant")
+	}
+	for name, tp := range p.Tenants {
+		if err := check("tenant "+name, &tp); err != nil {
+			return err
+		}
+		p.Tenants[name] = tp
+	}
+	return nil
+}
+
+// tenantPolicies holds the policy document of TENANT_POLICY_FILE. The file is re-read when its
+// modification time changes (checked at most every TENANT_SETTINGS_REFRESH_SEC); an invalid
+// new version is logged and the previous one kept. Without a file no policy applies.
+type tenantPolicies struct {
+	path    string
+	refresh time.Duration
+
+	mu        sync.RWMutex
+	doc       *PolicyDocument
+	modTime   time.Time
+	checkedAt time.Time
+	loadedAt  time.Time
+	lastError string
+	// sum is the SHA-256 of the loaded file
+	sum string
+	// onReload is told about every accepted reload (not the initial load)
+	onReload func(path, sum string)
+
+	// quota counts quota usage per tenant, operation and period without Redis
+	quotaMu sync.Mutex
+	quota   map[string]int64
+}
+
+func tenantPoliciesFromEnv() (*tenantPolicies, error) {
+	tp := &tenantPolicies{
+		path:    strings.TrimSpace(common.MaybeEnv("TENANT_POLICY_FILE")),
+		refresh: time.Duration(envInt("TENANT_SETTINGS_REFRESH_SEC", int(defaultTenantSettingsRefresh.Seconds()))) * time.Second,
+		quota:   map[string]int64{},
+	}
+	if tp.path == "" {
+		return tp, nil
+	}
+	if err := tp.load(); err != nil {
+		return nil, fmt.Errorf("tenant policy %s: %w", tp.path, err)
+	}
+	return tp, nil
+}
+
+func (tp *tenantPolicies) load() error {
+	info, err := os.Stat(tp.path)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(tp.path)
+	if err != nil {
+		return err
+	}
+	var doc PolicyDocument
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if err := doc.validate(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(raw)
+	tp.mu.Lock()
+	tp.doc, tp.modTime, tp.loadedAt, tp.lastError = &doc, info.ModTime(), time.Now().UTC(), ""
+	tp.sum = hex.EncodeToString(sum[:])
+	tp.mu.Unlock()
+	return nil
+}
+
+// current returns the policy document, re-reading a changed file first.
+func (tp *tenantPolicies) current() *PolicyDocument {
+	if tp.path == "" {
+		return nil
+	}
+	tp.mu.RLock()
+	stale := time.Since(tp.checkedAt) > tp.refresh
+	tp.mu.RUnlock()
+	if stale {
+		tp.mu.Lock()
+		tp.checkedAt = time.Now()
+		modTime := tp.modTime
+		tp.mu.Unlock()
+		if info, err := os.Stat(tp.path); err == nil && !info.ModTime().Equal(modTime) {
+			if err := tp.load(); err != nil {
+				log.Printf("tenant policy: reload of %s rejected, keeping the previous policy: %v", tp.path, err)
+				tp.mu.Lock()
+				tp.lastError = err.Error()
+				tp.mu.Unlock()
+			} else {
+				log.Printf("tenant policy: reloaded %s", tp.path)
+				if tp.onReload != nil {
+					tp.mu.RLock()
+					sum := tp.sum
+					tp.mu.RUnlock()
+					tp.onReload(tp.path, sum)
+				}
+			}
+		}
+	}
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return tp.doc
+}
+
+// policyFor returns the effective policy of the request's tenant; ok is false when no policy
+// applies (no policy file, or a caller without tenant).
+func (s *Server) policyFor(ctx context.Context) (effectivePolicy, bool) {
+	tenant := TenantFromContext(ctx)
+	doc := s.policies.current()
+	if doc == nil || tenant == "" {
+		return effectivePolicy{}, false
+	}
+	return doc.resolve(tenant), true
+}
+
+// checkTypeAllowed enforces the tenant's allowed_types.
+func (s *Server) checkTypeAllowed(ctx context.Context, dataType string) error {
+	p, ok := s.policyFor(ctx)
+	if !ok || p.allowedTypes == nil || slices.Contains(p.allowedTypes, strings.ToUpper(dataType)) {
+		return nil
+	}
+	auditEvent(ctx, "policy.type_denied", "data_type", dataType)
+	return ErrTypeNotAllowed
+}
+
+// detokenizeOutput applies the tenant's masking policy to a detokenized value.
+func (s *Server) detokenizeOutput(ctx context.Context, dataType, value string) string {
+	if p, ok := s.policyFor(ctx); ok && p.maskDetokenize {
+		return common.MaskPII(dataType, value)
+	}
+	return value
+}
+
+// tokenRetentionDays returns the tenants with a token retention period.
+func (s *Server) tokenRetentionDays() map[string]int {
+	doc := s.policies.current()
+	if doc == nil {
+		return nil
+	}
+	out := map[string]int{}
+	for tenant := range doc.Tenants {
+		if days := doc.resolve(tenant).tokenRetentionDays; days > 0 {
+			out[tenant] = days
+		}
+	}
+	return out
+}
+
+// GET /admin/tenant-policy
+// The loaded policy document with its source, load time and the error of a rejected reload.
+func (s *Server) tenantPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	doc := s.policies.current()
+	tp := s.policies
+	tp.mu.RLock()
+	out := map[string]interface{}{"source": tp.path, "policy": doc}
+	if doc != nil {
+		out["loaded_at"] = tp.loadedAt
+		out["sha256"] = tp.sum
+	}
+	if tp.lastError != "" {
+		out["last_error"] = tp.lastError
+	}
+	tp.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,126 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const defaultTenantSettingsRefresh = 30 * time.Second
+
+// tenantSettings is an in-memory copy of pii_tenant_settings, reloaded every
+// TENANT_SETTINGS_REFRESH_SEC so changes made on another replica apply without a restart.
+type tenantSettings struct {
+	mu       sync.RWMutex
+	byKey    map[string]models.TenantSetting
+	loadedAt time.Time
+	refresh  time.Duration
+}
+
+func newTenantSettings() *tenantSettings {
+	return &tenantSettings{
+		refresh: time.Duration(envInt("TENANT_SETTINGS_REFRESH_SEC", int(defaultTenantSettingsRefresh.Seconds()))) * time.Second,
+	}
+}
+
+func tenantSettingKey(tenantID, dataType string) string {
+	return tenantID + "|" + strings.ToUpper(dataType)
+}
+
+// tenantSetting returns the settings of tenantID for dataType (zero value when none).
+func (s *Server) tenantSetting(tenantID, dataType string) models.TenantSetting {
+	if tenantID == "" {
+		return models.TenantSetting{}
+	}
+	ts := s.tenantSettings
+	ts.mu.RLock()
+	stale := time.Since(ts.loadedAt) > ts.refresh
+	ts.mu.RUnlock()
+	if stale {
+		s.reloadTenantSettings()
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.byKey[tenantSettingKey(tenantID, dataType)]
+}
+
+// reloadTenantSettings refreshes the in-memory copy; on error the previous copy is kept.
+func (s *Server) reloadTenantSettings() {
+	list, err := s.store.TenantSettings()
+	ts := s.tenantSettings
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.loadedAt = time.Now()
+	s.degradation.track(subsystemTenantSettings, impactStale, err)
+	if err != nil {
+		log.Printf("tenant settings: reload failed, keeping previous settings: %v", err)
+		return
+	}
+	byKey := make(map[string]models.TenantSetting, len(list))
+	for _, t := range list {
+		byKey[tenantSettingKey(t.TenantID, t.DataType)] = t
+	}
+	ts.byKey = byKey
+}
+
+type PutTenantSettingRequest struct {
+	TokenPrefix string `json:"token_prefix"`
+}
+
+// GET /admin/tenant-settings
+func (s *Server) listTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.TenantSettings()
+	if err != nil {
+		log.Printf("list tenant settings error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": list})
+}
+
+// PUT /admin/tenant-settings/{tenant}/{data_type}
+func (s *Server) putTenantSettingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant := strings.TrimSpace(vars["tenant"])
+	dataType := strings.ToUpper(strings.TrimSpace(vars["data_type"]))
+	var req PutTenantSettingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.TokenPrefix = strings.ToUpper(strings.TrimSpace(req.TokenPrefix))
+	if tenant == "" || dataType == "" {
+		writeJSONError(w, http.StatusBadRequest, "tenant and data_type are required")
+		return
+	}
+	if req.TokenPrefix != "" {
+		if err := common.ValidateTokenPrefix(dataType, req.TokenPrefix); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.checkPrefixConstraints(dataType, req.TokenPrefix); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	t, err := s.store.PutTenantSetting(&models.TenantSetting{TenantID: tenant, DataType: dataType, TokenPrefix: req.TokenPrefix})
+	if err != nil {
+		log.Printf("put tenant setting error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.reloadTenantSettings()
+	s.adminChange(r.Context(), "tenant_settings.updated", "settings_tenant", tenant, "data_type", dataType, "token_prefix", t.TokenPrefix)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,332 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+var tenantIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type OnboardTenantRequest struct {
+	Tenant string `json:"tenant"`
+	Name   string `json:"name"`
+	// CallerID identifies the first API key in usage reports and audit logs (default: tenant)
+	CallerID string `json:"caller_id,omitempty"`
+	// Scopes of the first API key (default: tokenize, detokenize)
+	Scopes []string `json:"scopes,omitempty"`
+	// Settings are the per-type tenant settings, keyed by data type
+	Settings map[string]PutTenantSettingRequest `json:"settings,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	// Tenant binds a key created with POST /admin/api-keys to a tenant ("" = team key)
+	Tenant   string   `json:"tenant,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	CallerID string   `json:"caller_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	// ExpiresAt is when the key stops being accepted (default: never)
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// UpdateAPIKeyRequest changes an API key; omitted fields are left alone.
+type UpdateAPIKeyRequest struct {
+	Enabled *bool    `json:"enabled,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+	// ExpiresAt sets the expiry; ClearExpiry removes it
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ClearExpiry bool       `json:"clear_expiry,omitempty"`
+}
+
+// ClientConfig is what a client needs to call the service as the tenant; its fields match the
+// arguments of the Python client (TokenizerClient(**config)).
+type ClientConfig struct {
+	BaseURL  string `json:"base_url,omitempty"`
+	APIKey   string `json:"api_key"`
+	TenantID string `json:"tenant_id"`
+	CallerID string `json:"caller_id"`
+}
+
+// TenantBootstrap is the onboarding result. The API key in Config is only ever returned here.
+type TenantBootstrap struct {
+	Tenant   *models.Tenant         `json:"tenant,omitempty"`
+	APIKey   *models.APIKey         `json:"api_key"`
+	Settings []models.TenantSetting `json:"settings,omitempty"`
+	Config   ClientConfig           `json:"config"`
+	Versions map[string]string      `json:"versions"`
+}
+
+func (s *Server) clientConfig(key *models.APIKey, secret string) ClientConfig {
+	cfg := ClientConfig{APIKey: secret, TenantID: key.TenantID, CallerID: key.CallerID}
+	if base := strings.TrimRight(common.MaybeEnv("PUBLIC_BASE_URL"), "/"); base != "" {
+		cfg.BaseURL = base + apiPathPrefix
+	}
+	return cfg
+}
+
+func (s *Server) bootstrap(t *models.Tenant, key *models.APIKey, secret string, settings []models.TenantSetting) TenantBootstrap {
+	return TenantBootstrap{
+		Tenant:   t,
+		APIKey:   key,
+		Settings: settings,
+		Config:   s.clientConfig(key, secret),
+		Versions: map[string]string{"key_version": s.keyVersion(), "generator": s.tokenGeneratorVersion()},
+	}
+}
+
+// POST /admin/tenants
+// Onboards a tenant in one step: the tenant record, its per-type settings and a first API key
+// with scopes, returned with a ready-to-use client config. Tokens of all tenants use the
+// service keys, so there is no per-tenant key material to generate.
+func (s *Server) onboardTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var req OnboardTenantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Tenant = strings.TrimSpace(req.Tenant)
+	if !tenantIDRE.MatchString(req.Tenant) {
+		writeJSONError(w, http.StatusBadRequest, "tenant must be 1 to 64 letters, digits, '.', '_' or '-'")
+		return
+	}
+	req.CallerID = strings.TrimSpace(req.CallerID)
+	if req.CallerID == "" {
+		req.CallerID = req.Tenant
+	}
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var settings []models.TenantSetting
+	for dataType, st := range req.Settings {
+		dataType = strings.ToUpper(strings.TrimSpace(dataType))
+		prefix := strings.ToUpper(strings.TrimSpace(st.TokenPrefix))
+		if prefix != "" {
+			if err := common.ValidateTokenPrefix(dataType, prefix); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := s.checkPrefixConstraints(dataType, prefix); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		settings = append(settings, models.TenantSetting{TenantID: req.Tenant, DataType: dataType, TokenPrefix: prefix})
+	}
+
+	secret, hash, err := newAPIKey()
+	if err != nil {
+		log.Printf("onboard tenant: generate API key: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	tenant := &models.Tenant{TenantID: req.Tenant, Name: strings.TrimSpace(req.Name)}
+	key := &models.APIKey{TenantID: req.Tenant, CallerID: req.CallerID, Scopes: scopes}
+	if err := s.store.OnboardTenant(tenant, settings, key, hash); err != nil {
+		if err == models.ErrTenantExists {
+			writeJSONError(w, http.StatusConflict, "tenant already exists")
+			return
+		}
+		log.Printf("onboard tenant error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if len(settings) > 0 {
+		s.reloadTenantSettings()
+	}
+	s.adminChange(r.Context(), "tenant.onboarded", "onboarded_tenant", tenant.TenantID, "api_key_id", key.ID,
+		"scopes", strings.Join(key.Scopes, ","), "settings", len(settings))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.bootstrap(tenant, key, secret, settings))
+}
+
+// GET /admin/tenants
+// Onboarded tenants with their API keys (never the keys themselves).
+func (s *Server) listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.store.Tenants()
+	if err != nil {
+		log.Printf("list tenants error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	keys, err := s.store.APIKeys("")
+	if err != nil {
+		log.Printf("list API keys error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	byTenant := map[string][]*models.APIKey{}
+	for _, k := range keys {
+		byTenant[k.TenantID] = append(byTenant[k.TenantID], k)
+	}
+	results := make([]map[string]interface{}, 0, len(tenants))
+	for _, t := range tenants {
+		tenantKeys := byTenant[t.TenantID]
+		if tenantKeys == nil {
+			tenantKeys = []*models.APIKey{}
+		}
+		results = append(results, map[string]interface{}{
+			"tenant": t.TenantID, "name": t.Name, "created_at": t.CreatedAt, "api_keys": tenantKeys,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// POST /admin/tenants/{tenant}/api-keys
+// Provisions another API key for an onboarded tenant (e.g. to rotate keys or split callers).
+func (s *Server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Tenant = strings.TrimSpace(mux.Vars(r)["tenant"])
+	s.createAPIKey(w, r, req)
+}
+
+// POST /admin/api-keys
+// Provisions an API key for a consuming team (no tenant: it acts for the tenant in
+// X-Tenant-ID) or, with "tenant", for an onboarded tenant. The key is only returned here.
+func (s *Server) createTeamAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Tenant = strings.TrimSpace(req.Tenant)
+	req.CallerID = strings.TrimSpace(req.CallerID)
+	if req.Tenant == "" && req.CallerID == "" {
+		writeJSONError(w, http.StatusBadRequest, "caller_id is required for a team key")
+		return
+	}
+	s.createAPIKey(w, r, req)
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request, req CreateAPIKeyRequest) {
+	tenant := req.Tenant
+	req.CallerID = strings.TrimSpace(req.CallerID)
+	if req.CallerID == "" {
+		req.CallerID = tenant
+	}
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeJSONError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+	secret, hash, err := newAPIKey()
+	if err != nil {
+		log.Printf("create API key: generate: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	key, err := s.store.CreateAPIKey(&models.APIKey{
+		TenantID: tenant, Name: strings.TrimSpace(req.Name), CallerID: req.CallerID, Scopes: scopes, ExpiresAt: req.ExpiresAt,
+	}, hash)
+	if err != nil {
+		log.Printf("create API key error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if key == nil {
+		writeJSONError(w, http.StatusNotFound, "tenant not found")
+		return
+	}
+	s.adminChange(r.Context(), "api_key.created", "key_tenant", tenant, "api_key_id", key.ID, "scopes", strings.Join(key.Scopes, ","))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.bootstrap(nil, key, secret, nil))
+}
+
+// DELETE /admin/api-keys/{id}
+func (s *Server) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid API key id")
+		return
+	}
+	ok, err := s.store.RevokeAPIKey(id)
+	if err != nil {
+		log.Printf("revoke API key error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "API key not found or already revoked")
+		return
+	}
+	s.apiKeys.clear()
+	s.adminChange(r.Context(), "api_key.revoked", "api_key_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/api-keys[?tenant=]
+// Every API key, tenant and team keys, with scopes, expiry and state (never the keys).
+func (s *Server) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.APIKeys(strings.TrimSpace(r.URL.Query().Get("tenant")))
+	if err != nil {
+		log.Printf("list API keys error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_keys": keys})
+}
+
+// PATCH /admin/api-keys/{id}
+// Enables or disables a key, or changes its scopes or expiry. Like a revocation, it applies
+// immediately on this instance and within API_KEY_CACHE_SEC on the others.
+func (s *Server) updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid API key id")
+		return
+	}
+	var req UpdateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	u := models.APIKeyUpdate{Enabled: req.Enabled, ExpiresAt: req.ExpiresAt, ClearExpiry: req.ClearExpiry}
+	if req.Scopes != nil {
+		if u.Scopes, err = normalizeScopes(req.Scopes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.ExpiresAt != nil && req.ClearExpiry {
+		writeJSONError(w, http.StatusBadRequest, "expires_at and clear_expiry are exclusive")
+		return
+	}
+	key, err := s.store.UpdateAPIKey(id, u)
+	if err != nil {
+		log.Printf("update API key error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if key == nil {
+		writeJSONError(w, http.StatusNotFound, "API key not found or revoked")
+		return
+	}
+	s.apiKeys.clear()
+	s.adminChange(r.Context(), "api_key.updated", "api_key_id", id, "enabled", key.Enabled, "scopes", strings.Join(key.Scopes, ","))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,90 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// testVectorTypes are the data types with fixed test vector inputs.
+var testVectorTypes = []string{"PAN", "AADHAR", "MOBILE"}
+
+// TestVector is one input→token pair of the current key and generator configuration.
+type TestVector struct {
+	PIIType    string `json:"pii_type"`
+	Input      string `json:"input"`
+	Normalized string `json:"normalized"`
+	Token      string `json:"token"`
+}
+
+type TestVectorsResponse struct {
+	Generator      string       `json:"generator"`
+	KeyVersion     string       `json:"key_version"`
+	HMACKeyVersion string       `json:"hmac_key_version"`
+	Tenant         string       `json:"tenant,omitempty"`
+	Vectors        []TestVector `json:"vectors"`
+}
+
+// testVectorsEnabled reports TEST_VECTORS_ENABLED; the endpoint exposes generator output under
+// the live keys, so it is only for non-production environments with test keys.
+func testVectorsEnabled() bool {
+	return strings.EqualFold(common.MaybeEnv("TEST_VECTORS_ENABLED"), "true")
+}
+
+// GET /test-vectors[?type=PAN]
+// Non-production only (TEST_VECTORS_ENABLED=true). Tokens of fixed synthetic values under the
+// current keys, generator and the caller's tenant settings, so integrators can check that
+// their clients produce and consume identical tokens. Nothing is written to the vault.
+func (s *Server) testVectorsHandler(w http.ResponseWriter, r *http.Request) {
+	types := testVectorTypes
+	if t := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("type"))); t != "" {
+		types = []string{t}
+	}
+
+	ctx := r.Context()
+	km := s.keys.Load()
+	resp := TestVectorsResponse{
+		Generator:      s.tokenGeneratorVersion(),
+		KeyVersion:     s.keyVersion(),
+		HMACKeyVersion: km.hmacVersion,
+		Tenant:         TenantFromContext(ctx),
+		Vectors:        []TestVector{},
+	}
+	for _, dataType := range types {
+		inputs, err := common.TestVectorInputs(dataType)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "type must be "+strings.Join(testVectorTypes, ", "))
+			return
+		}
+		for _, input := range inputs {
+			normalized := common.NormalizePII(dataType, input)
+			token, err := firstTokenCandidate(s.generator(ctx, dataType, km), blindIndexIn(km.hmac, tenantBlindDomain(TenantFromContext(ctx)), normalized), normalized)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			resp.Vectors = append(resp.Vectors, TestVector{PIIType: dataType, Input: input, Normalized: normalized, Token: token})
+		}
+	}
+	s.setVersionHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// firstTokenCandidate is the token /tokenize issues for a value new to the vault: the first
+// candidate that passes the output constraints.
+func firstTokenCandidate(gen *FPTGenerator, blind, normalized string) (string, error) {
+	for counter := 0; counter < maxTokenCandidates; counter++ {
+		candidate, valid, err := gen.Candidate(blind, normalized, counter)
+		if err != nil {
+			return "", err
+		}
+		if valid {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no valid %s token candidate after %d attempts", gen.dataType, maxTokenCandidates)
+}
@@ -0,0 +1,152 @@
+package bi_internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+)
+
+const (
+	// tlsReloadCheck is how often the certificate files are checked for a rotation
+	tlsReloadCheck = 5 * time.Second
+	// tlsExpiryWarning is how long before expiry a loaded certificate is logged as expiring
+	tlsExpiryWarning = 14 * 24 * time.Hour
+)
+
+// ServerTLSConfig returns the TLS settings of the listener, or nil to serve plain HTTP when
+// TLS_CERT_FILE is unset. TLS_MIN_VERSION is 1.2 (default) or 1.3; FIPS mode allows only TLS
+// 1.2 with ECDHE AES-GCM suites. The certificate, its key and the client CA bundle are re-read
+// when their files change, so a rotation (cert-manager, a mounted secret) applies to new
+// connections without a restart. With TLS_CLIENT_CA_FILE
+// client certificates signed by that CA are verified when presented; whether one is required
+// is decided per request, so readiness probes and reveal links still work without one.
+func ServerTLSConfig() (*tls.Config, error) {
+	f := &tlsFiles{
+		certFile: strings.TrimSpace(common.MaybeEnv("TLS_CERT_FILE")),
+		keyFile:  strings.TrimSpace(common.MaybeEnv("TLS_KEY_FILE")),
+		caFile:   strings.TrimSpace(common.MaybeEnv("TLS_CLIENT_CA_FILE")),
+	}
+	if f.certFile == "" {
+		if f.caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if f.keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE needs TLS_KEY_FILE")
+	}
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch v := strings.TrimSpace(common.MaybeEnv("TLS_MIN_VERSION")); v {
+	case "", "1.2":
+	case "1.3":
+		base.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("TLS_MIN_VERSION %q: want 1.2 or 1.3", v)
+	}
+	if FIPSMode() {
+		if base.MinVersion == tls.VersionTLS13 {
+			return nil, errors.New("TLS_MIN_VERSION=1.3 is not available in FIPS mode")
+		}
+		restrictTLSToFIPS(base)
+	}
+	if f.caFile != "" {
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := f.current()
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*cert}
+		c.ClientCAs = pool
+		return c, nil
+	}
+	return cfg, nil
+}
+
+// tlsFiles holds the loaded server certificate and client CA pool and reloads them when one
+// of the files changes. A failed reload (e.g. the certificate was written but the key not yet)
+// keeps the previous pair and is retried at the next check.
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// stamp is the modification times and sizes of the files at the last load
+	stamp   string
+	checked time.Time
+}
+
+func (f *tlsFiles) fileStamp() (string, error) {
+	var b strings.Builder
+	for _, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", name, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return b.String(), nil
+}
+
+// load reads the files; on error nothing changes.
+func (f *tlsFiles) load() error {
+	stamp, err := f.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE %s holds no PEM certificates", f.caFile)
+		}
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		cert.Leaf = leaf
+		log.Printf("tls: serving certificate %s, valid until %s", leaf.Subject, leaf.NotAfter.UTC().Format(time.RFC3339))
+		if time.Until(leaf.NotAfter) < tlsExpiryWarning {
+			log.Printf("warning: tls: server certificate expires at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	f.cert, f.clientCAs, f.stamp = &cert, pool, stamp
+	return nil
+}
+
+// current returns the certificate and client CA pool, reloading them first when the files
+// changed since the last load.
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) >= tlsReloadCheck {
+		f.checked = time.Now()
+		if stamp, err := f.fileStamp(); err == nil && stamp != f.stamp {
+			if err := f.load(); err != nil {
+				log.Printf("tls: reloading certificates failed, keeping the current ones: %v", err)
+			}
+		}
+	}
+	return f.cert, f.clientCAs
+}
@@ -0,0 +1,119 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+// DeleteTokenRequest names the token to delete, by fpt or by pii_type + pii_value.
+type DeleteTokenRequest struct {
+	FPT      string `json:"fpt,omitempty"`
+	PIIType  string `json:"pii_type,omitempty"`
+	PIIValue string `json:"pii_value,omitempty"`
+}
+
+// DeletionReceipt confirms an erasure. It never contains the PII value.
+type DeletionReceipt struct {
+	ReceiptID string    `json:"receipt_id"`
+	FPT       string    `json:"fpt"`
+	DataType  string    `json:"data_type"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// CacheEvicted is false when the cache could not be reached; its entries then expire with
+	// their TTL (detokenize of a still-cached token keeps working until then).
+	CacheEvicted bool `json:"cache_evicted"`
+	// KeyShredded is set when the token's data key was deleted too (envelope encryption), so
+	// copies of the ciphertext elsewhere no longer decrypt.
+	KeyShredded bool `json:"key_shredded,omitempty"`
+}
+
+// DELETE /token
+// Data-subject erasure: removes the token row (ciphertext, blind index and token) and its
+// source-system metadata, and evicts its cache entries. Only the owning tenant can delete a
+// token; sharing grants do not apply.
+func (s *Server) deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeleteTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	req.FPT = strings.TrimSpace(req.FPT)
+	req.PIIType = strings.ToUpper(strings.TrimSpace(req.PIIType))
+	req.PIIValue = strings.TrimSpace(req.PIIValue)
+	byValue := req.PIIType != "" || req.PIIValue != ""
+	switch {
+	case req.FPT != "" && byValue:
+		writeJSONError(w, http.StatusBadRequest, "set fpt or pii_type and pii_value, not both")
+		return
+	case req.FPT == "" && (req.PIIType == "" || req.PIIValue == ""):
+		writeJSONError(w, http.StatusBadRequest, "fpt or pii_type and pii_value are required")
+		return
+	}
+
+	ctx := r.Context()
+	var pt *models.PiiToken
+	var err error
+	if byValue {
+		pt, _, err = s.lookupByValue(ctx, s.keys.Load(), req.PIIType, req.PIIValue)
+		if err == nil && pt != nil && pt.DataType != req.PIIType {
+			pt = nil
+		}
+	} else {
+		pt, err = s.store.GetByFPT(ctx, req.FPT)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "delete token: lookup failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if pt == nil {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if pt.TenantID != TenantFromContext(ctx) {
+		auditEvent(ctx, "token.delete_denied", "owner_tenant", pt.TenantID, "data_type", pt.DataType, "fpt", pt.FPT)
+		writeJSONError(w, http.StatusForbidden, "token belongs to another tenant")
+		return
+	}
+
+	ok, err := s.store.DeleteToken(pt.ID, pt.BlindIndex)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "delete token failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+
+	receipt := DeletionReceipt{
+		ReceiptID: newRequestID(),
+		FPT:       pt.FPT,
+		DataType:  pt.DataType,
+		TenantID:  pt.TenantID,
+		DeletedAt: time.Now().UTC(),
+	}
+	receipt.CacheEvicted = true
+	if s.tokens != nil {
+		if err := s.tokens.Evict(ctx, pt.DataType, pt.BlindIndex, pt.FPT); err != nil {
+			slog.WarnContext(ctx, "delete token: cache eviction failed", "data_type", pt.DataType, "fpt", pt.FPT, "error", err)
+			receipt.CacheEvicted = false
+		}
+	}
+	if shredded, err := s.shredTokenKey(pt); err != nil {
+		slog.WarnContext(ctx, "delete token: shredding the data key failed", "data_type", pt.DataType, "fpt", pt.FPT, "error", err)
+	} else {
+		receipt.KeyShredded = shredded
+	}
+	s.recordUsage(ctx, "delete", pt.DataType)
+	auditEvent(ctx, "token.deleted", "receipt_id", receipt.ReceiptID, "data_type", pt.DataType, "fpt", pt.FPT, "cache_evicted", receipt.CacheEvicted, "key_shredded", receipt.KeyShredded)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
@@ -0,0 +1,289 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/common"
+)
+
+// Token segment sources.
+const (
+	// segmentGenerated characters are derived by the token generator
+	segmentGenerated = "generated"
+	// segmentPrefix is the tenant's token prefix of the type
+	segmentPrefix = "prefix"
+	// segmentValue characters are copied from the value (MOBILE country code, EMAIL domain,
+	// preserved PAN positions)
+	segmentValue   = "value"
+	segmentLiteral = "literal"
+)
+
+const (
+	formatLetters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	formatDigits  = "0123456789"
+)
+
+// TokenSegment is one part of a token, in order. Pattern is a regular expression in the
+// subset shared by RE2, PCRE, Java and ECMAScript: literals, character classes, counted
+// repetition and non-capturing alternation.
+type TokenSegment struct {
+	Name      string `json:"name"`
+	Pattern   string `json:"pattern"`
+	MinLength int    `json:"min_length"`
+	// MaxLength is 0 when the segment has the (unbounded) length of the value
+	MaxLength int    `json:"max_length"`
+	Source    string `json:"source"`
+}
+
+// TokenFormat describes the tokens of a PII type under the current generator settings and the
+// caller's tenant prefix, for schema validators and DLP scanners. Tokens are format
+// preserving, so Regex also matches real values unless the validity policy sets them apart;
+// Constraints lists what the regex does not express.
+type TokenFormat struct {
+	PIIType   string         `json:"pii_type"`
+	Generator string         `json:"generator"`
+	Tenant    string         `json:"tenant,omitempty"`
+	Regex     string         `json:"regex"`
+	MinLength int            `json:"min_length"`
+	MaxLength int            `json:"max_length"`
+	Segments  []TokenSegment `json:"segments"`
+	// Validity is TOKEN_VALIDITY_<TYPE> (any when unset)
+	Validity    string   `json:"validity,omitempty"`
+	Constraints []string `json:"constraints,omitempty"`
+}
+
+// tokenPosition is one character of a fixed-length token body.
+type tokenPosition struct {
+	name, chars, source string
+}
+
+// fixedSegments merges runs of equal positions into segments; prefix positions become one
+// literal.
+func fixedSegments(positions []tokenPosition) []TokenSegment {
+	var out []TokenSegment
+	for i := 0; i < len(positions); {
+		p, j := positions[i], i+1
+		for j < len(positions) && positions[j].name == p.name && positions[j].source == p.source && (p.source == segmentPrefix || positions[j].chars == p.chars) {
+			j++
+		}
+		if p.source == segmentPrefix {
+			var lit strings.Builder
+			for _, q := range positions[i:j] {
+				lit.WriteString(q.chars)
+			}
+			out = append(out, literalSegment(p.name, lit.String(), segmentPrefix))
+		} else {
+			out = append(out, classSegment(p.name, p.chars, p.source, j-i, j-i))
+		}
+		i = j
+	}
+	return out
+}
+
+func literalSegment(name, lit, source string) TokenSegment {
+	return TokenSegment{Name: name, Pattern: regexp.QuoteMeta(lit), MinLength: len(lit), MaxLength: len(lit), Source: source}
+}
+
+// classSegment is min to max (0 = unbounded) characters of chars.
+func classSegment(name, chars, source string, min, max int) TokenSegment {
+	return TokenSegment{Name: name, Pattern: charClass(chars) + repetition(min, max), MinLength: min, MaxLength: max, Source: source}
+}
+
+func repetition(min, max int) string {
+	switch {
+	case min == 1 && max == 1:
+		return ""
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	case max == 0 && min <= 1:
+		return "+"
+	case max == 0:
+		return fmt.Sprintf("{%d,}", min)
+	}
+	return fmt.Sprintf("{%d,%d}", min, max)
+}
+
+// charClass writes chars as a bracket expression, with runs of three or more consecutive
+// characters as ranges.
+func charClass(chars string) string {
+	set := []byte(chars)
+	slices.Sort(set)
+	set = slices.Compact(set)
+	esc := func(c byte) string {
+		if strings.IndexByte(`\]^-[`, c) >= 0 {
+			return `\` + string(c)
+		}
+		return string(c)
+	}
+	var b strings.Builder
+	b.WriteByte('[')
+	for i := 0; i < len(set); {
+		j := i
+		for j+1 < len(set) && set[j+1] == set[j]+1 {
+			j++
+		}
+		if j-i >= 2 {
+			b.WriteString(esc(set[i]) + "-" + esc(set[j]))
+		} else {
+			for k := i; k <= j; k++ {
+				b.WriteString(esc(set[k]))
+			}
+		}
+		i = j + 1
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// withPrefix puts the tenant's token prefix over the first positions.
+func withPrefix(positions []tokenPosition, prefix string) {
+	for i := 0; i < len(prefix) && i < len(positions); i++ {
+		positions[i] = tokenPosition{name: "prefix", chars: prefix[i : i+1], source: segmentPrefix}
+	}
+}
+
+// tokenFormat describes the tokens of dataType issued to tenant.
+func (s *Server) tokenFormat(tenant, dataType string) TokenFormat {
+	prefix := s.tenantSetting(tenant, dataType).TokenPrefix
+	validity := s.tokenValidity[dataType]
+	f := TokenFormat{PIIType: dataType, Generator: s.generators.Version(), Tenant: tenant, Validity: validity}
+	if f.Validity == "" {
+		f.Validity = common.ValidityAny
+	}
+	switch dataType {
+	case "PAN":
+		positions := make([]tokenPosition, 10)
+		for i := range positions {
+			switch {
+			case i < 5:
+				positions[i] = tokenPosition{"letters", formatLetters, segmentGenerated}
+			case i < 9:
+				positions[i] = tokenPosition{"digits", formatDigits, segmentGenerated}
+			default:
+				positions[i] = tokenPosition{"check_letter", formatLetters, segmentGenerated}
+			}
+		}
+		// in the order the generator applies them: prefix, validity, preserved positions
+		withPrefix(positions, prefix)
+		if f.Validity != common.ValidityAny {
+			positions[3] = tokenPosition{"entity_type", common.PANEntityTypeLetters(validity), segmentGenerated}
+		}
+		for _, i := range s.panPreserve {
+			name := "entity_type"
+			if i == 4 {
+				name = "name_initial"
+			}
+			positions[i] = tokenPosition{name, formatLetters, segmentValue}
+		}
+		f.Segments = fixedSegments(positions)
+		f.Constraints = append(f.Constraints, "the 4 digits are never one digit repeated", "never a well-known sample PAN such as ABCDE1234F")
+	case "AADHAR":
+		positions := make([]tokenPosition, 12)
+		positions[0] = tokenPosition{"leading_digit", "23456789", segmentGenerated}
+		for i := 1; i < len(positions); i++ {
+			positions[i] = tokenPosition{"digits", formatDigits, segmentGenerated}
+		}
+		withPrefix(positions, prefix)
+		switch f.Validity {
+		case common.ValidityValid:
+			positions[11] = tokenPosition{"check_digit", formatDigits, segmentGenerated}
+			f.Constraints = append(f.Constraints, "the check digit passes the Verhoeff check")
+		case common.ValidityInvalid:
+			positions[11] = tokenPosition{"check_digit", formatDigits, segmentGenerated}
+			f.Constraints = append(f.Constraints, "the check digit fails the Verhoeff check")
+		}
+		f.Segments = fixedSegments(positions)
+		f.Constraints = append(f.Constraints, "never one digit repeated", "never a well-known sample number such as 123456789012")
+	case "MOBILE":
+		codes, minNSN, maxNSN := common.PhoneNumberFormat()
+		f.Segments = append(f.Segments,
+			literalSegment("plus", "+", segmentLiteral),
+			TokenSegment{Name: "country_code", Pattern: "(?:" + strings.Join(codes, "|") + ")", MinLength: 1, MaxLength: 3, Source: segmentValue},
+		)
+		if prefix != "" {
+			f.Segments = append(f.Segments, literalSegment("prefix", prefix, segmentPrefix))
+		}
+		f.Segments = append(f.Segments, classSegment("national_number", formatDigits, segmentGenerated, minNSN-len(prefix), maxNSN-len(prefix)))
+		f.Constraints = append(f.Constraints, "the national number has the length of the value's, which depends on the country code", "the national number is never one digit repeated")
+	default:
+		f.Segments, f.Constraints = s.alphabetTokenSegments(dataType, prefix)
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	for _, seg := range f.Segments {
+		re.WriteString(seg.Pattern)
+		f.MinLength += seg.MinLength
+		if f.MaxLength >= 0 && seg.MaxLength > 0 {
+			f.MaxLength += seg.MaxLength
+		} else {
+			f.MaxLength = -1
+		}
+	}
+	re.WriteString("$")
+	f.Regex = re.String()
+	f.MaxLength = max(f.MaxLength, 0)
+	if len(s.reservedTokens) > 0 {
+		f.Constraints = append(f.Constraints, "never one of RESERVED_TOKENS")
+	}
+	return f
+}
+
+// alphabetTokenSegments describes the tokens of types without a fixed format: the length of
+// the value over TOKEN_ALPHABET_<TYPE> (base36 by default; printable ASCII, or the email-local
+// preset for EMAIL, under FF1). With an alphabet or FF1, EMAIL tokens keep the domain.
+func (s *Server) alphabetTokenSegments(dataType, prefix string) ([]TokenSegment, []string) {
+	alphabet := s.generators.alphabets[dataType]
+	email := dataType == "EMAIL" && (alphabet != "" || s.generators.ff1)
+	minLen := 1
+	switch {
+	case s.generators.ff1 && alphabet == "" && dataType == "EMAIL":
+		alphabet = common.AlphabetEmailLocal
+	case s.generators.ff1 && alphabet == "":
+		alphabet = common.AlphabetPrintable
+	case alphabet == "":
+		alphabet = common.AlphabetBase36
+	}
+	if s.generators.ff1 {
+		minLen = common.FF1MinLength(len(alphabet))
+	}
+	var segs []TokenSegment
+	var constraints []string
+	if prefix != "" {
+		segs = append(segs, literalSegment("prefix", prefix, segmentPrefix))
+	}
+	if !email {
+		segs = append(segs, classSegment("token", alphabet, segmentGenerated, max(minLen-len(prefix), 1), 0))
+		constraints = append(constraints, "tokens have the length of their value")
+		return segs, constraints
+	}
+	segs = append(segs,
+		classSegment("local_part", alphabet, segmentGenerated, max(minLen-len(prefix), 1), 0),
+		literalSegment("at", "@", segmentLiteral),
+		TokenSegment{Name: "domain", Pattern: "[^@]+", MinLength: 1, Source: segmentValue},
+	)
+	constraints = append(constraints,
+		"the local part has the length of the value's and never starts or ends with a dot or has two dots in a row",
+		"values without @ are tokenized whole, as the local part alone")
+	return segs, constraints
+}
+
+// GET /pii-types/{type}/format
+// The token format descriptor of a PII type (regex and segment layout) under the current
+// generator settings and the caller's tenant prefix.
+func (s *Server) tokenFormatHandler(w http.ResponseWriter, r *http.Request) {
+	dataType := strings.ToUpper(strings.TrimSpace(mux.Vars(r)["type"]))
+	if !s.validation.supported(dataType) {
+		writeJSONErrorCode(w, http.StatusNotFound, ValidationUnsupportedType, "Unsupported pii_type")
+		return
+	}
+	s.setVersionHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.tokenFormat(TenantFromContext(r.Context()), dataType))
+}
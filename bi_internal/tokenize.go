@@ -3,22 +3,43 @@ package bi_internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strings"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
 )
 
 type TokenizeRequest struct {
 	PIIType  string `json:"pii_type"`
 	PIIValue string `json:"pii_value"`
+	// SourceSystem optionally tags which upstream system sent the value (token metadata).
+	SourceSystem string `json:"source_system,omitempty"`
+	// ReportNormalization asks the server to say whether normalization changed the input.
+	ReportNormalization bool `json:"report_normalization,omitempty"`
+	// OutputFormat selects the output: "fpt" (default, reversible token stored in the vault)
+	// or "hash16" (non-reversible 16-char keyed join hash, nothing is stored).
+	OutputFormat string `json:"output_format,omitempty"`
+	// OutputFormats requests several representations at once (fpt, masked, hash16,
+	// blind_hash); it takes precedence over OutputFormat.
+	OutputFormats []string `json:"output_formats,omitempty"`
 }
 
 type TokenizeResponse struct {
-	FPT string `json:"fpt"`
+	FPT       string `json:"fpt,omitempty"`
+	Masked    string `json:"masked,omitempty"`
+	Hash16    string `json:"hash16,omitempty"`
+	BlindHash string `json:"blind_hash,omitempty"`
+	// Only set when the request has report_normalization=true.
+	WasNormalized       *bool  `json:"was_normalized,omitempty"`
+	NormalizedValueHash string `json:"normalized_value_hash,omitempty"`
 }
 func isValidPAN(pan string) bool {
     pan = strings.ToUpper(strings.TrimSpace(pan))
@@ -41,6 +62,13 @@ func isValidAADHAR(aadhar string) bool {
     return re.MatchString(aadhar)
 }
 
+// isValidMOBILE accepts E.164 numbers ("+<cc><nsn>" / "00<cc><nsn>") for known country
+// codes, and bare 10-digit Indian numbers.
+func isValidMOBILE(mobile string) bool {
+	_, _, err := common.ParseE164(mobile)
+	return err == nil
+}
+
 func (s *Server) tokenizeHandler(w http.ResponseWriter, r *http.Request) {
 	var req TokenizeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -48,119 +76,346 @@ func (s *Server) tokenizeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.PIIType = strings.ToUpper(strings.TrimSpace(req.PIIType))
+	rawValue := req.PIIValue
 	req.PIIValue = strings.TrimSpace(req.PIIValue)
 	if req.PIIType == "" || req.PIIValue == "" {
 		writeJSONError(w, http.StatusBadRequest, "pii_type and pii_value are required")
 		return
 	}
 
-	if req.PIIType == "PAN" {
-		if !isValidPAN(req.PIIValue) {
-			writeJSONError(w, http.StatusBadRequest, "Invalid PAN format")
-			return
-		}
+	if verr := s.validatePII(r.Context(), req.PIIType, req.PIIValue); verr != nil {
+		writeJSONErrorCode(w, http.StatusBadRequest, verr.Code, verr.Message)
+		return
+	}
+	if err := s.checkTypeAllowed(r.Context(), req.PIIType); err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
 	}
 
-	if req.PIIType == "AADHAR" {
-		if !isValidAADHAR(req.PIIValue) {
-			writeJSONError(w, http.StatusBadRequest, "Invalid AADHAR format")
+	formats := req.OutputFormats
+	if len(formats) == 0 && req.OutputFormat == "" {
+		// the tenant policy may default to e.g. fpt + masked
+		if p, ok := s.policyFor(r.Context()); ok {
+			formats = p.defaultOutputFormats
+		}
+	}
+	if len(formats) == 0 {
+		formats = []string{req.OutputFormat}
+	}
+	want := map[string]bool{}
+	for _, f := range formats {
+		switch f = strings.ToLower(strings.TrimSpace(f)); f {
+		case "":
+			want["fpt"] = true
+		case "fpt", "masked", "hash16", "blind_hash":
+			want[f] = true
+		default:
+			writeJSONError(w, http.StatusBadRequest, "unsupported output format: "+f)
 			return
 		}
 	}
 
+	// derived outputs are charged like a token: they are computed from the same PII
+	charge, err := s.chargeQuota(r.Context(), quotaTokenize, 1)
+	if err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+
+	// derived, non-reversible representations are computed without touching the vault
+	resp := TokenizeResponse{}
+	normalized := common.NormalizePII(req.PIIType, req.PIIValue)
+	if want["masked"] {
+		resp.Masked = common.MaskPII(req.PIIType, normalized)
+	}
+	if want["hash16"] {
+		resp.Hash16 = s.hash16(req.PIIType, normalized)
+		s.recordUsage(r.Context(), "hash16", req.PIIType)
+	}
+	if want["blind_hash"] {
+		resp.BlindHash = s.blindHash(req.PIIType, normalized)
+	}
+	if !want["fpt"] {
+		// Tokenize audits the fpt path; without it the request is audited here
+		s.recordAudit(r.Context(), "tokenize", req.PIIType, "", nil, "output_formats="+derivedFormats(want))
+		s.setVersionHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
 	fpt, err := s.Tokenize(r.Context(), req.PIIType, req.PIIValue)
 	if err != nil {
-		log.Printf("tokenize error: %v", err)
+		s.refundQuota(r.Context(), charge, 1)
+		if err == ErrGlobalFallbackDenied || err == ErrTypeNotAllowed {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if err == ErrReadOnly {
+			s.writeReadOnly(w)
+			return
+		}
+		if err == ErrCryptoperiodExceeded {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "tokenize failed", "data_type", req.PIIType, "error", err)
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	log.Println("API Call SuccessFul")
+	if src := strings.TrimSpace(req.SourceSystem); src != "" {
+		blind := s.storedBlindIndex(r.Context(), req.PIIType, req.PIIValue)
+		if err := s.store.RecordTokenSource(blind, req.PIIType, TenantFromContext(r.Context()), src); err != nil {
+			slog.WarnContext(r.Context(), "tokenize: record source system failed", "data_type", req.PIIType, "error", err)
+		}
+	}
+
+	resp.FPT = fpt
+	if req.ReportNormalization {
+		normalized := common.NormalizePII(req.PIIType, rawValue)
+		changed := normalized != rawValue
+		resp.WasNormalized = &changed
+		resp.NormalizedValueHash = s.normalizedValueHash(req.PIIType, normalized)
+	}
+	s.setVersionHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TokenizeResponse{FPT: fpt})
+	json.NewEncoder(w).Encode(resp)
+
+}
+
+// derivedFormats lists the requested non-token outputs in a stable order for the audit detail.
+func derivedFormats(want map[string]bool) string {
+	var out []string
+	for _, f := range []string{"masked", "hash16", "blind_hash"} {
+		if want[f] {
+			out = append(out, f)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// normalizedValueHash is a keyed hash of the normalized value that integrators can compare
+// across records without the server echoing PII back. It is domain-separated from the
+// blind index so it cannot be used against the vault.
+func (s *Server) normalizedValueHash(dataType, normalized string) string {
+	return common.HMACBlindIndex(s.hmacKey(), "normalized:"+dataType+":"+normalized)
+}
 
+// hash16 is a deterministic, non-reversible 16 hex char join key: a truncated HMAC-SHA256
+// of the normalized value, domain-separated by purpose and data type.
+func (s *Server) hash16(dataType, normalized string) string {
+	return common.HMACBlindIndex(s.hmacKey(), "hash16:"+dataType+":"+normalized)[:16]
 }
 
+// blindHash is the full-length (64 hex char) keyed hash of the normalized value for
+// consumers that store a blind-hash column. Domain-separated from the internal blind index.
+func (s *Server) blindHash(dataType, normalized string) string {
+	return common.HMACBlindIndex(s.hmacKey(), "blind_hash:"+dataType+":"+normalized)
+}
+
+// storedBlindIndex is the blind index the caller's vault row of a value is stored under: the
+// row's own when the caller has a token of the value (e.g. one created under a previous HMAC
+// key), else the one a new token would get.
+func (s *Server) storedBlindIndex(ctx context.Context, dataType, value string) string {
+	km := s.keys.Load()
+	pt, blind, err := s.lookupByValue(ctx, km, dataType, value)
+	if err == nil && pt != nil {
+		return pt.BlindIndex
+	}
+	if blind == "" {
+		blind = blindIndexIn(km.hmac, tenantBlindDomain(TenantFromContext(ctx)), common.NormalizePII(dataType, value))
+	}
+	return blind
+}
+
+// maxTokenCandidates bounds cycle walking over the deterministic candidates of a value.
+const maxTokenCandidates = 1000
+
 // Tokenize creates or returns a format-preserving token (FPT) for given PII value.
 // It is deterministic for the same PII (returns existing token if present) and
 // will try alternate deterministic candidates when there is a collision.
-func (s *Server) Tokenize(ctx context.Context, dataType, value string) (string, error) {
-	var normalized string
-	if strings.ToUpper(strings.TrimSpace(dataType)) == "PAN" {
-		normalized = strings.ToUpper(strings.TrimSpace(value))
-	} else {
-		normalized = strings.TrimSpace(value)
-	}
-	blind := common.HMACBlindIndex(s.hmacKey, normalized)
-
-	// 1) Cache lookup (blind -> fpt)
-	if s.cache != nil {
-		if fpt, err := s.cache.GetByBlindIndex(ctx, dataType, blind); err == nil && fpt != "" {
-			log.Println("Tokenize", fpt)
+func (s *Server) Tokenize(ctx context.Context, dataType, value string) (fpt string, err error) {
+	defer func() { s.recordAudit(ctx, "tokenize", dataType, fpt, err, "") }()
+	if err := s.checkTypeAllowed(ctx, dataType); err != nil {
+		return "", err
+	}
+	fpt, err = s.tokenize(ctx, dataType, value)
+	if err == nil {
+		s.recordUsage(ctx, "tokenize", dataType)
+	}
+	return fpt, err
+}
+
+func (s *Server) tokenize(ctx context.Context, dataType, value string) (fpt string, err error) {
+	ctx, span := startSpan(ctx, "tokenize", attribute.String("pii.type", dataType))
+	defer func() { endSpan(span, err) }()
+
+	normalized := common.NormalizePII(dataType, value)
+	// One snapshot of the keys, so the recorded key versions match the blind index and both
+	// ciphertexts.
+	km := s.keys.Load()
+	tenant := TenantFromContext(ctx)
+	// the blind index of the value in the caller's domain: tenant-bound for tenant callers
+	blind := blindIndexIn(km.hmac, tenantBlindDomain(tenant), normalized)
+
+	// a value repeated within a batch request reuses the first lookup
+	memo, memoKey := lookupMemoFrom(ctx), blind
+	if fpt, ok := memo.token(dataType, memoKey); ok {
+		s.memoLookup("blind")
+		return fpt, nil
+	}
+	defer func() {
+		if err == nil {
+			memo.setToken(dataType, memoKey, fpt)
+		}
+	}()
+
+	// 1) Cache lookup (blind -> fpt). A tenant-bound blind index only ever holds the tenant's
+	// token; the plain one may hold a tenant token created before tenant-bound indexes, so a
+	// global caller's hit is only used when the token's cached owner is global too.
+	if s.tokens != nil {
+		var fpt string
+		err := traced(ctx, "cache.get_by_blind_index", func(ctx context.Context) (err error) {
+			fpt, err = s.tokens.GetByBlindIndex(ctx, dataType, blind)
+			if err == nil && fpt != "" && tenant == "" {
+				var enc, owner string
+				if enc, owner, err = s.tokens.GetByFPTWithOwner(ctx, dataType, fpt); err != nil || enc == "" || owner != "" {
+					fpt = ""
+				}
+			}
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.hit", err == nil && fpt != ""))
+			return err
+		})
+		s.cacheLookup("blind", fpt != "", err)
+		if err == nil && fpt != "" {
 			return fpt, nil // cache hit
 		}
 		// on cache error fallthrough to DB
 	}
 
-	// 2) DB lookup by blind index
-	found, err := s.store.GetByBlindIndex(blind)
+	// 2) DB lookup of the caller's token (previous HMAC keys included)
+	var found *models.PiiToken
+	err = traced(ctx, "store.lookup_by_value", func(context.Context) (err error) {
+		found, blind, err = s.lookupByValue(ctx, km, dataType, value)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	if found != nil {
-		// write-back to cache (EncryptedValue is []byte in model)
-		if s.cache != nil {
-			_ = s.cache.SetByBlindIndex(ctx, dataType, blind, found.FPT)
-			_ = s.cache.SetByFPT(ctx, dataType, found.FPT, found.EncryptedValue)
+		// write-back to cache (EncryptedValue is []byte in model); under the row's blind index,
+		// which erasure evicts
+		if s.tokens != nil {
+			_ = s.tokens.SetByBlindIndex(ctx, dataType, found.BlindIndex, found.FPT)
+			_ = s.tokens.SetByFPT(ctx, dataType, found.FPT, found.TenantID, found.EncryptedValue)
 		}
 		return found.FPT, nil
 	}
 
 	// 3) Not found -> allocate deterministically with retries
-	const maxAttempts = 1000
-	for counter := 0; counter < maxAttempts; counter++ {
-		candidate, ferr := common.FPTFromBlindIndexWithCounter(blind, normalized, dataType, counter)
+	gen := s.generator(ctx, dataType, km)
+	for counter := 0; counter < maxTokenCandidates; counter++ {
+		var candidate string
+		var valid bool
+		ferr := traced(ctx, "fpt.candidate", func(ctx context.Context) (err error) {
+			if c, ok := preparedCandidate(ctx, gen, blind, counter); ok {
+				candidate, valid, err = c.FPT, c.Valid, c.Err
+			} else {
+				candidate, valid, err = gen.Candidate(blind, normalized, counter)
+			}
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("fpt.valid", valid))
+			return err
+		}, attribute.Int("fpt.counter", counter))
 		if ferr != nil {
 			return "", ferr
 		}
+		// cycle walking: a disallowed output moves on to the next counter, which keeps the
+		// mapping deterministic
+		if !valid {
+			continue
+		}
 
-		existing, gerr := s.store.GetByFPT(candidate)
+		var existing *models.PiiToken
+		gerr := traced(ctx, "store.get_by_fpt", func(context.Context) (err error) {
+			existing, err = s.store.GetByFPT(ctx, candidate)
+			return err
+		})
 		if gerr != nil {
 			return "", gerr
 		}
 
 		if existing == nil {
+			// a new token is a vault write; lookups above still work in read-only mode
+			if s.readOnly.Load() {
+				return "", ErrReadOnly
+			}
+			encryptions := int64(1)
+			if s.ciphertext.dualWrite {
+				encryptions++
+			}
+			if err := s.countEncryptions(encryptions); err != nil {
+				return "", err
+			}
 			// encrypt returns string (base64 or b64-like). Convert to []byte only when inserting/caching.
-			encStr, err := common.AESGCMEncrypt(s.aesKey, []byte(normalized))
+			var encStr, keyVersion string
+			var encV2 []byte
+			err := traced(ctx, "cipher.encrypt", func(ctx context.Context) (err error) {
+				if encStr, keyVersion, err = s.cipher.Encrypt(ctx, []byte(normalized)); err != nil {
+					return err
+				}
+				encV2, err = s.encryptV2(km.aes, dataType, blind, []byte(normalized))
+				return err
+			})
 			if err != nil {
 				return "", err
 			}
 			encBytes := []byte(encStr)
 
-			created, ierr := s.store.InsertToken(encBytes, blind, candidate, dataType) // InsertToken expects []byte
-			if ierr == nil && created != nil {
+			var created *models.PiiToken
+			fresh := true
+			ierr := traced(ctx, "store.insert_token", func(context.Context) (err error) {
+				if s.cache == nil {
+					// without Redis, concurrent creators of this value queue on an advisory lock
+					created, fresh, err = s.store.InsertTokenLocked(ctx, encBytes, encV2, keyVersion, km.hmacVersion, blind, candidate, dataType, TenantFromContext(ctx))
+					return err
+				}
+				created, err = s.store.InsertToken(ctx, encBytes, encV2, keyVersion, km.hmacVersion, blind, candidate, dataType, TenantFromContext(ctx)) // InsertToken expects []byte
+				return err
+			})
+			switch {
+			case ierr == nil && fresh:
 				// success — write-through cache (pass []byte)
-				if s.cache != nil {
-					_ = s.cache.SetByBlindIndex(ctx, dataType, blind, candidate)
-					_ = s.cache.SetByFPT(ctx, dataType, candidate, encBytes)
+				if s.tokens != nil {
+					_ = s.tokens.SetByBlindIndex(ctx, dataType, blind, candidate)
+					_ = s.tokens.SetByFPT(ctx, dataType, candidate, created.TenantID, encBytes)
 				}
 				return candidate, nil
+			case ierr == nil:
+				// a concurrent request created the value's token first
+				existing = created
+			case errors.Is(ierr, models.ErrFPTTaken):
+				// collision with a different PII created since the lookup -> next counter
+				continue
+			case s.cache == nil:
+				return "", ierr
+			default:
+				// likely race — retry
+				slog.WarnContext(ctx, "tokenize: insert race or error, trying the next candidate", "data_type", dataType, "counter", counter, "error", ierr)
+				continue
 			}
-			// likely race — retry
-			log.Printf("insert race or error for candidate %s: %v (retrying)", candidate, ierr)
-			continue
 		}
 
-		// existing token found
+		// existing token found; the blind index is in the caller's domain, so it is the caller's
 		if existing.BlindIndex == blind {
 			// same PII, write-back and return
-			if s.cache != nil {
-				_ = s.cache.SetByBlindIndex(ctx, dataType, blind, existing.FPT)
-				_ = s.cache.SetByFPT(ctx, dataType, existing.FPT, existing.EncryptedValue)
+			if s.tokens != nil {
+				_ = s.tokens.SetByBlindIndex(ctx, dataType, blind, existing.FPT)
+				_ = s.tokens.SetByFPT(ctx, dataType, existing.FPT, existing.TenantID, existing.EncryptedValue)
 			}
 			return existing.FPT, nil
 		}
 		// collision with different PII -> next counter
 		continue
 	}
-	return "", fmt.Errorf("unable to allocate unique token after %d attempts", maxAttempts)
+	return "", fmt.Errorf("unable to allocate unique token after %d attempts", maxTokenCandidates)
 }
@@ -0,0 +1,148 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+type BatchTokenizeRequest struct {
+	PIIType   string   `json:"pii_type"`
+	PIIValues []string `json:"pii_values"`
+}
+
+// BatchTokenizeResult is one item's outcome, in request order.
+type BatchTokenizeResult struct {
+	FPT   string `json:"fpt,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Code is the validation failure code of a rejected value.
+	Code string `json:"code,omitempty"`
+}
+
+type BatchTokenizeResponse struct {
+	Results []BatchTokenizeResult `json:"results"`
+	// Total / Unique are the item count and the distinct normalized values actually tokenized;
+	// DedupFactor is Total / Unique.
+	Total       int     `json:"total"`
+	Unique      int     `json:"unique"`
+	DedupFactor float64 `json:"dedup_factor"`
+}
+
+// batchTokenizeItemError maps a per-item tokenize error to the message returned to the client.
+func batchTokenizeItemError(err error) string {
+	switch err {
+	case ErrGlobalFallbackDenied, ErrReadOnly, ErrCryptoperiodExceeded, ErrTypeNotAllowed:
+		return err.Error()
+	}
+	slog.Error("batch tokenize item failed", "error", err)
+	return "internal error"
+}
+
+// prepareBatchCandidates generates the first token candidate of every distinct valid value in
+// one batch call, for the values that turn out to be new to the vault. Values already tokenized
+// never use theirs; generation is cheap next to the lookups, so this is not worth avoiding.
+func (s *Server) prepareBatchCandidates(ctx context.Context, dataType string, values []string) context.Context {
+	km := s.keys.Load()
+	domain := tenantBlindDomain(TenantFromContext(ctx))
+	seen := map[string]bool{}
+	var blinds, normalized []string
+	for _, raw := range values {
+		value := strings.TrimSpace(raw)
+		if s.validation.check(dataType, value) != nil {
+			continue
+		}
+		n := common.NormalizePII(dataType, value)
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		blinds = append(blinds, blindIndexIn(km.hmac, domain, n))
+		normalized = append(normalized, n)
+	}
+	if len(blinds) == 0 {
+		return ctx
+	}
+	gen := s.generator(ctx, dataType, km)
+	cands, err := gen.Candidates(ctx, blinds, normalized, 0)
+	if err != nil {
+		// each value generates its own candidate instead
+		return ctx
+	}
+	byBlind := make(map[string]TokenCandidate, len(cands))
+	for i, c := range cands {
+		byBlind[blinds[i]] = c
+	}
+	return withPreparedCandidates(ctx, gen, byBlind)
+}
+
+// POST /tokenize/batch
+// Tokenizes up to BATCH_MAX_SIZE values of one PII type. Values are deduplicated after
+// normalization: each distinct value is tokenized once and its result fanned out to every
+// position it appears at (usage counters count distinct values).
+func (s *Server) batchTokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchTokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid Body Keep PII Type and PII Values")
+		return
+	}
+	req.PIIType = strings.ToUpper(strings.TrimSpace(req.PIIType))
+	if req.PIIType == "" || len(req.PIIValues) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "pii_type and pii_values are required")
+		return
+	}
+	if len(req.PIIValues) > s.batchMaxSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "batch too large, max "+strconv.Itoa(s.batchMaxSize))
+		return
+	}
+	charge, err := s.chargeQuota(r.Context(), quotaTokenize, len(req.PIIValues))
+	if err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+	// the whole batch is charged up front so it cannot overrun the quota; values that fail
+	// (or are never reached) are given back
+	tokenized := 0
+	defer func() { s.refundQuota(r.Context(), charge, len(req.PIIValues)-tokenized) }()
+
+	ctx := s.prepareBatchCandidates(withLookupMemo(r.Context()), req.PIIType, req.PIIValues)
+	resp := BatchTokenizeResponse{Results: make([]BatchTokenizeResult, len(req.PIIValues)), Total: len(req.PIIValues)}
+	done := map[string]BatchTokenizeResult{}
+	for i, raw := range req.PIIValues {
+		if ctx.Err() != nil {
+			return
+		}
+		value := strings.TrimSpace(raw)
+		if verr := s.validatePII(ctx, req.PIIType, value); verr != nil {
+			resp.Results[i] = BatchTokenizeResult{Error: verr.Message, Code: verr.Code}
+			continue
+		}
+		key := common.NormalizePII(req.PIIType, value)
+		res, ok := done[key]
+		if !ok {
+			fpt, err := s.Tokenize(ctx, req.PIIType, value)
+			if err != nil {
+				res = BatchTokenizeResult{Error: batchTokenizeItemError(err)}
+			} else {
+				res = BatchTokenizeResult{FPT: fpt}
+			}
+			done[key] = res
+		}
+		resp.Results[i] = res
+		if res.Error == "" {
+			tokenized++
+		}
+	}
+	resp.Unique = len(done)
+	if resp.Unique > 0 {
+		resp.DedupFactor = float64(resp.Total) / float64(resp.Unique)
+	}
+
+	s.setVersionHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
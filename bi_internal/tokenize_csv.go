@@ -0,0 +1,298 @@
+package bi_internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// csvUploadMaxField bounds the form fields of a CSV upload other than the file.
+const csvUploadMaxField = 64 << 10
+
+// csvUpload is the parsed form of POST /tokenize/csv.
+type csvUpload struct {
+	// mapping is header column -> PII type
+	mapping     map[string]string
+	delimiter   rune
+	errorColumn string
+	stage       bool
+	exportURL   string
+	file        *multipart.Part
+}
+
+// POST /tokenize/csv
+// Tokenizes the mapped columns of an uploaded CSV file, for partners that deliver flat files
+// instead of database access. The multipart/form-data body holds the fields
+//
+//	mapping       JSON object of header column -> PII type, e.g. {"pan": "PAN"} (required)
+//	delimiter     one character (default ",")
+//	error_column  header of an extra column holding the errors of each row (optional)
+//	stage         "true" stages the result instead of returning it
+//	export_url    pre-signed https PUT URL of the staged result on a BULK_EXPORT_HOSTS host (implies stage)
+//	file          the CSV with a header row, after the other fields
+//
+// The file is read as it arrives and each row is tokenized and written straight away, so
+// neither side buffers the whole file; values go through the tokenize path of the caller
+// (validation, allowed types, tokenize quota, audit). A value that cannot be tokenized leaves
+// an empty cell. The row count is capped at BULK_MAX_ROWS. A staged result is uploaded to
+// export_url or written to BULK_EXPORT_DIR, like a bulk mapping export, and the response is
+// its location.
+func (s *Server) csvUploadHandler(w http.ResponseWriter, r *http.Request) {
+	up, err := readCSVUpload(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if up.exportURL != "" {
+		if _, err := checkExportURL(up.exportURL, s.bulk.exportHosts); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	in := csv.NewReader(up.file)
+	in.Comma = up.delimiter
+	in.ReuseRecord = true
+	header, err := in.Read()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "file: cannot read the header row: "+err.Error())
+		return
+	}
+	header = append([]string(nil), header...)
+	// spreadsheet exports often start with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	columns, err := csvMappedColumns(header, up.mapping)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if up.errorColumn != "" {
+		for _, h := range header {
+			if h == up.errorColumn {
+				writeJSONError(w, http.StatusBadRequest, "error_column "+up.errorColumn+" is already a column of the file")
+				return
+			}
+		}
+		header = append(header, up.errorColumn)
+	}
+
+	ctx := withLookupMemo(r.Context())
+	var out func([]string) error
+	var spool *bulkExport
+	if up.stage {
+		if spool, err = newBulkExport(header...); err != nil {
+			slog.ErrorContext(ctx, "csv upload: creating the spool failed", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		defer spool.discard()
+		out = spool.write
+	} else {
+		// results are written while the upload is still being read
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			slog.WarnContext(ctx, "csv upload: full duplex unavailable, results may block until the upload ends", "error", err)
+		}
+		s.setVersionHeaders(w)
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename="+csvResultName(up.file.FileName()))
+		// counts and a read error are only known at the end of the stream
+		w.Header().Set("Trailer", "X-CSV-Rows, X-CSV-Failed-Values, X-CSV-Error")
+		cw := csv.NewWriter(w)
+		cw.Comma = up.delimiter
+		flusher, _ := w.(http.Flusher)
+		written := 0
+		out = func(record []string) error {
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+			if written++; written%batchStreamFlushEvery == 0 {
+				cw.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return cw.Error()
+		}
+		defer cw.Flush()
+	}
+	if err := out(header); err != nil {
+		slog.WarnContext(ctx, "csv upload: write failed", "error", err)
+		return
+	}
+
+	rows, failed := 0, 0
+	var readErr error
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("file: %w", err)
+			break
+		}
+		if ctx.Err() != nil {
+			// client went away; stop doing work for nobody
+			return
+		}
+		if rows >= s.bulk.maxRows {
+			readErr = errors.New("too many rows, stopped at BULK_MAX_ROWS")
+			break
+		}
+		rows++
+		var rowErrs []string
+		for _, i := range columns {
+			value := strings.TrimSpace(record[i])
+			if value == "" {
+				continue
+			}
+			fpt, _, msg := s.tokenizeStreamValue(ctx, up.mapping[header[i]], value)
+			record[i] = fpt
+			if msg != "" {
+				failed++
+				rowErrs = append(rowErrs, header[i]+": "+msg)
+			}
+		}
+		if up.errorColumn != "" {
+			record = append(record, strings.Join(rowErrs, "; "))
+		}
+		if err := out(record); err != nil {
+			slog.WarnContext(ctx, "csv upload: write failed", "error", err)
+			return
+		}
+	}
+	slog.InfoContext(ctx, "csv upload tokenized", "rows", rows, "failed_values", failed, "stage", up.stage, "error", readErr)
+
+	if !up.stage {
+		w.Header().Set("X-CSV-Rows", strconv.Itoa(rows))
+		w.Header().Set("X-CSV-Failed-Values", strconv.Itoa(failed))
+		if readErr != nil {
+			w.Header().Set("X-CSV-Error", readErr.Error())
+		}
+		return
+	}
+	if readErr != nil {
+		writeJSONError(w, http.StatusBadRequest, readErr.Error())
+		return
+	}
+	loc, err := spool.publish(ctx, "csv_upload", up.exportURL, s.bulk.exportHosts)
+	if err != nil {
+		slog.ErrorContext(ctx, "csv upload: staging the result failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "staging the result failed: "+err.Error())
+		return
+	}
+	s.setVersionHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"location":      loc,
+		"rows":          rows,
+		"failed_values": failed,
+	})
+}
+
+// readCSVUpload reads the form fields up to the file part, which is left unread.
+func readCSVUpload(r *http.Request) (*csvUpload, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("multipart/form-data body required")
+	}
+	up := &csvUpload{delimiter: ','}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("file is required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if part.FormName() == "file" {
+			if len(up.mapping) == 0 {
+				return nil, errors.New("mapping is required before file")
+			}
+			up.file = part
+			return up, nil
+		}
+		raw, err := io.ReadAll(io.LimitReader(part, csvUploadMaxField+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if len(raw) > csvUploadMaxField {
+			return nil, fmt.Errorf("%s is too large", part.FormName())
+		}
+		v := strings.TrimSpace(string(raw))
+		switch part.FormName() {
+		case "mapping":
+			if err := json.Unmarshal(raw, &up.mapping); err != nil {
+				return nil, errors.New("mapping must be a JSON object of column -> PII type")
+			}
+			for col, t := range up.mapping {
+				if up.mapping[col] = strings.ToUpper(strings.TrimSpace(t)); up.mapping[col] == "" {
+					return nil, fmt.Errorf("mapping: no PII type for column %q", col)
+				}
+			}
+		case "delimiter":
+			// not trimmed: a tab is a delimiter
+			d, n := utf8.DecodeRuneInString(string(raw))
+			if n == 0 || n != len(raw) || d == '"' || d == '\r' || d == '\n' || d == utf8.RuneError {
+				return nil, errors.New("delimiter must be one character other than a quote or line break")
+			}
+			up.delimiter = d
+		case "error_column":
+			up.errorColumn = v
+		case "stage":
+			up.stage = v == "true"
+		case "export_url":
+			up.exportURL, up.stage = v, v != "" || up.stage
+		default:
+			return nil, fmt.Errorf("unknown field %q", part.FormName())
+		}
+	}
+}
+
+// csvMappedColumns returns the indexes of the mapped header columns.
+func csvMappedColumns(header []string, mapping map[string]string) ([]int, error) {
+	index := map[string]int{}
+	for i, h := range header {
+		if _, ok := mapping[h]; !ok {
+			continue
+		}
+		if _, dup := index[h]; dup {
+			return nil, fmt.Errorf("mapped column %q appears twice in the header", h)
+		}
+		index[h] = i
+	}
+	var columns []int
+	for col := range mapping {
+		i, ok := index[col]
+		if !ok {
+			return nil, fmt.Errorf("mapped column %q is not in the header", col)
+		}
+		columns = append(columns, i)
+	}
+	sort.Ints(columns)
+	return columns, nil
+}
+
+// csvResultName is the download name of a tokenized upload: <name>_tokenized.csv.
+func csvResultName(upload string) string {
+	name := strings.TrimSuffix(filepath.Base(upload), filepath.Ext(upload))
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || name == "." {
+		name = "upload"
+	}
+	return name + "_tokenized.csv"
+}
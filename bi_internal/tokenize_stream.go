@@ -0,0 +1,132 @@
+package bi_internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const bulkValuesMaxLine = 64 << 10
+
+// BulkValueItem is one NDJSON input line of /tokenize/bulk-values. A line may also be a bare
+// JSON string, which is the value with the pii_type from the query string.
+type BulkValueItem struct {
+	// ID is echoed back unchanged so callers can correlate results without sending PII twice.
+	ID       json.RawMessage `json:"id,omitempty"`
+	PIIType  string          `json:"pii_type,omitempty"`
+	PIIValue string          `json:"pii_value"`
+}
+
+// BulkValueResult is one NDJSON output line; Line is the 1-based input line number.
+type BulkValueResult struct {
+	Line  int             `json:"line"`
+	ID    json.RawMessage `json:"id,omitempty"`
+	FPT   string          `json:"fpt,omitempty"`
+	Error string          `json:"error,omitempty"`
+	// Code is the validation failure code of a rejected value.
+	Code string `json:"code,omitempty"`
+}
+
+// POST /tokenize/bulk-values[?pii_type=PAN]
+// Streams NDJSON in and out: every input line is tokenized as it is read and its result is
+// written straight away (flushed every few hundred lines), so neither side buffers the whole
+// upload. This is the bulk path for callers that cannot hand over a source DSN. Input is capped
+// at BULK_MAX_ROWS lines; blank lines are skipped.
+func (s *Server) bulkValuesHandler(w http.ResponseWriter, r *http.Request) {
+	defaultType := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("pii_type")))
+	maxRows := s.bulk.maxRows
+
+	// results are written while the upload is still being read
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		slog.WarnContext(r.Context(), "bulk-values: full duplex unavailable, results may block until the upload ends", "error", err)
+	}
+
+	ctx := withLookupMemo(r.Context())
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(make([]byte, 0, 4096), bulkValuesMaxLine)
+
+	s.setVersionHeaders(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	line, written := 0, 0
+	for sc.Scan() {
+		line++
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			// client went away; stop doing work for nobody
+			return
+		}
+		res := BulkValueResult{Line: line}
+		if written >= maxRows {
+			res.Error = "too many lines, stopped at BULK_MAX_ROWS"
+			enc.Encode(res)
+			break
+		}
+		res.ID, res.FPT, res.Code, res.Error = s.tokenizeBulkValue(ctx, raw, defaultType)
+		if err := enc.Encode(res); err != nil {
+			slog.WarnContext(ctx, "bulk-values: stream write failed", "error", err)
+			return
+		}
+		written++
+		if flusher != nil && written%batchStreamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := sc.Err(); err != nil {
+		// the body is broken mid-stream (oversized line, client abort); report it as the last line
+		enc.Encode(BulkValueResult{Line: line + 1, Error: "read error: " + err.Error()})
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// tokenizeBulkValue decodes and tokenizes one input line; it returns the echoed id, the token,
+// and the validation failure code and error message of a rejected line.
+func (s *Server) tokenizeBulkValue(ctx context.Context, raw []byte, defaultType string) (json.RawMessage, string, string, string) {
+	var item BulkValueItem
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &item.PIIValue); err != nil {
+			return nil, "", "", "invalid JSON line"
+		}
+	} else if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, "", "", "invalid JSON line"
+	}
+	dataType := strings.ToUpper(strings.TrimSpace(item.PIIType))
+	if dataType == "" {
+		dataType = defaultType
+	}
+	value := strings.TrimSpace(item.PIIValue)
+	if dataType == "" || value == "" {
+		return item.ID, "", "", "pii_type and pii_value are required"
+	}
+	fpt, code, msg := s.tokenizeStreamValue(ctx, dataType, value)
+	return item.ID, fpt, code, msg
+}
+
+// tokenizeStreamValue validates, charges and tokenizes one value of a streamed upload; it
+// returns the token, or the validation failure code and error message.
+func (s *Server) tokenizeStreamValue(ctx context.Context, dataType, value string) (string, string, string) {
+	if verr := s.validatePII(ctx, dataType, value); verr != nil {
+		return "", verr.Code, verr.Message
+	}
+	charge, err := s.chargeQuota(ctx, quotaTokenize, 1)
+	if err != nil {
+		return "", "", err.Error()
+	}
+	fpt, err := s.Tokenize(ctx, dataType, value)
+	if err != nil {
+		s.refundQuota(ctx, charge, 1)
+		return "", "", batchTokenizeItemError(err)
+	}
+	return fpt, "", ""
+}
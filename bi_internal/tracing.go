@@ -0,0 +1,109 @@
+package bi_internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"bi_pii_tokenizer/common"
+)
+
+const defaultTraceServiceName = "bi-pii-tokenizer"
+
+// tracer is the global tracer: a no-op until InitTracing installs the OTLP exporter.
+var tracer = otel.Tracer("bi_pii_tokenizer")
+
+// InitTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set; without an endpoint tracing stays off. The
+// exporter, service name (OTEL_SERVICE_NAME, default bi-pii-tokenizer) and sampler
+// (OTEL_TRACES_SAMPLER, default parent-based always on) follow the standard OTel variables.
+// Incoming W3C traceparent/baggage headers continue the caller's trace.
+func InitTracing(ctx context.Context) error {
+	if common.MaybeEnv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && common.MaybeEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return fmt.Errorf("otlp trace exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultTraceServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return fmt.Errorf("trace resource: %w", err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res)))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Println("tracing: exporting spans over OTLP/HTTP")
+	return nil
+}
+
+// startSpan starts a child span of the span on ctx. Span attributes never carry PII values
+// or tokens.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed on err. Expected outcomes (unknown token, denied
+// access) are not span errors.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrTokenNotFound) && !errors.Is(err, ErrTokenNotCached) && !errors.Is(err, ErrTokenForbidden) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traced runs fn in a child span named name, e.g. one cache or store call.
+func traced(ctx context.Context, name string, fn func(ctx context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := startSpan(ctx, name, attrs...)
+	err := fn(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// tracing starts the server span of every routed request, continuing the trace of the incoming
+// traceparent header. Spans are named by method and route template, never the raw path, which
+// may hold a token.
+func (s *Server) tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = strings.TrimPrefix(tpl, apiPathPrefix)
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/models"
+)
+
+const defaultUsageFlushInterval = 10 * time.Second
+
+type usageKey struct {
+	day       string
+	callerID  string
+	tenantID  string
+	dataType  string
+	operation string
+}
+
+// usageRecorder aggregates per-request usage in memory and flushes it to the daily counters
+// table periodically, so the hot path never waits on a DB write.
+type usageRecorder struct {
+	mu      sync.Mutex
+	pending map[usageKey]int64
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{pending: map[usageKey]int64{}}
+}
+
+// recordUsage counts one successful operation for the caller/tenant on ctx.
+func (s *Server) recordUsage(ctx context.Context, operation, dataType string) {
+	if s.metrics != nil {
+		s.metrics.operations.WithLabelValues(operation, dataType).Inc()
+	}
+	if s.usage == nil {
+		return
+	}
+	k := usageKey{
+		day:       time.Now().UTC().Format("2006-01-02"),
+		callerID:  CallerIDFromContext(ctx),
+		tenantID:  TenantFromContext(ctx),
+		dataType:  dataType,
+		operation: operation,
+	}
+	s.usage.mu.Lock()
+	s.usage.pending[k]++
+	s.usage.mu.Unlock()
+}
+
+// flushUsage writes pending counters; on failure they are merged back for the next flush.
+func (s *Server) flushUsage() {
+	s.usage.mu.Lock()
+	batch := s.usage.pending
+	s.usage.pending = map[usageKey]int64{}
+	s.usage.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	counts := make([]models.UsageCount, 0, len(batch))
+	for k, n := range batch {
+		day, _ := time.Parse("2006-01-02", k.day)
+		counts = append(counts, models.UsageCount{
+			Day: day, CallerID: k.callerID, TenantID: k.tenantID, DataType: k.dataType, Operation: k.operation, Count: n,
+		})
+	}
+	err := s.store.AddUsage(counts)
+	s.degradation.track(subsystemUsageCounters, impactBuffering, err)
+	if err != nil {
+		log.Printf("usage: flush failed, will retry: %v", err)
+		s.usage.mu.Lock()
+		for k, n := range batch {
+			s.usage.pending[k] += n
+		}
+		s.usage.mu.Unlock()
+	}
+}
+
+func (s *Server) startUsageFlusher(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			s.flushUsage()
+			s.flushAPIUsage()
+			s.flushKeyUsage()
+		}
+	}()
+}
+
+// GET /admin/reports/usage?from=YYYY-MM-DD&to=YYYY-MM-DD[&format=csv]
+// Aggregates tokenize/detokenize counts per caller, tenant and PII type for chargeback.
+func (s *Server) usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse("2006-01-02", v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from must be YYYY-MM-DD")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse("2006-01-02", v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to must be YYYY-MM-DD")
+			return
+		}
+	}
+	if to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	counts, err := s.store.UsageReport(from, to)
+	if err != nil {
+		log.Printf("usage report error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage_"+from.Format("20060102")+"_"+to.Format("20060102")+".csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"caller_id", "tenant", "data_type", "operation", "count"})
+		for _, c := range counts {
+			cw.Write([]string{c.CallerID, c.TenantID, c.DataType, c.Operation, strconv.FormatInt(c.Count, 10)})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    from.Format("2006-01-02"),
+		"to":      to.Format("2006-01-02"),
+		"results": counts,
+	})
+}
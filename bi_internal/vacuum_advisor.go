@@ -0,0 +1,234 @@
+package bi_internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/models"
+)
+
+const (
+	defaultVacuumDeadRatio      = 0.2
+	defaultReindexLeafDensity   = 50.0
+	defaultVacuumMinDeadTuples  = 10000
+	defaultVacuumAdvisorMinutes = 0
+)
+
+// vacuumAdvisorTables are the vault tables that key rotation, shredding and token retention
+// rewrite or delete from.
+var vacuumAdvisorTables = []string{"pii_tokens", "pii_deks"}
+
+// VacuumRecommendation is one maintenance statement the advisor recommends, and its outcome
+// when the advisor ran it.
+type VacuumRecommendation struct {
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Statement string `json:"statement"`
+	Reason    string `json:"reason"`
+	Applied   bool   `json:"applied,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// VacuumReport is the bloat of the vault tables and indexes and what to do about it.
+type VacuumReport struct {
+	GeneratedAt     time.Time              `json:"generated_at"`
+	Tables          []models.TableBloat    `json:"tables"`
+	Indexes         []models.IndexBloat    `json:"indexes"`
+	Recommendations []VacuumRecommendation `json:"recommendations"`
+	// DensityAvailable is false without the pgstattuple extension: index bloat is then not
+	// estimated and no REINDEX is recommended
+	DensityAvailable bool `json:"density_available"`
+}
+
+// vacuumAdvisor holds the thresholds (VACUUM_ADVISOR_*) and the last report.
+type vacuumAdvisor struct {
+	deadRatio      float64
+	minDeadTuples  int64
+	minLeafDensity float64
+	apply          bool
+
+	mu   sync.Mutex
+	last *VacuumReport
+}
+
+func vacuumAdvisorFromEnv() *vacuumAdvisor {
+	a := &vacuumAdvisor{
+		deadRatio:      defaultVacuumDeadRatio,
+		minDeadTuples:  int64(envInt("VACUUM_ADVISOR_MIN_DEAD_TUPLES", defaultVacuumMinDeadTuples)),
+		minLeafDensity: defaultReindexLeafDensity,
+		apply:          strings.EqualFold(common.MaybeEnv("VACUUM_ADVISOR_APPLY"), "true"),
+	}
+	if v, err := strconv.ParseFloat(common.MaybeEnv("VACUUM_ADVISOR_DEAD_RATIO"), 64); err == nil && v > 0 && v < 1 {
+		a.deadRatio = v
+	}
+	if v, err := strconv.ParseFloat(common.MaybeEnv("VACUUM_ADVISOR_MIN_LEAF_DENSITY"), 64); err == nil && v > 0 && v < 100 {
+		a.minLeafDensity = v
+	}
+	return a
+}
+
+// vacuumReport collects the bloat of the vault tables and recommends VACUUM for tables with
+// too many dead tuples and REINDEX CONCURRENTLY for indexes whose leaves are too sparse.
+// withDensity runs pgstatindex, which reads every index page.
+func (s *Server) vacuumReport(ctx context.Context, withDensity bool) (*VacuumReport, error) {
+	a := s.vacuum
+	rep := &VacuumReport{GeneratedAt: time.Now().UTC(), Tables: []models.TableBloat{}, Indexes: []models.IndexBloat{}, Recommendations: []VacuumRecommendation{}}
+	for _, table := range vacuumAdvisorTables {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tb, err := s.store.TableBloat(table)
+		if err != nil {
+			return nil, fmt.Errorf("table bloat of %s: %w", table, err)
+		}
+		if tb == nil {
+			continue
+		}
+		rep.Tables = append(rep.Tables, *tb)
+		if tb.DeadTuples >= a.minDeadTuples && tb.DeadRatio >= a.deadRatio {
+			rep.Recommendations = append(rep.Recommendations, VacuumRecommendation{
+				Action:    "vacuum",
+				Target:    table,
+				Statement: "VACUUM (ANALYZE) " + table,
+				Reason:    fmt.Sprintf("%d dead tuples (%.0f%% of the table)", tb.DeadTuples, tb.DeadRatio*100),
+			})
+		}
+
+		idx, err := s.store.IndexBloat(table, withDensity)
+		if err != nil {
+			return nil, fmt.Errorf("index bloat of %s: %w", table, err)
+		}
+		for _, ib := range idx {
+			rep.Indexes = append(rep.Indexes, ib)
+			if ib.AvgLeafDensity == nil {
+				continue
+			}
+			rep.DensityAvailable = true
+			if *ib.AvgLeafDensity < a.minLeafDensity {
+				rep.Recommendations = append(rep.Recommendations, VacuumRecommendation{
+					Action:    "reindex",
+					Target:    ib.Index,
+					Statement: "REINDEX INDEX CONCURRENTLY " + ib.Index,
+					Reason:    fmt.Sprintf("leaf density %.0f%% (%.0f%% fragmented)", *ib.AvgLeafDensity, *ib.LeafFragmentation),
+				})
+			}
+		}
+	}
+	return rep, nil
+}
+
+// applyVacuumReport runs the recommended statements one by one; a failure is recorded on its
+// recommendation and the others still run.
+func (s *Server) applyVacuumReport(ctx context.Context, rep *VacuumReport) {
+	for i := range rep.Recommendations {
+		if ctx.Err() != nil {
+			return
+		}
+		rec := &rep.Recommendations[i]
+		var err error
+		switch rec.Action {
+		case "vacuum":
+			err = s.store.VacuumTable(rec.Target)
+		case "reindex":
+			err = s.store.ReindexIndex(rec.Target)
+		}
+		rec.Applied = err == nil
+		if err != nil {
+			rec.Error = err.Error()
+			log.Printf("vacuum advisor: %s failed: %v", rec.Statement, err)
+			continue
+		}
+		s.adminChange(ctx, "maintenance."+rec.Action, "target", rec.Target, "reason", rec.Reason)
+	}
+}
+
+// runVacuumAdvisor is the scheduled job: report, and run the recommendations with
+// VACUUM_ADVISOR_APPLY=true.
+func (s *Server) runVacuumAdvisor(ctx context.Context) error {
+	rep, err := s.vacuumReport(ctx, true)
+	if err != nil {
+		return err
+	}
+	for _, rec := range rep.Recommendations {
+		log.Printf("vacuum advisor: recommends %s (%s)", rec.Statement, rec.Reason)
+	}
+	if s.vacuum.apply {
+		s.applyVacuumReport(ctx, rep)
+	}
+	s.vacuum.mu.Lock()
+	s.vacuum.last = rep
+	s.vacuum.mu.Unlock()
+	return nil
+}
+
+// startVacuumAdvisor runs the advisor every VACUUM_ADVISOR_INTERVAL_MIN (default 0 = only on
+// demand) on one replica at a time. It is skipped in read-only maintenance mode.
+func (s *Server) startVacuumAdvisor() {
+	minutes := envInt("VACUUM_ADVISOR_INTERVAL_MIN", defaultVacuumAdvisorMinutes)
+	if minutes <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer t.Stop()
+		for range t.C {
+			if s.readOnly.Load() {
+				continue
+			}
+			if _, err := s.RunExclusive(context.Background(), "vacuum-advisor", s.runVacuumAdvisor); err != nil {
+				log.Printf("vacuum advisor: %v", err)
+			}
+		}
+	}()
+}
+
+// GET /admin/vacuum-advisor[?density=false]
+// Reports dead tuples and index bloat of the vault tables with the recommended VACUUM and
+// REINDEX statements, plus the last scheduled report (with what it applied). density=false
+// skips pgstatindex, which reads whole indexes.
+func (s *Server) vacuumAdvisorHandler(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.vacuumReport(r.Context(), r.URL.Query().Get("density") != "false")
+	if err != nil {
+		log.Printf("vacuum advisor error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.vacuum.mu.Lock()
+	last := s.vacuum.last
+	s.vacuum.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"report": rep, "last_scheduled": last, "apply": s.vacuum.apply})
+}
+
+// POST /admin/vacuum-advisor/apply
+// Runs the current recommendations now (once across replicas) and returns the report with the
+// outcome of each statement.
+func (s *Server) applyVacuumAdvisorHandler(w http.ResponseWriter, r *http.Request) {
+	var rep *VacuumReport
+	ran, err := s.RunExclusive(r.Context(), "vacuum-advisor", func(ctx context.Context) (err error) {
+		if rep, err = s.vacuumReport(ctx, true); err != nil {
+			return err
+		}
+		s.applyVacuumReport(ctx, rep)
+		return nil
+	})
+	if err != nil {
+		log.Printf("vacuum advisor apply error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ran {
+		writeJSONError(w, http.StatusConflict, "the vacuum advisor is already running on another instance")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"report": rep})
+}
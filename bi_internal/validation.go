@@ -0,0 +1,113 @@
+package bi_internal
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// Validation failure codes, returned as "code" next to the error message and counted in
+// pii_validation_failures_total.
+const (
+	ValidationMissingValue    = "missing_value"
+	ValidationUnsupportedType = "unsupported_type"
+	ValidationInvalidPAN      = "invalid_pan"
+	ValidationInvalidAadhar   = "invalid_aadhar_format"
+	ValidationAadharChecksum  = "invalid_aadhar_checksum"
+	ValidationInvalidMobile   = "invalid_mobile"
+	ValidationFPEDomain       = "outside_fpe_domain"
+)
+
+// typeNameRE is the shape of a PII type name when PII_TYPES does not list the accepted ones.
+var typeNameRE = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_.-]{0,63}$`)
+
+// ValidationError is a rejected input value: a stable code for dashboards and clients, and
+// the message returned as "error".
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+// piiValidation holds the optional input checks: PII_TYPES restricts the accepted types and
+// AADHAR_VALIDATE_CHECKSUM=true rejects Aadhaar numbers failing the Verhoeff check.
+type piiValidation struct {
+	types          []string
+	aadharChecksum bool
+}
+
+func piiValidationFromEnv() piiValidation {
+	v := piiValidation{aadharChecksum: strings.EqualFold(common.MaybeEnv("AADHAR_VALIDATE_CHECKSUM"), "true")}
+	for _, t := range strings.Split(common.MaybeEnv("PII_TYPES"), ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			v.types = append(v.types, t)
+		}
+	}
+	return v
+}
+
+// supported reports whether dataType is accepted: one of PII_TYPES when set, otherwise any
+// well-formed type name.
+func (v piiValidation) supported(dataType string) bool {
+	if len(v.types) > 0 {
+		return slices.Contains(v.types, dataType)
+	}
+	return typeNameRE.MatchString(dataType)
+}
+
+// check returns why value cannot be tokenized as dataType, or nil.
+func (v piiValidation) check(dataType, value string) *ValidationError {
+	if !v.supported(dataType) {
+		return &ValidationError{ValidationUnsupportedType, "Unsupported pii_type"}
+	}
+	if strings.TrimSpace(value) == "" {
+		return &ValidationError{ValidationMissingValue, "pii_value is required"}
+	}
+	switch dataType {
+	case "PAN":
+		if !isValidPAN(value) {
+			return &ValidationError{ValidationInvalidPAN, "Invalid PAN format"}
+		}
+	case "AADHAR":
+		normalized := common.NormalizePII(dataType, value)
+		if !isValidAADHAR(normalized) {
+			return &ValidationError{ValidationInvalidAadhar, "Invalid AADHAR format"}
+		}
+		if valid, _ := common.RealWorldValid(dataType, normalized); v.aadharChecksum && !valid {
+			return &ValidationError{ValidationAadharChecksum, "Invalid AADHAR checksum"}
+		}
+	case "MOBILE":
+		if !isValidMOBILE(value) {
+			return &ValidationError{ValidationInvalidMobile, "Invalid MOBILE format"}
+		}
+	}
+	return nil
+}
+
+// validatePII checks one input value and counts a failure under its code, data type and the
+// caller, so data-quality dashboards can tell which upstream system sends bad values.
+func (s *Server) validatePII(ctx context.Context, dataType, value string) *ValidationError {
+	verr := s.validation.check(dataType, value)
+	if verr == nil {
+		// FIPS mode: FF1 only encrypts values of the type's alphabet and minimum length
+		if err := s.generators.checkFF1(dataType, common.NormalizePII(dataType, value)); err != nil {
+			verr = &ValidationError{ValidationFPEDomain, "pii_value cannot be tokenized in FIPS mode: " + err.Error()}
+		}
+	}
+	if verr != nil && s.metrics != nil {
+		if verr.Code == ValidationUnsupportedType {
+			// the type is client input; keep the label bounded
+			dataType = "other"
+		}
+		caller := CallerIDFromContext(ctx)
+		if caller == "" {
+			caller = "unknown"
+		}
+		s.metrics.validationFailures.WithLabelValues(verr.Code, dataType, caller).Inc()
+	}
+	return verr
+}
@@ -0,0 +1,119 @@
+package bi_internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"bi_pii_tokenizer/common"
+)
+
+// TokenVerifier re-derives tokens offline, for auditors checking a sample of issued tokens
+// without API access: it needs only the HMAC keys and the generator settings of the server
+// (TOKEN_TWEAK_POLICY, TOKEN_ALPHABET_<TYPE>, TOKEN_VALIDITY_<TYPE>, PAN_PRESERVE_*,
+// RESERVED_TOKENS, FIPS_MODE), read from the same environment variables. The AES key, the
+// vault and the cache are not used; tokens of FF1_HSM_KEYS version entries need the sidecar.
+type TokenVerifier struct {
+	// hmacKeys is the current HMAC key followed by HMAC_PREVIOUS_KEYS_BASE64
+	hmacKeys   []versionedKey
+	generators *GeneratorRegistry
+}
+
+// TokenVerification is the outcome of verifying one (value, token) pair.
+type TokenVerification struct {
+	Match bool
+	// HMACKeyVersion and Counter are the key version and candidate that derive the token. A
+	// counter past the first valid candidate means that candidate was already another
+	// value's token (cycle walking), which the vault alone can confirm.
+	HMACKeyVersion string
+	Counter        int
+	FirstCandidate bool
+	// Expected is the token a new value gets under the current HMAC key
+	Expected string
+}
+
+// NewTokenVerifier reads the HMAC keys (unwrapped by KEY_PROVIDER) and generator settings from
+// the environment. Invalid generator settings panic, like at server startup.
+func NewTokenVerifier() (*TokenVerifier, error) {
+	kp, err := keyProviderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	raw := common.MaybeEnv("HMAC_KEY_BASE64")
+	if raw == "" {
+		return nil, errors.New("missing env: HMAC_KEY_BASE64 (or HMAC_KEY_FILE)")
+	}
+	hmacKey, err := kp.unwrap(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HMAC key: %w", err)
+	}
+	previous, err := loadPreviousHMACKeys(kp)
+	if err != nil {
+		return nil, err
+	}
+	reserved := reservedTokensFromEnv()
+	validity := tokenValidityFromEnv()
+	valid := func(dataType, fpt string) bool {
+		return common.ValidTokenOutput(dataType, fpt) && !reserved[fpt]
+	}
+	return &TokenVerifier{
+		hmacKeys:   append([]versionedKey{{version: hmacKeyVersionOf(common.MaybeEnv("HMAC_KEY_VERSION"), hmacKey), key: hmacKey}}, previous...),
+		generators: newGeneratorRegistry(typePostprocessorsFromEnv(validity), panPreserveFromEnv(validity), tokenAlphabetsFromEnv(), tweakPolicyFromEnv(), FIPSMode(), ff1HSMFromEnv(FIPSMode()), valid),
+	}, nil
+}
+
+// Generator is the X-Token-Generator the verifier derives tokens with.
+func (v *TokenVerifier) Generator() string { return v.generators.Version() }
+
+// Verify reports whether token is a token of value as dataType: a valid candidate under one of
+// the HMAC keys. tenant is the tenant that issued the token ("" = a global token) and prefix its
+// token prefix of the type ("" = none). A tenant's tokens derive from its tenant-bound blind
+// index, or the plain one for tokens created before tenant-bound indexes.
+func (v *TokenVerifier) Verify(dataType, tenant, prefix, value, token string) (TokenVerification, error) {
+	dataType = strings.ToUpper(strings.TrimSpace(dataType))
+	normalized := common.NormalizePII(dataType, value)
+	domains := []string{tenantBlindDomain(tenant)}
+	if tenant == "" {
+		domains = append(domains, overflowBlindDomain)
+	} else {
+		domains = append(domains, plainBlindDomain)
+	}
+	var res TokenVerification
+	for i, k := range v.hmacKeys {
+		gen := v.generators.Get("", dataType, k.version, prefix, k.key)
+		for d, domain := range domains {
+			m, err := v.verifyIn(gen, blindIndexIn(k.key, domain, normalized), normalized, token, i == 0 && d == 0, &res)
+			if err != nil || m {
+				if m {
+					res.HMACKeyVersion = k.version
+				}
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// verifyIn walks the candidates of one blind index; expected records the first valid one as
+// the token a new value gets.
+func (v *TokenVerifier) verifyIn(gen *FPTGenerator, blind, normalized, token string, expected bool, res *TokenVerification) (bool, error) {
+	first := true
+	for counter := 0; counter < maxTokenCandidates; counter++ {
+		candidate, valid, err := gen.Candidate(blind, normalized, counter)
+		if err != nil {
+			return false, err
+		}
+		if !valid {
+			continue
+		}
+		if expected && first {
+			res.Expected = candidate
+		}
+		if candidate == token {
+			res.Match, res.Counter, res.FirstCandidate = true, counter, first
+			return true, nil
+		}
+		first = false
+	}
+	return false, nil
+}
@@ -0,0 +1,63 @@
+package bi_internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// tokenGeneratorVersion identifies the token generation algorithm (see TOKEN_TWEAK_POLICY); bump
+// it whenever the same input and keys would produce a different token.
+func (s *Server) tokenGeneratorVersion() string { return s.generators.Version() }
+
+const (
+	HeaderKeyVersion         = "X-Token-KeyVersion"
+	HeaderGenerator          = "X-Token-Generator"
+	HeaderExpectedKeyVersion = "X-Expected-Key-Version"
+)
+
+// keyVersionOf is KEY_VERSION when set, otherwise a short fingerprint of the key material, so
+// a rotation always shows up as a new version.
+func keyVersionOf(configured string, aes, hmac []byte) string {
+	if v := strings.TrimSpace(configured); v != "" {
+		return v
+	}
+	h := sha256.New()
+	h.Write([]byte("key-version:"))
+	h.Write(aes)
+	h.Write(hmac)
+	return "fp-" + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// hmacKeyVersionOf is HMAC_KEY_VERSION when set, otherwise a short fingerprint of the HMAC key.
+func hmacKeyVersionOf(configured string, hmac []byte) string {
+	if v := strings.TrimSpace(configured); v != "" {
+		return v
+	}
+	h := sha256.New()
+	h.Write([]byte("hmac-key-version:"))
+	h.Write(hmac)
+	return "fp-" + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+func (s *Server) keyVersion() string { return s.cipher.KeyVersion() }
+
+// setVersionHeaders tells clients which key version and generator produced the response.
+func (s *Server) setVersionHeaders(w http.ResponseWriter) {
+	w.Header().Set(HeaderKeyVersion, s.keyVersion())
+	w.Header().Set(HeaderGenerator, s.tokenGeneratorVersion())
+}
+
+// checkExpectedKeyVersion handles the optional X-Expected-Key-Version request header: on a
+// mismatch it answers 409 (with the current version in the response headers) so the client
+// knows a rotation happened and can refresh its caches. It reports whether to continue.
+func (s *Server) checkExpectedKeyVersion(w http.ResponseWriter, r *http.Request) bool {
+	s.setVersionHeaders(w)
+	expected := strings.TrimSpace(r.Header.Get(HeaderExpectedKeyVersion))
+	if expected == "" || expected == s.keyVersion() {
+		return true
+	}
+	writeJSONError(w, http.StatusConflict, "key version changed, refresh cached tokens")
+	return false
+}
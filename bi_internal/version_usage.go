@@ -0,0 +1,171 @@
+package bi_internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bi_pii_tokenizer/models"
+)
+
+// apiPathPrefix is the prefix of every route; endpoints are reported without it.
+const apiPathPrefix = "/api/fpt-tokenization"
+
+// apiVersionSegmentRE matches a version segment ("/v2/") of a route template.
+var apiVersionSegmentRE = regexp.MustCompile(`/(v[0-9]+)(/|$)`)
+
+// apiVersionOf returns the API version of a route template: its version segment, or v1 for
+// the original, unversioned endpoints.
+func apiVersionOf(pathTemplate string) string {
+	if m := apiVersionSegmentRE.FindStringSubmatch(pathTemplate); m != nil {
+		return m[1]
+	}
+	return "v1"
+}
+
+type apiUsageKey struct {
+	day        string
+	apiVersion string
+	endpoint   string
+	callerID   string
+}
+
+// apiUsageRecorder aggregates requests per API version, endpoint and caller in memory; it is
+// flushed with the usage counters.
+type apiUsageRecorder struct {
+	mu      sync.Mutex
+	pending map[apiUsageKey]int64
+}
+
+func newAPIUsageRecorder() *apiUsageRecorder {
+	return &apiUsageRecorder{pending: map[apiUsageKey]int64{}}
+}
+
+// versionUsage counts every routed request (probes excluded) per API version, endpoint
+// ("POST /tokenize") and caller.
+func (s *Server) versionUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil && !strings.HasSuffix(tpl, "/health") && !strings.HasSuffix(tpl, ReadyPath) {
+				k := apiUsageKey{
+					day:        time.Now().UTC().Format("2006-01-02"),
+					apiVersion: apiVersionOf(strings.TrimPrefix(tpl, apiPathPrefix)),
+					endpoint:   r.Method + " " + strings.TrimPrefix(tpl, apiPathPrefix),
+					callerID:   CallerIDFromContext(r.Context()),
+				}
+				s.apiUsage.mu.Lock()
+				s.apiUsage.pending[k]++
+				s.apiUsage.mu.Unlock()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// flushAPIUsage writes pending counters; on failure they are merged back for the next flush.
+func (s *Server) flushAPIUsage() {
+	s.apiUsage.mu.Lock()
+	batch := s.apiUsage.pending
+	s.apiUsage.pending = map[apiUsageKey]int64{}
+	s.apiUsage.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	counts := make([]models.APIUsageCount, 0, len(batch))
+	for k, n := range batch {
+		day, _ := time.Parse("2006-01-02", k.day)
+		counts = append(counts, models.APIUsageCount{
+			Day: day, APIVersion: k.apiVersion, Endpoint: k.endpoint, CallerID: k.callerID, Count: n,
+		})
+	}
+	if err := s.store.AddAPIUsage(counts); err != nil {
+		log.Printf("api usage: flush failed, will retry: %v", err)
+		s.apiUsage.mu.Lock()
+		for k, n := range batch {
+			s.apiUsage.pending[k] += n
+		}
+		s.apiUsage.mu.Unlock()
+	}
+}
+
+// VersionUsageSummary is the request total of one API version and the callers still using it.
+type VersionUsageSummary struct {
+	APIVersion string   `json:"api_version"`
+	Requests   int64    `json:"requests"`
+	Callers    []string `json:"callers"`
+	LastSeen   string   `json:"last_seen"`
+}
+
+// GET /admin/version-usage?from=YYYY-MM-DD&to=YYYY-MM-DD
+// Requests per API version with the callers using it, plus the per endpoint and caller
+// counters, for deprecating legacy endpoints. Defaults to the last 30 days.
+func (s *Server) versionUsageHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse("2006-01-02", v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from must be YYYY-MM-DD")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse("2006-01-02", v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to must be YYYY-MM-DD")
+			return
+		}
+	}
+	if to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	counts, err := s.store.APIUsageReport(from, to)
+	if err != nil {
+		log.Printf("version usage report error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	byVersion := map[string]*VersionUsageSummary{}
+	callers := map[string]map[string]bool{}
+	for _, c := range counts {
+		v := byVersion[c.APIVersion]
+		if v == nil {
+			v = &VersionUsageSummary{APIVersion: c.APIVersion}
+			byVersion[c.APIVersion] = v
+			callers[c.APIVersion] = map[string]bool{}
+		}
+		v.Requests += c.Count
+		if c.LastSeen > v.LastSeen {
+			v.LastSeen = c.LastSeen
+		}
+		if !callers[c.APIVersion][c.CallerID] {
+			callers[c.APIVersion][c.CallerID] = true
+			v.Callers = append(v.Callers, c.CallerID)
+		}
+	}
+	versions := make([]VersionUsageSummary, 0, len(byVersion))
+	for _, v := range byVersion {
+		sort.Strings(v.Callers)
+		versions = append(versions, *v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].APIVersion < versions[j].APIVersion })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"versions": versions,
+		"results":  counts,
+	})
+}
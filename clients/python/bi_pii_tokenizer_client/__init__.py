@@ -0,0 +1,5 @@
+"""Python client for the BI PII tokenization service (see api/openapi.yaml)."""
+
+from .client import TokenizerClient, TokenizerError, BatchResult
+
+__all__ = ["TokenizerClient", "TokenizerError", "BatchResult"]
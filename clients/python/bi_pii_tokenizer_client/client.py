@@ -0,0 +1,133 @@
+"""Thin, dependency-free client for the tokenization API.
+
+It follows api/openapi.yaml and takes care of the parts consumers kept getting wrong:
+API key / tenant / caller headers, retries on transient failures, and splitting large
+detokenize batches so each request stays below the server's BATCH_MAX_SIZE.
+"""
+
+import json
+import time
+import urllib.error
+import urllib.request
+from dataclasses import dataclass
+from typing import Dict, Iterable, Iterator, List, Optional
+
+DEFAULT_BASE_URL = "http://localhost:8081/api/fpt-tokenization"
+RETRY_STATUSES = {502, 503, 504}
+
+
+class TokenizerError(Exception):
+    """Raised for non-2xx responses; carries the HTTP status, server error message and, for
+    rejected input values, the validation code (e.g. invalid_pan)."""
+
+    def __init__(self, status: int, message: str, code: Optional[str] = None):
+        super().__init__(f"{status}: {message}")
+        self.status = status
+        self.message = message
+        self.code = code
+
+
+@dataclass
+class BatchResult:
+    fpt: str
+    pii_value: Optional[str] = None
+    error: Optional[str] = None
+    passthrough: bool = False
+
+
+class TokenizerClient:
+    def __init__(
+        self,
+        api_key: str,
+        base_url: str = DEFAULT_BASE_URL,
+        tenant_id: Optional[str] = None,
+        caller_id: Optional[str] = None,
+        timeout: float = 30.0,
+        retries: int = 3,
+        batch_size: int = 1000,
+    ):
+        self.base_url = base_url.rstrip("/")
+        self.timeout = timeout
+        self.retries = retries
+        self.batch_size = batch_size
+        self.headers = {"X-API-Key": api_key, "Content-Type": "application/json"}
+        if tenant_id:
+            self.headers["X-Tenant-ID"] = tenant_id
+        if caller_id:
+            self.headers["X-Caller-ID"] = caller_id
+
+    def _request(self, method: str, path: str, body: Optional[dict] = None) -> dict:
+        data = json.dumps(body).encode() if body is not None else None
+        for attempt in range(self.retries + 1):
+            req = urllib.request.Request(self.base_url + path, data=data, method=method, headers=self.headers)
+            try:
+                with urllib.request.urlopen(req, timeout=self.timeout) as resp:
+                    raw = resp.read()
+                    return json.loads(raw) if raw else {}
+            except urllib.error.HTTPError as e:
+                if e.code in RETRY_STATUSES and attempt < self.retries:
+                    retry_after = e.headers.get("Retry-After")
+                    time.sleep(float(retry_after) if retry_after and retry_after.isdigit() else 0.5 * 2 ** attempt)
+                    continue
+                raw = e.read()
+                code = None
+                try:
+                    payload = json.loads(raw)
+                    msg, code = payload.get("error", ""), payload.get("code")
+                except ValueError:
+                    msg = raw.decode(errors="replace").strip()
+                raise TokenizerError(e.code, msg, code) from None
+            except urllib.error.URLError:
+                if attempt < self.retries:
+                    time.sleep(0.5 * 2 ** attempt)
+                    continue
+                raise
+        raise AssertionError("unreachable")
+
+    def tokenize(self, pii_type: str, pii_value: str, **options) -> str:
+        """Returns the token (fpt) of a value."""
+        return self.tokenize_formats(pii_type, pii_value, **options)["fpt"]
+
+    def tokenize_formats(self, pii_type: str, pii_value: str, **options) -> Dict[str, str]:
+        """Returns the raw tokenize response; pass output_formats=[...] etc. as options."""
+        body = {"pii_type": pii_type, "pii_value": pii_value}
+        body.update(options)
+        return self._request("POST", "/tokenize", body)
+
+    def detokenize(self, fpt: str, cache_only: bool = False) -> str:
+        body = {"fpt": fpt}
+        if cache_only:
+            body["cache_only"] = True
+        return self._request("POST", "/detokenize", body)["pii_value"]
+
+    def detokenize_batch(self, fpts: Iterable[str], cache_only: bool = False, lenient: bool = False) -> Iterator[BatchResult]:
+        """Detokenizes any number of tokens, batch_size per request, in input order."""
+        chunk: List[str] = []
+        for fpt in fpts:
+            chunk.append(fpt)
+            if len(chunk) >= self.batch_size:
+                yield from self._detokenize_chunk(chunk, cache_only, lenient)
+                chunk = []
+        if chunk:
+            yield from self._detokenize_chunk(chunk, cache_only, lenient)
+
+    def _detokenize_chunk(self, fpts: List[str], cache_only: bool, lenient: bool) -> Iterator[BatchResult]:
+        body = {"fpts": fpts}
+        if cache_only:
+            body["cache_only"] = True
+        if lenient:
+            body["lenient"] = True
+        for r in self._request("POST", "/detokenize/batch", body)["results"]:
+            yield BatchResult(
+                fpt=r["fpt"],
+                pii_value=r.get("pii_value"),
+                error=r.get("error"),
+                passthrough=r.get("passthrough", False),
+            )
+
+    def ready(self) -> bool:
+        try:
+            self._request("GET", "/ready")
+            return True
+        except TokenizerError:
+            return False
@@ -0,0 +1,55 @@
+"""Integration tests against a running server.
+
+Set TOKENIZER_BASE_URL and TOKENIZER_API_KEY (CI starts the Go server for this); the tests
+are skipped otherwise.
+"""
+
+import os
+
+import pytest
+
+from bi_pii_tokenizer_client import TokenizerClient, TokenizerError
+
+BASE_URL = os.environ.get("TOKENIZER_BASE_URL")
+API_KEY = os.environ.get("TOKENIZER_API_KEY", "")
+
+pytestmark = pytest.mark.skipif(not BASE_URL, reason="TOKENIZER_BASE_URL not set")
+
+
+@pytest.fixture
+def client():
+    return TokenizerClient(API_KEY, base_url=BASE_URL, batch_size=2)
+
+
+def test_round_trip_pan(client):
+    fpt = client.tokenize("PAN", "BNZPM2501F")
+    assert len(fpt) == 10
+    assert client.tokenize("PAN", "bnzpm2501f") == fpt  # normalized, deterministic
+    assert client.detokenize(fpt) == "BNZPM2501F"
+
+
+def test_batch_detokenize_splits_and_keeps_order(client):
+    values = ["234567890123", "345678901234", "456789012345"]
+    fpts = [client.tokenize("AADHAR", v) for v in values]
+    results = list(client.detokenize_batch(fpts))
+    assert [r.fpt for r in results] == fpts
+    assert [r.pii_value for r in results] == values
+
+
+def test_lenient_passthrough(client):
+    results = list(client.detokenize_batch(["not-a-token"], lenient=True))
+    assert results[0].passthrough
+    assert results[0].pii_value == "not-a-token"
+
+
+def test_errors_carry_status(client):
+    with pytest.raises(TokenizerError) as exc:
+        client.tokenize("PAN", "invalid")
+    assert exc.value.status == 400
+
+
+def test_bad_api_key_is_rejected():
+    bad = TokenizerClient("wrong-key", base_url=BASE_URL, retries=0)
+    with pytest.raises(TokenizerError) as exc:
+        bad.tokenize("PAN", "BNZPM2501F")
+    assert exc.value.status == 401
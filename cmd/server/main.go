@@ -52,10 +52,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"flag"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -63,14 +69,66 @@ import (
 	"bi_pii_tokenizer/bi_internal"
 	"bi_pii_tokenizer/models"
 	"bi_pii_tokenizer/common"
+	"bi_pii_tokenizer/migrations"
 )
 
-func apiKeyMiddleware(next http.Handler) http.Handler {
+// apiKeyMiddleware accepts a verified client certificate (mTLS), an OIDC bearer token, the
+// static API_KEY or an API key provisioned for a tenant (POST /admin/tenants). The credential
+// fixes the request's tenant, caller id and scopes; X-Tenant-ID only selects a tenant for
+// credentials without one that hold the tenant_admin scope.
+func apiKeyMiddleware(srv *bi_internal.Server, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get API key from environment
-		expectedAPIKey := os.Getenv("API_KEY")
-		if expectedAPIKey == "" {
-			log.Println("Warning: Api Key Not Found For Login User")
+		// Reveal URLs are authorized by their single-use token, not the API key;
+		// the readiness probe and the Prometheus scrape are unauthenticated
+		if strings.HasPrefix(r.URL.Path, bi_internal.RevealPathPrefix) || r.URL.Path == bi_internal.ReadyPath || r.URL.Path == bi_internal.MetricsPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// client certificate mapped in MTLS_CLIENTS
+		if srv.MTLSEnabled() && bi_internal.HasClientCert(r) {
+			authed, err := srv.AuthenticateClientCert(r)
+			switch {
+			case err == bi_internal.ErrClientCertTenantMismatch:
+				http.Error(w, `{"error": "X-Tenant-ID does not match the client certificate"}`, http.StatusForbidden)
+				return
+			case err == bi_internal.ErrTenantHeaderNotAllowed:
+				http.Error(w, `{"error": "X-Tenant-ID needs the tenant_admin scope"}`, http.StatusForbidden)
+				return
+			case err != nil:
+				http.Error(w, `{"error": "Client certificate is not authorized"}`, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, authed)
+			return
+		}
+		if srv.MTLSRequired() {
+			http.Error(w, `{"error": "Client certificate required"}`, http.StatusUnauthorized)
+			return
+		}
+
+		// OIDC bearer token (AUTH_MODE oidc or both)
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && srv.OIDCEnabled() {
+			authed, err := srv.AuthenticateBearer(r, strings.TrimSpace(bearer))
+			switch {
+			case err == bi_internal.ErrAPIKeyTenantMismatch:
+				http.Error(w, `{"error": "X-Tenant-ID does not match the token"}`, http.StatusForbidden)
+				return
+			case err == bi_internal.ErrBearerTokenNoTenant:
+				http.Error(w, `{"error": "Bearer token has no tenant claim"}`, http.StatusForbidden)
+				return
+			case err != nil:
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, `{"error": "Invalid bearer token"}`, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, srv.WithoutCertOnlyScopes(authed))
+			return
+		}
+		if !srv.APIKeysAccepted() {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, `{"error": "Missing bearer token"}`, http.StatusUnauthorized)
+			return
 		}
 
 		// Get API key from request header
@@ -83,10 +141,24 @@ func apiKeyMiddleware(next http.Handler) http.Handler {
 		}
 		
 
-		if apiKey != expectedAPIKey {
+		// static API_KEY, SERVICE_API_KEYS or a provisioned tenant key, with its scopes
+		authed, err := srv.AuthenticateAPIKey(r, apiKey)
+		switch {
+		case err == bi_internal.ErrAPIKeyTenantMismatch:
+			http.Error(w, `{"error": "X-Tenant-ID does not match the API key"}`, http.StatusForbidden)
+			return
+		case err == bi_internal.ErrTenantHeaderNotAllowed:
+			http.Error(w, `{"error": "X-Tenant-ID needs the tenant_admin scope"}`, http.StatusForbidden)
+			return
+		case err == bi_internal.ErrInvalidAPIKey:
 			http.Error(w, `{"error": "Invalid API key"}`, http.StatusUnauthorized)
 			return
+		case err != nil:
+			log.Printf("api key lookup error: %v", err)
+			http.Error(w, `{"error": "authentication unavailable"}`, http.StatusServiceUnavailable)
+			return
 		}
+		r = srv.WithoutCertOnlyScopes(authed)
 
 		next.ServeHTTP(w, r)
 	})
@@ -95,8 +167,9 @@ func apiKeyMiddleware(next http.Handler) http.Handler {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-API-Key")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-API-Key, X-Request-ID, X-Tenant-ID, X-Caller-ID, X-Expected-Key-Version")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Token-KeyVersion, X-Token-Generator")
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -107,9 +180,25 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// migrationFS returns the migration files: the ones embedded in the binary, or the directory
+// MIGRATIONS_DIR when set (local development on new migrations).
+func migrationFS() fs.FS {
+	if dir := common.MaybeEnv("MIGRATIONS_DIR"); dir != "" {
+		log.Printf("using migrations from %s", dir)
+		return os.DirFS(dir)
+	}
+	return migrations.FS
+}
+
 func main() {
+	dryRun := flag.Bool("dry-run", false, "print pending migration statements and exit")
+	flag.Parse()
+
+	// JSON application logs with request identity and PII redaction (LOG_LEVEL)
+	bi_internal.InitLogging()
+
 	// Load DB connection string
-	dsn := os.Getenv("DATABASE_URL")
+	dsn := common.MaybeEnv("DATABASE_URL")
 	if dsn == "" {
 		log.Fatalf("DATABASE_URL is required")
 	}
@@ -127,24 +216,56 @@ func main() {
 		log.Fatalf("ping db: %v", err)
 	}
 
+	// --dry-run only prints the pending migration statements
+	if *dryRun {
+		if err := common.PrintPendingMigrations(db, os.Stdout, migrationFS()); err != nil {
+			log.Fatalf("migration dry-run failed: %v", err)
+		}
+		return
+	}
+
 	// Run migrations before server starts
-	if err := common.RunMigrations(db, "migrations/001_create_pii_tokens.sql"); err != nil {
+	if err := common.RunMigrations(db, migrationFS()); err != nil {
 		log.Fatalf("migration failed: %v", err)
 	}
 
+	// Export traces over OTLP when an endpoint is configured
+	if err := bi_internal.InitTracing(context.Background()); err != nil {
+		log.Fatalf("tracing: %v", err)
+	}
+
 	// Create datastore wrapper
 	store := models.NewStore(db)
 
 	// Create server (this initializes Redis Cluster + preload)
 	srv := bi_internal.NewServer(store)
 
-	handler := corsMiddleware(apiKeyMiddleware(srv.Router()))
+	// Re-read mounted secret files (*_FILE) so rotated secrets apply without a restart
+	reloadEvery := 30 * time.Second
+	if v, err := strconv.Atoi(os.Getenv("SECRETS_RELOAD_INTERVAL_SEC")); err == nil && v > 0 {
+		reloadEvery = time.Duration(v) * time.Second
+	}
+	go common.WatchSecretFiles(reloadEvery, func(changed []string) {
+		srv.ReloadSecrets()
+	})
+
+	handler := corsMiddleware(bi_internal.AccessLogMiddleware(apiKeyMiddleware(srv, srv.Router())))
 
 	// Start HTTP server
 	addr := os.Getenv("HTTP_ADDR")
 	if addr == "" {
 		addr = ":8081"
 	}
-	log.Printf("starting server on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, handler))
+	// HTTPS, with client certificates when TLS_CLIENT_CA_FILE is set
+	tlsConfig, err := bi_internal.ServerTLSConfig()
+	if err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+	if tlsConfig == nil {
+		log.Printf("starting server on %s", addr)
+		log.Fatal(http.ListenAndServe(addr, handler))
+	}
+	httpServer := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	log.Printf("starting server on %s (TLS, client auth %v)", addr, tlsConfig.ClientAuth != tls.NoClientCert)
+	log.Fatal(httpServer.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,143 @@
+// Command verify re-derives tokens offline from a key bundle and reports the (value, token)
+// pairs of a CSV sample that do not match, so auditors can check issued tokens without access
+// to the production API or vault.
+//
+//	verify -keys bundle.env -type PAN -in sample.csv > report.csv
+//
+// Tokens issued to a tenant derive from its tenant-bound blind index: pass -tenant (and its
+// -prefix, if any) for them.
+//
+// The key bundle is an env file with the server's HMAC keys and generator settings
+// (HMAC_KEY_BASE64, HMAC_PREVIOUS_KEYS_BASE64, TOKEN_TWEAK_POLICY, TOKEN_ALPHABET_<TYPE>, ...);
+// without -keys the process environment is used. CSV rows are value,token[,data_type]. The
+// report never contains the values, only line numbers and tokens. The exit status is 1 when a
+// token does not match.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"bi_pii_tokenizer/bi_internal"
+)
+
+// loadKeyBundle sets the KEY=VALUE lines of path in the environment; blank lines and # comments
+// are skipped and values may be quoted.
+func loadKeyBundle(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if err := os.Setenv(strings.TrimSpace(key), value); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func main() {
+	keys := flag.String("keys", "", "key bundle: env file with HMAC_KEY_BASE64 and the generator settings (default: the environment)")
+	in := flag.String("in", "-", "CSV of value,token[,data_type] (- = stdin)")
+	dataType := flag.String("type", "", "data type of rows without a data_type column")
+	tenant := flag.String("tenant", "", "tenant that issued the tokens (default: global tokens)")
+	prefix := flag.String("prefix", "", "token prefix of the tenant that issued the tokens")
+	flag.Parse()
+
+	if *keys != "" {
+		if err := loadKeyBundle(*keys); err != nil {
+			log.Fatalf("key bundle: %v", err)
+		}
+	}
+	v, err := bi_internal.NewTokenVerifier()
+	if err != nil {
+		log.Fatalf("key bundle: %v", err)
+	}
+
+	src := io.Reader(os.Stdin)
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("open %s: %v", *in, err)
+		}
+		defer f.Close()
+		src = f
+	}
+	r := csv.NewReader(src)
+	r.FieldsPerRecord = -1
+	out := csv.NewWriter(os.Stdout)
+	out.Write([]string{"line", "data_type", "token", "status", "hmac_key_version", "counter", "expected"})
+
+	var checked, mismatched, failed int
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatalf("read %s: %v", *in, err)
+		}
+		line, _ := r.FieldPos(0)
+		if len(rec) < 2 {
+			log.Fatalf("line %d: want value,token[,data_type]", line)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(rec[0]), "value") && strings.EqualFold(strings.TrimSpace(rec[1]), "token") {
+			continue // header
+		}
+		typ := *dataType
+		if len(rec) > 2 && strings.TrimSpace(rec[2]) != "" {
+			typ = rec[2]
+		}
+		if strings.TrimSpace(typ) == "" {
+			log.Fatalf("line %d: no data_type column and no -type", line)
+		}
+		typ = strings.ToUpper(strings.TrimSpace(typ))
+		token := strings.TrimSpace(rec[1])
+		checked++
+		res, err := v.Verify(typ, strings.TrimSpace(*tenant), *prefix, rec[0], token)
+		switch {
+		case err != nil:
+			// the error may quote the value, so it is not reported
+			failed++
+			out.Write([]string{strconv.Itoa(line), typ, token, "error", "", "", ""})
+		case !res.Match:
+			mismatched++
+			out.Write([]string{strconv.Itoa(line), typ, token, "mismatch", "", "", res.Expected})
+		case res.FirstCandidate:
+			out.Write([]string{strconv.Itoa(line), typ, token, "ok", res.HMACKeyVersion, strconv.Itoa(res.Counter), ""})
+		default:
+			// a later candidate: the first one was already issued to another value
+			out.Write([]string{strconv.Itoa(line), typ, token, "ok_cycle_walked", res.HMACKeyVersion, strconv.Itoa(res.Counter), ""})
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Fatalf("write report: %v", err)
+	}
+	log.Printf("verified %d tokens with %s: %d mismatched, %d could not be derived", checked, v.Generator(), mismatched, failed)
+	if mismatched > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Token alphabet presets (TOKEN_ALPHABET_<TYPE>). Any other value is taken as the literal
+// alphabet.
+const (
+	AlphabetBase36     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	AlphabetBase62     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	AlphabetEmailLocal = AlphabetBase62 + "._%+-"
+)
+
+var tokenAlphabetPresets = map[string]string{
+	"base36":      AlphabetBase36,
+	"base62":      AlphabetBase62,
+	"email-local": AlphabetEmailLocal,
+}
+
+// maxAlphabetRadix is every printable ASCII character except space.
+const maxAlphabetRadix = 94
+
+// ErrInvalidAlphabet is returned for alphabets that cannot encode tokens.
+var ErrInvalidAlphabet = errors.New("invalid token alphabet")
+
+// ParseTokenAlphabet resolves a preset name (base36, base62, email-local) or validates a literal
+// alphabet: 2 to 94 distinct printable ASCII characters, no space.
+func ParseTokenAlphabet(spec string) (string, error) {
+	if a, ok := tokenAlphabetPresets[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		return a, nil
+	}
+	if len(spec) < 2 || len(spec) > maxAlphabetRadix {
+		return "", fmt.Errorf("%w: needs 2 to %d characters, got %d", ErrInvalidAlphabet, maxAlphabetRadix, len(spec))
+	}
+	seen := map[byte]bool{}
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c <= ' ' || c > '~' {
+			return "", fmt.Errorf("%w: only printable ASCII characters except space are allowed", ErrInvalidAlphabet)
+		}
+		if seen[c] {
+			return "", fmt.Errorf("%w: %q appears twice", ErrInvalidAlphabet, c)
+		}
+		seen[c] = true
+	}
+	return spec, nil
+}
+
+// FPTFromBlindIndexWithAlphabet is FPTFromBlindIndexWithCounter for data types with a custom
+// token alphabet: a token of the same length as the value, drawn from alphabet. For EMAIL only
+// the local part is replaced and "@domain" is kept.
+func FPTFromBlindIndexWithAlphabet(blindHex, original, dataType string, counter int, alphabet string) (string, error) {
+	enc, err := newAlphabetEncoder(alphabet)
+	if err != nil {
+		return "", err
+	}
+	return enc.token(blindHex, original, dataType, counter)
+}
+
+// alphabetEncoder writes hashes in base len(alphabet). Building one is the per-alphabet setup,
+// so batch generation builds it once; it is read-only afterwards and safe for concurrent use.
+type alphabetEncoder struct {
+	alphabet string
+	radix    *big.Int
+	// perRound is fewer digits per hash than it holds, so every digit is close to uniform
+	perRound int
+}
+
+func newAlphabetEncoder(alphabet string) (*alphabetEncoder, error) {
+	if len(alphabet) < 2 {
+		return nil, ErrInvalidAlphabet
+	}
+	return &alphabetEncoder{
+		alphabet: alphabet,
+		radix:    big.NewInt(int64(len(alphabet))),
+		perRound: int(256/math.Log2(float64(len(alphabet)))) - 2,
+	}, nil
+}
+
+func (e *alphabetEncoder) token(blindHex, original, dataType string, counter int) (string, error) {
+	if strings.EqualFold(dataType, "EMAIL") {
+		if at := strings.LastIndex(original, "@"); at > 0 {
+			local, err := e.digits(blindHex, at, counter)
+			if err != nil {
+				return "", err
+			}
+			return local + original[at:], nil
+		}
+	}
+	return e.digits(blindHex, len(original), counter)
+}
+
+// digits writes SHA-256(blindHex:counter:round) in base len(alphabet).
+func (e *alphabetEncoder) digits(blindHex string, length, counter int) (string, error) {
+	if length <= 0 {
+		return "", errors.New("invalid length for alphabet fpt")
+	}
+	out := make([]byte, 0, length)
+	digit := new(big.Int)
+	for round := 0; len(out) < length; round++ {
+		src := sha256.Sum256([]byte(blindHex + ":" + fmt.Sprint(counter) + ":" + fmt.Sprint(round)))
+		n := new(big.Int).SetBytes(src[:])
+		for i := 0; i < e.perRound && len(out) < length; i++ {
+			n.DivMod(n, e.radix, digit)
+			out = append(out, e.alphabet[digit.Int64()])
+		}
+	}
+	return string(out), nil
+}
+
+// validEmailToken rejects local parts an email validator would refuse: a leading or trailing
+// dot, or two dots in a row.
+func validEmailToken(fpt string) bool {
+	at := strings.LastIndex(fpt, "@")
+	if at < 0 {
+		return true
+	}
+	local := fpt[:at]
+	return local != "" && !strings.HasPrefix(local, ".") && !strings.HasSuffix(local, ".") && !strings.Contains(local, "..")
+}
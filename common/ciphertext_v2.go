@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+// CiphertextV2Prefix marks the v2 ciphertext format: "v2:" + base64(nonce||ciphertext), sealed
+// with AES-GCM and associated data binding the ciphertext to its vault row, so a ciphertext
+// copied onto another row no longer decrypts.
+const CiphertextV2Prefix = "v2:"
+
+// CiphertextV2CompressedPrefix is the v2 format with the plaintext DEFLATE-compressed before
+// sealing. It is no longer written: the compressed length of a value reveals how much of it
+// repeats, and vault values are too short to gain anything. Rows written with it still decrypt.
+const CiphertextV2CompressedPrefix = "v2z:"
+
+// maxDecompressedPlaintext bounds the inflated size of a compressed v2 plaintext.
+const maxDecompressedPlaintext = 1 << 20
+
+// TokenAAD is the associated data of a v2 ciphertext.
+func TokenAAD(dataType, blindIndex string) []byte {
+	return []byte(strings.ToUpper(dataType) + "|" + blindIndex)
+}
+
+// EncryptV2 seals plaintext in the v2 format.
+func EncryptV2(aesKey, plaintext, aad []byte) (string, error) {
+	aesgcm, err := newGCM(aesKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aesgcm.Seal(nonce, nonce, plaintext, aad)
+	return CiphertextV2Prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptV2 opens a v2 ciphertext, compressed or not; aad must match the value used at
+// encryption.
+func DecryptV2(aesKey []byte, encoded string, aad []byte) ([]byte, error) {
+	compressed := strings.HasPrefix(encoded, CiphertextV2CompressedPrefix)
+	var body string
+	switch {
+	case compressed:
+		body = encoded[len(CiphertextV2CompressedPrefix):]
+	case strings.HasPrefix(encoded, CiphertextV2Prefix):
+		body = encoded[len(CiphertextV2Prefix):]
+	default:
+		return nil, errors.New("not a v2 ciphertext")
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ns := aesgcm.NonceSize()
+	if len(data) < ns {
+		return nil, errors.New("ciphertext too short")
+	}
+	plain, err := aesgcm.Open(nil, data[:ns], data[ns:], aad)
+	if err != nil || !compressed {
+		return plain, err
+	}
+	return inflate(plain)
+}
+
+func inflate(b []byte) ([]byte, error) {
+	zr := flate.NewReader(bytes.NewReader(b))
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedPlaintext+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedPlaintext {
+		return nil, errors.New("decompressed plaintext too large")
+	}
+	return out, nil
+}
+
+func newGCM(aesKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// FF1 limits of NIST SP 800-38G Rev. 1: the domain of every radix and length must hold at
+// least a million values.
+const (
+	ff1MinDomain = 1000000
+	ff1MaxRadix  = 1 << 16
+	ff1Rounds    = 10
+)
+
+// ErrFF1Domain is returned for numeral strings FF1 cannot encrypt (too short for the radix).
+var ErrFF1Domain = errors.New("value too short for FF1 (domain below 10^6)")
+
+// FF1 is the format-preserving encryption mode FF1 of NIST SP 800-38G over numeral strings of
+// one radix, with AES as the block cipher. It is immutable and safe for concurrent use.
+type FF1 struct {
+	block cipher.Block
+	radix int
+}
+
+// NewFF1 returns FF1 with an AES-128, -192 or -256 key over numerals 0..radix-1.
+func NewFF1(key []byte, radix int) (*FF1, error) {
+	if radix < 2 || radix > ff1MaxRadix {
+		return nil, fmt.Errorf("ff1: radix %d out of range", radix)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("ff1: %w", err)
+	}
+	return &FF1{block: block, radix: radix}, nil
+}
+
+// MinLength is the shortest numeral string the radix allows.
+func (f *FF1) MinLength() int {
+	n, domain := 1, f.radix
+	for domain < ff1MinDomain {
+		n++
+		domain *= f.radix
+	}
+	return max(n, 2)
+}
+
+// FF1MinLength is the shortest numeral string FF1 encrypts over radix.
+func FF1MinLength(radix int) int {
+	return (&FF1{radix: radix}).MinLength()
+}
+
+// Encrypt encrypts the numeral string x under tweak (Algorithm 7 of SP 800-38G).
+func (f *FF1) Encrypt(tweak []byte, x []int) ([]int, error) {
+	return f.feistel(tweak, x, false)
+}
+
+// Decrypt decrypts the numeral string y encrypted under tweak (Algorithm 8 of SP 800-38G).
+func (f *FF1) Decrypt(tweak []byte, y []int) ([]int, error) {
+	return f.feistel(tweak, y, true)
+}
+
+// feistel runs the ten FF1 rounds over x, backwards when decrypting.
+func (f *FF1) feistel(tweak []byte, x []int, decrypt bool) ([]int, error) {
+	n := len(x)
+	if n < f.MinLength() {
+		return nil, ErrFF1Domain
+	}
+	for _, d := range x {
+		if d < 0 || d >= f.radix {
+			return nil, fmt.Errorf("ff1: numeral %d out of radix %d", d, f.radix)
+		}
+	}
+	u := n / 2
+	v := n - u
+	a, b := append([]int(nil), x[:u]...), append([]int(nil), x[u:]...)
+
+	radix := big.NewInt(int64(f.radix))
+	// b bytes hold any numeral string of length v; d bytes are drawn per round
+	limit := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	bLen := (new(big.Int).Sub(limit, big.NewInt(1)).BitLen() + 7) / 8
+	dLen := 4*((bLen+3)/4) + 4
+
+	p := make([]byte, 16)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3], p[4], p[5] = byte(f.radix>>16), byte(f.radix>>8), byte(f.radix)
+	p[6], p[7] = 10, byte(u)
+	binary.BigEndian.PutUint32(p[8:], uint32(n))
+	binary.BigEndian.PutUint32(p[12:], uint32(len(tweak)))
+
+	pad := (16 - (len(tweak)+bLen+1)%16) % 16
+	q := make([]byte, len(tweak)+pad+1+bLen)
+	copy(q, tweak)
+
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := limit
+	for r := 0; r < ff1Rounds; r++ {
+		// decryption undoes the rounds last to first, feeding A where encryption fed B
+		i, in := r, b
+		if decrypt {
+			i, in = ff1Rounds-1-r, a
+		}
+		q[len(tweak)+pad] = byte(i)
+		numIn := f.num(in).Bytes()
+		clear(q[len(q)-bLen:])
+		copy(q[len(q)-len(numIn):], numIn)
+
+		prf := f.prf(append(append([]byte(nil), p...), q...))
+		s := make([]byte, 0, dLen+16)
+		s = append(s, prf...)
+		for j := 1; len(s) < dLen; j++ {
+			var blk [16]byte
+			binary.BigEndian.PutUint64(blk[8:], uint64(j))
+			for k := range blk {
+				blk[k] ^= prf[k]
+			}
+			f.block.Encrypt(blk[:], blk[:])
+			s = append(s, blk[:]...)
+		}
+		y := new(big.Int).SetBytes(s[:dLen])
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+		if decrypt {
+			c := new(big.Int).Sub(f.num(b), y)
+			c.Mod(c, mod)
+			a, b = f.str(c, m), a
+			continue
+		}
+		c := new(big.Int).Add(f.num(a), y)
+		c.Mod(c, mod)
+		a, b = b, f.str(c, m)
+	}
+	return append(a, b...), nil
+}
+
+// prf is the CBC-MAC of data (a multiple of 16 bytes) with a zero IV.
+func (f *FF1) prf(data []byte) []byte {
+	y := make([]byte, 16)
+	for i := 0; i < len(data); i += 16 {
+		for k := 0; k < 16; k++ {
+			y[k] ^= data[i+k]
+		}
+		f.block.Encrypt(y, y)
+	}
+	return y
+}
+
+// num is the value of a numeral string, most significant numeral first.
+func (f *FF1) num(x []int) *big.Int {
+	n := new(big.Int)
+	radix := big.NewInt(int64(f.radix))
+	for _, d := range x {
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return n
+}
+
+// str is the numeral string of length m of n.
+func (f *FF1) str(n *big.Int, m int) []int {
+	out := make([]int, m)
+	n = new(big.Int).Set(n)
+	radix := big.NewInt(int64(f.radix))
+	d := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		n.DivMod(n, radix, d)
+		out[i] = int(d.Int64())
+	}
+	return out
+}
+
+// DeriveKey derives a 256-bit key for purpose from key with the KDF in counter mode of NIST
+// SP 800-108 (HMAC-SHA256 PRF, one iteration).
+func DeriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{0, 0, 0, 1})
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte{0, 0, 1, 0})
+	return mac.Sum(nil)
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ff1Samples are the FF1 samples of NIST SP 800-38G (FF1samples.pdf), numerals written in
+// base 36.
+var ff1Samples = []struct {
+	name, key, tweak string
+	radix            int
+	plaintext, want  string
+}{
+	{"sample 1", "2B7E151628AED2A6ABF7158809CF4F3C", "", 10, "0123456789", "2433477484"},
+	{"sample 2", "2B7E151628AED2A6ABF7158809CF4F3C", "39383736353433323130", 10, "0123456789", "6124200773"},
+	{"sample 3", "2B7E151628AED2A6ABF7158809CF4F3C", "3737373770717273373737", 36, "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+	{"sample 4", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F", "", 10, "0123456789", "2830668132"},
+	{"sample 5", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F", "39383736353433323130", 10, "0123456789", "2496655549"},
+	{"sample 6", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F", "3737373770717273373737", 36, "0123456789abcdefghi", "xbj3kv35jrawxv32ysr"},
+	{"sample 7", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "", 10, "0123456789", "6657667009"},
+	{"sample 8", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "39383736353433323130", 10, "0123456789", "1001623463"},
+	{"sample 9", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "3737373770717273373737", 36, "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+}
+
+const base36 = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func numerals(t *testing.T, s string) []int {
+	x := make([]int, len(s))
+	for i := range s {
+		if x[i] = strings.IndexByte(base36, s[i]); x[i] < 0 {
+			t.Fatalf("numeral %q", s[i])
+		}
+	}
+	return x
+}
+
+func numeralString(x []int) string {
+	out := make([]byte, len(x))
+	for i, d := range x {
+		out[i] = base36[d]
+	}
+	return string(out)
+}
+
+func TestFF1NISTSamples(t *testing.T) {
+	for _, c := range ff1Samples {
+		key, _ := hex.DecodeString(c.key)
+		tweak, _ := hex.DecodeString(c.tweak)
+		f, err := NewFF1(key, c.radix)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		y, err := f.Encrypt(tweak, numerals(t, c.plaintext))
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", c.name, err)
+		}
+		if got := numeralString(y); got != c.want {
+			t.Errorf("%s: encrypt = %s, want %s", c.name, got, c.want)
+		}
+		x, err := f.Decrypt(tweak, numerals(t, c.want))
+		if err != nil {
+			t.Fatalf("%s: decrypt: %v", c.name, err)
+		}
+		if got := numeralString(x); got != c.plaintext {
+			t.Errorf("%s: decrypt = %s, want %s", c.name, got, c.plaintext)
+		}
+	}
+}
+
+// TestFF1RoundTrip covers the radixes tokens use: digits (PAN, AADHAR, MOBILE), the EMAIL
+// local-part preset and printable ASCII, at the shortest allowed length and beyond.
+func TestFF1RoundTrip(t *testing.T) {
+	key := DeriveKey([]byte("0123456789abcdef0123456789abcdef"), FF1TokenKeyPurpose)
+	tweak := ff1Tweak("TEST", 0)
+	for _, radix := range []int{10, len(AlphabetEmailLocal), len(AlphabetPrintable)} {
+		f, err := NewFF1(key, radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{f.MinLength(), f.MinLength() + 1, 12, 33} {
+			x := make([]int, n)
+			for i := range x {
+				x[i] = (i*7 + 3) % radix
+			}
+			y, err := f.Encrypt(tweak, x)
+			if err != nil {
+				t.Fatalf("radix %d, length %d: %v", radix, n, err)
+			}
+			if slices.Equal(x, y) {
+				t.Errorf("radix %d, length %d: ciphertext equals plaintext", radix, n)
+			}
+			back, err := f.Decrypt(tweak, y)
+			if err != nil {
+				t.Fatalf("radix %d, length %d: %v", radix, n, err)
+			}
+			if !slices.Equal(back, x) {
+				t.Errorf("radix %d, length %d: decrypt = %v, want %v", radix, n, back, x)
+			}
+		}
+		if _, err := f.Encrypt(tweak, make([]int, f.MinLength()-1)); err != ErrFF1Domain {
+			t.Errorf("radix %d: below the minimum length: err = %v, want ErrFF1Domain", radix, err)
+		}
+	}
+}
+
+func TestFF1TokensRoundTrip(t *testing.T) {
+	key := DeriveKey([]byte("0123456789abcdef0123456789abcdef"), FF1TokenKeyPurpose)
+	cases := []struct{ dataType, value string }{
+		{"PAN", "ABCDE1234F"},
+		{"AADHAR", "234567890123"},
+		{"MOBILE", "+919876543210"},
+		{"EMAIL", "john.doe@example.com"},
+		{"NAME", "Jane Q. Public"},
+	}
+	for _, c := range cases {
+		g, err := NewFF1TokenGenerator(c.dataType, "", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for counter := 0; counter < 3; counter++ {
+			token, err := g.Generate("", c.value, counter)
+			if err != nil {
+				t.Fatalf("%s: %v", c.dataType, err)
+			}
+			if token == c.value || len(token) != len(c.value) {
+				t.Errorf("%s: token %q of %q", c.dataType, token, c.value)
+			}
+			back, err := g.Original(token, counter)
+			if err != nil || back != c.value {
+				t.Errorf("%s counter %d: %q decrypts to %q (%v)", c.dataType, counter, token, back, err)
+			}
+		}
+	}
+}
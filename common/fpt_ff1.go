@@ -0,0 +1,291 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// FF1TokenKeyPurpose is the SP 800-108 label of the FF1 token key derived from the HMAC key.
+const FF1TokenKeyPurpose = "fpt-ff1-v1 token key"
+
+// AlphabetPrintable is the FF1 alphabet of data types without a built-in format or
+// TOKEN_ALPHABET_<TYPE>: printable ASCII including space.
+const AlphabetPrintable = " !\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~"
+
+// ErrFF1Format is returned for values outside the FF1 domain of their data type.
+var ErrFF1Format = errors.New("value does not fit the FF1 format of its data type")
+
+// maxFF1CycleWalk bounds the re-encryptions of a PAN until it lands in the PAN domain; each
+// one lands there with probability 0.31.
+const maxFF1CycleWalk = 1000
+
+// panDomain is the number of AAAAA9999A values: 26^5 * 10^4 * 26.
+var panDomain = new(big.Int).Mul(new(big.Int).Exp(big.NewInt(26), big.NewInt(6), nil), big.NewInt(10000))
+
+// panDomainDigits is the decimal length of the largest PAN value.
+var panDomainDigits = len(new(big.Int).Sub(panDomain, big.NewInt(1)).String())
+
+// FF1Cipher is FF1 over the numeral strings of one radix. *FF1 encrypts in process; an
+// HSM-backed FF1Cipher keeps the key out of the process and encrypts remotely.
+type FF1Cipher interface {
+	Encrypt(tweak []byte, x []int) ([]int, error)
+}
+
+// FF1Decrypter is an FF1Cipher that also decrypts. *FF1 is one; ciphers without Decrypt (the
+// HSM sidecar) issue tokens that only the vault resolves.
+type FF1Decrypter interface {
+	FF1Cipher
+	Decrypt(tweak []byte, y []int) ([]int, error)
+}
+
+// ErrFF1NotReversible is returned when a token cannot be decrypted back into its value: it is
+// not an FF1 token, or its cipher does not decrypt.
+var ErrFF1NotReversible = errors.New("token is not reversible with FF1")
+
+// ff1Decimal converts PAN numbers to and from decimal numerals; it holds no key.
+var ff1Decimal = &FF1{radix: 10}
+
+// ff1Encoder encrypts values with FF1 (NIST SP 800-38G) instead of deriving tokens from the
+// blind index: PAN as one mixed-radix number, AADHAR and the MOBILE national number as digits,
+// anything else over its alphabet. The counter is part of the tweak, so cycle walking still
+// yields a new candidate per counter.
+type ff1Encoder struct {
+	digits   FF1Cipher
+	alphabet string
+	chars    FF1Cipher
+}
+
+func newFF1Encoder(newCipher func(radix int) (FF1Cipher, error), alphabet string) (*ff1Encoder, error) {
+	digits, err := newCipher(10)
+	if err != nil {
+		return nil, err
+	}
+	chars, err := newCipher(len(alphabet))
+	if err != nil {
+		return nil, err
+	}
+	return &ff1Encoder{digits: digits, alphabet: alphabet, chars: chars}, nil
+}
+
+func ff1Tweak(dataType string, counter int) []byte {
+	return []byte(fmt.Sprintf("fpt-ff1-v1:%s:%d", dataType, counter))
+}
+
+// CheckFF1Value reports why original cannot be FF1-tokenized as dataType with the
+// TOKEN_ALPHABET_<TYPE> alphabet ("" = the built-in format), or nil.
+func CheckFF1Value(dataType, alphabet, original string) error {
+	dataType = strings.ToUpper(dataType)
+	builtIn := alphabet == ""
+	alphabet = ff1Alphabet(dataType, alphabet)
+	in, err := parseFF1Input(original, dataType, alphabet, builtIn)
+	if err != nil {
+		return err
+	}
+	radix := 10
+	if in.chars {
+		radix = len(alphabet)
+	}
+	f := &FF1{radix: radix}
+	if !in.pan && len(in.x) < f.MinLength() {
+		return ErrFF1Domain
+	}
+	return nil
+}
+
+// ff1Alphabet is the alphabet of the non built-in formats: TOKEN_ALPHABET_<TYPE>, the
+// email-local preset for EMAIL, AlphabetPrintable otherwise.
+func ff1Alphabet(dataType, alphabet string) string {
+	switch {
+	case alphabet != "":
+		return alphabet
+	case dataType == "EMAIL":
+		return AlphabetEmailLocal
+	}
+	return AlphabetPrintable
+}
+
+// ff1Input is the part of a value FF1 encrypts: the numerals x (over the alphabet when chars
+// is set, digits otherwise) or, for a PAN, its number below panDomain. The kept prefix and
+// suffix (MOBILE country code, EMAIL domain) are not encrypted.
+type ff1Input struct {
+	prefix, suffix string
+	x              []int
+	chars          bool
+	pan            bool
+	n              *big.Int
+}
+
+var panRadices = [10]int64{26, 26, 26, 26, 26, 10, 10, 10, 10, 26}
+
+func panNumeralBase(radix int64) byte {
+	if radix == 10 {
+		return '0'
+	}
+	return 'A'
+}
+
+func parseFF1Input(original, dataType, alphabet string, builtIn bool) (ff1Input, error) {
+	var in ff1Input
+	if builtIn {
+		switch dataType {
+		case "PAN":
+			if len(original) != len(panRadices) {
+				return in, fmt.Errorf("%w: PAN must be 5 letters, 4 digits and a letter", ErrFF1Format)
+			}
+			in.pan, in.n = true, new(big.Int)
+			for i, radix := range panRadices {
+				d := int64(original[i]) - int64(panNumeralBase(radix))
+				if d < 0 || d >= radix {
+					return in, fmt.Errorf("%w: PAN must be 5 letters, 4 digits and a letter", ErrFF1Format)
+				}
+				in.n.Mul(in.n, big.NewInt(radix)).Add(in.n, big.NewInt(d))
+			}
+			return in, nil
+		case "AADHAR":
+			return in, in.setDigits(original)
+		case "MOBILE":
+			cc, nsn, err := ParseE164(original)
+			if err != nil {
+				return in, err
+			}
+			in.prefix = "+" + cc
+			return in, in.setDigits(nsn)
+		}
+	}
+	value := original
+	if dataType == "EMAIL" {
+		if at := strings.LastIndex(original, "@"); at > 0 {
+			value, in.suffix = original[:at], original[at:]
+		}
+	}
+	in.chars = true
+	in.x = make([]int, len(value))
+	for i := 0; i < len(value); i++ {
+		if in.x[i] = strings.IndexByte(alphabet, value[i]); in.x[i] < 0 {
+			return in, fmt.Errorf("%w: %q is not in the token alphabet", ErrFF1Format, value[i])
+		}
+	}
+	return in, nil
+}
+
+func (in *ff1Input) setDigits(s string) error {
+	in.x = make([]int, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return fmt.Errorf("%w: digits expected", ErrFF1Format)
+		}
+		in.x[i] = int(s[i] - '0')
+	}
+	return nil
+}
+
+// token returns the counter-th FF1 token of original; builtIn selects the built-in format of
+// PAN, AADHAR and MOBILE (false when the type has a TOKEN_ALPHABET_<TYPE>).
+func (e *ff1Encoder) token(original, dataType string, counter int, builtIn bool) (string, error) {
+	in, err := parseFF1Input(original, dataType, e.alphabet, builtIn)
+	if err != nil {
+		return "", err
+	}
+	tweak := ff1Tweak(dataType, counter)
+	if in.pan {
+		return e.pan(in.n, tweak)
+	}
+	f, symbols := e.digits, "0123456789"
+	if in.chars {
+		f, symbols = e.chars, e.alphabet
+	}
+	y, err := f.Encrypt(tweak, in.x)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, len(y))
+	for i, d := range y {
+		out[i] = symbols[d]
+	}
+	return in.prefix + string(out) + in.suffix, nil
+}
+
+// pan encrypts a PAN number written in decimal, re-encrypting results outside panDomain
+// (cycle walking) so the token is again 5 letters, 4 digits and a letter.
+func (e *ff1Encoder) pan(n *big.Int, tweak []byte) (string, error) {
+	x := ff1Decimal.str(n, panDomainDigits)
+	for i := 0; ; i++ {
+		if i == maxFF1CycleWalk {
+			return "", errors.New("ff1: PAN cycle walk did not converge")
+		}
+		var err error
+		if x, err = e.digits.Encrypt(tweak, x); err != nil {
+			return "", err
+		}
+		if n = ff1Decimal.num(x); n.Cmp(panDomain) < 0 {
+			break
+		}
+	}
+	return panString(n), nil
+}
+
+// original decrypts the counter-th FF1 token of a value back into the value; token must be the
+// raw token, without output constraints.
+func (e *ff1Encoder) original(token, dataType string, counter int, builtIn bool) (string, error) {
+	in, err := parseFF1Input(token, dataType, e.alphabet, builtIn)
+	if err != nil {
+		return "", err
+	}
+	tweak := ff1Tweak(dataType, counter)
+	if in.pan {
+		return e.panOriginal(in.n, tweak)
+	}
+	c, symbols := e.digits, "0123456789"
+	if in.chars {
+		c, symbols = e.chars, e.alphabet
+	}
+	f, ok := c.(FF1Decrypter)
+	if !ok {
+		return "", ErrFF1NotReversible
+	}
+	x, err := f.Decrypt(tweak, in.x)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, len(x))
+	for i, d := range x {
+		out[i] = symbols[d]
+	}
+	return in.prefix + string(out) + in.suffix, nil
+}
+
+// panOriginal undoes pan: it decrypts until the number is back in panDomain, since the values
+// cycle walking passed through all lie outside it.
+func (e *ff1Encoder) panOriginal(n *big.Int, tweak []byte) (string, error) {
+	f, ok := e.digits.(FF1Decrypter)
+	if !ok {
+		return "", ErrFF1NotReversible
+	}
+	x := ff1Decimal.str(n, panDomainDigits)
+	for i := 0; ; i++ {
+		if i == maxFF1CycleWalk {
+			return "", errors.New("ff1: PAN cycle walk did not converge")
+		}
+		var err error
+		if x, err = f.Decrypt(tweak, x); err != nil {
+			return "", err
+		}
+		if n = ff1Decimal.num(x); n.Cmp(panDomain) < 0 {
+			break
+		}
+	}
+	return panString(n), nil
+}
+
+// panString writes a number below panDomain as 5 letters, 4 digits and a letter.
+func panString(n *big.Int) string {
+	out := make([]byte, len(panRadices))
+	d := new(big.Int)
+	for i := len(panRadices) - 1; i >= 0; i-- {
+		n.DivMod(n, big.NewInt(panRadices[i]), d)
+		out[i] = panNumeralBase(panRadices[i]) + byte(d.Int64())
+	}
+	return string(out)
+}
@@ -12,25 +12,24 @@ import (
 	"fmt"
 	"io"
 	"math/big"
-	"os"
 	"strings"
 	"github.com/joho/godotenv"
 )
 func init() {
     godotenv.Load()
 }
-// MustEnv returns env value or panics (used at startup)
+// MustEnv returns env value (or the contents of <KEY>_FILE) or panics (used at startup)
 func MustEnv(key string) string {
-	v := os.Getenv(key)
+	v := lookupEnvOrFile(key)
 	if v == "" {
 		panic("missing env: " + key)
 	}
 	return v
 }
 
-// MaybeEnv returns environment value or empty string (non-panicking)
+// MaybeEnv returns environment value (or the contents of <KEY>_FILE) or empty string (non-panicking)
 func MaybeEnv(key string) string {
-    return os.Getenv(key)
+	return lookupEnvOrFile(key)
 }
 
 
@@ -107,8 +106,27 @@ func FPTFromBlindIndex(blindHex string, original string, dataType string) (strin
 	return FPTFromBlindIndexWithCounter(blindHex, original, dataType, 0)
 }
 
+// NormalizePII returns the canonical form of a PII value used for blind indexing and encryption.
+// PAN is uppercased, MOBILE is converted to E.164 ("+<cc><nsn>") when it parses; everything
+// else is only trimmed. The result feeds the blind index, so a change here moves every
+// existing value of the type to a new index: lookups must keep finding rows under the old
+// form, as lookupByValue does for MOBILE numbers indexed before E.164 normalization.
+func NormalizePII(dataType, value string) string {
+	value = strings.TrimSpace(value)
+	switch strings.ToUpper(strings.TrimSpace(dataType)) {
+	case "PAN":
+		return strings.ToUpper(value)
+	case "MOBILE":
+		if n, err := NormalizeE164(value); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
 // FPTFromBlindIndexWithCounter returns a deterministic format-preserving token derived from blindHex and counter.
-// Supported dataType: "PAN" (5 letters + 4 digits + 1 letter), "AADHAR" (numeric, same length as original).
+// Supported dataType: "PAN" (5 letters + 4 digits + 1 letter), "AADHAR" (numeric, same length as original),
+// "MOBILE" (E.164; country code kept, national number replaced by digits of the same length).
 // For other types we fall back to base36 uppercase trimmed/padded to original length.
 func FPTFromBlindIndexWithCounter(blindHex, original, dataType string, counter int) (string, error) {
 	switch strings.ToUpper(dataType) {
@@ -116,6 +134,8 @@ func FPTFromBlindIndexWithCounter(blindHex, original, dataType string, counter i
 		return fptPANFromBlind(blindHex, counter)
 	case "AADHAR":
 		return fptDigitsFromBlind(blindHex, len(original), counter)
+	case "MOBILE":
+		return fptMobileFromBlind(blindHex, original, counter)
 	default:
 		return deterministicBase36FromHexWithCounter(blindHex, len(original), counter)
 	}
@@ -141,6 +161,57 @@ func fptPANFromBlind(blindHex string, counter int) (string, error) {
 	return string(out), nil
 }
 
+// TweakPolicy selects how the token of a multi-segment format is derived from the blind index.
+type TweakPolicy int
+
+const (
+	// TweakShared derives all segments of a PAN token from one hash, so the letters, digits and
+	// check letter are bytes of the same SHA-256 (generator fpt-sha256-v1).
+	TweakShared TweakPolicy = 1
+	// TweakPerSegment binds every segment to its own tweak (blind:counter:segment), so each
+	// segment comes from an independent hash (generator fpt-sha256-v2).
+	TweakPerSegment TweakPolicy = 2
+)
+
+// ParseTweakPolicy parses "v1" (shared) or "v2" (per segment).
+func ParseTweakPolicy(v string) (TweakPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "v1":
+		return TweakShared, nil
+	case "v2":
+		return TweakPerSegment, nil
+	}
+	return 0, fmt.Errorf("unknown tweak policy %q (want v1 or v2)", v)
+}
+
+// FPTFromBlindIndexWithPolicy is FPTFromBlindIndexWithCounter under a tweak policy. Only PAN has
+// several segments; every other type yields the same token under both policies.
+func FPTFromBlindIndexWithPolicy(blindHex, original, dataType string, counter int, policy TweakPolicy) (string, error) {
+	if policy == TweakPerSegment && strings.EqualFold(dataType, "PAN") {
+		return fptPANSegmentedFromBlind(blindHex, counter), nil
+	}
+	return FPTFromBlindIndexWithCounter(blindHex, original, dataType, counter)
+}
+
+// fptPANSegmentedFromBlind derives the letters, digits and check letter of a PAN token from
+// SHA256(blindHex:counter:<segment>) each.
+func fptPANSegmentedFromBlind(blindHex string, counter int) string {
+	segment := func(name string) []byte {
+		src := sha256.Sum256([]byte(blindHex + ":" + fmt.Sprint(counter) + ":pan-" + name))
+		return src[:]
+	}
+	out := make([]byte, 10)
+	letters, digits, check := segment("letters"), segment("digits"), segment("check")
+	for i := 0; i < 5; i++ {
+		out[i] = byte('A' + (letters[i] % 26))
+	}
+	for i := 0; i < 4; i++ {
+		out[5+i] = byte('0' + (digits[i] % 10))
+	}
+	out[9] = byte('A' + (check[0] % 26))
+	return string(out)
+}
+
 func fptDigitsFromBlind(blindHex string, length, counter int) (string, error) {
 	if length <= 0 {
 		return "", errors.New("invalid length for digits fpt")
@@ -160,6 +231,20 @@ func fptDigitsFromBlind(blindHex string, length, counter int) (string, error) {
 	return string(out), nil
 }
 
+// fptMobileFromBlind preserves the country code segment of an E.164 number and tokenizes the
+// national significant number with the same length.
+func fptMobileFromBlind(blindHex, original string, counter int) (string, error) {
+	cc, nsn, err := ParseE164(original)
+	if err != nil {
+		return "", err
+	}
+	digits, err := fptDigitsFromBlind(blindHex, len(nsn), counter)
+	if err != nil {
+		return "", err
+	}
+	return "+" + cc + digits, nil
+}
+
 func deterministicBase36FromHexWithCounter(hexstr string, length int, counter int) (string, error) {
 	// Use sha256(hexstr + ":" + counter) and convert to base36 uppercase
 	src := sha256.Sum256([]byte(hexstr + ":" + fmt.Sprint(counter)))
@@ -0,0 +1,28 @@
+package common
+
+import "strings"
+
+// MaskPII returns a display-safe masked form of a normalized PII value:
+// MOBILE keeps the country code and last 4 digits, EMAIL keeps the first character of the
+// local part and the domain, everything else keeps the last 4 characters.
+func MaskPII(dataType, normalized string) string {
+	switch strings.ToUpper(dataType) {
+	case "MOBILE":
+		if cc, nsn, err := ParseE164(normalized); err == nil {
+			return "+" + cc + maskKeepLast(nsn, 4)
+		}
+	case "EMAIL":
+		if at := strings.LastIndex(normalized, "@"); at > 0 {
+			return normalized[:1] + strings.Repeat("*", at-1) + normalized[at:]
+		}
+	}
+	return maskKeepLast(normalized, 4)
+}
+
+func maskKeepLast(s string, keep int) string {
+	r := []rune(s)
+	if len(r) <= keep {
+		return strings.Repeat("X", len(r))
+	}
+	return strings.Repeat("X", len(r)-keep) + string(r[len(r)-keep:])
+}
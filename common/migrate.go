@@ -1,27 +1,184 @@
 package common
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
+	"sort"
+	"strings"
 )
 
-// RunMigrations reads and executes the given SQL migration file(s).
-func RunMigrations(db *sql.DB, paths ...string) error {
-	for _, path := range paths {
-		log.Printf("Running migration: %s", path)
+// schemaMigrationsDDL creates the table recording applied migration files and their checksums.
+const schemaMigrationsDDL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    name TEXT PRIMARY KEY,
+    checksum TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
 
-		sqlBytes, err := ioutil.ReadFile(path)
+// Migration is one SQL migration file: Name is its file name (the key in schema_migrations)
+// and Checksum the hex SHA-256 of its contents.
+type Migration struct {
+	Name     string
+	SQL      string
+	Checksum string
+}
+
+// LoadMigrations reads the *.sql files at the root of fsys, ordered by name. Two files with
+// the same numeric version prefix ("001_") are refused.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no migration files found")
+	}
+	sort.Strings(names)
+	var out []Migration
+	seen := map[string]string{}
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
 		if err != nil {
-			return fmt.Errorf("read migration file: %w", err)
+			return nil, fmt.Errorf("read migration file: %w", err)
+		}
+		version, _, _ := strings.Cut(name, "_")
+		if prev, ok := seen[version]; ok {
+			return nil, fmt.Errorf("duplicate migration %s: %s already uses version %s", name, prev, version)
+		}
+		seen[version] = name
+		sum := sha256.Sum256(b)
+		out = append(out, Migration{Name: name, SQL: string(b), Checksum: hex.EncodeToString(sum[:])})
+	}
+	return out, nil
+}
+
+// PendingMigrations returns the migrations not yet recorded in schema_migrations. It fails
+// when an applied file's checksum changed: edits to applied migrations are never run again,
+// so they have to go into a new file.
+func PendingMigrations(db *sql.DB, fsys fs.FS) ([]Migration, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	var changed []string
+	for _, m := range migrations {
+		sum, ok := applied[m.Name]
+		switch {
+		case !ok:
+			pending = append(pending, m)
+		case sum != m.Checksum:
+			changed = append(changed, m.Name)
+		}
+	}
+	if len(changed) > 0 {
+		return nil, fmt.Errorf("applied migrations changed on disk: %s (restore them and put schema changes in a new migration file)", strings.Join(changed, ", "))
+	}
+	return pending, nil
+}
+
+// appliedMigrations returns name -> checksum of the applied migrations; empty before the
+// first run created schema_migrations.
+func appliedMigrations(db *sql.DB) (map[string]string, error) {
+	applied := map[string]string{}
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("check schema_migrations: %w", err)
+	}
+	if !exists {
+		return applied, nil
+	}
+	rows, err := db.Query(`SELECT name, checksum FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, sum string
+		if err := rows.Scan(&name, &sum); err != nil {
+			return nil, err
 		}
-		sql := string(sqlBytes)
+		applied[name] = sum
+	}
+	return applied, rows.Err()
+}
 
-		if _, err := db.Exec(sql); err != nil {
-			return fmt.Errorf("exec migration %s: %w", path, err)
+// RunMigrations executes the migration files of fsys that have not been applied yet, each
+// in its own transaction together with its schema_migrations record. It refuses to run when
+// an applied file changed (see PendingMigrations). Concurrent runners (replicas starting at
+// the same time) serialize on an advisory lock, so every file runs exactly once.
+func RunMigrations(db *sql.DB, fsys fs.FS) error {
+	if _, err := db.Exec(schemaMigrationsDDL); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	pending, err := PendingMigrations(db, fsys)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		ran, err := applyMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("exec migration %s: %w", m.Name, err)
+		}
+		if ran {
+			log.Printf("Applied migration: %s", m.Name)
 		}
 	}
 	log.Println("✅ All migrations applied successfully.")
 	return nil
 }
+
+// applyMigration runs m unless another runner applied it while this one waited for the lock.
+func applyMigration(db *sql.DB, m Migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`); err != nil {
+		return false, err
+	}
+	var sum string
+	err = tx.QueryRow(`SELECT checksum FROM schema_migrations WHERE name = $1`, m.Name).Scan(&sum)
+	switch {
+	case err == nil && sum == m.Checksum:
+		return false, nil
+	case err == nil:
+		return false, errors.New("applied concurrently with a different checksum")
+	case err != sql.ErrNoRows:
+		return false, err
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name, checksum) VALUES ($1, $2)`, m.Name, m.Checksum); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// PrintPendingMigrations writes the statements RunMigrations would execute to w, without
+// changing the database (--dry-run).
+func PrintPendingMigrations(db *sql.DB, w io.Writer, fsys fs.FS) error {
+	pending, err := PendingMigrations(db, fsys)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "-- no pending migrations")
+		return nil
+	}
+	for _, m := range pending {
+		fmt.Fprintf(w, "-- pending: %s (sha256 %s)\n%s\n", m.Name, m.Checksum, strings.TrimRight(m.SQL, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// phoneCountry describes the national significant number (NSN) length range of mobile
+// numbers for an E.164 country calling code.
+type phoneCountry struct {
+	MinLen int
+	MaxLen int
+}
+
+// phoneCountries is the country-code metadata table used to split and validate E.164 input.
+// Keys are calling codes without the leading '+'. Lengths are for mobile NSNs.
+var phoneCountries = map[string]phoneCountry{
+	"1":   {10, 10}, // NANP (US, CA, ...)
+	"7":   {10, 10}, // RU, KZ
+	"20":  {10, 10}, // EG
+	"27":  {9, 9},   // ZA
+	"31":  {9, 9},   // NL
+	"33":  {9, 9},   // FR
+	"34":  {9, 9},   // ES
+	"39":  {9, 10},  // IT
+	"41":  {9, 9},   // CH
+	"44":  {10, 10}, // GB
+	"45":  {8, 8},   // DK
+	"46":  {7, 9},   // SE
+	"47":  {8, 8},   // NO
+	"48":  {9, 9},   // PL
+	"49":  {10, 11}, // DE
+	"52":  {10, 10}, // MX
+	"55":  {10, 11}, // BR
+	"60":  {9, 10},  // MY
+	"61":  {9, 9},   // AU
+	"62":  {9, 12},  // ID
+	"63":  {10, 10}, // PH
+	"64":  {8, 10},  // NZ
+	"65":  {8, 8},   // SG
+	"66":  {9, 9},   // TH
+	"81":  {10, 10}, // JP
+	"82":  {9, 10},  // KR
+	"84":  {9, 10},  // VN
+	"86":  {11, 11}, // CN
+	"90":  {10, 10}, // TR
+	"91":  {10, 10}, // IN
+	"92":  {10, 10}, // PK
+	"94":  {9, 9},   // LK
+	"234": {10, 10}, // NG
+	"254": {9, 9},   // KE
+	"353": {9, 9},   // IE
+	"880": {10, 10}, // BD
+	"966": {9, 9},   // SA
+	"971": {9, 9},   // AE
+	"977": {10, 10}, // NP
+}
+
+// DefaultPhoneCountryCode is assumed for bare national numbers (no '+' / '00' prefix).
+const DefaultPhoneCountryCode = "91"
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// ParseE164 splits a phone number into (country code, national significant number).
+// It accepts "+<cc><nsn>", "00<cc><nsn>" and bare national numbers (assumed +91),
+// ignoring spaces, dashes, dots and parentheses.
+func ParseE164(raw string) (string, string, error) {
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(raw))
+
+	international := false
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s, international = s[1:], true
+	case strings.HasPrefix(s, "00"):
+		s, international = s[2:], true
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return "", "", ErrInvalidPhone
+	}
+
+	if !international {
+		// tolerate a national trunk prefix, e.g. 09876543210
+		nsn := strings.TrimPrefix(s, "0")
+		c := phoneCountries[DefaultPhoneCountryCode]
+		if len(nsn) < c.MinLen || len(nsn) > c.MaxLen {
+			return "", "", ErrInvalidPhone
+		}
+		return DefaultPhoneCountryCode, nsn, nil
+	}
+
+	// E.164 country codes are prefix-free, so the first match of 1..3 digits is the code.
+	for n := 1; n <= 3 && n < len(s); n++ {
+		c, ok := phoneCountries[s[:n]]
+		if !ok {
+			continue
+		}
+		nsn := s[n:]
+		if len(nsn) < c.MinLen || len(nsn) > c.MaxLen {
+			return "", "", ErrInvalidPhone
+		}
+		return s[:n], nsn, nil
+	}
+	return "", "", ErrInvalidPhone
+}
+
+// PhoneNumberFormat returns the supported country calling codes (sorted) and the shortest
+// and longest national significant number among them.
+func PhoneNumberFormat() (codes []string, minNSN, maxNSN int) {
+	for cc, c := range phoneCountries {
+		codes = append(codes, cc)
+		if minNSN == 0 || c.MinLen < minNSN {
+			minNSN = c.MinLen
+		}
+		maxNSN = max(maxNSN, c.MaxLen)
+	}
+	sort.Strings(codes)
+	return codes, minNSN, maxNSN
+}
+
+// NormalizeE164 returns the canonical "+<cc><nsn>" form of a phone number.
+func NormalizeE164(raw string) (string, error) {
+	cc, nsn, err := ParseE164(raw)
+	if err != nil {
+		return "", err
+	}
+	return "+" + cc + nsn, nil
+}
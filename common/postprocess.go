@@ -0,0 +1,99 @@
+package common
+
+import (
+	"errors"
+	"strings"
+)
+
+// Postprocessor enforces an output constraint on a freshly generated token. It must be
+// deterministic and keep the data type's format; it runs after the generator for every
+// candidate, so the same PII and counter always produce the same final token.
+type Postprocessor func(fpt string) (string, error)
+
+// ApplyPostprocessors runs pps in order.
+func ApplyPostprocessors(fpt string, pps ...Postprocessor) (string, error) {
+	var err error
+	for _, pp := range pps {
+		if fpt, err = pp(fpt); err != nil {
+			return "", err
+		}
+	}
+	return fpt, nil
+}
+
+// PrefixPostprocessor constrains tokens to start with prefix (see ApplyTokenPrefix).
+func PrefixPostprocessor(dataType, prefix string) Postprocessor {
+	return func(fpt string) (string, error) {
+		return ApplyTokenPrefix(dataType, fpt, prefix)
+	}
+}
+
+// Verhoeff tables (dihedral group D5 multiplication, permutation, inverse).
+var (
+	verhoeffD = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+	verhoeffInv = [10]int{0, 4, 3, 2, 1, 5, 6, 7, 8, 9}
+)
+
+// VerhoeffCheckDigit computes the Verhoeff check digit of a digit string.
+func VerhoeffCheckDigit(digits string) (byte, error) {
+	c := 0
+	for i := 0; i < len(digits); i++ {
+		d := digits[len(digits)-1-i]
+		if d < '0' || d > '9' {
+			return 0, errors.New("verhoeff: non-digit input")
+		}
+		c = verhoeffD[c][verhoeffP[(i+1)%8][d-'0']]
+	}
+	return byte('0' + verhoeffInv[c]), nil
+}
+
+// AadharChecksumPostprocessor rewrites the last digit of a 12-digit token so the token passes
+// the Verhoeff check used by Aadhaar numbers (for downstream validators that reject tokens).
+func AadharChecksumPostprocessor(fpt string) (string, error) {
+	fpt = strings.TrimSpace(fpt)
+	if len(fpt) != 12 {
+		return "", errors.New("aadhar checksum: token must have 12 digits")
+	}
+	check, err := VerhoeffCheckDigit(fpt[:11])
+	if err != nil {
+		return "", err
+	}
+	return fpt[:11] + string(check), nil
+}
+
+// PreservePostprocessor copies the characters at the 0-based positions of original into the
+// token, e.g. the PAN holder type (4th character) so tokens keep that segmentation signal.
+// The remaining positions stay tokenized.
+func PreservePostprocessor(original string, positions ...int) Postprocessor {
+	return func(fpt string) (string, error) {
+		if len(fpt) != len(original) {
+			return "", errors.New("preserve: token and value differ in length")
+		}
+		out := []byte(fpt)
+		for _, i := range positions {
+			out[i] = original[i]
+		}
+		return string(out), nil
+	}
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// ErrInvalidTokenPrefix is returned when a prefix does not fit the token format of a data type.
+var ErrInvalidTokenPrefix = errors.New("token prefix does not fit the data type's format")
+
+// tokenAlphabet returns the allowed characters of each position of a token body. For MOBILE
+// the body is the national number after "+<cc>".
+func tokenAlphabet(dataType string, bodyLen int) []string {
+	const letters, digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "0123456789"
+	out := make([]string, bodyLen)
+	for i := range out {
+		switch strings.ToUpper(dataType) {
+		case "PAN":
+			out[i] = letters
+			if i >= 5 && i < 9 {
+				out[i] = digits
+			}
+		case "AADHAR", "MOBILE":
+			out[i] = digits
+		default:
+			out[i] = digits + letters
+		}
+	}
+	return out
+}
+
+// ValidateTokenPrefix checks that prefix can lead a token body of the data type.
+func ValidateTokenPrefix(dataType, prefix string) error {
+	positions := tokenAlphabet(dataType, 10)
+	if strings.EqualFold(dataType, "AADHAR") {
+		positions = tokenAlphabet(dataType, 12)
+	}
+	if len(prefix) == 0 || len(prefix) >= len(positions) {
+		return ErrInvalidTokenPrefix
+	}
+	for i := 0; i < len(prefix); i++ {
+		if !strings.ContainsRune(positions[i], rune(prefix[i])) {
+			return ErrInvalidTokenPrefix
+		}
+	}
+	// a prefix every token fails ValidTokenOutput with would exhaust cycle walking
+	if strings.EqualFold(dataType, "AADHAR") && (prefix[0] == '0' || prefix[0] == '1') {
+		return ErrInvalidTokenPrefix
+	}
+	return nil
+}
+
+// ApplyTokenPrefix remaps a generated token into the subset of tokens starting with prefix.
+// The rank of the positions after the prefix is offset by the replaced leading characters and
+// reduced modulo the size of that subset, then re-ranked under the prefix. The mapping stays
+// deterministic and keeps the data type's format, and tokens that differ only in their leading
+// characters stay distinct. The subset is smaller than the token space, so other tokens can
+// still map onto each other; the unique fpt index refuses such a candidate on insert and cycle
+// walking moves on to the next one, as for any token already taken.
+func ApplyTokenPrefix(dataType, fpt, prefix string) (string, error) {
+	if prefix == "" {
+		return fpt, nil
+	}
+	head, body := "", fpt
+	if strings.EqualFold(dataType, "MOBILE") {
+		cc, nsn, err := ParseE164(fpt)
+		if err != nil {
+			return "", err
+		}
+		head, body = "+"+cc, nsn
+	}
+	if len(prefix) >= len(body) {
+		return "", ErrInvalidTokenPrefix
+	}
+	positions := tokenAlphabet(dataType, len(body))
+	for i := 0; i < len(prefix); i++ {
+		if !strings.ContainsRune(positions[i], rune(prefix[i])) {
+			return "", ErrInvalidTokenPrefix
+		}
+	}
+	// rank the positions after the prefix; characters outside a position's alphabet (custom
+	// token alphabets) are kept as they are
+	var ranked []int
+	rank, size := new(big.Int), big.NewInt(1)
+	for i := len(prefix); i < len(body); i++ {
+		d := strings.IndexByte(positions[i], body[i])
+		if d < 0 {
+			continue
+		}
+		radix := big.NewInt(int64(len(positions[i])))
+		rank.Mul(rank, radix).Add(rank, big.NewInt(int64(d)))
+		size.Mul(size, radix)
+		ranked = append(ranked, i)
+	}
+	rank.Add(rank, new(big.Int).SetBytes([]byte(body[:len(prefix)]))).Mod(rank, size)
+	out := []byte(body)
+	copy(out, prefix)
+	for k := len(ranked) - 1; k >= 0; k-- {
+		i, d := ranked[k], new(big.Int)
+		rank.DivMod(rank, big.NewInt(int64(len(positions[i]))), d)
+		out[i] = positions[i][d.Int64()]
+	}
+	return head + string(out), nil
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyTokenPrefixKeepsTokensDistinct(t *testing.T) {
+	cases := []struct {
+		dataType, prefix string
+		a, b             string
+	}{
+		{"AADHAR", "9", "234567890123", "534567890123"},
+		{"PAN", "AB", "CDEFG1234H", "XYEFG1234H"},
+		{"MOBILE", "9", "+919876543210", "+917876543210"},
+	}
+	for _, c := range cases {
+		pa, err := ApplyTokenPrefix(c.dataType, c.a, c.prefix)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.dataType, c.a, err)
+		}
+		pb, err := ApplyTokenPrefix(c.dataType, c.b, c.prefix)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.dataType, c.b, err)
+		}
+		if pa == pb {
+			t.Errorf("%s: %s and %s both map to %s", c.dataType, c.a, c.b, pa)
+		}
+		for _, p := range []string{pa, pb} {
+			body := p
+			if c.dataType == "MOBILE" {
+				body = strings.TrimPrefix(p, "+91")
+			}
+			if !strings.HasPrefix(body, c.prefix) || len(p) != len(c.a) {
+				t.Errorf("%s: %s does not keep the prefix %s and the length", c.dataType, p, c.prefix)
+			}
+		}
+		if again, _ := ApplyTokenPrefix(c.dataType, c.a, c.prefix); again != pa {
+			t.Errorf("%s: %s maps to %s, then %s", c.dataType, c.a, pa, again)
+		}
+	}
+}
+
+func TestApplyTokenPrefixKeepsFormat(t *testing.T) {
+	out, err := ApplyTokenPrefix("PAN", "CDEFG1234H", "AB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := tokenAlphabet("PAN", len(out))
+	for i := range out {
+		if !strings.ContainsRune(positions[i], rune(out[i])) {
+			t.Fatalf("%s: position %d is not in the PAN format", out, i)
+		}
+	}
+}
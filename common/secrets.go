@@ -0,0 +1,117 @@
+package common
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretFileAliases lets the short *_FILE names used by our platform point at the
+// canonical env names, e.g. AES_KEY_FILE for AES_KEY_BASE64.
+var secretFileAliases = map[string]string{
+	"AES_KEY_BASE64":  "AES_KEY_FILE",
+	"HMAC_KEY_BASE64": "HMAC_KEY_FILE",
+}
+
+// fileSecrets caches values read from mounted secret files, keyed by env name. failed holds
+// the keys whose file could not be read yet (e.g. mounted after startup).
+var fileSecrets = struct {
+	sync.RWMutex
+	values map[string]string
+	failed map[string]bool
+}{values: map[string]string{}, failed: map[string]bool{}}
+
+// secretFilePath returns the file configured for key via <KEY>_FILE (or its alias).
+func secretFilePath(key string) string {
+	if p := os.Getenv(key + "_FILE"); p != "" {
+		return p
+	}
+	if alias, ok := secretFileAliases[key]; ok {
+		return os.Getenv(alias)
+	}
+	return ""
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// lookupEnvOrFile returns the env value of key, falling back to the contents of the file
+// named by <KEY>_FILE. File contents are cached until RefreshSecretFiles sees a change.
+func lookupEnvOrFile(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	path := secretFilePath(key)
+	if path == "" {
+		return ""
+	}
+	fileSecrets.RLock()
+	v, ok := fileSecrets.values[key]
+	fileSecrets.RUnlock()
+	if ok {
+		return v
+	}
+	v, err := readSecretFile(path)
+	fileSecrets.Lock()
+	defer fileSecrets.Unlock()
+	if err != nil {
+		log.Printf("secrets: read %s for %s: %v", path, key, err)
+		fileSecrets.failed[key] = true
+		return ""
+	}
+	delete(fileSecrets.failed, key)
+	fileSecrets.values[key] = v
+	return v
+}
+
+// RefreshSecretFiles re-reads every file-backed secret looked up so far, including files that
+// could not be read before, and returns the keys whose contents changed (e.g. after a
+// Kubernetes secret rotation).
+func RefreshSecretFiles() []string {
+	fileSecrets.RLock()
+	keys := make([]string, 0, len(fileSecrets.values)+len(fileSecrets.failed))
+	for k := range fileSecrets.values {
+		keys = append(keys, k)
+	}
+	for k := range fileSecrets.failed {
+		keys = append(keys, k)
+	}
+	fileSecrets.RUnlock()
+
+	var changed []string
+	for _, k := range keys {
+		v, err := readSecretFile(secretFilePath(k))
+		if err != nil {
+			log.Printf("secrets: re-read %s: %v (keeping previous value)", k, err)
+			continue
+		}
+		fileSecrets.Lock()
+		if old, ok := fileSecrets.values[k]; !ok || old != v {
+			fileSecrets.values[k] = v
+			delete(fileSecrets.failed, k)
+			changed = append(changed, k)
+		}
+		fileSecrets.Unlock()
+	}
+	return changed
+}
+
+// WatchSecretFiles polls mounted secret files every interval and calls onChange with the
+// keys whose contents changed. It never returns; run it in a goroutine.
+func WatchSecretFiles(interval time.Duration, onChange func(changed []string)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if changed := RefreshSecretFiles(); len(changed) > 0 {
+			log.Printf("secrets: mounted secrets changed: %v", changed)
+			onChange(changed)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// ErrUnsupportedSynthetic is returned for data types without a synthetic generator.
+var ErrUnsupportedSynthetic = errors.New("no synthetic generator for data type")
+
+// panEntityTypes are the valid 4th PAN characters (holder type: P = individual, C = company, ...).
+const panEntityTypes = "ABCFGHJLPT"
+
+// SyntheticPII returns a random, format-valid value of dataType for demos and end-to-end
+// tests: PAN with a valid holder-type character, AADHAR with a valid first digit and
+// Verhoeff check digit, MOBILE as an Indian +91 number. Values are random, never real data.
+func SyntheticPII(dataType string) (string, error) {
+	switch strings.ToUpper(dataType) {
+	case "PAN":
+		const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		return randomFrom(letters, 3) + randomFrom(panEntityTypes, 1) + randomFrom(letters, 1) +
+			randomFrom("0123456789", 4) + randomFrom(letters, 1), nil
+	case "AADHAR":
+		body := randomFrom("23456789", 1) + randomFrom("0123456789", 10)
+		check, err := VerhoeffCheckDigit(body)
+		if err != nil {
+			return "", err
+		}
+		return body + string(check), nil
+	case "MOBILE":
+		return "+91" + randomFrom("6789", 1) + randomFrom("0123456789", 9), nil
+	}
+	return "", ErrUnsupportedSynthetic
+}
+
+func randomFrom(alphabet string, n int) string {
+	out := make([]byte, n)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range out {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("crypto/rand: " + err.Error())
+		}
+		out[i] = alphabet[v.Int64()]
+	}
+	return string(out)
+}
+
+// TestVectorInputs returns fixed synthetic values of dataType for the integrator test vectors,
+// including spellings that normalize to the same value (case, spaces, a missing country code).
+// Like SyntheticPII they are format-valid and never real data, but they never change.
+func TestVectorInputs(dataType string) ([]string, error) {
+	switch strings.ToUpper(dataType) {
+	case "PAN":
+		return []string{"AAAPA1111A", "BBBCB2222B", "zzzhz3333z", " AAAPA1111A "}, nil
+	case "AADHAR":
+		var out []string
+		for _, body := range []string{"23456789012", "98765432101", "55556666777"} {
+			check, err := VerhoeffCheckDigit(body)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, body+string(check))
+		}
+		// the spaced spelling of the first value
+		return append(out, out[0][:4]+" "+out[0][4:8]+" "+out[0][8:]), nil
+	case "MOBILE":
+		return []string{"+919812345670", "+917000000001", "9812345670"}, nil
+	}
+	return nil, ErrUnsupportedSynthetic
+}
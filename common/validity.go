@@ -0,0 +1,128 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// wellKnownTestTokens are values widely used as sample/test data; a token equal to one of them
+// would be mistaken for (or filtered out as) test data downstream.
+var wellKnownTestTokens = map[string]bool{
+	"ABCDE1234F":   true,
+	"AAAAA0000A":   true,
+	"AAAPZ1234C":   true,
+	"ABCPE1234F":   true,
+	"999999990019": true,
+	"999941057058": true,
+	"123456789012": true,
+}
+
+// ValidTokenOutput is the validity predicate generated tokens must pass before they are used:
+// no well-known test values, no AADHAR tokens starting with 0 or 1 (not issued, rejected by
+// validators), no single-repeated-digit number parts and no EMAIL local parts with misplaced dots.
+func ValidTokenOutput(dataType, fpt string) bool {
+	if wellKnownTestTokens[fpt] {
+		return false
+	}
+	switch strings.ToUpper(dataType) {
+	case "AADHAR":
+		return len(fpt) == 12 && fpt[0] != '0' && fpt[0] != '1' && !repeatedDigit(fpt)
+	case "MOBILE":
+		_, nsn, err := ParseE164(fpt)
+		return err == nil && !repeatedDigit(nsn)
+	case "PAN":
+		return len(fpt) == 10 && !repeatedDigit(fpt[5:9])
+	case "EMAIL":
+		return validEmailToken(fpt)
+	}
+	return true
+}
+
+func repeatedDigit(s string) bool {
+	return len(s) > 0 && strings.Count(s, s[:1]) == len(s)
+}
+
+// Token validity policies (TOKEN_VALIDITY_<TYPE>): whether generated tokens pass the real-world
+// checks of their type or deliberately fail them, so a leaked token can never be mistaken for a
+// real identifier.
+const (
+	ValidityAny     = "any"
+	ValidityValid   = "valid"
+	ValidityInvalid = "invalid"
+)
+
+// panNonEntityTypes are the letters that are not a valid 4th PAN character.
+const panNonEntityTypes = "DEIKMNOQRSUVWXYZ"
+
+// RealWorldValid reports whether value passes the real-world check of dataType: the Verhoeff
+// check digit for AADHAR, a known holder-type 4th character for PAN. checked is false for
+// types without such a check.
+func RealWorldValid(dataType, value string) (valid, checked bool) {
+	switch strings.ToUpper(dataType) {
+	case "AADHAR":
+		if len(value) != 12 {
+			return false, true
+		}
+		check, err := VerhoeffCheckDigit(value[:11])
+		return err == nil && check == value[11], true
+	case "PAN":
+		return len(value) == 10 && strings.IndexByte(panEntityTypes, value[3]) >= 0, true
+	}
+	return false, false
+}
+
+// ValidityPostprocessor returns the postprocessor enforcing policy on tokens of dataType, or nil
+// for ValidityAny. Like every postprocessor it is deterministic and generator-independent: it
+// only rewrites the check position (AADHAR's last digit, PAN's 4th character).
+func ValidityPostprocessor(dataType, policy string) (Postprocessor, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if policy == "" || policy == ValidityAny {
+		return nil, nil
+	}
+	if policy != ValidityValid && policy != ValidityInvalid {
+		return nil, fmt.Errorf("token validity %q: want %s, %s or %s", policy, ValidityAny, ValidityValid, ValidityInvalid)
+	}
+	valid := policy == ValidityValid
+	switch strings.ToUpper(dataType) {
+	case "AADHAR":
+		if valid {
+			return AadharChecksumPostprocessor, nil
+		}
+		return aadharBadChecksumPostprocessor, nil
+	case "PAN":
+		alphabet := panEntityTypes
+		if !valid {
+			alphabet = panNonEntityTypes
+		}
+		return func(fpt string) (string, error) {
+			if len(fpt) != 10 || fpt[3] < 'A' || fpt[3] > 'Z' {
+				return "", errors.New("pan validity: token must be a 10 character PAN")
+			}
+			return fpt[:3] + string(alphabet[int(fpt[3]-'A')%len(alphabet)]) + fpt[4:], nil
+		}, nil
+	}
+	return nil, fmt.Errorf("token validity: %s has no real-world check", dataType)
+}
+
+// PANEntityTypeLetters returns the 4th characters of PAN tokens under a validity policy: the
+// holder types for valid, the other letters for invalid, any letter otherwise.
+func PANEntityTypeLetters(policy string) string {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case ValidityValid:
+		return panEntityTypes
+	case ValidityInvalid:
+		return panNonEntityTypes
+	}
+	return "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+}
+
+// aadharBadChecksumPostprocessor rewrites the last digit of a 12-digit token to one that fails
+// the Verhoeff check (Verhoeff catches every single-digit change, so any other digit does).
+func aadharBadChecksumPostprocessor(fpt string) (string, error) {
+	fpt, err := AadharChecksumPostprocessor(fpt)
+	if err != nil {
+		return "", err
+	}
+	return fpt[:11] + string('0'+(fpt[11]-'0'+1)%10), nil
+}
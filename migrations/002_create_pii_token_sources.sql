@@ -0,0 +1,11 @@
+-- migrations/002_create_pii_token_sources.sql
+-- Token metadata: which source systems (per tenant) have tokenized a given blind index.
+CREATE TABLE IF NOT EXISTS pii_token_sources (
+    blind_index TEXT NOT NULL,
+    data_type TEXT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    source_system TEXT NOT NULL,
+    first_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, data_type, blind_index, source_system)
+);
@@ -0,0 +1,24 @@
+-- migrations/003_create_pii_sharing_grants.sql
+-- Owning tenant per token (NULL = global token, readable by every caller).
+ALTER TABLE pii_tokens ADD COLUMN IF NOT EXISTS tenant_id TEXT;
+
+-- Time-bound grants letting grantee_tenant detokenize owner_tenant's tokens of one data type.
+-- fpts (optional) bounds the grant to an explicit set of tokens; max_uses (optional) caps usage.
+CREATE TABLE IF NOT EXISTS pii_sharing_grants (
+    id BIGSERIAL PRIMARY KEY,
+    owner_tenant TEXT NOT NULL,
+    grantee_tenant TEXT NOT NULL,
+    data_type TEXT NOT NULL,
+    operation TEXT NOT NULL DEFAULT 'detokenize',
+    fpts TEXT[],
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ix_pii_sharing_grants_lookup
+    ON pii_sharing_grants (grantee_tenant, owner_tenant, data_type);
@@ -0,0 +1,11 @@
+-- migrations/004_add_pii_tokens_tenant_indexes.sql
+-- Composite indexes for tenant-aware and type-scoped lookups. The single-column unique
+-- indexes from 001 stay in place as the global uniqueness constraints.
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_tenant_blind ON pii_tokens (tenant_id, blind_index);
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_tenant_fpt ON pii_tokens (tenant_id, fpt);
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_type_blind ON pii_tokens (data_type, blind_index);
+
+-- Global (NULL tenant) rows are looked up without a tenant_id predicate value, so give them
+-- their own small partial indexes.
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_global_blind ON pii_tokens (blind_index) WHERE tenant_id IS NULL;
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_global_fpt ON pii_tokens (fpt) WHERE tenant_id IS NULL;
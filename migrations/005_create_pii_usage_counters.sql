@@ -0,0 +1,11 @@
+-- migrations/005_create_pii_usage_counters.sql
+-- Daily usage counters per caller (API key fingerprint / caller id), tenant, PII type and operation.
+CREATE TABLE IF NOT EXISTS pii_usage_counters (
+    day DATE NOT NULL,
+    caller_id TEXT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    data_type TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, caller_id, tenant_id, data_type, operation)
+);
@@ -0,0 +1,10 @@
+-- migrations/006_create_pii_tenant_settings.sql
+-- Per-tenant, per-PII-type settings. token_prefix constrains newly generated tokens to start
+-- with the given characters (e.g. AADHAR tokens starting with '9').
+CREATE TABLE IF NOT EXISTS pii_tenant_settings (
+    tenant_id TEXT NOT NULL,
+    data_type TEXT NOT NULL,
+    token_prefix TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, data_type)
+);
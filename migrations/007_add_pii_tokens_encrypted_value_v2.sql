@@ -0,0 +1,7 @@
+-- migrations/007_add_pii_tokens_encrypted_value_v2.sql
+-- Dual-write column for the v2 ciphertext format (AES-GCM bound to data type + blind index).
+-- Filled on insert when ENCRYPTION_DUAL_WRITE=true and for existing rows by the backfill job;
+-- reads use it when ENCRYPTION_READ_PREFERENCE=v2.
+ALTER TABLE pii_tokens ADD COLUMN IF NOT EXISTS encrypted_value_v2 BYTEA;
+
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_missing_v2 ON pii_tokens (id) WHERE encrypted_value_v2 IS NULL;
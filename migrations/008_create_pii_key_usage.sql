@@ -0,0 +1,9 @@
+-- migrations/008_create_pii_key_usage.sql
+-- Encryptions performed per key version, for cryptoperiod enforcement. first_used_at is when a
+-- replica first ran with the key version and starts its cryptoperiod.
+CREATE TABLE IF NOT EXISTS pii_key_usage (
+    key_version TEXT PRIMARY KEY,
+    encryptions BIGINT NOT NULL DEFAULT 0,
+    first_used_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,11 @@
+-- migrations/009_create_pii_connection_profiles.sql
+-- Named source database connections for bulk runs. The DSN (with its credentials) is stored
+-- AES-GCM encrypted and never returned by the API; bulk requests reference the profile by name.
+CREATE TABLE IF NOT EXISTS pii_connection_profiles (
+    name TEXT PRIMARY KEY,
+    encrypted_dsn BYTEA NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
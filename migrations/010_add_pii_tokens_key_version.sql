@@ -0,0 +1,6 @@
+-- migrations/010_add_pii_tokens_key_version.sql
+-- AES key version each row is encrypted with (NULL = written before key versions were
+-- recorded; decrypted by trying every key of the ring). The index drives re-encryption.
+ALTER TABLE pii_tokens ADD COLUMN IF NOT EXISTS key_version TEXT;
+
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_key_version ON pii_tokens (key_version, id);
@@ -0,0 +1,11 @@
+-- migrations/011_create_pii_api_usage.sql
+-- Daily request counters per API version, endpoint (route template) and caller, to find who
+-- still uses legacy endpoints before they are deprecated.
+CREATE TABLE IF NOT EXISTS pii_api_usage (
+    day DATE NOT NULL,
+    api_version TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    caller_id TEXT NOT NULL,
+    count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, api_version, endpoint, caller_id)
+);
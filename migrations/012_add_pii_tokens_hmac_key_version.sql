@@ -0,0 +1,4 @@
+-- migrations/012_add_pii_tokens_hmac_key_version.sql
+-- HMAC key version of each row's blind index, which the token is derived from (NULL = written
+-- before HMAC key versions were recorded; looked up with every key of the HMAC ring).
+ALTER TABLE pii_tokens ADD COLUMN IF NOT EXISTS hmac_key_version TEXT;
@@ -0,0 +1,20 @@
+-- migrations/013_create_pii_tenants.sql
+-- Onboarded tenants and their provisioned API keys. Only the SHA-256 of a key is stored; the
+-- key itself is returned once, when it is created.
+CREATE TABLE IF NOT EXISTS pii_tenants (
+    tenant_id TEXT PRIMARY KEY,
+    name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS pii_api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    key_hash TEXT NOT NULL UNIQUE,
+    tenant_id TEXT NOT NULL REFERENCES pii_tenants (tenant_id),
+    caller_id TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ix_pii_api_keys_tenant ON pii_api_keys (tenant_id);
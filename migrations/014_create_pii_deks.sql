@@ -0,0 +1,10 @@
+-- migrations/014_create_pii_deks.sql
+-- Envelope encryption: per-token data keys (DEKs), wrapped by the key encryption key (KEK).
+-- Envelope ciphertexts reference their DEK by id; deleting the row crypto-shreds every copy
+-- of the ciphertext (vault row, cache entries, exports).
+CREATE TABLE IF NOT EXISTS pii_deks (
+    id BIGSERIAL PRIMARY KEY,
+    wrapped_dek BYTEA NOT NULL,
+    kek_version TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
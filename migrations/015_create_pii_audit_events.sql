@@ -0,0 +1,20 @@
+-- migrations/015_create_pii_audit_events.sql
+-- Audit trail of tokenize, detokenize, reveal and bulk operations: who (caller, tenant, source
+-- IP), what (data type, token) and the outcome. Never holds PII values.
+CREATE TABLE IF NOT EXISTS pii_audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    operation TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    caller_id TEXT NOT NULL DEFAULT '',
+    tenant_id TEXT NOT NULL DEFAULT '',
+    data_type TEXT NOT NULL DEFAULT '',
+    fpt TEXT NOT NULL DEFAULT '',
+    source_ip TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS ix_pii_audit_events_occurred_at ON pii_audit_events (occurred_at);
+CREATE INDEX IF NOT EXISTS ix_pii_audit_events_tenant ON pii_audit_events (tenant_id, id);
+CREATE INDEX IF NOT EXISTS ix_pii_audit_events_fpt ON pii_audit_events (fpt, id) WHERE fpt <> '';
@@ -0,0 +1,8 @@
+-- migrations/016_add_pii_api_keys_team_keys.sql
+-- API keys of consuming teams that are not tenants (tenant_id NULL: the key acts for the tenant
+-- in X-Tenant-ID), with a label, an optional expiry and an enabled flag that can be switched
+-- back on, unlike a revocation.
+ALTER TABLE pii_api_keys ALTER COLUMN tenant_id DROP NOT NULL;
+ALTER TABLE pii_api_keys ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+ALTER TABLE pii_api_keys ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE pii_api_keys ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT true;
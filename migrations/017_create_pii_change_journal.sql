@@ -0,0 +1,32 @@
+-- migrations/017_create_pii_change_journal.sql
+-- Append-only journal of admin mutations (API keys, tenants, grants, settings, key rotation,
+-- maintenance). Each row carries the SHA-256 of its content chained to the previous row's
+-- hash, so an edited, deleted or reordered row breaks every hash after it.
+CREATE TABLE IF NOT EXISTS pii_change_journal (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    tenant_id TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    source_ip TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '{}',
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS ix_pii_change_journal_occurred_at ON pii_change_journal (occurred_at);
+
+CREATE OR REPLACE FUNCTION pii_change_journal_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'pii_change_journal is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS pii_change_journal_append_only ON pii_change_journal;
+CREATE TRIGGER pii_change_journal_append_only BEFORE UPDATE OR DELETE ON pii_change_journal
+    FOR EACH ROW EXECUTE FUNCTION pii_change_journal_append_only();
+
+DROP TRIGGER IF EXISTS pii_change_journal_no_truncate ON pii_change_journal;
+CREATE TRIGGER pii_change_journal_no_truncate BEFORE TRUNCATE ON pii_change_journal
+    FOR EACH STATEMENT EXECUTE FUNCTION pii_change_journal_append_only();
@@ -0,0 +1,22 @@
+-- migrations/018_create_pii_bulk_jobs.sql
+-- Asynchronous bulk-tokenize jobs. request holds the run parameters without the source DSN and
+-- export URL; result is the progress (BulkResult) written while the job runs. updated_at is the
+-- owning replica's heartbeat: a queued or running job whose heartbeat stopped is failed.
+CREATE TABLE IF NOT EXISTS pii_bulk_jobs (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+    tenant_id TEXT NOT NULL DEFAULT '',
+    caller_id TEXT NOT NULL DEFAULT '',
+    instance_id TEXT NOT NULL,
+    src_table TEXT NOT NULL,
+    request TEXT NOT NULL,
+    result TEXT NOT NULL DEFAULT '{}',
+    message TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_pii_bulk_jobs_tenant_created ON pii_bulk_jobs (tenant_id, created_at DESC);
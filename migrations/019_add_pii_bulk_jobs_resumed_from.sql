@@ -0,0 +1,4 @@
+-- migrations/019_add_pii_bulk_jobs_resumed_from.sql
+-- A job started by POST /bulk-jobs/{id}/resume names the failed job whose checkpoint it
+-- continues from.
+ALTER TABLE pii_bulk_jobs ADD COLUMN IF NOT EXISTS resumed_from TEXT NOT NULL DEFAULT '';
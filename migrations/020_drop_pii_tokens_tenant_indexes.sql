@@ -0,0 +1,10 @@
+-- migrations/020_drop_pii_tokens_tenant_indexes.sql
+-- The indexes of 004 match no query: tokens are looked up by blind_index or fpt alone, which
+-- the unique indexes of 001 serve (tenant-bound blind indexes are unique values of the same
+-- column), and no query filters on tenant_id IS NULL. They only added write cost to every
+-- token insert.
+DROP INDEX IF EXISTS ix_pii_tokens_tenant_blind;
+DROP INDEX IF EXISTS ix_pii_tokens_tenant_fpt;
+DROP INDEX IF EXISTS ix_pii_tokens_type_blind;
+DROP INDEX IF EXISTS ix_pii_tokens_global_blind;
+DROP INDEX IF EXISTS ix_pii_tokens_global_fpt;
@@ -0,0 +1,10 @@
+-- migrations/021_create_pii_maintenance.sql
+-- Read-only maintenance mode shared by every replica: POST /admin/read-only writes the single
+-- row and each replica polls it. Without a row, replicas follow READ_ONLY.
+CREATE TABLE IF NOT EXISTS pii_maintenance (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    read_only BOOLEAN NOT NULL,
+    retry_after_seconds BIGINT NOT NULL,
+    updated_by TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,5 @@
+-- migrations/022_add_pii_connection_profiles_tenant.sql
+-- The tenant a connection profile belongs to: bulk runs only resolve profiles of the caller's
+-- own tenant. '' is a global profile, usable only by callers without a tenant; existing
+-- profiles become global.
+ALTER TABLE pii_connection_profiles ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- migrations/023_add_pii_tokens_tenant_created_index.sql
+-- 020 dropped every tenant index of 004 on the grounds that no query filters pii_tokens on
+-- tenant_id; the retention purger does (PurgeTenantTokensBefore: tenant_id = $1 AND
+-- created_at < $2, batch after batch), and scanned the whole table for each batch without an
+-- index. The other indexes of 004 stay dropped: token lookups go by blind_index or fpt alone,
+-- and the tenant storage report reads every row anyway.
+CREATE INDEX IF NOT EXISTS ix_pii_tokens_tenant_created ON pii_tokens (tenant_id, created_at);
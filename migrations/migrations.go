@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migration files, so the binary applies them regardless of
+// its working directory.
+package migrations
+
+import "embed"
+
+// FS holds the *.sql files of this directory; they are applied in file name order.
+//
+//go:embed *.sql
+var FS embed.FS
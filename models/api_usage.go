@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+)
+
+// APIUsageCount is one aggregated request counter of an endpoint version and caller.
+type APIUsageCount struct {
+	Day        time.Time `json:"-"`
+	APIVersion string    `json:"api_version"`
+	Endpoint   string    `json:"endpoint"`
+	CallerID   string    `json:"caller_id"`
+	Count      int64     `json:"count"`
+	// LastSeen is the last day with a request (reports only)
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// AddAPIUsage adds the given increments to the daily API usage counters in one transaction.
+func (s *Store) AddAPIUsage(counts []APIUsageCount) error {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(
+		`INSERT INTO pii_api_usage (day, api_version, endpoint, caller_id, count)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (day, api_version, endpoint, caller_id)
+		 DO UPDATE SET count = pii_api_usage.count + EXCLUDED.count`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range counts {
+		if _, err := stmt.Exec(c.Day, c.APIVersion, c.Endpoint, c.CallerID, c.Count); err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	s.observe("add_api_usage", "pk", start, err)
+	return err
+}
+
+// APIUsageReport sums API usage counters in [from, to] per version, endpoint and caller.
+func (s *Store) APIUsageReport(from, to time.Time) ([]APIUsageCount, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT api_version, endpoint, caller_id, sum(count), to_char(max(day), 'YYYY-MM-DD')
+		 FROM pii_api_usage
+		 WHERE day BETWEEN $1 AND $2
+		 GROUP BY api_version, endpoint, caller_id
+		 ORDER BY api_version, endpoint, caller_id`,
+		from, to,
+	)
+	s.observe("api_usage_report", "day_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []APIUsageCount{}
+	for rows.Next() {
+		var c APIUsageCount
+		if err := rows.Scan(&c.APIVersion, &c.Endpoint, &c.CallerID, &c.Count, &c.LastSeen); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
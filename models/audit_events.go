@@ -0,0 +1,107 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent is one audited operation on the vault. It never holds a PII value.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Operation  string    `json:"operation"`
+	Outcome    string    `json:"outcome"`
+	RequestID  string    `json:"request_id,omitempty"`
+	CallerID   string    `json:"caller_id,omitempty"`
+	TenantID   string    `json:"tenant,omitempty"`
+	DataType   string    `json:"data_type,omitempty"`
+	FPT        string    `json:"fpt,omitempty"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// AuditEventFilter selects audit events; empty fields match everything. Events are returned
+// newest first, starting below BeforeID when it is set.
+type AuditEventFilter struct {
+	From, To  time.Time
+	TenantID  string
+	CallerID  string
+	Operation string
+	Outcome   string
+	FPT       string
+	BeforeID  int64
+	Limit     int
+}
+
+// InsertAuditEvents writes a batch of audit events in one transaction.
+func (s *Store) InsertAuditEvents(events []AuditEvent) error {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(
+		`INSERT INTO pii_audit_events (occurred_at, operation, outcome, request_id, caller_id, tenant_id, data_type, fpt, source_ip, detail)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range events {
+		if _, err := stmt.Exec(e.OccurredAt, e.Operation, e.Outcome, e.RequestID, e.CallerID, e.TenantID, e.DataType, e.FPT, e.SourceIP, e.Detail); err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	s.observe("insert_audit_events", "pk", start, err)
+	return err
+}
+
+// ListAuditEvents returns the events matching f, newest first.
+func (s *Store) ListAuditEvents(f AuditEventFilter) ([]AuditEvent, error) {
+	start := time.Now()
+	var from, to interface{}
+	if !f.From.IsZero() {
+		from = f.From
+	}
+	if !f.To.IsZero() {
+		to = f.To
+	}
+	rows, err := s.db.Query(
+		`SELECT id, occurred_at, operation, outcome, request_id, caller_id, tenant_id, data_type, fpt, source_ip, detail
+		 FROM pii_audit_events
+		 WHERE ($1::timestamptz IS NULL OR occurred_at >= $1)
+		   AND ($2::timestamptz IS NULL OR occurred_at < $2)
+		   AND ($3 = '' OR tenant_id = $3)
+		   AND ($4 = '' OR caller_id = $4)
+		   AND ($5 = '' OR operation = $5)
+		   AND ($6 = '' OR outcome = $6)
+		   AND ($7 = '' OR fpt = $7)
+		   AND ($8 = 0 OR id < $8)
+		 ORDER BY id DESC
+		 LIMIT $9`,
+		from, to, f.TenantID, f.CallerID, f.Operation, f.Outcome, f.FPT, f.BeforeID, f.Limit,
+	)
+	s.observe("list_audit_events", "audit", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Operation, &e.Outcome, &e.RequestID, &e.CallerID, &e.TenantID, &e.DataType, &e.FPT, &e.SourceIP, &e.Detail); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// PurgeAuditEventsBefore deletes audit events that occurred before cutoff.
+func (s *Store) PurgeAuditEventsBefore(cutoff time.Time) (int64, error) {
+	return s.purgeBatched("purge_audit_events",
+		`DELETE FROM pii_audit_events WHERE id IN (
+		     SELECT id FROM pii_audit_events WHERE occurred_at < $1 LIMIT $2)`,
+		cutoff, retentionBatch)
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TableBloat is the dead-tuple state of a table from pg_stat_user_tables.
+type TableBloat struct {
+	Table          string     `json:"table"`
+	LiveTuples     int64      `json:"live_tuples"`
+	DeadTuples     int64      `json:"dead_tuples"`
+	DeadRatio      float64    `json:"dead_ratio"`
+	TableBytes     int64      `json:"table_bytes"`
+	TotalBytes     int64      `json:"total_bytes"`
+	LastVacuum     *time.Time `json:"last_vacuum,omitempty"`
+	LastAutovacuum *time.Time `json:"last_autovacuum,omitempty"`
+}
+
+// IndexBloat is the size of an index and, when the pgstattuple extension is installed, the
+// leaf density and fragmentation reported by pgstatindex (nil otherwise).
+type IndexBloat struct {
+	Index             string   `json:"index"`
+	Table             string   `json:"table"`
+	IndexBytes        int64    `json:"index_bytes"`
+	AvgLeafDensity    *float64 `json:"avg_leaf_density,omitempty"`
+	LeafFragmentation *float64 `json:"leaf_fragmentation,omitempty"`
+}
+
+// TableBloat returns the dead-tuple state of table (nil when it has no statistics yet).
+func (s *Store) TableBloat(table string) (*TableBloat, error) {
+	start := time.Now()
+	var b TableBloat
+	var lastVacuum, lastAutovacuum sql.NullTime
+	err := s.db.QueryRow(
+		`SELECT relname, n_live_tup, n_dead_tup, pg_table_size(relid), pg_total_relation_size(relid),
+		        last_vacuum, last_autovacuum
+		 FROM pg_stat_user_tables WHERE relname = $1`, table,
+	).Scan(&b.Table, &b.LiveTuples, &b.DeadTuples, &b.TableBytes, &b.TotalBytes, &lastVacuum, &lastAutovacuum)
+	s.observe("table_bloat", "catalog", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if total := b.LiveTuples + b.DeadTuples; total > 0 {
+		b.DeadRatio = float64(b.DeadTuples) / float64(total)
+	}
+	if lastVacuum.Valid {
+		b.LastVacuum = &lastVacuum.Time
+	}
+	if lastAutovacuum.Valid {
+		b.LastAutovacuum = &lastAutovacuum.Time
+	}
+	return &b, nil
+}
+
+// IndexBloat returns the B-tree indexes of table. pgstatindex reads every index page, so the
+// densities are only collected when withDensity is set and pgstattuple is installed.
+func (s *Store) IndexBloat(table string, withDensity bool) ([]IndexBloat, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT c.relname, pg_relation_size(i.indexrelid)
+		 FROM pg_index i
+		 JOIN pg_class c ON c.oid = i.indexrelid
+		 JOIN pg_am am ON am.oid = c.relam
+		 WHERE i.indrelid = to_regclass($1) AND am.amname = 'btree'
+		 ORDER BY 1`, table)
+	s.observe("index_bloat", "catalog", start, err)
+	if err != nil {
+		return nil, err
+	}
+	out := []IndexBloat{}
+	for rows.Next() {
+		b := IndexBloat{Table: table}
+		if err := rows.Scan(&b.Index, &b.IndexBytes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !withDensity {
+		return out, nil
+	}
+	var installed bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pgstattuple')`).Scan(&installed); err != nil || !installed {
+		return out, err
+	}
+	for i := range out {
+		start := time.Now()
+		var density, fragmentation float64
+		err := s.db.QueryRow(`SELECT avg_leaf_density, leaf_fragmentation FROM pgstatindex($1)`, out[i].Index).Scan(&density, &fragmentation)
+		s.observe("pgstatindex", "catalog", start, err)
+		if err != nil {
+			return out, err
+		}
+		out[i].AvgLeafDensity, out[i].LeafFragmentation = &density, &fragmentation
+	}
+	return out, nil
+}
+
+// VacuumTable runs VACUUM (ANALYZE) on table. It cannot run inside a transaction.
+func (s *Store) VacuumTable(table string) error {
+	start := time.Now()
+	_, err := s.db.Exec(fmt.Sprintf(`VACUUM (ANALYZE) %s`, pq.QuoteIdentifier(table)))
+	s.observe("vacuum", "maintenance", start, err)
+	return err
+}
+
+// ReindexIndex rebuilds index without blocking writes (REINDEX CONCURRENTLY, PostgreSQL 12+).
+func (s *Store) ReindexIndex(index string) error {
+	start := time.Now()
+	_, err := s.db.Exec(fmt.Sprintf(`REINDEX INDEX CONCURRENTLY %s`, pq.QuoteIdentifier(index)))
+	s.observe("reindex", "maintenance", start, err)
+	return err
+}
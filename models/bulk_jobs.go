@@ -0,0 +1,149 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Bulk job statuses.
+const (
+	BulkJobQueued    = "queued"
+	BulkJobRunning   = "running"
+	BulkJobSucceeded = "succeeded"
+	BulkJobFailed    = "failed"
+)
+
+// BulkJob is one asynchronous bulk-tokenize run. Request and Result are JSON objects: the run
+// parameters (never the source DSN or export URL) and its progress.
+type BulkJob struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	TenantID   string          `json:"tenant,omitempty"`
+	CallerID   string          `json:"caller_id,omitempty"`
+	InstanceID string          `json:"instance_id"`
+	Table      string          `json:"src_table"`
+	Request    json.RawMessage `json:"request"`
+	Result     json.RawMessage `json:"result"`
+	Message    string          `json:"message,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	// ResumedFrom is the failed job this one continues from its checkpoint
+	ResumedFrom string     `json:"resumed_from,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+const bulkJobColumns = `id, status, tenant_id, caller_id, instance_id, src_table, request, result, message, error, resumed_from, created_at, started_at, finished_at, updated_at`
+
+func scanBulkJob(sc interface{ Scan(...interface{}) error }) (*BulkJob, error) {
+	var j BulkJob
+	var request, result string
+	var startedAt, finishedAt sql.NullTime
+	if err := sc.Scan(&j.ID, &j.Status, &j.TenantID, &j.CallerID, &j.InstanceID, &j.Table, &request, &result, &j.Message, &j.Error, &j.ResumedFrom, &j.CreatedAt, &startedAt, &finishedAt, &j.UpdatedAt); err != nil {
+		return nil, err
+	}
+	j.Request, j.Result = json.RawMessage(request), json.RawMessage(result)
+	if startedAt.Valid {
+		j.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	return &j, nil
+}
+
+// CreateBulkJob inserts a queued job and sets its timestamps.
+func (s *Store) CreateBulkJob(j *BulkJob) error {
+	start := time.Now()
+	j.Status = BulkJobQueued
+	err := s.db.QueryRow(
+		`INSERT INTO pii_bulk_jobs (id, status, tenant_id, caller_id, instance_id, src_table, request, result, resumed_from)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 RETURNING created_at, updated_at`,
+		j.ID, j.Status, j.TenantID, j.CallerID, j.InstanceID, j.Table, string(j.Request), string(j.Result), j.ResumedFrom,
+	).Scan(&j.CreatedAt, &j.UpdatedAt)
+	s.observe("create_bulk_job", "insert", start, err)
+	return err
+}
+
+// UpdateBulkJob records the status, progress, message and error of a job and renews its
+// heartbeat. Entering running sets started_at; succeeded and failed set finished_at.
+func (s *Store) UpdateBulkJob(id, status string, result json.RawMessage, message, errMsg string) error {
+	start := time.Now()
+	_, err := s.db.Exec(
+		`UPDATE pii_bulk_jobs
+		 SET status = $2, result = $3, message = $4, error = $5, updated_at = now(),
+		     started_at = CASE WHEN $2 = 'running' THEN COALESCE(started_at, now()) ELSE started_at END,
+		     finished_at = CASE WHEN $2 IN ('succeeded', 'failed') THEN now() ELSE finished_at END
+		 WHERE id = $1`,
+		id, status, string(result), message, errMsg,
+	)
+	s.observe("update_bulk_job", "pk", start, err)
+	return err
+}
+
+// TouchBulkJobs renews the heartbeat of the queued and running jobs among ids.
+func (s *Store) TouchBulkJobs(ids []string) error {
+	start := time.Now()
+	_, err := s.db.Exec(
+		`UPDATE pii_bulk_jobs SET updated_at = now() WHERE id = ANY($1) AND status IN ('queued', 'running')`,
+		pq.Array(ids),
+	)
+	s.observe("touch_bulk_jobs", "pk", start, err)
+	return err
+}
+
+// FailStaleBulkJob marks a queued or running job failed when its heartbeat is older than
+// before; it reports whether it did.
+func (s *Store) FailStaleBulkJob(id string, before time.Time, errMsg string) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(
+		`UPDATE pii_bulk_jobs SET status = 'failed', error = $3, finished_at = now(), updated_at = now()
+		 WHERE id = $1 AND status IN ('queued', 'running') AND updated_at < $2`,
+		id, before, errMsg,
+	)
+	s.observe("fail_stale_bulk_job", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetBulkJob returns a job by id (nil when there is none).
+func (s *Store) GetBulkJob(id string) (*BulkJob, error) {
+	start := time.Now()
+	j, err := scanBulkJob(s.db.QueryRow(`SELECT `+bulkJobColumns+` FROM pii_bulk_jobs WHERE id = $1`, id))
+	s.observe("get_bulk_job", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return j, err
+}
+
+// ListBulkJobs returns the newest jobs of a tenant ("" = jobs without a tenant), up to limit.
+func (s *Store) ListBulkJobs(tenantID string, limit int) ([]BulkJob, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT `+bulkJobColumns+` FROM pii_bulk_jobs WHERE tenant_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		tenantID, limit,
+	)
+	s.observe("list_bulk_jobs", "tenant_created", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []BulkJob{}
+	for rows.Next() {
+		j, err := scanBulkJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *j)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// ChangeJournalEntry is one admin mutation in the hash-chained change journal. Detail is a
+// JSON object of the change's attributes.
+type ChangeJournalEntry struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Action     string          `json:"action"`
+	Actor      string          `json:"actor,omitempty"`
+	TenantID   string          `json:"tenant,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	SourceIP   string          `json:"source_ip,omitempty"`
+	Detail     json.RawMessage `json:"detail"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// ChainHash is the hex SHA-256 of the JSON array [prevHash, occurred_at (RFC 3339, UTC),
+// action, actor, tenant, request_id, source_ip, detail]. The first entry chains to "".
+func (e *ChangeJournalEntry) ChainHash(prevHash string) string {
+	fields, _ := json.Marshal([]string{
+		prevHash,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.Action,
+		e.Actor,
+		e.TenantID,
+		e.RequestID,
+		e.SourceIP,
+		string(e.Detail),
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendChangeJournal chains and inserts entries in one transaction, setting their ID,
+// PrevHash and Hash. An advisory lock orders appends across replicas.
+func (s *Store) AppendChangeJournal(entries []ChangeJournalEntry) error {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('pii_change_journal'))`); err != nil {
+		return err
+	}
+	var prev string
+	err = tx.QueryRow(`SELECT hash FROM pii_change_journal ORDER BY id DESC LIMIT 1`).Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		// stored with microsecond precision; hash what will be read back
+		e.OccurredAt = e.OccurredAt.UTC().Truncate(time.Microsecond)
+		e.PrevHash, e.Hash = prev, e.ChainHash(prev)
+		if err := tx.QueryRow(
+			`INSERT INTO pii_change_journal (occurred_at, action, actor, tenant_id, request_id, source_ip, detail, prev_hash, hash)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+			e.OccurredAt, e.Action, e.Actor, e.TenantID, e.RequestID, e.SourceIP, string(e.Detail), e.PrevHash, e.Hash,
+		).Scan(&e.ID); err != nil {
+			return err
+		}
+		prev = e.Hash
+	}
+	err = tx.Commit()
+	s.observe("append_change_journal", "pk", start, err)
+	return err
+}
+
+// ChangeJournalHead returns the newest journal entry (nil when the journal is empty).
+func (s *Store) ChangeJournalHead() (*ChangeJournalEntry, error) {
+	start := time.Now()
+	e, err := scanChangeJournalEntry(s.db.QueryRow(
+		`SELECT id, occurred_at, action, actor, tenant_id, request_id, source_ip, detail, prev_hash, hash
+		 FROM pii_change_journal ORDER BY id DESC LIMIT 1`))
+	s.observe("change_journal_head", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// ListChangeJournal returns up to limit entries after afterID in id order, limited to
+// [from, to) when those are set.
+func (s *Store) ListChangeJournal(afterID int64, from, to time.Time, limit int) ([]ChangeJournalEntry, error) {
+	start := time.Now()
+	var fromArg, toArg interface{}
+	if !from.IsZero() {
+		fromArg = from
+	}
+	if !to.IsZero() {
+		toArg = to
+	}
+	rows, err := s.db.Query(
+		`SELECT id, occurred_at, action, actor, tenant_id, request_id, source_ip, detail, prev_hash, hash
+		 FROM pii_change_journal
+		 WHERE id > $1
+		   AND ($2::timestamptz IS NULL OR occurred_at >= $2)
+		   AND ($3::timestamptz IS NULL OR occurred_at < $3)
+		 ORDER BY id
+		 LIMIT $4`,
+		afterID, fromArg, toArg, limit,
+	)
+	s.observe("list_change_journal", "pk", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ChangeJournalEntry{}
+	for rows.Next() {
+		e, err := scanChangeJournalEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *e)
+	}
+	return out, rows.Err()
+}
+
+func scanChangeJournalEntry(sc interface{ Scan(...interface{}) error }) (*ChangeJournalEntry, error) {
+	var e ChangeJournalEntry
+	var detail string
+	if err := sc.Scan(&e.ID, &e.OccurredAt, &e.Action, &e.Actor, &e.TenantID, &e.RequestID, &e.SourceIP, &detail, &e.PrevHash, &e.Hash); err != nil {
+		return nil, err
+	}
+	e.Detail = json.RawMessage(detail)
+	return &e, nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ConnectionProfile is a named source database for bulk runs. EncryptedDSN is never serialized.
+type ConnectionProfile struct {
+	Name         string    `json:"name"`
+	TenantID     string    `json:"tenant,omitempty"` // whose bulk runs may use it ("" = callers without a tenant)
+	EncryptedDSN []byte    `json:"-"`
+	Description  string    `json:"description"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const profileColumns = `name, tenant_id, encrypted_dsn, description, created_by, created_at, updated_at`
+
+func scanProfile(sc interface{ Scan(...interface{}) error }) (*ConnectionProfile, error) {
+	var p ConnectionProfile
+	if err := sc.Scan(&p.Name, &p.TenantID, &p.EncryptedDSN, &p.Description, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PutConnectionProfile creates or replaces a profile.
+func (s *Store) PutConnectionProfile(p *ConnectionProfile) (*ConnectionProfile, error) {
+	start := time.Now()
+	row := s.db.QueryRow(
+		`INSERT INTO pii_connection_profiles (name, tenant_id, encrypted_dsn, description, created_by)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (name)
+		 DO UPDATE SET tenant_id = EXCLUDED.tenant_id, encrypted_dsn = EXCLUDED.encrypted_dsn, description = EXCLUDED.description, updated_at = now()
+		 RETURNING `+profileColumns,
+		p.Name, p.TenantID, p.EncryptedDSN, p.Description, p.CreatedBy,
+	)
+	saved, err := scanProfile(row)
+	s.observe("put_connection_profile", "pk", start, err)
+	return saved, err
+}
+
+// GetConnectionProfile returns the named profile of tenantID, or nil when that tenant has no
+// such profile.
+func (s *Store) GetConnectionProfile(name, tenantID string) (*ConnectionProfile, error) {
+	start := time.Now()
+	p, err := scanProfile(s.db.QueryRow(`SELECT `+profileColumns+` FROM pii_connection_profiles WHERE name = $1 AND tenant_id = $2`, name, tenantID))
+	s.observe("get_connection_profile", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// ConnectionProfiles lists every profile by name.
+func (s *Store) ConnectionProfiles() ([]*ConnectionProfile, error) {
+	start := time.Now()
+	rows, err := s.db.Query(`SELECT ` + profileColumns + ` FROM pii_connection_profiles ORDER BY name`)
+	s.observe("connection_profiles", "seq", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*ConnectionProfile{}
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// DeleteConnectionProfile removes a profile; it reports false when none existed.
+func (s *Store) DeleteConnectionProfile(name string) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(`DELETE FROM pii_connection_profiles WHERE name = $1`, name)
+	s.observe("delete_connection_profile", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetConnectionProfileDSN replaces the encrypted DSN of a profile (key rotation).
+func (s *Store) SetConnectionProfileDSN(name string, encryptedDSN []byte) error {
+	start := time.Now()
+	_, err := s.db.Exec(`UPDATE pii_connection_profiles SET encrypted_dsn = $2 WHERE name = $1`, name, encryptedDSN)
+	s.observe("set_connection_profile_dsn", "pk", start, err)
+	return err
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DEK is a wrapped data key of envelope encryption.
+type DEK struct {
+	ID         int64
+	Wrapped    []byte
+	KEKVersion string
+	CreatedAt  time.Time
+}
+
+// CreateDEK stores a wrapped data key and returns its id.
+func (s *Store) CreateDEK(wrapped []byte, kekVersion string) (int64, error) {
+	start := time.Now()
+	var id int64
+	err := s.db.QueryRow(
+		`INSERT INTO pii_deks (wrapped_dek, kek_version) VALUES ($1, $2) RETURNING id`,
+		wrapped, kekVersion,
+	).Scan(&id)
+	s.observe("create_dek", "insert", start, err)
+	return id, err
+}
+
+// DEKByID returns a wrapped data key (nil when it does not exist or was shredded).
+func (s *Store) DEKByID(ctx context.Context, id int64) (*DEK, error) {
+	start := time.Now()
+	var d DEK
+	err := s.retry(ctx, "dek_by_id", false, func() error {
+		return s.db.QueryRow(
+			`SELECT id, wrapped_dek, kek_version, created_at FROM pii_deks WHERE id = $1`, id,
+		).Scan(&d.ID, &d.Wrapped, &d.KEKVersion, &d.CreatedAt)
+	})
+	s.observe("dek_by_id", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ShredDEK deletes a data key, which makes every ciphertext sealed with it unreadable. It
+// reports false when the key was already gone.
+func (s *Store) ShredDEK(id int64) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(`DELETE FROM pii_deks WHERE id = $1`, id)
+	s.observe("shred_dek", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ShredTokenDEK crypto-shreds a vault row: it deletes the row's data key and clears its v2
+// ciphertext, which is sealed with the key ring instead of the data key, in one transaction.
+// It reports false when the data key was already gone; the v2 ciphertext is cleared either way.
+func (s *Store) ShredTokenDEK(tokenID, dekID int64) (bool, error) {
+	start := time.Now()
+	ok, err := s.shredTokenDEK(tokenID, dekID)
+	s.observe("shred_token_dek", "pk", start, err)
+	return ok, err
+}
+
+func (s *Store) shredTokenDEK(tokenID, dekID int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM pii_deks WHERE id = $1`, dekID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE pii_tokens SET encrypted_value_v2 = NULL WHERE id = $1`, tokenID); err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
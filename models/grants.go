@@ -0,0 +1,134 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SharingGrant allows GranteeTenant to perform Operation on OwnerTenant's tokens of DataType
+// until ExpiresAt. FPTs, when non-empty, bounds the grant to those tokens only.
+type SharingGrant struct {
+	ID            int64      `json:"id"`
+	OwnerTenant   string     `json:"owner_tenant"`
+	GranteeTenant string     `json:"grantee_tenant"`
+	DataType      string     `json:"data_type"`
+	Operation     string     `json:"operation"`
+	FPTs          []string   `json:"fpts,omitempty"`
+	MaxUses       *int64     `json:"max_uses,omitempty"`
+	Uses          int64      `json:"uses"`
+	Reason        string     `json:"reason"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+}
+
+const grantColumns = `id, owner_tenant, grantee_tenant, data_type, operation, fpts, max_uses, uses, reason, created_by, created_at, expires_at, revoked_at`
+
+func scanGrant(sc interface{ Scan(...interface{}) error }) (*SharingGrant, error) {
+	var g SharingGrant
+	var maxUses sql.NullInt64
+	var revokedAt sql.NullTime
+	if err := sc.Scan(&g.ID, &g.OwnerTenant, &g.GranteeTenant, &g.DataType, &g.Operation, pq.Array(&g.FPTs),
+		&maxUses, &g.Uses, &g.Reason, &g.CreatedBy, &g.CreatedAt, &g.ExpiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	if maxUses.Valid {
+		g.MaxUses = &maxUses.Int64
+	}
+	if revokedAt.Valid {
+		g.RevokedAt = &revokedAt.Time
+	}
+	return &g, nil
+}
+
+func (s *Store) CreateGrant(g *SharingGrant) (*SharingGrant, error) {
+	var maxUses sql.NullInt64
+	if g.MaxUses != nil {
+		maxUses = sql.NullInt64{Int64: *g.MaxUses, Valid: true}
+	}
+	var fpts interface{}
+	if len(g.FPTs) > 0 {
+		fpts = pq.Array(g.FPTs)
+	}
+	start := time.Now()
+	row := s.db.QueryRow(
+		`INSERT INTO pii_sharing_grants (owner_tenant, grantee_tenant, data_type, operation, fpts, max_uses, reason, created_by, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 RETURNING `+grantColumns,
+		g.OwnerTenant, g.GranteeTenant, g.DataType, g.Operation, fpts, maxUses, g.Reason, g.CreatedBy, g.ExpiresAt,
+	)
+	created, err := scanGrant(row)
+	s.observe("create_grant", "insert", start, err)
+	return created, err
+}
+
+// ListGrants returns grants filtered by owner/grantee ("" means any), newest first.
+func (s *Store) ListGrants(ownerTenant, granteeTenant string) ([]*SharingGrant, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT `+grantColumns+` FROM pii_sharing_grants
+		 WHERE ($1 = '' OR owner_tenant = $1) AND ($2 = '' OR grantee_tenant = $2)
+		 ORDER BY id DESC`,
+		ownerTenant, granteeTenant,
+	)
+	s.observe("list_grants", "tenant", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*SharingGrant{}
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+// RevokeGrant marks a grant revoked. Returns (false, nil) when no active grant has that id.
+func (s *Store) RevokeGrant(id int64) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(`UPDATE pii_sharing_grants SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	s.observe("revoke_grant", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseGrant finds an active grant covering (owner, grantee, dataType, operation, fpt) and
+// atomically consumes one use. Returns nil when no grant applies.
+func (s *Store) UseGrant(ctx context.Context, ownerTenant, granteeTenant, dataType, operation, fpt string) (*SharingGrant, error) {
+	start := time.Now()
+	var g *SharingGrant
+	err := s.retry(ctx, "use_grant", true, func() (err error) {
+		g, err = scanGrant(s.db.QueryRow(
+			`UPDATE pii_sharing_grants SET uses = uses + 1
+			 WHERE id = (
+			     SELECT id FROM pii_sharing_grants
+			     WHERE owner_tenant = $1 AND grantee_tenant = $2 AND data_type = $3 AND operation = $4
+			       AND revoked_at IS NULL AND expires_at > now()
+			       AND (max_uses IS NULL OR uses < max_uses)
+			       AND (fpts IS NULL OR $5 = ANY(fpts))
+			     ORDER BY expires_at
+			     LIMIT 1
+			     FOR UPDATE SKIP LOCKED
+			 )
+			 RETURNING `+grantColumns,
+			ownerTenant, granteeTenant, dataType, operation, fpt,
+		))
+		return err
+	})
+	s.observe("use_grant", "tenant", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"time"
+)
+
+// KeyVersionCount is the number of vault rows at one AES (or HMAC) key version.
+type KeyVersionCount struct {
+	KeyVersion string `json:"key_version"`
+	Rows       int64  `json:"rows"`
+}
+
+// TokensNotAtKeyVersion returns up to limit tokens with id > afterID that are not encrypted
+// with keyVersion (including rows without a recorded version), in id order.
+func (s *Store) TokensNotAtKeyVersion(keyVersion string, afterID int64, limit int) ([]PiiToken, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT id, encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, COALESCE(tenant_id, ''), COALESCE(key_version, '')
+		 FROM pii_tokens
+		 WHERE key_version IS DISTINCT FROM $1 AND id > $2
+		 ORDER BY id LIMIT $3`,
+		keyVersion, afterID, limit,
+	)
+	s.observe("tokens_not_at_key_version", "key_version", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PiiToken
+	for rows.Next() {
+		var pt PiiToken
+		if err := rows.Scan(&pt.ID, &pt.EncryptedValue, &pt.EncryptedValueV2, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.TenantID, &pt.KeyVersion); err != nil {
+			return nil, err
+		}
+		out = append(out, pt)
+	}
+	return out, rows.Err()
+}
+
+// ReencryptToken replaces the ciphertexts of a token written with oldVersion ("" = not
+// recorded) by ones written with keyVersion. It reports false when the row changed or went
+// away in the meantime.
+func (s *Store) ReencryptToken(id int64, oldVersion string, enc, encV2 []byte, keyVersion string) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(
+		`UPDATE pii_tokens SET encrypted_value = $3, encrypted_value_v2 = $4, key_version = $5
+		 WHERE id = $1 AND COALESCE(key_version, '') = $2`,
+		id, oldVersion, enc, encV2, keyVersion,
+	)
+	s.observe("reencrypt_token", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// KeyVersionCounts returns the number of rows per key version ("" = not recorded).
+func (s *Store) KeyVersionCounts() ([]KeyVersionCount, error) {
+	return s.versionCounts("key_version_counts", "key_version", "key_version")
+}
+
+// HMACKeyVersionCounts returns the number of rows per HMAC key version of the blind index
+// ("" = not recorded).
+func (s *Store) HMACKeyVersionCounts() ([]KeyVersionCount, error) {
+	return s.versionCounts("hmac_key_version_counts", "hmac_key_version", "seq")
+}
+
+// versionCounts groups pii_tokens by a key version column (a constant, never user input).
+func (s *Store) versionCounts(op, column, indexPath string) ([]KeyVersionCount, error) {
+	start := time.Now()
+	rows, err := s.db.Query(`SELECT COALESCE(` + column + `, ''), count(*) FROM pii_tokens GROUP BY 1 ORDER BY 1`)
+	s.observe(op, indexPath, start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []KeyVersionCount
+	for rows.Next() {
+		var c KeyVersionCount
+		if err := rows.Scan(&c.KeyVersion, &c.Rows); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
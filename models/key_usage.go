@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+)
+
+// KeyUsage is the usage record of one key version.
+type KeyUsage struct {
+	KeyVersion  string    `json:"key_version"`
+	Encryptions int64     `json:"encryptions"`
+	FirstUsedAt time.Time `json:"first_used_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+}
+
+// AddKeyUsage adds n encryptions to a key version (creating its record on first use) and
+// returns the updated totals across all replicas.
+func (s *Store) AddKeyUsage(keyVersion string, n int64) (*KeyUsage, error) {
+	start := time.Now()
+	u := KeyUsage{KeyVersion: keyVersion}
+	err := s.db.QueryRow(
+		`INSERT INTO pii_key_usage (key_version, encryptions)
+		 VALUES ($1, $2)
+		 ON CONFLICT (key_version)
+		 DO UPDATE SET encryptions = pii_key_usage.encryptions + EXCLUDED.encryptions,
+		               last_used_at = CASE WHEN EXCLUDED.encryptions > 0 THEN now() ELSE pii_key_usage.last_used_at END
+		 RETURNING encryptions, first_used_at, last_used_at`,
+		keyVersion, n,
+	).Scan(&u.Encryptions, &u.FirstUsedAt, &u.LastUsedAt)
+	s.observe("add_key_usage", "pk", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// KeyUsages returns the usage records of every key version, newest first.
+func (s *Store) KeyUsages() ([]KeyUsage, error) {
+	start := time.Now()
+	rows, err := s.db.Query(`SELECT key_version, encryptions, first_used_at, last_used_at FROM pii_key_usage ORDER BY first_used_at DESC`)
+	s.observe("key_usages", "seq", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []KeyUsage{}
+	for rows.Next() {
+		var u KeyUsage
+		if err := rows.Scan(&u.KeyVersion, &u.Encryptions, &u.FirstUsedAt, &u.LastUsedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
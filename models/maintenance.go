@@ -0,0 +1,46 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// MaintenanceMode is the read-only maintenance mode shared by every replica.
+type MaintenanceMode struct {
+	ReadOnly          bool
+	RetryAfterSeconds int64
+	UpdatedBy         string
+	UpdatedAt         time.Time
+}
+
+// MaintenanceMode returns the shared maintenance mode, or nil when it was never set.
+func (s *Store) MaintenanceMode() (*MaintenanceMode, error) {
+	start := time.Now()
+	var m MaintenanceMode
+	err := s.db.QueryRow(`SELECT read_only, retry_after_seconds, updated_by, updated_at FROM pii_maintenance`).
+		Scan(&m.ReadOnly, &m.RetryAfterSeconds, &m.UpdatedBy, &m.UpdatedAt)
+	s.observe("maintenance_mode", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenanceMode creates or replaces the shared maintenance mode.
+func (s *Store) SetMaintenanceMode(m *MaintenanceMode) error {
+	start := time.Now()
+	err := s.db.QueryRow(
+		`INSERT INTO pii_maintenance (id, read_only, retry_after_seconds, updated_by, updated_at)
+		 VALUES (TRUE, $1, $2, $3, now())
+		 ON CONFLICT (id)
+		 DO UPDATE SET read_only = EXCLUDED.read_only, retry_after_seconds = EXCLUDED.retry_after_seconds,
+		   updated_by = EXCLUDED.updated_by, updated_at = now()
+		 RETURNING updated_at`,
+		m.ReadOnly, m.RetryAfterSeconds, m.UpdatedBy,
+	).Scan(&m.UpdatedAt)
+	s.observe("set_maintenance_mode", "pk", start, err)
+	return err
+}
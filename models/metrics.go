@@ -0,0 +1,107 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultSlowQueryThreshold = 200 * time.Millisecond
+
+// QueryStat aggregates timings of one store operation.
+type QueryStat struct {
+	Op        string  `json:"op"`
+	IndexPath string  `json:"index_path"`
+	Calls     int64   `json:"calls"`
+	Errors    int64   `json:"errors"`
+	Slow      int64   `json:"slow"`
+	TotalMs   float64 `json:"total_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+type queryStats struct {
+	mu   sync.Mutex
+	byOp map[string]*QueryStat
+	slow time.Duration
+}
+
+func newQueryStats() *queryStats {
+	slow := defaultSlowQueryThreshold
+	if v := os.Getenv("STORE_SLOW_QUERY_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			slow = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return &queryStats{byOp: map[string]*QueryStat{}, slow: slow}
+}
+
+// observe records one store call. indexPath names the lookup path used (blind, fpt, tenant, ...)
+// so slow-query logs show which index needs tuning.
+func (s *Store) observe(op, indexPath string, start time.Time, err error) {
+	if s.stats == nil {
+		return
+	}
+	d := time.Since(start)
+	if s.observer != nil {
+		s.observer(op, d, err)
+	}
+	ms := float64(d.Microseconds()) / 1000
+
+	s.stats.mu.Lock()
+	st, ok := s.stats.byOp[op]
+	if !ok {
+		st = &QueryStat{Op: op, IndexPath: indexPath}
+		s.stats.byOp[op] = st
+	}
+	st.Calls++
+	st.TotalMs += ms
+	if ms > st.MaxMs {
+		st.MaxMs = ms
+	}
+	if err != nil {
+		st.Errors++
+	}
+	slow := d >= s.stats.slow
+	if slow {
+		st.Slow++
+	}
+	s.stats.mu.Unlock()
+
+	if slow {
+		log.Printf("store: slow query op=%s index_path=%s duration_ms=%.1f threshold_ms=%d err=%v",
+			op, indexPath, ms, s.stats.slow.Milliseconds(), err)
+	}
+}
+
+// ignoreNoRows keeps "not found" lookups from being counted as store errors.
+func ignoreNoRows(err error) error {
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// SetObserver makes fn receive the duration and error (not-found lookups excluded) of every
+// store call. Call it before the store is shared.
+func (s *Store) SetObserver(fn func(op string, d time.Duration, err error)) {
+	s.observer = fn
+}
+
+// QueryStats returns a snapshot of per-operation store timings, sorted by op.
+func (s *Store) QueryStats() []QueryStat {
+	if s.stats == nil {
+		return nil
+	}
+	s.stats.mu.Lock()
+	out := make([]QueryStat, 0, len(s.stats.byOp))
+	for _, st := range s.stats.byOp {
+		out = append(out, *st)
+	}
+	s.stats.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Op < out[j].Op })
+	return out
+}
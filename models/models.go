@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -9,18 +10,33 @@ import (
 type PiiToken struct {
 	ID             int64
 	EncryptedValue []byte
-	BlindIndex     string
-	FPT            string
-	DataType       string
+	// EncryptedValueV2 is the dual-written v2 ciphertext (nil until written or backfilled)
+	EncryptedValueV2 []byte
+	BlindIndex       string
+	FPT              string
+	DataType         string
+	// TenantID is the owning tenant ("" for global tokens created without a tenant)
+	TenantID string
+	// KeyVersion is the AES key version of the ciphertexts ("" when not recorded)
+	KeyVersion string
+	// HMACKeyVersion is the HMAC key version of the blind index ("" when not recorded)
+	HMACKeyVersion string
 	CreatedAt      time.Time
 }
 
 type Store struct {
-	db *sql.DB
+	db      *sql.DB
+	stats   *queryStats
+	retries retryPolicy
+	// observer, if set, also receives every store call (e.g. for Prometheus)
+	observer func(op string, d time.Duration, err error)
 }
 
+// NewStore wraps db. Every store call is timed; calls slower than STORE_SLOW_QUERY_MS
+// (default 200) are logged with the index path they used. Transient errors are retried
+// (STORE_RETRY_ATTEMPTS, STORE_RETRY_BASE_MS).
 func NewStore(db *sql.DB) *Store {
-	return &Store{db: db}
+	return &Store{db: db, stats: newQueryStats(), retries: newRetryPolicy()}
 }
 
 // Export DB handle safely
@@ -28,10 +44,13 @@ func (s *Store) DB() *sql.DB {
 	return s.db
 }
 
-func (s *Store) GetByBlindIndex(bi string) (*PiiToken, error) {
-	row := s.db.QueryRow(`SELECT id, encrypted_value, blind_index, fpt, data_type, created_at FROM pii_tokens WHERE blind_index = $1`, bi)
+func (s *Store) GetByBlindIndex(ctx context.Context, bi string) (*PiiToken, error) {
+	start := time.Now()
 	var pt PiiToken
-	err := row.Scan(&pt.ID, &pt.EncryptedValue, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.CreatedAt)
+	err := s.retry(ctx, "get_by_blind_index", false, func() error {
+		return s.db.QueryRow(`SELECT id, encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, COALESCE(tenant_id, ''), COALESCE(key_version, ''), COALESCE(hmac_key_version, ''), created_at FROM pii_tokens WHERE blind_index = $1`, bi).Scan(&pt.ID, &pt.EncryptedValue, &pt.EncryptedValueV2, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.TenantID, &pt.KeyVersion, &pt.HMACKeyVersion, &pt.CreatedAt)
+	})
+	s.observe("get_by_blind_index", "blind", start, ignoreNoRows(err))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -41,10 +60,13 @@ func (s *Store) GetByBlindIndex(bi string) (*PiiToken, error) {
 	return &pt, nil
 }
 
-func (s *Store) GetByFPT(fpt string) (*PiiToken, error) {
-	row := s.db.QueryRow(`SELECT id, encrypted_value, blind_index, fpt, data_type, created_at FROM pii_tokens WHERE fpt = $1`, fpt)
+func (s *Store) GetByFPT(ctx context.Context, fpt string) (*PiiToken, error) {
+	start := time.Now()
 	var pt PiiToken
-	err := row.Scan(&pt.ID, &pt.EncryptedValue, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.CreatedAt)
+	err := s.retry(ctx, "get_by_fpt", false, func() error {
+		return s.db.QueryRow(`SELECT id, encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, COALESCE(tenant_id, ''), COALESCE(key_version, ''), COALESCE(hmac_key_version, ''), created_at FROM pii_tokens WHERE fpt = $1`, fpt).Scan(&pt.ID, &pt.EncryptedValue, &pt.EncryptedValueV2, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.TenantID, &pt.KeyVersion, &pt.HMACKeyVersion, &pt.CreatedAt)
+	})
+	s.observe("get_by_fpt", "fpt", start, ignoreNoRows(err))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -56,25 +78,187 @@ func (s *Store) GetByFPT(fpt string) (*PiiToken, error) {
 
 var ErrDuplicate = errors.New("duplicate")
 
-func (s *Store) InsertToken(enc []byte, blindIndex, fpt, dataType string) (*PiiToken, error) {
-	row := s.db.QueryRow(
-		`INSERT INTO pii_tokens (encrypted_value, blind_index, fpt, data_type)
-		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, created_at`,
-		enc, blindIndex, fpt, dataType,
-	)
+// InsertToken stores a new token. tenantID may be "" for a global (unowned) token; encV2 is
+// the dual-written v2 ciphertext, nil when dual-write is off; keyVersion is the AES key
+// version both ciphertexts were written with and hmacKeyVersion the HMAC key version of the
+// blind index.
+func (s *Store) InsertToken(ctx context.Context, enc, encV2 []byte, keyVersion, hmacKeyVersion, blindIndex, fpt, dataType, tenantID string) (*PiiToken, error) {
+	start := time.Now()
 	var id int64
 	var createdAt time.Time
-	if err := row.Scan(&id, &createdAt); err != nil {
+	err := s.retry(ctx, "insert_token", true, func() error {
+		return s.db.QueryRow(
+			`INSERT INTO pii_tokens (encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, tenant_id, key_version, hmac_key_version)
+			 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''))
+			 RETURNING id, created_at`,
+			enc, encV2, blindIndex, fpt, dataType, tenantID, keyVersion, hmacKeyVersion,
+		).Scan(&id, &createdAt)
+	})
+	s.observe("insert_token", "insert", start, err)
+	if err != nil {
 		return nil, err
 	}
 	return &PiiToken{
-		ID:             id,
-		EncryptedValue: enc,
-		BlindIndex:     blindIndex,
-		FPT:            fpt,
-		DataType:       dataType,
-		CreatedAt:      createdAt,
+		ID:               id,
+		EncryptedValue:   enc,
+		EncryptedValueV2: encV2,
+		BlindIndex:       blindIndex,
+		FPT:              fpt,
+		DataType:         dataType,
+		TenantID:         tenantID,
+		KeyVersion:       keyVersion,
+		HMACKeyVersion:   hmacKeyVersion,
+		CreatedAt:        createdAt,
 	}, nil
 }
 
+// ErrFPTTaken is returned by InsertTokenLocked when the token already belongs to another value.
+var ErrFPTTaken = errors.New("fpt already belongs to another value")
+
+// InsertTokenLocked is the get-or-create of a token without a shared cache: a transaction-scoped
+// advisory lock on the blind index serializes concurrent creators of the same value across
+// replicas. The first inserts its row; the others find that row under the lock and get it back
+// with created false. A candidate owned by another value fails with ErrFPTTaken.
+func (s *Store) InsertTokenLocked(ctx context.Context, enc, encV2 []byte, keyVersion, hmacKeyVersion, blindIndex, fpt, dataType, tenantID string) (pt *PiiToken, created bool, err error) {
+	start := time.Now()
+	err = s.retry(ctx, "insert_token_locked", true, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "pii_tokens:"+blindIndex); err != nil {
+			return err
+		}
+		var found PiiToken
+		err = tx.QueryRow(`SELECT id, encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, COALESCE(tenant_id, ''), COALESCE(key_version, ''), COALESCE(hmac_key_version, ''), created_at FROM pii_tokens WHERE blind_index = $1`, blindIndex).Scan(&found.ID, &found.EncryptedValue, &found.EncryptedValueV2, &found.BlindIndex, &found.FPT, &found.DataType, &found.TenantID, &found.KeyVersion, &found.HMACKeyVersion, &found.CreatedAt)
+		if err == nil {
+			pt, created = &found, false
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		var id int64
+		var createdAt time.Time
+		err = tx.QueryRow(
+			`INSERT INTO pii_tokens (encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, tenant_id, key_version, hmac_key_version)
+			 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''))
+			 ON CONFLICT (fpt) DO NOTHING
+			 RETURNING id, created_at`,
+			enc, encV2, blindIndex, fpt, dataType, tenantID, keyVersion, hmacKeyVersion,
+		).Scan(&id, &createdAt)
+		if err == sql.ErrNoRows {
+			return ErrFPTTaken
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		pt, created = &PiiToken{
+			ID:               id,
+			EncryptedValue:   enc,
+			EncryptedValueV2: encV2,
+			BlindIndex:       blindIndex,
+			FPT:              fpt,
+			DataType:         dataType,
+			TenantID:         tenantID,
+			KeyVersion:       keyVersion,
+			HMACKeyVersion:   hmacKeyVersion,
+			CreatedAt:        createdAt,
+		}, true
+		return nil
+	})
+	if err == ErrFPTTaken {
+		// a token collision, not a store error
+		s.observe("insert_token_locked", "blind", start, nil)
+	} else {
+		s.observe("insert_token_locked", "blind", start, err)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return pt, created, nil
+}
+
+// SampleToken returns an arbitrary stored token (nil when the vault is empty).
+func (s *Store) SampleToken(ctx context.Context) (*PiiToken, error) {
+	start := time.Now()
+	var pt PiiToken
+	err := s.retry(ctx, "sample_token", false, func() error {
+		return s.db.QueryRow(`SELECT id, encrypted_value, encrypted_value_v2, blind_index, fpt, data_type, COALESCE(tenant_id, ''), COALESCE(key_version, ''), COALESCE(hmac_key_version, ''), created_at FROM pii_tokens LIMIT 1`).Scan(&pt.ID, &pt.EncryptedValue, &pt.EncryptedValueV2, &pt.BlindIndex, &pt.FPT, &pt.DataType, &pt.TenantID, &pt.KeyVersion, &pt.HMACKeyVersion, &pt.CreatedAt)
+	})
+	s.observe("sample_token", "seq", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pt, nil
+}
+
+// TokensMissingV2 returns up to limit tokens with id > afterID whose v2 ciphertext has not
+// been written yet, in id order (backfill batches).
+func (s *Store) TokensMissingV2(afterID int64, limit int) ([]PiiToken, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT id, encrypted_value, blind_index, data_type, COALESCE(key_version, '')
+		 FROM pii_tokens
+		 WHERE encrypted_value_v2 IS NULL AND id > $1
+		 ORDER BY id LIMIT $2`,
+		afterID, limit,
+	)
+	s.observe("tokens_missing_v2", "missing_v2", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PiiToken
+	for rows.Next() {
+		var pt PiiToken
+		if err := rows.Scan(&pt.ID, &pt.EncryptedValue, &pt.BlindIndex, &pt.DataType, &pt.KeyVersion); err != nil {
+			return nil, err
+		}
+		out = append(out, pt)
+	}
+	return out, rows.Err()
+}
+
+// SetEncryptedV2 writes the v2 ciphertext of a token unless one is already present.
+func (s *Store) SetEncryptedV2(id int64, encV2 []byte) error {
+	start := time.Now()
+	_, err := s.db.Exec(`UPDATE pii_tokens SET encrypted_value_v2 = $2 WHERE id = $1 AND encrypted_value_v2 IS NULL`, id, encV2)
+	s.observe("set_encrypted_v2", "pk", start, err)
+	return err
+}
+
+// DeleteToken removes a token row and the source-system metadata of its blind index in one
+// transaction; it reports false when the row was already gone.
+func (s *Store) DeleteToken(id int64, blindIndex string) (bool, error) {
+	start := time.Now()
+	ok, err := s.deleteToken(id, blindIndex)
+	s.observe("delete_token", "pk", start, err)
+	return ok, err
+}
+
+func (s *Store) deleteToken(id int64, blindIndex string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM pii_tokens WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM pii_token_sources WHERE blind_index = $1`, blindIndex); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
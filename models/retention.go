@@ -0,0 +1,110 @@
+package models
+
+import (
+	"time"
+)
+
+// retentionBatch bounds each purge DELETE so a large backlog never holds long locks.
+const retentionBatch = 10000
+
+// purgeBatched repeats a bounded DELETE until it removes fewer than retentionBatch rows.
+func (s *Store) purgeBatched(op, query string, args ...interface{}) (int64, error) {
+	var total int64
+	for {
+		start := time.Now()
+		res, err := s.db.Exec(query, args...)
+		s.observe(op, "purge", start, err)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < retentionBatch {
+			return total, nil
+		}
+	}
+}
+
+// PurgeUsageBefore deletes daily usage counters of days before cutoff.
+func (s *Store) PurgeUsageBefore(cutoff time.Time) (int64, error) {
+	return s.purgeBatched("purge_usage",
+		`DELETE FROM pii_usage_counters WHERE ctid IN (
+		     SELECT ctid FROM pii_usage_counters WHERE day < $1 LIMIT $2)`,
+		cutoff, retentionBatch)
+}
+
+// PurgeAPIUsageBefore deletes daily API version usage counters of days before cutoff.
+func (s *Store) PurgeAPIUsageBefore(cutoff time.Time) (int64, error) {
+	return s.purgeBatched("purge_api_usage",
+		`DELETE FROM pii_api_usage WHERE ctid IN (
+		     SELECT ctid FROM pii_api_usage WHERE day < $1 LIMIT $2)`,
+		cutoff, retentionBatch)
+}
+
+// PurgeGrantsEndedBefore deletes sharing grants that expired or were revoked before cutoff.
+func (s *Store) PurgeGrantsEndedBefore(cutoff time.Time) (int64, error) {
+	return s.purgeBatched("purge_grants",
+		`DELETE FROM pii_sharing_grants WHERE id IN (
+		     SELECT id FROM pii_sharing_grants
+		     WHERE COALESCE(revoked_at, expires_at) < $1
+		     LIMIT $2)`,
+		cutoff, retentionBatch)
+}
+
+// PurgeBulkJobsFinishedBefore deletes bulk jobs that finished before cutoff.
+func (s *Store) PurgeBulkJobsFinishedBefore(cutoff time.Time) (int64, error) {
+	return s.purgeBatched("purge_bulk_jobs",
+		`DELETE FROM pii_bulk_jobs WHERE id IN (
+		     SELECT id FROM pii_bulk_jobs
+		     WHERE finished_at < $1
+		     LIMIT $2)`,
+		cutoff, retentionBatch)
+}
+
+// PurgeTenantTokensBefore deletes the tenant's tokens created before cutoff together with their
+// source metadata, retentionBatch rows per statement. evict is called with each deleted token
+// so the caller can drop it from the cache.
+func (s *Store) PurgeTenantTokensBefore(tenantID string, cutoff time.Time, evict func(dataType, blindIndex, fpt string)) (int64, error) {
+	var total int64
+	for {
+		start := time.Now()
+		rows, err := s.db.Query(
+			`WITH gone AS (
+			     DELETE FROM pii_tokens WHERE id IN (
+			         SELECT id FROM pii_tokens
+			         WHERE tenant_id = $1 AND created_at < $2
+			         LIMIT $3)
+			     RETURNING data_type, blind_index, fpt
+			 ), sources AS (
+			     DELETE FROM pii_token_sources
+			     WHERE tenant_id = $1 AND blind_index IN (SELECT blind_index FROM gone)
+			 )
+			 SELECT data_type, blind_index, fpt FROM gone`,
+			tenantID, cutoff, retentionBatch)
+		var n int64
+		if err == nil {
+			for rows.Next() {
+				var dataType, blindIndex, fpt string
+				if err = rows.Scan(&dataType, &blindIndex, &fpt); err != nil {
+					break
+				}
+				n++
+				if evict != nil {
+					evict(dataType, blindIndex, fpt)
+				}
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+			rows.Close()
+		}
+		s.observe("purge_tenant_tokens", "purge", start, err)
+		total += n
+		if err != nil || n < retentionBatch {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBase     = 50 * time.Millisecond
+	maxRetryBackoff      = 2 * time.Second
+)
+
+// retryPolicy retries store calls on transient Postgres errors (serialization failures,
+// deadlocks, connection loss, failover) with exponential backoff and full jitter.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+}
+
+// newRetryPolicy reads STORE_RETRY_ATTEMPTS (total tries, default 3; 1 disables retries) and
+// STORE_RETRY_BASE_MS (first backoff, default 50).
+func newRetryPolicy() retryPolicy {
+	p := retryPolicy{attempts: defaultRetryAttempts, base: defaultRetryBase}
+	if v, err := strconv.Atoi(os.Getenv("STORE_RETRY_ATTEMPTS")); err == nil && v > 0 {
+		p.attempts = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("STORE_RETRY_BASE_MS")); err == nil && v > 0 {
+		p.base = time.Duration(v) * time.Millisecond
+	}
+	return p
+}
+
+// retry runs fn until it succeeds, fails permanently, runs out of attempts or ctx ends during a
+// backoff. Writes are only retried when the error proves the statement did not take effect
+// (serialization failure, deadlock, connection refused, a read-only server after failover); a
+// connection lost mid-write is ambiguous and is returned.
+func (s *Store) retry(ctx context.Context, op string, write bool, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= s.retries.attempts || !retryable(err, write) {
+			return err
+		}
+		backoff := s.retries.base << (attempt - 1)
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		backoff = time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Printf("store: %s failed with a transient error (attempt %d/%d), retrying in %s: %v", op, attempt, s.retries.attempts, backoff, err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// retryable classifies err by SQLSTATE class / network error.
+func retryable(err error, write bool) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch code := string(pqErr.Code); {
+		case code == "40001", code == "40P01": // serialization_failure, deadlock_detected
+			return true
+		case code == "57P03", code == "08001", code == "08004": // cannot_connect_now, connection rejected
+			return true
+		case code == "25006": // read_only_sql_transaction: a write reached a demoted primary and was refused
+			return true
+		case code == "57P01", code == "57P02": // shutdown, crash
+			return !write
+		case code[:2] == "08": // other connection exceptions
+			return !write
+		}
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.As(err, &netErr) {
+		return !write
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+// TenantSetting holds one tenant's settings for one PII type.
+type TenantSetting struct {
+	TenantID    string    `json:"tenant"`
+	DataType    string    `json:"data_type"`
+	TokenPrefix string    `json:"token_prefix"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TenantSettings returns every tenant's settings.
+func (s *Store) TenantSettings() ([]TenantSetting, error) {
+	start := time.Now()
+	rows, err := s.db.Query(`SELECT tenant_id, data_type, token_prefix, updated_at FROM pii_tenant_settings ORDER BY tenant_id, data_type`)
+	s.observe("tenant_settings", "seq", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TenantSetting{}
+	for rows.Next() {
+		var t TenantSetting
+		if err := rows.Scan(&t.TenantID, &t.DataType, &t.TokenPrefix, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// PutTenantSetting creates or replaces the settings of one tenant and PII type.
+func (s *Store) PutTenantSetting(t *TenantSetting) (*TenantSetting, error) {
+	start := time.Now()
+	err := s.db.QueryRow(
+		`INSERT INTO pii_tenant_settings (tenant_id, data_type, token_prefix, updated_at)
+		 VALUES ($1, $2, $3, now())
+		 ON CONFLICT (tenant_id, data_type)
+		 DO UPDATE SET token_prefix = EXCLUDED.token_prefix, updated_at = now()
+		 RETURNING updated_at`,
+		t.TenantID, t.DataType, t.TokenPrefix,
+	).Scan(&t.UpdatedAt)
+	s.observe("put_tenant_setting", "pk", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
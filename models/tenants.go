@@ -0,0 +1,231 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrTenantExists is returned when onboarding a tenant id that is already taken.
+var ErrTenantExists = errors.New("tenant already exists")
+
+// Tenant is an onboarded tenant.
+type Tenant struct {
+	TenantID  string    `json:"tenant"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey is a provisioned API key of a tenant, or of a team when TenantID is empty; the key
+// itself is never stored.
+type APIKey struct {
+	ID        int64      `json:"id"`
+	TenantID  string     `json:"tenant"`
+	Name      string     `json:"name,omitempty"`
+	CallerID  string     `json:"caller_id"`
+	Scopes    []string   `json:"scopes"`
+	Enabled   bool       `json:"enabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key is accepted at now: enabled, not revoked and not expired.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.Enabled && k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// APIKeyUpdate changes an API key; nil fields are left alone.
+type APIKeyUpdate struct {
+	Enabled *bool
+	Scopes  []string
+	// ExpiresAt sets the expiry; ClearExpiry removes it
+	ExpiresAt   *time.Time
+	ClearExpiry bool
+}
+
+const apiKeyColumns = `id, COALESCE(tenant_id, ''), name, caller_id, scopes, enabled, expires_at, created_at, revoked_at`
+
+func scanAPIKey(sc interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var expiresAt, revokedAt sql.NullTime
+	if err := sc.Scan(&k.ID, &k.TenantID, &k.Name, &k.CallerID, pq.Array(&k.Scopes), &k.Enabled, &expiresAt, &k.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return &k, nil
+}
+
+// OnboardTenant creates a tenant with its per-type settings and first API key in one
+// transaction. It returns ErrTenantExists when the tenant id is taken.
+func (s *Store) OnboardTenant(t *Tenant, settings []TenantSetting, key *APIKey, keyHash string) error {
+	start := time.Now()
+	err := s.onboardTenant(t, settings, key, keyHash)
+	s.observe("onboard_tenant", "insert", start, err)
+	return err
+}
+
+func (s *Store) onboardTenant(t *Tenant, settings []TenantSetting, key *APIKey, keyHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		`INSERT INTO pii_tenants (tenant_id, name) VALUES ($1, $2)
+		 ON CONFLICT (tenant_id) DO NOTHING
+		 RETURNING created_at`,
+		t.TenantID, t.Name,
+	).Scan(&t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrTenantExists
+	}
+	if err != nil {
+		return err
+	}
+	for i := range settings {
+		st := &settings[i]
+		if err := tx.QueryRow(
+			`INSERT INTO pii_tenant_settings (tenant_id, data_type, token_prefix, updated_at)
+			 VALUES ($1, $2, $3, now())
+			 ON CONFLICT (tenant_id, data_type)
+			 DO UPDATE SET token_prefix = EXCLUDED.token_prefix, updated_at = now()
+			 RETURNING updated_at`,
+			st.TenantID, st.DataType, st.TokenPrefix,
+		).Scan(&st.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	created, err := scanAPIKey(tx.QueryRow(
+		`INSERT INTO pii_api_keys (key_hash, tenant_id, name, caller_id, scopes, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+apiKeyColumns,
+		keyHash, key.TenantID, key.Name, key.CallerID, pq.Array(key.Scopes), key.ExpiresAt,
+	))
+	if err != nil {
+		return err
+	}
+	*key = *created
+	return tx.Commit()
+}
+
+// CreateAPIKey provisions another API key for an existing tenant, or a team key when
+// key.TenantID is empty. It returns (nil, nil) when the tenant does not exist.
+func (s *Store) CreateAPIKey(key *APIKey, keyHash string) (*APIKey, error) {
+	start := time.Now()
+	created, err := scanAPIKey(s.db.QueryRow(
+		`INSERT INTO pii_api_keys (key_hash, tenant_id, name, caller_id, scopes, expires_at)
+		 SELECT $1, NULLIF($2, ''), $3, $4, $5, $6
+		 WHERE $2 = '' OR EXISTS (SELECT 1 FROM pii_tenants WHERE tenant_id = $2)
+		 RETURNING `+apiKeyColumns,
+		keyHash, key.TenantID, key.Name, key.CallerID, pq.Array(key.Scopes), key.ExpiresAt,
+	))
+	s.observe("create_api_key", "insert", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return created, err
+}
+
+// APIKeyByHash returns the API key with that hash (nil when unknown or revoked). Disabled and
+// expired keys are returned; callers check Active.
+func (s *Store) APIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	start := time.Now()
+	var k *APIKey
+	err := s.retry(ctx, "api_key_by_hash", false, func() (err error) {
+		k, err = scanAPIKey(s.db.QueryRow(
+			`SELECT `+apiKeyColumns+` FROM pii_api_keys WHERE key_hash = $1 AND revoked_at IS NULL`, keyHash))
+		return err
+	})
+	s.observe("api_key_by_hash", "key_hash", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// RevokeAPIKey revokes an API key. Returns (false, nil) when no active key has that id.
+func (s *Store) RevokeAPIKey(id int64) (bool, error) {
+	start := time.Now()
+	res, err := s.db.Exec(`UPDATE pii_api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	s.observe("revoke_api_key", "pk", start, err)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Tenants returns every onboarded tenant.
+func (s *Store) Tenants() ([]Tenant, error) {
+	start := time.Now()
+	rows, err := s.db.Query(`SELECT tenant_id, name, created_at FROM pii_tenants ORDER BY tenant_id`)
+	s.observe("tenants", "seq", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Tenant{}
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.TenantID, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// UpdateAPIKey applies u to an unrevoked API key and returns it, or nil when no unrevoked key
+// has that id.
+func (s *Store) UpdateAPIKey(id int64, u APIKeyUpdate) (*APIKey, error) {
+	start := time.Now()
+	var scopes interface{}
+	if u.Scopes != nil {
+		scopes = pq.Array(u.Scopes)
+	}
+	k, err := scanAPIKey(s.db.QueryRow(
+		`UPDATE pii_api_keys SET
+		     enabled = COALESCE($2, enabled),
+		     scopes = COALESCE($3, scopes),
+		     expires_at = CASE WHEN $5 THEN NULL ELSE COALESCE($4, expires_at) END
+		 WHERE id = $1 AND revoked_at IS NULL
+		 RETURNING `+apiKeyColumns,
+		id, u.Enabled, scopes, u.ExpiresAt, u.ClearExpiry,
+	))
+	s.observe("update_api_key", "pk", start, ignoreNoRows(err))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// APIKeys returns the API keys of a tenant ("" = all tenants and team keys), revoked ones
+// included.
+func (s *Store) APIKeys(tenantID string) ([]*APIKey, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT `+apiKeyColumns+` FROM pii_api_keys WHERE ($1 = '' OR tenant_id = $1) ORDER BY id`, tenantID)
+	s.observe("api_keys", "tenant", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
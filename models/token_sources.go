@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// DuplicateStat summarises, for one tenant and data type, how many blind indexes were
+// tokenized by more than one source system.
+type DuplicateStat struct {
+	TenantID        string `json:"tenant"`
+	DataType        string `json:"data_type"`
+	DuplicateValues int64  `json:"duplicate_values"`
+	MaxSources      int64  `json:"max_sources"`
+}
+
+// RecordTokenSource notes that sourceSystem tokenized the value behind blindIndex.
+func (s *Store) RecordTokenSource(blindIndex, dataType, tenantID, sourceSystem string) error {
+	start := time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO pii_token_sources (blind_index, data_type, tenant_id, source_system)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (tenant_id, data_type, blind_index, source_system)
+		 DO UPDATE SET last_seen = now()`,
+		blindIndex, dataType, tenantID, sourceSystem,
+	)
+	s.observe("record_token_source", "tenant", start, err)
+	return err
+}
+
+// DuplicateReport counts, per tenant and data type, blind indexes seen from more than one
+// source system. Empty tenantID / dataType mean "all".
+func (s *Store) DuplicateReport(tenantID, dataType string) ([]DuplicateStat, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT tenant_id, data_type, count(*), COALESCE(max(sources), 0)
+		 FROM (
+		     SELECT tenant_id, data_type, blind_index, count(*) AS sources
+		     FROM pii_token_sources
+		     WHERE ($1 = '' OR tenant_id = $1) AND ($2 = '' OR data_type = $2)
+		     GROUP BY tenant_id, data_type, blind_index
+		     HAVING count(*) > 1
+		 ) d
+		 GROUP BY tenant_id, data_type
+		 ORDER BY tenant_id, data_type`,
+		tenantID, dataType,
+	)
+	s.observe("duplicate_report", "tenant_scan", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DuplicateStat{}
+	for rows.Next() {
+		var d DuplicateStat
+		if err := rows.Scan(&d.TenantID, &d.DataType, &d.DuplicateValues, &d.MaxSources); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
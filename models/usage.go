@@ -0,0 +1,128 @@
+package models
+
+import (
+	"time"
+)
+
+// UsageCount is one aggregated usage counter row.
+type UsageCount struct {
+	Day       time.Time `json:"day,omitempty"`
+	CallerID  string    `json:"caller_id"`
+	TenantID  string    `json:"tenant"`
+	DataType  string    `json:"data_type"`
+	Operation string    `json:"operation"`
+	Count     int64     `json:"count"`
+}
+
+// AddUsage adds the given increments to the daily usage counters in one transaction.
+func (s *Store) AddUsage(counts []UsageCount) error {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(
+		`INSERT INTO pii_usage_counters (day, caller_id, tenant_id, data_type, operation, count)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (day, caller_id, tenant_id, data_type, operation)
+		 DO UPDATE SET count = pii_usage_counters.count + EXCLUDED.count`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range counts {
+		if _, err := stmt.Exec(c.Day, c.CallerID, c.TenantID, c.DataType, c.Operation, c.Count); err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	s.observe("add_usage", "pk", start, err)
+	return err
+}
+
+// UsageReport sums usage counters in [from, to] per caller, tenant, data type and operation.
+func (s *Store) UsageReport(from, to time.Time) ([]UsageCount, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT caller_id, tenant_id, data_type, operation, sum(count)
+		 FROM pii_usage_counters
+		 WHERE day BETWEEN $1 AND $2
+		 GROUP BY caller_id, tenant_id, data_type, operation
+		 ORDER BY caller_id, tenant_id, data_type, operation`,
+		from, to,
+	)
+	s.observe("usage_report", "day_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []UsageCount{}
+	for rows.Next() {
+		var c UsageCount
+		if err := rows.Scan(&c.CallerID, &c.TenantID, &c.DataType, &c.Operation, &c.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// TenantStorage is the vault footprint of one tenant ("" = global tokens).
+type TenantStorage struct {
+	TenantID string
+	Tokens   int64
+	Bytes    int64
+}
+
+// TenantDailyUsage sums usage counters in [from, to] per day, tenant and operation.
+func (s *Store) TenantDailyUsage(from, to time.Time) ([]UsageCount, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT day, tenant_id, operation, sum(count)
+		 FROM pii_usage_counters
+		 WHERE day BETWEEN $1 AND $2
+		 GROUP BY day, tenant_id, operation
+		 ORDER BY day, tenant_id, operation`,
+		from, to,
+	)
+	s.observe("tenant_daily_usage", "day_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []UsageCount{}
+	for rows.Next() {
+		var c UsageCount
+		if err := rows.Scan(&c.Day, &c.TenantID, &c.Operation, &c.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// TenantStorageReport counts the tokens of every tenant and the bytes of their rows. It reads
+// the whole vault table.
+func (s *Store) TenantStorageReport() ([]TenantStorage, error) {
+	start := time.Now()
+	rows, err := s.db.Query(
+		`SELECT COALESCE(tenant_id, ''), count(*), COALESCE(sum(pg_column_size(t.*)), 0)::bigint
+		 FROM pii_tokens t
+		 GROUP BY 1
+		 ORDER BY 1`)
+	s.observe("tenant_storage_report", "seq", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TenantStorage{}
+	for rows.Next() {
+		var t TenantStorage
+		if err := rows.Scan(&t.TenantID, &t.Tokens, &t.Bytes); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}